@@ -205,10 +205,55 @@ func (this *Consumers) printConsumersByGroup(zkzone *zk.ZkZone, clusterPattern s
 
 			this.displayGroupOffsets(zkcluster, group)
 		}
+
+		this.displayKafkaGroups(zkcluster)
 	})
 
 }
 
+// displayKafkaGroups prints the consumer groups whose offsets are in kafka.
+func (this *Consumers) displayKafkaGroups(zkcluster *zk.ZkCluster) {
+	offsetsByGroup, err := zkcluster.KafkaConsumerOffsets(this.groupPattern)
+	if err != nil {
+		this.Ui.Error(fmt.Sprintf("%s: %v", zkcluster.Name(), err))
+		return
+	}
+
+	sortedGroups := make([]string, 0, len(offsetsByGroup))
+	for group := range offsetsByGroup {
+		sortedGroups = append(sortedGroups, group)
+	}
+	sort.Strings(sortedGroups)
+
+	for _, group := range sortedGroups {
+		members, err := zkcluster.KafkaConsumerGroupMembers(group)
+		if err != nil {
+			this.Ui.Error(fmt.Sprintf("%s: %v", group, err))
+			continue
+		}
+
+		if len(members) > 0 {
+			this.Ui.Output(fmt.Sprintf("\t%s %s kafka", color.Green("☀︎"), group))
+			for _, member := range members {
+				this.Ui.Output(fmt.Sprintf("\t\t%s", member))
+			}
+		} else if !this.onlineOnly {
+			this.Ui.Output(fmt.Sprintf("\t%s %s kafka", color.Yellow("☔︎"), group))
+		} else {
+			continue
+		}
+
+		for _, po := range offsetsByGroup[group] {
+			if !patternMatched(po.Topic, this.topicPattern) {
+				continue
+			}
+
+			this.Ui.Output(fmt.Sprintf("\t\t%s/%d Offset:%s",
+				po.Topic, po.Partition, gofmt.Comma(po.Offset)))
+		}
+	}
+}
+
 func (this *Consumers) displayGroupOffsets(zkcluster *zk.ZkCluster, group string) {
 	offsetMap := zkcluster.ConsumerOffsetsOfGroup(group)
 	sortedTopics := make([]string, 0, len(offsetMap))
@@ -237,14 +282,14 @@ func (this *Consumers) displayGroupOffsets(zkcluster *zk.ZkCluster, group string
 }
 
 func (*Consumers) Synopsis() string {
-	return "Print high level consumer groups from Zookeeper"
+	return "Print high level consumer groups from Zookeeper and kafka"
 }
 
 func (this *Consumers) Help() string {
 	help := fmt.Sprintf(`
 Usage: %s consumers [options]
 
-    Print high level consumer groups from Zookeeper
+    Print high level consumer groups from Zookeeper and kafka
 
 Options:
 
@@ -368,7 +368,7 @@ Options:
     -loglevel <info|debug|trace|warn|alarm|error>
       Set kateway log level
     
-    -option <debug|clients|nometrics|ratelimit>=<true|false>
+    -option <debug|clients|nometrics>=<true|false>
       Set kateway options value
 
 `, this.Cmd)
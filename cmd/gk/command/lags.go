@@ -157,11 +157,17 @@ func (this *Lags) printConsumersLag(zkcluster *zk.ZkCluster) {
 				var (
 					host   string
 					uptime string
+					mtime  = gofmt.PrettySince(consumer.Mtime.Time())
 				)
-				if consumer.ConsumerZnode == nil {
+				switch {
+				case consumer.Kafka:
+					host = color.Green("%90s", "kafka group coordinator")
+					uptime = "-"
+					mtime = "-" // the coordinator tells no commit time
+				case consumer.ConsumerZnode == nil:
 					host = "unrecognized"
 					uptime = "-"
-				} else {
+				default:
 					host = color.Green("%90s", consumer.ConsumerZnode.Host())
 					uptime = gofmt.PrettySince(consumer.ConsumerZnode.Uptime())
 				}
@@ -172,7 +178,7 @@ func (this *Lags) printConsumersLag(zkcluster *zk.ZkCluster) {
 					gofmt.Comma(consumer.ProducerOffset),
 					gofmt.Comma(consumer.ConsumerOffset),
 					lagOutput,
-					gofmt.PrettySince(consumer.Mtime.Time()),
+					mtime,
 					host, uptime))
 			} else if !this.onlineOnly {
 				this.Ui.Output(fmt.Sprintf("\t%s %35s/%-2s %12s -> %-12s %s %s",
@@ -3,8 +3,11 @@ package command
 import (
 	"flag"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/Shopify/sarama"
 	"github.com/funkygao/gafka/ctx"
 	"github.com/funkygao/gafka/zk"
 	"github.com/funkygao/gocli"
@@ -17,10 +20,19 @@ type Offset struct {
 
 func (this *Offset) Run(args []string) (exitCode int) {
 	var (
-		zone    string
-		cluster string
-		topic   string
-		group   string
+		zone      string
+		cluster   string
+		topic     string
+		group     string
+		partition int
+		offset    int64
+		delta     int64
+		timestamp string
+		reset     string
+		force     bool
+		dryRun    bool
+		toKafka   bool
+		inKafka   bool
 	)
 	cmdFlags := flag.NewFlagSet("offset", flag.ContinueOnError)
 	cmdFlags.Usage = func() { this.Ui.Output(this.Help()) }
@@ -28,6 +40,15 @@ func (this *Offset) Run(args []string) (exitCode int) {
 	cmdFlags.StringVar(&cluster, "c", "", "")
 	cmdFlags.StringVar(&topic, "t", "", "")
 	cmdFlags.StringVar(&group, "g", "", "")
+	cmdFlags.IntVar(&partition, "p", -1, "")
+	cmdFlags.Int64Var(&offset, "offset", -1, "")
+	cmdFlags.Int64Var(&delta, "delta", 0, "")
+	cmdFlags.StringVar(&timestamp, "time", "", "")
+	cmdFlags.StringVar(&reset, "reset", "", "")
+	cmdFlags.BoolVar(&force, "force", false, "")
+	cmdFlags.BoolVar(&dryRun, "dryrun", false, "")
+	cmdFlags.BoolVar(&toKafka, "tokafka", false, "")
+	cmdFlags.BoolVar(&inKafka, "kafka", false, "")
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
@@ -39,9 +60,164 @@ func (this *Offset) Run(args []string) (exitCode int) {
 		return 2
 	}
 
+	if toKafka {
+		return this.migrateToKafka(zone, cluster, topic, group, force, dryRun)
+	}
+
+	var (
+		seek   zk.OffsetSeek
+		seekBy int
+	)
+	switch reset {
+	case "":
+	case "oldest":
+		seek = zk.OffsetSeek{Whence: zk.SeekAbsolute, Value: sarama.OffsetOldest}
+		seekBy++
+	case "newest":
+		seek = zk.OffsetSeek{Whence: zk.SeekAbsolute, Value: sarama.OffsetNewest}
+		seekBy++
+	default:
+		this.Ui.Error("-reset must be oldest or newest")
+		return 2
+	}
+	if offset >= 0 {
+		seek = zk.OffsetSeek{Whence: zk.SeekAbsolute, Value: offset}
+		seekBy++
+	}
+	if delta != 0 {
+		seek = zk.OffsetSeek{Whence: zk.SeekDelta, Value: delta}
+		seekBy++
+	}
+	if timestamp != "" {
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", timestamp, time.Local)
+		if err != nil {
+			this.Ui.Error(err.Error())
+			return 2
+		}
+
+		seek = zk.OffsetSeek{Whence: zk.SeekTime, Value: t.UnixNano() / int64(time.Millisecond)}
+		seekBy++
+	}
+	if seekBy != 1 {
+		this.Ui.Error("exactly one of -reset, -offset, -delta, -time required")
+		this.Ui.Output(this.Help())
+		return 2
+	}
+
+	var partitions []int32
+	if partition >= 0 {
+		partitions = []int32{int32(partition)}
+	}
+
+	zkzone := zk.NewZkZone(zk.DefaultConfig(zone, ctx.ZoneZkAddrs(zone)))
+	zkcluster := zkzone.NewCluster(cluster)
+	var (
+		offsets    map[int32]int64
+		oldOffsets map[int32]int64
+		err        error
+	)
+	if inKafka {
+		offsets, err = zkcluster.ResolveKafkaConsumerGroupOffset(topic, group, partitions, seek)
+		if err == nil {
+			oldOffsets, err = zkcluster.KafkaConsumerOffsetsOfTopic(group, topic)
+		}
+	} else {
+		offsets, err = zkcluster.ResolveConsumerGroupOffset(topic, group, partitions, seek)
+		oldOffsets = zkcluster.ConsumerOffsetsOfTopic(group, topic)
+	}
+	if err != nil {
+		this.Ui.Error(err.Error())
+		return 1
+	}
+
+	online := zkcluster.ConsumerGroupOnline(topic, group)
+	sortedPartitions := make([]int, 0, len(offsets))
+	for p := range offsets {
+		sortedPartitions = append(sortedPartitions, int(p))
+	}
+	sort.Ints(sortedPartitions)
+	for _, p := range sortedPartitions {
+		newOffset := offsets[int32(p)]
+		oldOffset, present := oldOffsets[int32(p)]
+		if !present {
+			this.Ui.Output(fmt.Sprintf("%s/%d %8s -> %d", topic, p, "-", newOffset))
+		} else {
+			this.Ui.Output(fmt.Sprintf("%s/%d %8d -> %d %+d", topic, p, oldOffset,
+				newOffset, newOffset-oldOffset))
+		}
+	}
+
+	if online {
+		this.Ui.Warn(fmt.Sprintf("group[%s] has online consumers on %s", group, topic))
+	}
+
+	if dryRun {
+		this.Ui.Output("dry run, nothing changed")
+		return
+	}
+
+	if inKafka {
+		err = zkcluster.ResetKafkaConsumerGroupOffset(topic, group, offsets, force)
+	} else {
+		err = zkcluster.ResetConsumerGroupOffset(topic, group, offsets, force)
+	}
+	if err != nil {
+		if err == zk.ErrConsumerGroupOnline {
+			this.Ui.Error("stop the consumers first or use -force")
+		}
+
+		this.Ui.Error(err.Error())
+		return 1
+	}
+
+	this.Ui.Output("done")
+	return
+}
+
+// migrateToKafka copies the zk offsets of the consumer group to the kafka group
+// coordinator, so that the group can switch to kafka offset storage.
+func (this *Offset) migrateToKafka(zone, cluster, topic, group string, force, dryRun bool) (exitCode int) {
 	zkzone := zk.NewZkZone(zk.DefaultConfig(zone, ctx.ZoneZkAddrs(zone)))
 	zkcluster := zkzone.NewCluster(cluster)
-	zkcluster.ResetConsumerGroupOffset(topic, group)
+	offsets := zkcluster.ConsumerOffsetsOfTopic(group, topic)
+	if len(offsets) == 0 {
+		this.Ui.Error(fmt.Sprintf("group[%s] has no offsets on %s in zk", group, topic))
+		return 1
+	}
+
+	sortedPartitions := make([]int, 0, len(offsets))
+	for p := range offsets {
+		sortedPartitions = append(sortedPartitions, int(p))
+	}
+	sort.Ints(sortedPartitions)
+	for _, p := range sortedPartitions {
+		this.Ui.Output(fmt.Sprintf("%s/%d %d -> kafka", topic, p, offsets[int32(p)]))
+	}
+
+	if zkcluster.ConsumerGroupOnline(topic, group) {
+		// they keep committing to zk after the migration
+		this.Ui.Warn(fmt.Sprintf("group[%s] has online zk consumers on %s", group, topic))
+		if !force {
+			this.Ui.Error("stop the consumers first or use -force")
+			return 1
+		}
+	}
+
+	if dryRun {
+		this.Ui.Output("dry run, nothing changed")
+		return
+	}
+
+	err := zkcluster.CommitKafkaConsumerOffsets(group, map[string]map[int32]int64{topic: offsets})
+	if err != nil {
+		if err == zk.ErrConsumerGroupOnline {
+			this.Ui.Error("stop the kafka consumers of the group first")
+		}
+
+		this.Ui.Error(err.Error())
+		return 1
+	}
+
 	this.Ui.Output("done")
 	return
 }
@@ -54,10 +230,41 @@ func (this *Offset) Help() string {
 	help := fmt.Sprintf(`
 Usage: %s offset -z zone -c cluster -t topic -g group [options]
 
-    Manually reset consumer group offset
+    Manually reset consumer group offset, or migrate it from zk to kafka
 
 Options:
 
+    -p partition id
+      Default all partitions.
+
+    -reset <oldest|newest>
+      Move the consumer group to the log start or log end.
+
+    -offset absolute offset
+
+    -delta relative offset
+      Move the consumer group forward if positive, backward if negative.
+
+    -time 'yyyy-mm-dd hh:mm:ss'
+      Move the consumer group to the first message at or after the time,
+      or to the newest offset if there is none. Requires kafka 0.10.1+.
+
+    -dryrun
+      Only show the old and new offsets of each partition.
+
+    -force
+      Reset even if the consumer group has online members.
+      The kafka group coordinator refuses while the group has members anyway.
+
+    -kafka
+      The consumer group commits offsets to kafka instead of zk, e,g. the
+      clusters of kateway -kafkaoffsets, or kateway -offsetstore=kafka.
+
+    -tokafka
+      Copy the zk offsets of the consumer group to kafka group coordinator
+      before its consumers switch to kafka offset storage.
+      Nothing is changed in zk.
+
 `, this.Cmd)
 	return strings.TrimSpace(help)
 }
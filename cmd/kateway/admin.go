@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/funkygao/gafka/cmd/kateway/manager"
+	log "github.com/funkygao/log4go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// adminHandler guards a man server route by the role of the admin principal,
+// which is identified by the appid header with the pubkey header as secret.
+//
+// Every mutating call is audited, including the denied ones.
+func (this *Gateway) adminHandler(required manager.Role, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		principal := r.Header.Get(HttpHeaderAppid)
+		role := manager.RoleNone
+		if required != manager.RoleNone {
+			var err error
+			if role, err = manager.Default.AuthAdmin(principal, r.Header.Get(HttpHeaderPubkey)); err != nil {
+				role = manager.RoleNone
+			}
+		}
+
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		if !role.Allows(required) {
+			log.Warn("suspicous admin call from %s(%s): {principal:%s role:%s required:%s} %s %s",
+				r.RemoteAddr, getHttpRemoteIp(r), principal, role, required, r.Method, r.RequestURI)
+
+			this.writeAuthFailure(sw, manager.ErrPermDenied)
+		} else {
+			h(sw, r, params)
+		}
+
+		if r.Method == "GET" {
+			return
+		}
+
+		record := manager.AuditRecord{
+			Principal:  principal,
+			Role:       role,
+			Method:     r.Method,
+			Uri:        r.RequestURI,
+			RemoteAddr: getHttpRemoteIp(r),
+			Status:     sw.status,
+			Ctime:      time.Now(),
+		}
+		if err := manager.Default.Audit(record); err != nil {
+			log.Error("audit %+v: %v", record, err)
+		}
+	}
+}
+
+// statusResponseWriter remembers the http status for the audit.
+type statusResponseWriter struct {
+	http.ResponseWriter
+
+	status int
+}
+
+func (this *statusResponseWriter) WriteHeader(status int) {
+	this.status = status
+	this.ResponseWriter.WriteHeader(status)
+}
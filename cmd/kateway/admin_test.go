@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/funkygao/assert"
+	"github.com/funkygao/gafka/cmd/kateway/manager"
+	"github.com/funkygao/gafka/cmd/kateway/manager/dummy"
+	"github.com/julienschmidt/httprouter"
+)
+
+type adminManager struct {
+	manager.Manager
+
+	roles  map[string]manager.Role // key is principal:secret
+	audits []manager.AuditRecord
+}
+
+func (this *adminManager) AuthAdmin(principal, secret string) (manager.Role, error) {
+	if role, present := this.roles[principal+":"+secret]; present {
+		return role, nil
+	}
+	return manager.RoleNone, manager.ErrAuthenticationFail
+}
+
+func (this *adminManager) Audit(record manager.AuditRecord) error {
+	this.audits = append(this.audits, record)
+	return nil
+}
+
+func TestRole(t *testing.T) {
+	assert.Equal(t, manager.RoleTopicAdmin, manager.ParseRole("topicadmin"))
+	assert.Equal(t, manager.RoleNone, manager.ParseRole("root"))
+	assert.Equal(t, "superuser", manager.RoleSuperuser.String())
+	assert.Equal(t, true, manager.RoleSuperuser.Allows(manager.RoleTopicAdmin))
+	assert.Equal(t, false, manager.RoleReadOnly.Allows(manager.RoleTopicAdmin))
+}
+
+func TestAdminHandler(t *testing.T) {
+	defer func(m manager.Manager) { manager.Default = m }(manager.Default)
+	m := &adminManager{
+		Manager: dummy.New(),
+		roles: map[string]manager.Role{
+			"alice:s1": manager.RoleReadOnly,
+			"bob:s2":   manager.RoleSuperuser,
+		},
+	}
+	manager.Default = m
+
+	gw := &Gateway{}
+	h := gw.adminHandler(manager.RoleSuperuser, func(w http.ResponseWriter, r *http.Request,
+		params httprouter.Params) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	call := func(method, principal, secret string) int {
+		r, _ := http.NewRequest(method, "/log/debug", nil)
+		r.RequestURI = "/log/debug"
+		r.Header.Set(HttpHeaderAppid, principal)
+		r.Header.Set(HttpHeaderPubkey, secret)
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, call("PUT", "alice", "s1"))
+	assert.Equal(t, http.StatusUnauthorized, call("PUT", "bob", "wrong"))
+	assert.Equal(t, http.StatusAccepted, call("PUT", "bob", "s2"))
+	assert.Equal(t, http.StatusAccepted, call("GET", "bob", "s2"))
+
+	// the GET is not audited
+	assert.Equal(t, 3, len(m.audits))
+	assert.Equal(t, "alice", m.audits[0].Principal)
+	assert.Equal(t, manager.RoleReadOnly, m.audits[0].Role)
+	assert.Equal(t, http.StatusUnauthorized, m.audits[0].Status)
+	assert.Equal(t, manager.RoleNone, m.audits[1].Role)
+	assert.Equal(t, "PUT", m.audits[2].Method)
+	assert.Equal(t, "/log/debug", m.audits[2].Uri)
+	assert.Equal(t, http.StatusAccepted, m.audits[2].Status)
+
+	// the public route needs no admin
+	h = gw.adminHandler(manager.RoleNone, gw.checkAliveHandler)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/alive", nil)
+	h(w, r, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 
+	"github.com/funkygao/gafka/cmd/kateway/sign"
 	"github.com/funkygao/gafka/mpool"
 )
 
@@ -70,7 +71,13 @@ func (this *Client) Publish(topic, ver, key string, msg []byte) (err error) {
 	}
 
 	req.Header.Set("AppId", this.cf.AppId)
-	req.Header.Set("Pubkey", this.cf.Secret)
+	if this.cf.Sign {
+		if err = sign.SignRequest(req, this.cf.AppId, this.cf.Secret, msg); err != nil {
+			return
+		}
+	} else {
+		req.Header.Set("Pubkey", this.cf.Secret)
+	}
 
 	var response *http.Response
 	response, err = this.conn.Do(req)
@@ -106,12 +113,21 @@ func (this *Client) Subscribe(appid, topic, ver, group string, h SubHandler) err
 	}
 
 	req.Header.Set("AppId", this.cf.AppId)
-	req.Header.Set("Subkey", this.cf.Secret)
+	if !this.cf.Sign {
+		req.Header.Set("Subkey", this.cf.Secret)
+	}
 	for {
 		if this.cf.Debug {
 			log.Printf("sub: %s", url)
 		}
 
+		if this.cf.Sign {
+			// each request has its own timestamp and nonce
+			if err = sign.SignRequest(req, this.cf.AppId, this.cf.Secret, nil); err != nil {
+				return err
+			}
+		}
+
 		response, err := this.conn.Do(req)
 		if err != nil {
 			return err
@@ -8,6 +8,9 @@ type Config struct {
 	AppId  string
 	Secret string
 
+	// Sign signs each request by the secret instead of sending the secret.
+	Sign bool
+
 	Timeout   time.Duration
 	KeepAlive time.Duration
 
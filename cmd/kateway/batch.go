@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/funkygao/gafka/cmd/kateway/envelope"
+	"github.com/funkygao/gafka/cmd/kateway/store"
+	log "github.com/funkygao/log4go"
+)
+
+// batchPubMessage is the element of a batch pub request body, which is a json array:
+// [{"key": "k1", "value": "msg1"}, {"value": "msg2", "attrs": {"Trace-Id": "abc"}}]
+type batchPubMessage struct {
+	Key   string            `json:"key,omitempty"`
+	Value string            `json:"value"`
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+// batchPubResult is the element of a batch pub response body, in the same
+// order as the request.
+type batchPubResult struct {
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Errmsg    string `json:"errmsg,omitempty"`
+}
+
+// maxPubRequestBodySize returns the max body size of all kinds of pub requests.
+func maxPubRequestBodySize() int64 {
+	if options.MaxPubBatchSize > options.MaxPubSize {
+		return options.MaxPubBatchSize
+	}
+
+	return options.MaxPubSize
+}
+
+// decodeBatchMessages decodes a batch pub request body and validates each message.
+// An invalid message will not abort the whole batch: its Err is set instead.
+func decodeBatchMessages(body []byte) ([]*store.PubMessage, error) {
+	var batch []batchPubMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, ErrInvalidBatchBody
+	}
+
+	switch {
+	case len(batch) == 0:
+		return nil, ErrEmptyBatch
+
+	case len(batch) > options.MaxPubBatch:
+		return nil, ErrTooBigBatch
+	}
+
+	msgs := make([]*store.PubMessage, len(batch))
+	for i, m := range batch {
+		msgs[i] = &store.PubMessage{
+			Key:   []byte(m.Key),
+			Value: []byte(m.Value),
+		}
+
+		switch {
+		case int64(len(m.Value)) > options.MaxPubSize:
+			msgs[i].Err = ErrTooBigPubMessage
+
+		case len(m.Value) < options.MinPubSize:
+			msgs[i].Err = ErrTooSmallPubMessage
+
+		case len(m.Key) > MaxPartitionKeyLen:
+			msgs[i].Err = ErrTooBigPartitionKey
+
+		case len(m.Attrs) > 0:
+			msgs[i].Value, msgs[i].Err = envelope.Encode(m.Attrs, msgs[i].Value)
+		}
+	}
+
+	return msgs, nil
+}
+
+// prePubBatch calls the PrePub hooks on the valid messages of a batch, and
+// returns the plugin messages in the same order.
+func prePubBatch(chain *pluginChain, msgs []*store.PubMessage) []*PluginMessage {
+	pms := make([]*PluginMessage, len(msgs))
+	for i, m := range msgs {
+		attrs, body, _ := envelope.Decode(m.Value)
+		pms[i] = &PluginMessage{Key: m.Key, Body: body, Attrs: attrs}
+		if m.Err != nil {
+			continue
+		}
+
+		if m.Err = chain.PrePub(pms[i]); m.Err == nil {
+			m.Key = pms[i].Key
+			m.Value, m.Err = envelope.Encode(pms[i].Attrs, pms[i].Body)
+		}
+	}
+
+	return pms
+}
+
+// batchUsage returns the number and body bytes of the messages of a batch
+// that are not failed, which are charged to the quota.
+func batchUsage(msgs []*store.PubMessage, pms []*PluginMessage) (n, bytes int64) {
+	for i, m := range msgs {
+		if m.Err == nil {
+			n++
+			bytes += int64(len(pms[i].Body))
+		}
+	}
+	return
+}
+
+// validateBatchMessages checks the valid messages of a batch against the
+// schema of the topic.
+func (this *Gateway) validateBatchMessages(cluster, topic string, msgs []*store.PubMessage) {
+	for _, m := range msgs {
+		if m.Err != nil {
+			continue
+		}
+
+		_, body, _ := envelope.Decode(m.Value)
+		m.Err = this.schemas.Validate(cluster, topic, body)
+	}
+}
+
+// pubBatch publishes the valid messages of a batch in a single producer call
+// and returns the per message results.
+func (this *Gateway) pubBatch(chain *pluginChain, cluster string,
+	msgs []*store.PubMessage, pms []*PluginMessage) ([]batchPubResult, error) {
+	appid, topic, ver := chain.req.Appid, chain.req.Topic, chain.req.Ver
+	rawTopic := chain.req.rawTopic()
+	encrypted := this.encryption.Encrypted(rawTopic)
+	valid := make([]*store.PubMessage, 0, len(msgs))
+	for i, m := range msgs {
+		if m.Err == nil && encrypted {
+			m.Value, m.Err = this.encryption.SealPayload(rawTopic, pms[i].Attrs, pms[i].Body)
+		}
+		if m.Err == nil {
+			valid = append(valid, m)
+		}
+	}
+
+	if !options.DisableMetrics {
+		this.pubMetrics.PubBatchSize.Update(int64(len(msgs)))
+	}
+
+	if len(valid) > 0 {
+		if err := store.DefaultPubStore.SyncPubBatch(cluster, rawTopic, valid); err != nil {
+			for i, m := range msgs {
+				if m.Err == nil {
+					chain.PostPub(pms[i], err)
+				}
+			}
+
+			return nil, err
+		}
+	}
+
+	results := make([]batchPubResult, len(msgs))
+	for i, m := range msgs {
+		if m.Err != nil {
+			log.Warn("pub[%s] {topic:%s, ver:%s} batch #%d: %v", appid, topic, ver, i, m.Err)
+
+			results[i].Errmsg = m.Err.Error()
+			chain.PostPub(pms[i], m.Err)
+			continue
+		}
+
+		results[i].Partition = m.Partition
+		results[i].Offset = m.Offset
+		pms[i].Partition, pms[i].Offset = m.Partition, m.Offset
+		chain.PostPub(pms[i], nil)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/funkygao/assert"
+	"github.com/funkygao/gafka/cmd/kateway/envelope"
+)
+
+func TestDecodeBatchMessages(t *testing.T) {
+	options.MaxPubBatch = 3
+	options.MaxPubSize = 10
+	options.MinPubSize = 1
+
+	_, err := decodeBatchMessages([]byte(`{"value": "hello"}`))
+	assert.Equal(t, ErrInvalidBatchBody, err)
+
+	_, err = decodeBatchMessages([]byte(`[]`))
+	assert.Equal(t, ErrEmptyBatch, err)
+
+	_, err = decodeBatchMessages([]byte(`[{"value":"a"},{"value":"b"},{"value":"c"},{"value":"d"}]`))
+	assert.Equal(t, ErrTooBigBatch, err)
+
+	body := `[{"key":"k1","value":"hello"},{"value":""},{"value":"hello world!"},{"key":"` +
+		strings.Repeat("k", MaxPartitionKeyLen+1) + `","value":"a"}]`
+	options.MaxPubBatch = 10
+	msgs, err := decodeBatchMessages([]byte(body))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, len(msgs))
+	assert.Equal(t, "k1", string(msgs[0].Key))
+	assert.Equal(t, "hello", string(msgs[0].Value))
+	assert.Equal(t, nil, msgs[0].Err)
+	assert.Equal(t, ErrTooSmallPubMessage, msgs[1].Err)
+	assert.Equal(t, ErrTooBigPubMessage, msgs[2].Err)
+	assert.Equal(t, ErrTooBigPartitionKey, msgs[3].Err)
+
+	msgs, err = decodeBatchMessages([]byte(`[{"value":"hello","attrs":{"Trace-Id":"abc"}}]`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, msgs[0].Err)
+	attrs, value, err := envelope.Decode(msgs[0].Value)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "abc", attrs["Trace-Id"])
+	assert.Equal(t, "hello", string(value))
+}
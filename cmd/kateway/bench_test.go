@@ -136,7 +136,7 @@ func BenchmarkDirectKafkaProduce1K(b *testing.B) {
 	meta.Default = zkmeta.New(cf)
 	meta.Default.Start()
 	var wg sync.WaitGroup
-	store.DefaultPubStore = kafka.NewPubStore(100, 5, 0, &wg, false, true)
+	store.DefaultPubStore = kafka.NewPubStore(100, 5, 0, &wg, false, true, false)
 	store.DefaultPubStore.Start()
 
 	data := []byte(strings.Repeat("X", msgSize))
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/funkygao/log4go"
+)
+
+// clientCerts verifies the client certificates of the pub/sub https servers
+// against the CA, and revokes them by the CRL file, which is reloaded on
+// change without restarting kateway.
+//
+// The revocation is checked on each request besides the handshake, so that a
+// revoked client on a keep-alive connection is rejected too.
+type clientCerts struct {
+	gw *Gateway
+
+	required bool
+	pool     *x509.CertPool
+	cas      []*x509.Certificate
+	crlFile  string
+
+	mu       sync.RWMutex
+	revoked  map[string]bool // key is serial number
+	crlMtime time.Time
+}
+
+// newClientCerts returns nil if mTLS is not enabled.
+func newClientCerts(gw *Gateway, caFile, crlFile string, required bool) *clientCerts {
+	if caFile == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		panic(err)
+	}
+
+	this := &clientCerts{
+		gw:       gw,
+		required: required,
+		pool:     x509.NewCertPool(),
+		crlFile:  crlFile,
+		revoked:  make(map[string]bool),
+	}
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			panic(err)
+		}
+
+		this.cas = append(this.cas, ca)
+		this.pool.AddCert(ca)
+	}
+	if len(this.cas) == 0 {
+		panic("no CA certificate in " + caFile)
+	}
+
+	if crlFile != "" {
+		if err = this.reloadCRL(); err != nil {
+			panic(err)
+		}
+	}
+
+	return this
+}
+
+func (this *clientCerts) Start() {
+	if this.crlFile == "" {
+		return
+	}
+
+	this.gw.wg.Add(1)
+	go func() {
+		defer this.gw.wg.Done()
+
+		ticker := time.NewTicker(options.CrlRefresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := this.reloadCRL(); err != nil {
+					log.Error("crl[%s] %v", this.crlFile, err)
+				}
+
+			case <-this.gw.shutdownCh:
+				log.Trace("client certs stopped")
+				return
+			}
+		}
+	}()
+}
+
+// reloadCRL reloads the CRL file if it changed, the CRL must be signed by the
+// CA.
+func (this *clientCerts) reloadCRL() error {
+	fi, err := os.Stat(this.crlFile)
+	if err != nil {
+		return err
+	}
+
+	this.mu.RLock()
+	unchanged := fi.ModTime().Equal(this.crlMtime)
+	this.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(this.crlFile)
+	if err != nil {
+		return err
+	}
+
+	crl, err := x509.ParseCRL(b) // PEM or DER
+	if err != nil {
+		return err
+	}
+
+	signed := false
+	for _, ca := range this.cas {
+		if ca.CheckCRLSignature(crl) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return errors.New("crl not signed by the CA")
+	}
+
+	revoked := make(map[string]bool, len(crl.TBSCertList.RevokedCertificates))
+	for _, c := range crl.TBSCertList.RevokedCertificates {
+		revoked[c.SerialNumber.String()] = true
+	}
+
+	this.mu.Lock()
+	this.revoked = revoked
+	this.crlMtime = fi.ModTime()
+	this.mu.Unlock()
+
+	log.Info("crl[%s] loaded, %d revoked", this.crlFile, len(revoked))
+	return nil
+}
+
+// setupTLS makes the https server verify the client certificates.
+func (this *clientCerts) setupTLS(config *tls.Config) {
+	config.ClientCAs = this.pool
+	if this.required {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		// the clients without certificate are authenticated by key
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+}
+
+// Revoked tells whether a client certificate is revoked.
+func (this *clientCerts) Revoked(cert *x509.Certificate) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.revoked[cert.SerialNumber.String()]
+}
+
+// peerCert returns the verified client certificate of a connection, nil if
+// none.
+func peerCert(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return state.VerifiedChains[0][0]
+}
+
+// certIdentities returns the identities of a client certificate that map to
+// an appid: the subject common name and the SANs.
+func certIdentities(cert *x509.Certificate) []string {
+	identities := make([]string, 0, 1+len(cert.DNSNames)+len(cert.EmailAddresses))
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	return identities
+}
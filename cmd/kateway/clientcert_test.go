@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/funkygao/assert"
+)
+
+func TestClientCerts(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "clientcerts")
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kateway test ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(der)
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ = x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(100),
+		Subject:      pkix.Name{CommonName: "app1"},
+		DNSNames:     []string{"app1.example.com"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+	}, ca, &clientKey.PublicKey, caKey)
+	client, _ := x509.ParseCertificate(der)
+	assert.Equal(t, []string{"app1", "app1.example.com"}, certIdentities(client))
+
+	crlFile := filepath.Join(dir, "ca.crl")
+	crl, _ := ca.CreateCRL(rand.Reader, caKey, nil, now, now.Add(time.Hour))
+	ioutil.WriteFile(crlFile, crl, 0600)
+
+	cc := newClientCerts(nil, caFile, crlFile, false)
+	assert.Equal(t, false, cc.Revoked(client))
+
+	// revoke the client certificate
+	crl, _ = ca.CreateCRL(rand.Reader, caKey, []pkix.RevokedCertificate{
+		{SerialNumber: client.SerialNumber, RevocationTime: now},
+	}, now, now.Add(time.Hour))
+	ioutil.WriteFile(crlFile, crl, 0600)
+	os.Chtimes(crlFile, now.Add(time.Minute), now.Add(time.Minute))
+	assert.Equal(t, nil, cc.reloadCRL())
+	assert.Equal(t, true, cc.Revoked(client))
+
+	// the CRL not signed by the CA is refused
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	crl, _ = ca.CreateCRL(rand.Reader, otherKey, nil, now, now.Add(time.Hour))
+	ioutil.WriteFile(crlFile, crl, 0600)
+	os.Chtimes(crlFile, now.Add(time.Hour), now.Add(time.Hour))
+	assert.Equal(t, true, cc.reloadCRL() != nil)
+	assert.Equal(t, true, cc.Revoked(client))
+}
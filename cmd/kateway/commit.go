@@ -0,0 +1,303 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/gafka/cmd/kateway/store"
+	log "github.com/funkygao/log4go"
+)
+
+// The delivery guarantee of a subscription is decided by when its offsets are
+// committed:
+//
+//	atmostonce           commit and flush before a message is sent
+//	atleastonce[:N][:T]  commit after a message is sent, flush every N messages
+//	                     or T, and every -offsetcommit anyway
+//	sync                 commit after a message is sent, flush after each batch:
+//	                     a http response or a websocket message
+//
+// e,g. atleastonce:100:10s
+const (
+	commitAtMostOnce  = "atmostonce"
+	commitAtLeastOnce = "atleastonce"
+	commitSync        = "sync"
+)
+
+type commitPolicy struct {
+	mode     string
+	every    int           // flush every N messages, 0 means by the store
+	interval time.Duration // flush every T, 0 means by the store
+}
+
+var defaultCommitPolicy = commitPolicy{mode: commitAtLeastOnce}
+
+func parseCommitPolicy(s string) (commitPolicy, error) {
+	parts := strings.Split(s, ":")
+	p := commitPolicy{mode: parts[0]}
+	switch p.mode {
+	case commitAtMostOnce, commitSync:
+		if len(parts) > 1 {
+			return p, ErrInvalidCommit
+		}
+		return p, nil
+
+	case commitAtLeastOnce:
+		if len(parts) > 3 {
+			return p, ErrInvalidCommit
+		}
+
+	default:
+		return p, ErrInvalidCommit
+	}
+
+	for _, part := range parts[1:] {
+		if n, err := strconv.Atoi(part); err == nil {
+			if n <= 0 || p.every > 0 {
+				return p, ErrInvalidCommit
+			}
+
+			p.every = n
+			continue
+		}
+
+		d, err := time.ParseDuration(part)
+		if err != nil || d <= 0 || p.interval > 0 {
+			return p, ErrInvalidCommit
+		}
+		p.interval = d
+	}
+
+	return p, nil
+}
+
+func (this commitPolicy) String() string {
+	s := this.mode
+	if this.every > 0 {
+		s += ":" + strconv.Itoa(this.every)
+	}
+	if this.interval > 0 {
+		s += ":" + this.interval.String()
+	}
+	return s
+}
+
+// commitPolicies holds the commit policy of each consumer group in zk: set by
+// admin, or fixed by the first subscriber asking one, so that all the
+// consumers of a group commit the same way.
+type commitPolicies struct {
+	gw *Gateway
+
+	mu       sync.RWMutex
+	policies map[string]commitPolicy // key is appid.group
+}
+
+func newCommitPolicies(gw *Gateway) *commitPolicies {
+	return &commitPolicies{
+		gw:       gw,
+		policies: make(map[string]commitPolicy),
+	}
+}
+
+func (this *commitPolicies) Start() {
+	this.refresh()
+
+	this.gw.wg.Add(1)
+	go func() {
+		defer this.gw.wg.Done()
+
+		ticker := time.NewTicker(options.ManagerRefresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				this.refresh()
+
+			case <-this.gw.shutdownCh:
+				log.Trace("commit policies stopped")
+				return
+			}
+		}
+	}()
+}
+
+func (this *commitPolicies) refresh() {
+	policies := make(map[string]commitPolicy)
+	for group, s := range this.gw.GetZkZone().KatewayCommitPolicies() {
+		p, err := parseCommitPolicy(s)
+		if err != nil {
+			log.Error("commit policy[%s] %s: %v", group, s, err)
+			continue
+		}
+
+		policies[group] = p
+	}
+
+	this.mu.Lock()
+	this.policies = policies
+	this.mu.Unlock()
+}
+
+// lookup returns the commit policy of the consumer group as of the last
+// refresh or fix by this kateway: a group without policy stays so till the
+// next refresh, so that the sub requests never wait for zk unless asking one.
+func (this *commitPolicies) lookup(group string) (p commitPolicy, present bool) {
+	this.mu.RLock()
+	p, present = this.policies[group]
+	this.mu.RUnlock()
+	return
+}
+
+func (this *commitPolicies) cache(group string, p commitPolicy) {
+	this.mu.Lock()
+	this.policies[group] = p
+	this.mu.Unlock()
+}
+
+// Of returns the effective commit policy of the consumer group: the one in
+// zk, else the default.
+func (this *commitPolicies) Of(group string) commitPolicy {
+	if p, present := this.lookup(group); present {
+		return p
+	}
+
+	return defaultCommitPolicy
+}
+
+// Resolve returns the commit policy of a subscriber of the consumer group.
+// If the group has no policy yet, asked becomes its policy; else asked must
+// be empty or the same as the policy of the group.
+func (this *commitPolicies) Resolve(group, asked string) (commitPolicy, error) {
+	p, present := this.lookup(group)
+	if asked == "" {
+		if present {
+			return p, nil
+		}
+		return defaultCommitPolicy, nil
+	}
+
+	askedPolicy, err := parseCommitPolicy(asked)
+	if err != nil {
+		return askedPolicy, err
+	}
+	if present {
+		if askedPolicy != p {
+			return askedPolicy, ErrCommitMismatch
+		}
+		return askedPolicy, nil
+	}
+
+	// another kateway might have fixed a different one since the last refresh
+	fixed, err := this.gw.GetZkZone().CreateKatewayCommitPolicy(group, askedPolicy.String())
+	if err != nil {
+		return askedPolicy, err
+	}
+	if fixed != askedPolicy.String() {
+		if p, err = parseCommitPolicy(fixed); err == nil {
+			this.cache(group, p)
+		}
+		return askedPolicy, ErrCommitMismatch
+	}
+
+	this.cache(group, askedPolicy)
+	return askedPolicy, nil
+}
+
+func (this *commitPolicies) Set(group string, p commitPolicy) error {
+	if err := this.gw.GetZkZone().SetKatewayCommitPolicy(group, p.String()); err != nil {
+		return err
+	}
+
+	this.cache(group, p)
+	return nil
+}
+
+// offsetCommitter commits the offsets of a subscription by its commit policy,
+// it is not safe for concurrent use.
+type offsetCommitter struct {
+	policy  commitPolicy
+	fetcher store.Fetcher
+
+	pending int // committed but not flushed
+	flushed time.Time
+}
+
+func newOffsetCommitter(policy commitPolicy, fetcher store.Fetcher) *offsetCommitter {
+	return &offsetCommitter{
+		policy:  policy,
+		fetcher: fetcher,
+		flushed: time.Now(),
+	}
+}
+
+// BeforeSend is called before a message is sent to the client. With
+// atmostonce the message is never sent again, even if the sending fails.
+func (this *offsetCommitter) BeforeSend(msg *sarama.ConsumerMessage) error {
+	if this.policy.mode != commitAtMostOnce {
+		return nil
+	}
+
+	if err := this.fetcher.CommitUpto(msg); err != nil {
+		return err
+	}
+	return this.flush()
+}
+
+// AfterSend is called after a message is sent to the client.
+func (this *offsetCommitter) AfterSend(msg *sarama.ConsumerMessage) error {
+	if this.policy.mode == commitAtMostOnce {
+		return nil
+	}
+
+	return this.commit(msg)
+}
+
+// Skip commits a message that is not sent: filtered or rejected.
+func (this *offsetCommitter) Skip(msg *sarama.ConsumerMessage) error {
+	if this.policy.mode == commitAtMostOnce {
+		// it's flushed with the next sent message or by the store
+		return this.fetcher.CommitUpto(msg)
+	}
+
+	return this.commit(msg)
+}
+
+// EndBatch is called after a batch of messages is sent: a http response or a
+// websocket message.
+func (this *offsetCommitter) EndBatch() error {
+	if this.policy.mode != commitSync || this.pending == 0 {
+		return nil
+	}
+
+	return this.flush()
+}
+
+func (this *offsetCommitter) commit(msg *sarama.ConsumerMessage) error {
+	if err := this.fetcher.CommitUpto(msg); err != nil {
+		return err
+	}
+
+	this.pending++
+	if this.policy.mode != commitAtLeastOnce {
+		return nil
+	}
+	if (this.policy.every > 0 && this.pending >= this.policy.every) ||
+		(this.policy.interval > 0 && time.Since(this.flushed) >= this.policy.interval) {
+		return this.flush()
+	}
+	return nil
+}
+
+func (this *offsetCommitter) flush() error {
+	if err := this.fetcher.FlushOffsets(); err != nil {
+		return err
+	}
+
+	this.pending = 0
+	this.flushed = time.Now()
+	return nil
+}
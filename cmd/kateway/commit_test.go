@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/assert"
+)
+
+func TestParseCommitPolicy(t *testing.T) {
+	p, err := parseCommitPolicy("atleastonce:100:10s")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, commitPolicy{mode: commitAtLeastOnce, every: 100, interval: time.Second * 10}, p)
+	assert.Equal(t, "atleastonce:100:10s", p.String())
+
+	p, err = parseCommitPolicy("atleastonce:1m")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "atleastonce:1m0s", p.String())
+
+	for _, s := range []string{"atmostonce", "sync", "atleastonce"} {
+		p, err = parseCommitPolicy(s)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, s, p.String())
+	}
+
+	for _, s := range []string{"", "once", "sync:1", "atmostonce:1s", "atleastonce:0",
+		"atleastonce:-1s", "atleastonce:1:2", "atleastonce:1s:2s", "atleastonce:1:1s:1"} {
+		_, err = parseCommitPolicy(s)
+		assert.Equal(t, ErrInvalidCommit, err)
+	}
+}
+
+func TestOffsetCommitter(t *testing.T) {
+	msg := &sarama.ConsumerMessage{Topic: "app1.foo.v1", Offset: 10}
+
+	// commit before send
+	f := &ackFetcher{}
+	c := newOffsetCommitter(commitPolicy{mode: commitAtMostOnce}, f)
+	c.BeforeSend(msg)
+	assert.Equal(t, []int64{10}, f.commits)
+	assert.Equal(t, 1, f.flushes)
+	c.AfterSend(msg)
+	c.EndBatch()
+	assert.Equal(t, 1, len(f.commits))
+	assert.Equal(t, 1, f.flushes)
+
+	// flush every 2 messages
+	f = &ackFetcher{}
+	c = newOffsetCommitter(commitPolicy{mode: commitAtLeastOnce, every: 2}, f)
+	c.BeforeSend(msg)
+	c.AfterSend(msg)
+	c.EndBatch()
+	assert.Equal(t, 0, f.flushes)
+	c.Skip(msg)
+	assert.Equal(t, 2, len(f.commits))
+	assert.Equal(t, 1, f.flushes)
+
+	// flush each batch
+	f = &ackFetcher{}
+	c = newOffsetCommitter(commitPolicy{mode: commitSync}, f)
+	c.EndBatch()
+	assert.Equal(t, 0, f.flushes)
+	c.AfterSend(msg)
+	c.AfterSend(msg)
+	assert.Equal(t, 0, f.flushes)
+	c.EndBatch()
+	assert.Equal(t, 1, f.flushes)
+}
@@ -8,6 +8,11 @@ const (
 	HttpHeaderXForwardedFor = "X-Forwarded-For"
 	HttpHeaderPartition     = "X-Partition"
 	HttpHeaderOffset        = "X-Offset"
+	HttpHeaderRetryAfter    = "Retry-After"
+	HttpHeaderAttrPrefix    = "X-Attr-" // message attributes, e,g. X-Attr-Trace-Id
+
+	HttpHeaderIdempotencyKey = "Idempotency-Key"
+	HttpHeaderIdempotentDup  = "X-Idempotent-Replayed"
 
 	UrlParamCluster = "cluster"
 	UrlParamTopic   = "topic"
@@ -18,8 +23,17 @@ const (
 	UrlQueryReset = "reset"
 	UrlQueryAsync = "async"
 	UrlQueryDelay = "delay"
+	UrlQueryDueAt = "deliverat"
 	UrlQueryGroup = "group"
 
+	UrlQueryAutoCommit = "autocommit"
+	UrlQueryPartition  = "partition"
+	UrlQueryOffset     = "offset"
+	UrlQueryDelta      = "delta"
+	UrlQueryTimestamp  = "ts"
+	UrlQueryFilter     = "filter"
+	UrlQueryCommit     = "commit"
+
 	ContentTypeHeader = "Content-Type"
 	ContentTypeJson   = "application/json; charset=utf8"
 	ContentTypeText   = "text/plain; charset=utf8"
@@ -29,6 +43,13 @@ const (
 	CharDot           = '.'
 
 	MaxPartitionKeyLen = 256
+	MaxNackReasonLen   = 1 << 10
+	MaxSubFilterLen    = 1 << 10
+	MaxIdempotencyKey  = 128
+	MaxSchemaSize      = 64 << 10
+	MaxWsSubscriptions = 64 // of a multiplexed websocket sub
+
+	HttpStatusTooManyRequests = 429
 )
 
 var (
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/gafka/cmd/kateway/envelope"
+	"github.com/funkygao/gafka/cmd/kateway/meta"
+	"github.com/funkygao/gafka/cmd/kateway/store"
+	log "github.com/funkygao/log4go"
+)
+
+const (
+	deadLetterReplayGroup = "__kateway_dlq_replay"
+)
+
+// The attributes of a dead letter tell where the poison message came from
+// and why it failed, its key and body are kept intact.
+const (
+	deadLetterAttrTopic     = "dlq-topic"
+	deadLetterAttrPartition = "dlq-partition"
+	deadLetterAttrOffset    = "dlq-offset"
+	deadLetterAttrGroup     = "dlq-group"
+	deadLetterAttrFailures  = "dlq-failures"
+	deadLetterAttrError     = "dlq-error"
+
+	deadLetterMaxErrorLen = 1 << 10
+)
+
+// deadLetterPayload wraps the poison message with the dead letter attributes
+// besides its own.
+func deadLetterPayload(group string, msg *sarama.ConsumerMessage, failures int,
+	lastErr string) ([]byte, error) {
+	attrs, body, err := envelope.Decode(msg.Value)
+	if err != nil {
+		// kept as is
+		attrs, body = nil, msg.Value
+	}
+	if attrs == nil {
+		attrs = make(map[string]string, 6)
+	}
+
+	if len(lastErr) > deadLetterMaxErrorLen {
+		lastErr = lastErr[:deadLetterMaxErrorLen]
+	}
+	attrs[deadLetterAttrTopic] = msg.Topic
+	attrs[deadLetterAttrPartition] = strconv.Itoa(int(msg.Partition))
+	attrs[deadLetterAttrOffset] = strconv.FormatInt(msg.Offset, 10)
+	attrs[deadLetterAttrGroup] = group
+	attrs[deadLetterAttrFailures] = strconv.Itoa(failures)
+	if lastErr != "" {
+		attrs[deadLetterAttrError] = lastErr
+	}
+	return envelope.Encode(attrs, body)
+}
+
+// originalPayload strips the dead letter attributes, and returns the original
+// topic and payload of a dead letter.
+func originalPayload(payload []byte) (topic string, original []byte, err error) {
+	attrs, body, err := envelope.Decode(payload)
+	if err != nil {
+		return
+	}
+	if topic = attrs[deadLetterAttrTopic]; topic == "" {
+		return "", nil, envelope.ErrCorrupted
+	}
+
+	for _, attr := range []string{deadLetterAttrTopic, deadLetterAttrPartition,
+		deadLetterAttrOffset, deadLetterAttrGroup, deadLetterAttrFailures, deadLetterAttrError} {
+		delete(attrs, attr)
+	}
+	original, err = envelope.Encode(attrs, body)
+	return
+}
+
+// deadLetterTopic returns the dead letter topic of a kafka topic:
+// appid.topic.ver.dlq
+func deadLetterTopic(topic string) string {
+	return topic + ".dlq"
+}
+
+// deadLetters moves the poison messages of sub with autocommit=0 to the
+// dead letter topic after they are delivered too many times.
+type deadLetters struct {
+	gw *Gateway
+
+	mu            sync.RWMutex
+	maxDeliveries map[string]int  // {appid.group: max deliveries}, 0 means never
+	topics        map[string]bool // dead letter topics known to exist
+}
+
+func newDeadLetters(gw *Gateway) *deadLetters {
+	return &deadLetters{
+		gw:            gw,
+		maxDeliveries: make(map[string]int),
+		topics:        make(map[string]bool),
+	}
+}
+
+func (this *deadLetters) Start() {
+	this.refresh()
+
+	this.gw.wg.Add(1)
+	go func() {
+		defer this.gw.wg.Done()
+
+		ticker := time.NewTicker(options.ManagerRefresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				this.refresh()
+
+			case <-this.gw.shutdownCh:
+				log.Trace("dead letters stopped")
+				return
+			}
+		}
+	}()
+}
+
+func (this *deadLetters) refresh() {
+	maxDeliveries := this.gw.GetZkZone().KatewayMaxDeliveries()
+
+	this.mu.Lock()
+	this.maxDeliveries = maxDeliveries
+	this.mu.Unlock()
+}
+
+// MaxDeliveries returns how many times a message can be delivered to a group
+// before it goes to the dead letter topic.
+func (this *deadLetters) MaxDeliveries(group string) int {
+	this.mu.RLock()
+	n, present := this.maxDeliveries[group]
+	this.mu.RUnlock()
+	if present {
+		return n
+	}
+
+	return options.MaxDeliveries
+}
+
+func (this *deadLetters) SetMaxDeliveries(group string, n int) error {
+	if err := this.gw.GetZkZone().SetKatewayMaxDeliveries(group, n); err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	this.maxDeliveries[group] = n
+	this.mu.Unlock()
+	return nil
+}
+
+// Bury publishes a poison message to the dead letter topic of its topic.
+func (this *deadLetters) Bury(cluster, group string, m inflightMessage, failures int) error {
+	if store.DefaultPubStore == nil {
+		// the sub only kateway has no producer
+		return ErrDeadLetterDisabled
+	}
+
+	dlq := deadLetterTopic(m.msg.Topic)
+	if err := this.ensureTopic(cluster, dlq); err != nil {
+		return err
+	}
+
+	b, err := deadLetterPayload(group, m.msg, failures, m.lastErr)
+	if err != nil {
+		return err
+	}
+	partition, offset, err := store.DefaultPubStore.SyncPub(cluster, dlq, m.msg.Key, b)
+	if err != nil {
+		return err
+	}
+
+	log.Warn("cluster[%s] group[%s] {T:%s, P:%d, O:%d} failed %d times, buried to {T:%s, P:%d, O:%d}",
+		cluster, group, m.msg.Topic, m.msg.Partition, m.msg.Offset, failures,
+		dlq, partition, offset)
+	return nil
+}
+
+func (this *deadLetters) ensureTopic(cluster, topic string) error {
+	this.mu.RLock()
+	exists := this.topics[topic]
+	this.mu.RUnlock()
+	if exists {
+		return nil
+	}
+
+	if len(meta.Default.TopicPartitions(cluster, topic)) == 0 {
+		lines, err := meta.Default.ZkCluster(cluster).AddTopic(topic, clusterReplicas(cluster), 1)
+		if err != nil {
+			return err
+		}
+
+		for _, l := range lines {
+			log.Trace("cluster[%s] add dead letter topic[%s]: %s", cluster, topic, l)
+		}
+		if !strings.Contains(strings.Join(lines, "\n"), "Created topic") {
+			return ErrDeadLetterTopic
+		}
+	}
+
+	this.mu.Lock()
+	this.topics[topic] = true
+	this.mu.Unlock()
+	return nil
+}
+
+// Replay moves at most limit messages in the dead letter topic back to the
+// original topic, and returns the number of replayed messages.
+func (this *deadLetters) Replay(cluster, topic string, limit int) (n int, err error) {
+	if store.DefaultPubStore == nil || store.DefaultSubStore == nil {
+		return 0, ErrDeadLetterDisabled
+	}
+
+	dlq := deadLetterTopic(topic)
+	fetcher, err := store.DefaultSubStore.Fetch(cluster, dlq, deadLetterReplayGroup,
+		"replay:"+dlq, "")
+	if err != nil {
+		return
+	}
+	defer fetcher.Close()
+
+	// wait longer for the 1st message: joining the group takes time
+	idleTimeout := time.Second * 10
+	for n < limit {
+		select {
+		case msg := <-fetcher.Messages():
+			var (
+				originalTopic string
+				original      []byte
+			)
+			if originalTopic, original, err = originalPayload(msg.Value); err != nil || originalTopic != topic {
+				log.Error("cluster[%s] replay {T:%s, P:%d, O:%d} invalid dead letter, skipped",
+					cluster, msg.Topic, msg.Partition, msg.Offset)
+			} else if _, _, err = store.DefaultPubStore.SyncPub(cluster, topic, msg.Key, original); err != nil {
+				return
+			} else {
+				n++
+			}
+
+			if err = fetcher.CommitUpto(msg); err != nil {
+				return
+			}
+
+			idleTimeout = time.Second * 2
+
+		case err = <-fetcher.Errors():
+			return
+
+		case <-time.After(idleTimeout):
+			// all caught up
+			return n, nil
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/assert"
+	"github.com/funkygao/gafka/cmd/kateway/envelope"
+)
+
+func TestDeadLetterMaxDeliveries(t *testing.T) {
+	options.MaxDeliveries = 0
+	dl := newDeadLetters(nil)
+	dl.maxDeliveries["app1.group1"] = 3
+	assert.Equal(t, 3, dl.MaxDeliveries("app1.group1"))
+	assert.Equal(t, 0, dl.MaxDeliveries("app1.group2"))
+
+	options.MaxDeliveries = 5
+	assert.Equal(t, 5, dl.MaxDeliveries("app1.group2"))
+	assert.Equal(t, "app1.foo.v1.dlq", deadLetterTopic("app1.foo.v1"))
+}
+
+func TestDeadLetterPayload(t *testing.T) {
+	original, _ := envelope.Encode(map[string]string{"trace": "t1"}, []byte("hello"))
+	msg := &sarama.ConsumerMessage{Topic: "app1.foo.v1", Partition: 1, Offset: 10, Value: original}
+	b, err := deadLetterPayload("app2.group1", msg, 3, "bad")
+	assert.Equal(t, nil, err)
+
+	attrs, body, err := envelope.Decode(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, map[string]string{
+		"trace":         "t1",
+		"dlq-topic":     "app1.foo.v1",
+		"dlq-partition": "1",
+		"dlq-offset":    "10",
+		"dlq-group":     "app2.group1",
+		"dlq-failures":  "3",
+		"dlq-error":     "bad",
+	}, attrs)
+
+	topic, payload, err := originalPayload(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "app1.foo.v1", topic)
+	assert.Equal(t, original, payload)
+
+	// a plain message is replayed plain
+	msg.Value = []byte("world")
+	b, _ = deadLetterPayload("app2.group1", msg, 3, "")
+	_, payload, _ = originalPayload(b)
+	assert.Equal(t, "world", string(payload))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// parseDeliverTime returns when a pub message is due for the subscribers
+// according to the delay(in seconds) or deliverat(unix timestamp in seconds)
+// query params.
+// Zero due time means no delay at all.
+func parseDeliverTime(delay, deliverAt string, now time.Time) (due time.Time, err error) {
+	switch {
+	case delay == "" && deliverAt == "":
+		return
+
+	case delay != "" && deliverAt != "":
+		err = ErrInvalidDelay
+		return
+
+	case delay != "":
+		seconds, e := strconv.ParseInt(delay, 10, 64)
+		if e != nil || seconds < 0 {
+			err = ErrInvalidDelay
+			return
+		}
+
+		if seconds == 0 {
+			return
+		}
+		due = now.Add(time.Duration(seconds) * time.Second)
+
+	default:
+		ts, e := strconv.ParseInt(deliverAt, 10, 64)
+		if e != nil || ts < 0 {
+			err = ErrInvalidDelay
+			return
+		}
+
+		due = time.Unix(ts, 0)
+		if !due.After(now) {
+			// already due
+			due = time.Time{}
+			return
+		}
+	}
+
+	if due.Sub(now) > options.MaxPubDelay {
+		due = time.Time{}
+		err = ErrTooBigDelay
+	}
+
+	return
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/funkygao/assert"
+)
+
+func TestParseDeliverTime(t *testing.T) {
+	options.MaxPubDelay = time.Hour
+	now := time.Now()
+
+	due, err := parseDeliverTime("", "", now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, due.IsZero())
+
+	due, err = parseDeliverTime("0", "", now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, due.IsZero())
+
+	due, err = parseDeliverTime("100", "", now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, now.Add(100*time.Second), due)
+
+	_, err = parseDeliverTime("100", "100", now)
+	assert.Equal(t, ErrInvalidDelay, err)
+
+	_, err = parseDeliverTime("-1", "", now)
+	assert.Equal(t, ErrInvalidDelay, err)
+
+	_, err = parseDeliverTime("abc", "", now)
+	assert.Equal(t, ErrInvalidDelay, err)
+
+	_, err = parseDeliverTime("3601", "", now)
+	assert.Equal(t, ErrTooBigDelay, err)
+
+	// deliver at the past is not delayed at all
+	due, err = parseDeliverTime("", "100", now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, due.IsZero())
+
+	at := now.Add(time.Minute).Unix()
+	due, err = parseDeliverTime("", strconv.FormatInt(at, 10), now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, at, due.Unix())
+}
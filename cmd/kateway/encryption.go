@@ -0,0 +1,147 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/funkygao/gafka/cmd/kateway/envelope"
+	"github.com/funkygao/gafka/cmd/kateway/seal"
+	log "github.com/funkygao/log4go"
+)
+
+// encryption seals the message bodies of the topics that have encryption
+// enabled in zk before they are published, and opens the sealed bodies for
+// the subscribers. The attributes are not encrypted, so that the sub filters
+// still work.
+//
+// The master keys come from the keystore file, which is reloaded on refresh,
+// so the master key is rotated without restarting kateway.
+type encryption struct {
+	gw *Gateway
+
+	keystore *seal.FileKeystore // nil if encryption is disabled
+	sealer   *seal.Sealer
+
+	mu     sync.RWMutex
+	topics map[string]bool // key is raw topic
+}
+
+func newEncryption(gw *Gateway, keystoreFile string) *encryption {
+	this := &encryption{
+		gw:     gw,
+		topics: make(map[string]bool),
+	}
+	if keystoreFile == "" {
+		return this
+	}
+
+	keystore, err := seal.NewFileKeystore(keystoreFile)
+	if err != nil {
+		panic(err)
+	}
+
+	this.keystore = keystore
+	this.sealer = seal.NewSealer(keystore, options.DataKeyTTL)
+	return this
+}
+
+func (this *encryption) Start() {
+	this.refresh()
+
+	this.gw.wg.Add(1)
+	go func() {
+		defer this.gw.wg.Done()
+
+		ticker := time.NewTicker(options.ManagerRefresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				this.refresh()
+
+			case <-this.gw.shutdownCh:
+				log.Trace("encryption stopped")
+				return
+			}
+		}
+	}()
+}
+
+func (this *encryption) refresh() {
+	if this.keystore != nil {
+		if err := this.keystore.Reload(); err != nil {
+			log.Error("keystore: %v", err)
+		}
+	}
+
+	topics := make(map[string]bool)
+	for _, topic := range this.gw.GetZkZone().KatewayEncryptedTopics() {
+		topics[topic] = true
+	}
+
+	this.mu.Lock()
+	this.topics = topics
+	this.mu.Unlock()
+}
+
+// Encrypted tells whether the messages of a topic are to be sealed.
+func (this *encryption) Encrypted(topic string) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.topics[topic]
+}
+
+// SealPayload seals the body of a message of the topic, and wraps it with the
+// attributes.
+func (this *encryption) SealPayload(topic string, attrs map[string]string, body []byte) ([]byte, error) {
+	if this.sealer == nil {
+		return nil, ErrEncryptionDisabled
+	}
+
+	sealed, err := this.sealer.Seal(topic, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope.Encode(attrs, sealed)
+}
+
+// Open decrypts a sealed body.
+func (this *encryption) Open(body []byte) ([]byte, error) {
+	if this.sealer == nil {
+		return nil, ErrEncryptionDisabled
+	}
+
+	return this.sealer.Open(body)
+}
+
+// Encrypt enables or disables the encryption of a topic in zk, which takes
+// effect on all kateway instances after their next refresh. The sealed
+// messages are still opened after the encryption is disabled.
+func (this *encryption) Encrypt(topic string, on bool) error {
+	if on && this.sealer == nil {
+		return ErrEncryptionDisabled
+	}
+
+	if err := this.gw.GetZkZone().SetKatewayTopicEncryption(topic, on); err != nil {
+		return err
+	}
+
+	this.refresh()
+	return nil
+}
+
+// Topics returns the sorted encrypted topics.
+func (this *encryption) Topics() []string {
+	this.mu.RLock()
+	topics := make([]string, 0, len(this.topics))
+	for topic := range this.topics {
+		topics = append(topics, topic)
+	}
+	this.mu.RUnlock()
+
+	sort.Strings(topics)
+	return topics
+}
@@ -0,0 +1,3 @@
+// Package envelope encodes the attributes of a message together with its
+// body into the kafka payload, so that raw kafka consumers can decode them.
+package envelope
@@ -0,0 +1,79 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// An envelope is:
+// magic(0xff 'k' 'w') version(1 byte) attrsLen(4 bytes, big endian) attrs(json object) body
+//
+// 0xff never appears in utf8, so a text or json payload is never taken as an
+// envelope.
+const (
+	Version = 1
+
+	headerLen = 8
+)
+
+var (
+	magic = []byte{0xff, 'k', 'w'}
+
+	ErrCorrupted   = errors.New("corrupted envelope")
+	ErrVersion     = errors.New("unsupported envelope version")
+	ErrTooBigAttrs = errors.New("too big attributes")
+)
+
+// MaxAttrsLen is the max size of the encoded attributes.
+var MaxAttrsLen = 4 << 10
+
+// Is tells whether a kafka payload is an envelope.
+func Is(payload []byte) bool {
+	return len(payload) >= headerLen && bytes.Equal(payload[:len(magic)], magic)
+}
+
+// Encode wraps the body with the attributes. Without attributes, the body is
+// returned as is.
+func Encode(attrs map[string]string, body []byte) ([]byte, error) {
+	if len(attrs) == 0 {
+		return body, nil
+	}
+
+	a, _ := json.Marshal(attrs)
+	if len(a) > MaxAttrsLen {
+		return nil, ErrTooBigAttrs
+	}
+
+	payload := make([]byte, headerLen+len(a)+len(body))
+	copy(payload, magic)
+	payload[len(magic)] = Version
+	binary.BigEndian.PutUint32(payload[len(magic)+1:], uint32(len(a)))
+	copy(payload[headerLen:], a)
+	copy(payload[headerLen+len(a):], body)
+	return payload, nil
+}
+
+// Decode unwraps a kafka payload. If it is not an envelope, the attributes
+// are nil and the body is the payload.
+func Decode(payload []byte) (attrs map[string]string, body []byte, err error) {
+	if !Is(payload) {
+		return nil, payload, nil
+	}
+
+	if payload[len(magic)] != Version {
+		return nil, nil, ErrVersion
+	}
+
+	attrsLen := int(binary.BigEndian.Uint32(payload[len(magic)+1:]))
+	if attrsLen < 0 || len(payload) < headerLen+attrsLen {
+		return nil, nil, ErrCorrupted
+	}
+
+	if err = json.Unmarshal(payload[headerLen:headerLen+attrsLen], &attrs); err != nil {
+		return nil, nil, ErrCorrupted
+	}
+
+	return attrs, payload[headerLen+attrsLen:], nil
+}
@@ -0,0 +1,54 @@
+package envelope
+
+import (
+	"testing"
+
+	"github.com/funkygao/assert"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	body := []byte("hello world")
+	payload, err := Encode(nil, body)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, body, payload)
+	assert.Equal(t, false, Is(payload))
+
+	attrs := map[string]string{
+		"Content-Type": "text/plain",
+		"Trace-Id":     "abc",
+	}
+	payload, err = Encode(attrs, body)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, Is(payload))
+
+	a, b, err := Decode(payload)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, attrs, a)
+	assert.Equal(t, body, b)
+
+	// not an envelope
+	a, b, err = Decode(body)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(a))
+	assert.Equal(t, body, b)
+	a, b, err = Decode([]byte(`{"a": 1}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"a": 1}`, string(b))
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	payload, _ := Encode(map[string]string{"a": "b"}, []byte("body"))
+
+	payload[3] = 2
+	_, _, err := Decode(payload)
+	assert.Equal(t, ErrVersion, err)
+	payload[3] = Version
+
+	_, _, err = Decode(payload[:headerLen+3])
+	assert.Equal(t, ErrCorrupted, err)
+
+	MaxAttrsLen = 5
+	defer func() { MaxAttrsLen = 4 << 10 }()
+	_, err = Encode(map[string]string{"a": "b"}, nil)
+	assert.Equal(t, ErrTooBigAttrs, err)
+}
@@ -8,4 +8,39 @@ var (
 	ErrClientGone         = errors.New("remote client gone")
 	ErrTooBigPubMessage   = errors.New("too big message")
 	ErrTooSmallPubMessage = errors.New("too small message")
+	ErrTooBigPartitionKey = errors.New("too large partition key")
+	ErrInvalidBatchBody   = errors.New("invalid batch body")
+	ErrEmptyBatch         = errors.New("empty batch")
+	ErrTooBigBatch        = errors.New("too many messages in batch")
+	ErrInvalidDelay       = errors.New("invalid delay")
+	ErrTooBigDelay        = errors.New("too big delay")
+	ErrInvalidWsFrame     = errors.New("invalid websocket frame")
+	ErrInvalidSubCommand  = errors.New("invalid sub command")
+	ErrDupSubscription    = errors.New("duplicated subscription")
+	ErrNoSubscription     = errors.New("subscription not found")
+	ErrTooManySubs        = errors.New("too many subscriptions")
+	ErrStatelessAck       = errors.New("autocommit=0 not supported by stateless sub")
+	ErrNotInflight        = errors.New("message not inflight")
+	ErrDeadLetterDisabled = errors.New("dead letter requires both pub and sub store")
+	ErrDeadLetterTopic    = errors.New("fail to create dead letter topic")
+	ErrInvalidWebhook     = errors.New("invalid webhook")
+	ErrWebhookForbidden   = errors.New("webhook endpoint in an internal network")
+	ErrInvalidSeek        = errors.New("exactly one of offset, delta, ts required")
+	ErrQuotaExceeded      = errors.New("quota exceeded")
+	ErrInvalidFilter      = errors.New("invalid filter")
+	ErrFilterMismatch     = errors.New("filter differs from the filter of the group")
+	ErrTooBigIdempotency  = errors.New("too long idempotency key")
+	ErrPubInProgress      = errors.New("pub with the same idempotency key in progress")
+	ErrIdempotencyTopic   = errors.New("fail to create idempotency topic")
+	ErrTooBigSchema       = errors.New("too big schema")
+	ErrUnknownPlugin      = errors.New("unknown plugin")
+	ErrEncryptionDisabled = errors.New("payload encryption disabled without keystore")
+	ErrCertRevoked        = errors.New("client certificate revoked")
+	ErrInvalidTokenTTL    = errors.New("invalid token ttl")
+	ErrSignatureExpired   = errors.New("request timestamp out of clock skew window")
+	ErrSignatureReplay    = errors.New("replayed request nonce")
+	ErrBodyDigest         = errors.New("body differs from the signed digest")
+	ErrInvalidCommit      = errors.New("invalid commit policy")
+	ErrCommitMismatch     = errors.New("commit policy differs from the policy of the group")
+	ErrCommitAck          = errors.New("autocommit=0 commits by acks, only atleastonce allowed")
 )
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/funkygao/log4go"
+)
+
+// A sub filter matches the partition key or the attributes of a message:
+//
+//	expr := and { "||" and }
+//	and  := not { "&&" not }
+//	not  := "!" not | "(" expr ")" | cmp
+//	cmp  := field ("==" | "!=" | "^=") string
+//	field := key | attr.<Name>
+//
+// ^= means starts with, and a string is quoted with ' or ". e,g.
+//
+//	attr.Event-Type == 'order.created' && !(key ^= "test-")
+//
+// A missing attribute is an empty string.
+type subFilter struct {
+	expr string
+	root filterNode
+}
+
+type filterNode interface {
+	match(key string, attrs map[string]string) bool
+}
+
+type filterCmp struct {
+	field string // empty for the partition key, else attribute name
+	op    string
+	value string
+}
+
+func (this *filterCmp) match(key string, attrs map[string]string) bool {
+	v := key
+	if this.field != "" {
+		v = attrs[this.field]
+	}
+
+	switch this.op {
+	case "==":
+		return v == this.value
+	case "!=":
+		return v != this.value
+	default: // ^=
+		return strings.HasPrefix(v, this.value)
+	}
+}
+
+type filterAnd struct{ left, right filterNode }
+
+func (this *filterAnd) match(key string, attrs map[string]string) bool {
+	return this.left.match(key, attrs) && this.right.match(key, attrs)
+}
+
+type filterOr struct{ left, right filterNode }
+
+func (this *filterOr) match(key string, attrs map[string]string) bool {
+	return this.left.match(key, attrs) || this.right.match(key, attrs)
+}
+
+type filterNot struct{ node filterNode }
+
+func (this *filterNot) match(key string, attrs map[string]string) bool {
+	return !this.node.match(key, attrs)
+}
+
+func (this *subFilter) Match(key []byte, attrs map[string]string) bool {
+	return this.root.match(string(key), attrs)
+}
+
+// parseFilter compiles a filter expression.
+func parseFilter(expr string) (*subFilter, error) {
+	if len(expr) > MaxSubFilterLen {
+		return nil, ErrInvalidFilter
+	}
+
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, ErrInvalidFilter
+	}
+
+	return &subFilter{expr: expr, root: root}, nil
+}
+
+type filterToken struct {
+	kind  byte // 'i' ident, 's' string, 'o' operator
+	value string
+}
+
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(expr[i+1:], c)
+			if end < 0 {
+				return nil, ErrInvalidFilter
+			}
+			tokens = append(tokens, filterToken{'s', expr[i+1 : i+1+end]})
+			i += end + 2
+
+		case c == '(' || c == ')':
+			tokens = append(tokens, filterToken{'o', string(c)})
+			i++
+
+		case i+1 < len(expr) && (expr[i:i+2] == "==" || expr[i:i+2] == "!=" ||
+			expr[i:i+2] == "^=" || expr[i:i+2] == "&&" || expr[i:i+2] == "||"):
+			tokens = append(tokens, filterToken{'o', expr[i : i+2]})
+			i += 2
+
+		case c == '!':
+			tokens = append(tokens, filterToken{'o', "!"})
+			i++
+
+		case isFilterIdentChar(c):
+			j := i
+			for j < len(expr) && isFilterIdentChar(expr[j]) {
+				j++
+			}
+			tokens = append(tokens, filterToken{'i', expr[i:j]})
+			i = j
+
+		default:
+			return nil, ErrInvalidFilter
+		}
+	}
+
+	if len(tokens) == 0 {
+		return nil, ErrInvalidFilter
+	}
+
+	return tokens, nil
+}
+
+func isFilterIdentChar(c byte) bool {
+	return c == '_' || c == '-' || c == '.' || (c >= '0' && c <= '9') ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (this *filterParser) accept(op string) bool {
+	if this.pos < len(this.tokens) && this.tokens[this.pos].kind == 'o' &&
+		this.tokens[this.pos].value == op {
+		this.pos++
+		return true
+	}
+
+	return false
+}
+
+func (this *filterParser) parseOr() (filterNode, error) {
+	left, err := this.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for this.accept("||") {
+		right, err := this.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &filterOr{left, right}
+	}
+
+	return left, nil
+}
+
+func (this *filterParser) parseAnd() (filterNode, error) {
+	left, err := this.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for this.accept("&&") {
+		right, err := this.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &filterAnd{left, right}
+	}
+
+	return left, nil
+}
+
+func (this *filterParser) parseNot() (filterNode, error) {
+	if this.accept("!") {
+		node, err := this.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		return &filterNot{node}, nil
+	}
+
+	if this.accept("(") {
+		node, err := this.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !this.accept(")") {
+			return nil, ErrInvalidFilter
+		}
+
+		return node, nil
+	}
+
+	return this.parseCmp()
+}
+
+func (this *filterParser) parseCmp() (filterNode, error) {
+	if this.pos+3 > len(this.tokens) {
+		return nil, ErrInvalidFilter
+	}
+
+	field, op, value := this.tokens[this.pos], this.tokens[this.pos+1], this.tokens[this.pos+2]
+	if field.kind != 'i' || op.kind != 'o' || value.kind != 's' {
+		return nil, ErrInvalidFilter
+	}
+
+	cmp := &filterCmp{op: op.value, value: value.value}
+	switch {
+	case field.value == "key":
+	case strings.HasPrefix(field.value, "attr.") && len(field.value) > len("attr."):
+		cmp.field = field.value[len("attr."):]
+	default:
+		return nil, ErrInvalidFilter
+	}
+
+	switch op.value {
+	case "==", "!=", "^=":
+	default:
+		return nil, ErrInvalidFilter
+	}
+
+	this.pos += 3
+	return cmp, nil
+}
+
+// subFilters holds the filter of each consumer group in zk: once set, it is
+// fixed so that all the consumers of a group skip the same messages.
+type subFilters struct {
+	gw *Gateway
+
+	mu      sync.RWMutex
+	filters map[string]*subFilter // key is appid.group@topic
+}
+
+func newSubFilters(gw *Gateway) *subFilters {
+	return &subFilters{
+		gw:      gw,
+		filters: make(map[string]*subFilter),
+	}
+}
+
+func subFilterId(rawTopic, group string) string {
+	return group + "@" + rawTopic
+}
+
+func (this *subFilters) Start() {
+	this.refresh()
+
+	this.gw.wg.Add(1)
+	go func() {
+		defer this.gw.wg.Done()
+
+		ticker := time.NewTicker(options.ManagerRefresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				this.refresh()
+
+			case <-this.gw.shutdownCh:
+				log.Trace("sub filters stopped")
+				return
+			}
+		}
+	}()
+}
+
+func (this *subFilters) refresh() {
+	filters := make(map[string]*subFilter)
+	for id, expr := range this.gw.GetZkZone().KatewaySubFilters() {
+		f, err := parseFilter(expr)
+		if err != nil {
+			log.Error("sub filter[%s] %s: %v", id, expr, err)
+			continue
+		}
+
+		filters[id] = f
+	}
+
+	this.mu.Lock()
+	this.filters = filters
+	this.mu.Unlock()
+}
+
+// Fix returns the filter of the consumer group, nil if none.
+// If the group has no filter yet, expr becomes its filter; else expr must be
+// empty or the same as the filter of the group.
+func (this *subFilters) Fix(rawTopic, group, expr string) (*subFilter, error) {
+	id := subFilterId(rawTopic, group)
+	this.mu.RLock()
+	f, present := this.filters[id]
+	this.mu.RUnlock()
+
+	if !present && expr == "" {
+		// the filter might have been fixed by another kateway since the last
+		// refresh, a group without filter is cached as nil till the next one
+		fixed, err := this.gw.GetZkZone().KatewaySubFilter(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if fixed != "" {
+			if f, err = parseFilter(fixed); err != nil {
+				log.Error("sub filter[%s] %s: %v", id, fixed, err)
+				return nil, err
+			}
+		}
+
+		this.mu.Lock()
+		this.filters[id] = f
+		this.mu.Unlock()
+		return f, nil
+	}
+
+	switch {
+	case expr == "":
+		return f, nil
+
+	case f != nil && f.expr != expr:
+		return nil, ErrFilterMismatch
+
+	case f != nil:
+		return f, nil
+	}
+
+	f, err := parseFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	// another kateway might have fixed a different one
+	fixed, err := this.gw.GetZkZone().CreateKatewaySubFilter(id, expr)
+	if err != nil {
+		return nil, err
+	}
+	if fixed != expr {
+		return nil, ErrFilterMismatch
+	}
+
+	this.mu.Lock()
+	this.filters[id] = f
+	this.mu.Unlock()
+	return f, nil
+}
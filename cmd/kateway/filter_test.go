@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/funkygao/assert"
+)
+
+func TestParseFilterInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"key",
+		"key ==",
+		"key == abc",
+		"key = 'a'",
+		"foo == 'a'",
+		"attr. == 'a'",
+		"key == 'a",
+		"key == 'a' &&",
+		"(key == 'a'",
+		"key == 'a')",
+		"key == 'a' key == 'b'",
+		"key > 'a'",
+	} {
+		_, err := parseFilter(expr)
+		assert.Equal(t, ErrInvalidFilter, err, expr)
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	attrs := map[string]string{
+		"Event-Type": "order.created",
+		"Region":     "cn-north",
+	}
+	fixtures := []struct {
+		expr  string
+		key   string
+		match bool
+	}{
+		{"key == 'k1'", "k1", true},
+		{"key != 'k1'", "k1", false},
+		{`key ^= "k"`, "k1", true},
+		{"attr.Event-Type == 'order.created'", "", true},
+		{"attr.Missing == ''", "", true},
+		{"attr.Missing != 'a'", "", true},
+		{"attr.Region ^= 'cn-' && key == 'k2'", "k1", false},
+		{"attr.Region ^= 'us-' || key == 'k1'", "k1", true},
+		{"!(attr.Region ^= 'cn-')", "", false},
+		{"!attr.Region ^= 'us-'", "", true},
+		{"key == 'a' || key == 'b' && key == 'c'", "a", true},
+		{"(key == 'a' || key == 'b') && key == 'c'", "a", false},
+	}
+	for _, f := range fixtures {
+		filter, err := parseFilter(f.expr)
+		assert.Equal(t, nil, err, f.expr)
+		assert.Equal(t, f.match, filter.Match([]byte(f.key), attrs), f.expr)
+	}
+}
@@ -24,7 +24,6 @@ import (
 	"github.com/funkygao/gafka/registry"
 	"github.com/funkygao/gafka/registry/zk"
 	gzk "github.com/funkygao/gafka/zk"
-	"github.com/funkygao/golib/ratelimiter"
 	"github.com/funkygao/golib/signal"
 	"github.com/funkygao/golib/timewheel"
 	log "github.com/funkygao/log4go"
@@ -40,8 +39,10 @@ type Gateway struct {
 	shutdownCh   chan struct{}
 	wg           sync.WaitGroup
 
-	certFile string
-	keyFile  string
+	certFile    string
+	keyFile     string
+	clientCerts *clientCerts // nil if mTLS is disabled
+	signatures  *signatures
 
 	zkzone *gzk.ZkZone // load/resume/flush counter metrics to zk
 
@@ -49,15 +50,24 @@ type Gateway struct {
 	subServer *subServer
 	manServer *manServer
 
-	clientStates *ClientStates
+	clientStates   *ClientStates
+	inflights      *inflights // sub messages waiting for ack
+	deadLetters    *deadLetters
+	webhooks       *webhooks
+	subFilters     *subFilters
+	commitPolicies *commitPolicies
+	quotas         *quotas
+	idempotency    *idempotency
+	schemas        *schemas
+	plugins        *plugins
+	encryption     *encryption
 
 	pubMetrics *pubMetrics
 	subMetrics *subMetrics
 	svrMetrics *serverMetrics
 
-	guard        *guard
-	timer        *timewheel.TimeWheel
-	leakyBuckets *ratelimiter.LeakyBuckets // TODO
+	guard *guard
+	timer *timewheel.TimeWheel
 }
 
 func NewGateway(id string, metaRefreshInterval time.Duration) *Gateway {
@@ -65,11 +75,11 @@ func NewGateway(id string, metaRefreshInterval time.Duration) *Gateway {
 		id:           id,
 		zone:         options.Zone,
 		shutdownCh:   make(chan struct{}),
-		leakyBuckets: ratelimiter.NewLeakyBuckets(1000*60, time.Minute),
 		certFile:     options.CertFile,
 		keyFile:      options.KeyFile,
 		clientStates: NewClientStates(),
 	}
+	this.quotas = newQuotas(this, &zkQuotaCoordinator{gw: this})
 
 	registry.Default = zk.New(this.zone, this.id, this.InstanceInfo())
 
@@ -77,6 +87,12 @@ func NewGateway(id string, metaRefreshInterval time.Duration) *Gateway {
 	metaConf.Refresh = metaRefreshInterval
 	meta.Default = zkmeta.New(metaConf)
 	this.guard = newGuard(this)
+	this.schemas = newSchemas(this)
+	this.plugins = newPlugins(this, options.Plugins)
+	this.encryption = newEncryption(this, options.Keystore)
+	this.clientCerts = newClientCerts(this, options.ClientCAFile, options.CrlFile,
+		options.RequireClientCert)
+	this.signatures = newSignatures(this, options.SignatureSkew, &zkNonceStore{gw: this})
 	this.timer = timewheel.NewTimeWheel(time.Second, 120)
 
 	this.manServer = newManServer(options.ManHttpAddr, options.ManHttpsAddr,
@@ -100,12 +116,13 @@ func NewGateway(id string, metaRefreshInterval time.Duration) *Gateway {
 		this.pubServer = newPubServer(options.PubHttpAddr, options.PubHttpsAddr,
 			options.MaxClients, this)
 		this.pubMetrics = NewPubMetrics(this)
+		this.idempotency = newIdempotency(this)
 
 		switch options.Store {
 		case "kafka":
 			store.DefaultPubStore = kafka.NewPubStore(
 				options.PubPoolCapcity, options.MaxPubRetries, options.PubPoolIdleTimeout,
-				&this.wg, options.Debug, options.DryRun)
+				&this.wg, options.Debug, options.DryRun, options.DelayedPub)
 
 		case "dummy":
 			store.DefaultPubStore = storedummy.NewPubStore(&this.wg, options.Debug)
@@ -119,11 +136,34 @@ func NewGateway(id string, metaRefreshInterval time.Duration) *Gateway {
 		this.subServer = newSubServer(options.SubHttpAddr, options.SubHttpsAddr,
 			options.MaxClients, this)
 		this.subMetrics = NewSubMetrics(this)
+		this.inflights = newInflights(options.SubVisibilityTimeout)
+		this.deadLetters = newDeadLetters(this)
+		this.webhooks = newWebhooks(this)
+		this.subFilters = newSubFilters(this)
+		this.commitPolicies = newCommitPolicies(this)
 
 		switch options.Store {
 		case "kafka":
-			store.DefaultSubStore = kafka.NewSubStore(&this.wg,
-				this.subServer.closedConnCh, options.Debug)
+			if !options.StatelessSub {
+				store.DefaultSubStore = kafka.NewSubStore(&this.wg,
+					this.subServer.closedConnCh, splitNames(options.KafkaOffsets),
+					options.OffsetCommitInterval, options.Debug)
+				break
+			}
+
+			var offsets store.OffsetStore
+			switch options.OffsetStore {
+			case "zk":
+				offsets = kafka.NewZkOffsetStore()
+
+			case "kafka":
+				offsets = kafka.NewKafkaOffsetStore(ctx.Hostname())
+
+			default:
+				panic("invalid offset store")
+			}
+			store.DefaultSubStore = kafka.NewStatelessSubStore(&this.wg,
+				this.subServer.closedConnCh, offsets, options.SubLeaseTTL)
 
 		case "dummy":
 			store.DefaultSubStore = storedummy.NewSubStore(&this.wg,
@@ -171,6 +211,7 @@ func (this *Gateway) Start() (err error) {
 
 	// FIXME load balancer will redispatch the consumer to another
 	// kateway, but the offset has not been committed, then???
+	// -statelesssub commits the offsets before answering instead.
 	signal.RegisterSignalsHandler(func(sig os.Signal) {
 		if registry.Default == nil {
 			log.Warn("USR1 fired when no registry defined")
@@ -196,6 +237,20 @@ func (this *Gateway) Start() (err error) {
 	this.guard.Start()
 	log.Trace("guard started")
 
+	this.plugins.Start()
+	log.Trace("plugins started")
+
+	this.encryption.Start()
+	log.Trace("encryption started")
+
+	if this.clientCerts != nil {
+		this.clientCerts.Start()
+		log.Trace("client certs started")
+	}
+
+	this.signatures.Start()
+	log.Trace("signatures started")
+
 	this.buildRouting()
 	this.manServer.Start()
 
@@ -207,12 +262,23 @@ func (this *Gateway) Start() (err error) {
 
 	this.svrMetrics.Load()
 
+	if options.QuotaSyncInterval > 0 {
+		this.quotas.Start()
+		log.Trace("quota coordinator started")
+	}
+
 	if this.pubServer != nil {
 		if err := store.DefaultPubStore.Start(); err != nil {
 			panic(err)
 		}
 		log.Trace("pub store[%s] started", store.DefaultPubStore.Name())
 
+		this.idempotency.Start()
+		log.Trace("idempotency started")
+
+		this.schemas.Start()
+		log.Trace("schemas started")
+
 		this.pubMetrics.Load()
 		this.pubServer.Start()
 	}
@@ -222,6 +288,18 @@ func (this *Gateway) Start() (err error) {
 		}
 		log.Trace("sub store[%s] started", store.DefaultSubStore.Name())
 
+		this.deadLetters.Start()
+		log.Trace("dead letters started")
+
+		this.webhooks.Start()
+		log.Trace("webhooks started")
+
+		this.subFilters.Start()
+		log.Trace("sub filters started")
+
+		this.commitPolicies.Start()
+		log.Trace("commit policies started")
+
 		this.subMetrics.Load()
 		this.subServer.Start()
 	}
@@ -3,13 +3,18 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/buaazp/fasthttprouter"
+	"github.com/funkygao/gafka/cmd/kateway/envelope"
 	"github.com/funkygao/gafka/cmd/kateway/manager"
 	"github.com/funkygao/gafka/cmd/kateway/meta"
+	"github.com/funkygao/gafka/cmd/kateway/sign"
 	"github.com/funkygao/gafka/cmd/kateway/store"
 	log "github.com/funkygao/log4go"
 	"github.com/valyala/fasthttp"
@@ -23,11 +28,13 @@ func (this *Gateway) pubHandler(ctx *fasthttp.RequestCtx, params fasthttprouter.
 	header := ctx.Request.Header
 	appid := string(header.Peek(HttpHeaderAppid))
 	pubkey := string(header.Peek(HttpHeaderPubkey))
-	if err := manager.Default.AuthPub(appid, pubkey, topic); err != nil {
+	ver := params.ByName(UrlParamVersion)
+	chain := this.plugins.Chain(newPubPluginRequest(appid, pubkey, topic, ver,
+		ctx.RemoteAddr().String(), t1).WithFastRequest(ctx))
+	if err := chain.PrePub(nil); err != nil {
 		log.Error("app[%s] %s %+v: %v", appid, ctx.RemoteAddr(), params, err)
 
-		ctx.SetConnectionClose()
-		ctx.Error("invalid secret", fasthttp.StatusUnauthorized)
+		this.writeFastPluginError(ctx, err)
 		return
 	}
 
@@ -49,23 +56,52 @@ func (this *Gateway) pubHandler(ctx *fasthttp.RequestCtx, params fasthttprouter.
 		return
 	}
 
-	ver := params.ByName(UrlParamVersion)
+	if err := chain.req.Signature.verifyBody(ctx.PostBody()); err != nil {
+		log.Warn("pub[%s] %s %+v %v", appid, ctx.RemoteAddr(), params, err)
+		ctx.Error(err.Error(), fasthttp.StatusUnauthorized)
+		return
+	}
+
 	queryArgs := ctx.Request.URI().QueryArgs()
 	key := queryArgs.Peek(UrlQueryKey)
 	asyncArg := queryArgs.Peek(UrlQueryAsync)
 	async := len(asyncArg) == 1 && asyncArg[0] == '1'
-	//delay := hack.String(queryArgs.Peek(UrlQueryDelay))
+	due, err := parseDeliverTime(string(queryArgs.Peek(UrlQueryDelay)),
+		string(queryArgs.Peek(UrlQueryDueAt)), t1)
+	if err != nil {
+		log.Warn("pub[%s] %s %+v %v", appid, ctx.RemoteAddr(), params, err)
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	pm := &PluginMessage{Key: key, Body: ctx.PostBody()}
+	ctx.Request.Header.VisitAll(func(k, v []byte) {
+		if len(k) > len(HttpHeaderAttrPrefix) && strings.HasPrefix(string(k), HttpHeaderAttrPrefix) {
+			if pm.Attrs == nil {
+				pm.Attrs = make(map[string]string)
+			}
+			pm.Attrs[string(k[len(HttpHeaderAttrPrefix):])] = string(v)
+		}
+	})
+	if err = chain.PrePub(pm); err != nil {
+		log.Warn("pub[%s] %s %+v %v", appid, ctx.RemoteAddr(), params, err)
+		this.writeFastPluginError(ctx, err)
+		return
+	}
+
+	// the attributes go with the body in an envelope
+	payload, err := envelope.Encode(pm.Attrs, pm.Body)
+	if err != nil {
+		log.Warn("pub[%s] %s %+v %v", appid, ctx.RemoteAddr(), params, err)
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
 
 	if options.Debug {
 		log.Debug("pub[%s] %s {topic:%s, ver:%s, key:%s, async:%+v} %s",
 			appid, ctx.RemoteAddr(),
-			topic, ver, key, async,
-			string(ctx.Request.Body()))
-	}
-
-	if !options.DisableMetrics {
-		this.pubMetrics.PubQps.Mark(1)
-		this.pubMetrics.PubMsgSize.Update(int64(len(ctx.PostBody())))
+			topic, ver, pm.Key, async,
+			string(pm.Body))
 	}
 
 	pubMethod := store.DefaultPubStore.SyncPub
@@ -81,13 +117,60 @@ func (this *Gateway) pubHandler(ctx *fasthttp.RequestCtx, params fasthttprouter.
 		return
 	}
 
-	err := pubMethod(cluster, appid+"."+topic+"."+ver,
-		key, ctx.PostBody())
-	if err != nil {
+	rawTopic := appid + "." + topic + "." + ver
+	if err = this.schemas.Validate(cluster, rawTopic, pm.Body); err != nil {
+		log.Warn("pub[%s] %s %+v schema: %v", appid, ctx.RemoteAddr(), params, err)
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	if this.encryption.Encrypted(rawTopic) {
+		if payload, err = this.encryption.SealPayload(rawTopic, pm.Attrs, pm.Body); err != nil {
+			log.Error("pub[%s] %s %+v seal: %v", appid, ctx.RemoteAddr(), params, err)
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+	}
+
+	// charged right before pub, so that the rejected pubs are free
+	if retryAfter := this.quotas.Take(false, appid, topic, 1, int64(msgLen), time.Now()); retryAfter > 0 {
+		log.Warn("pub[%s] %s %+v quota exceeded, retry after %s", appid, ctx.RemoteAddr(), params, retryAfter)
+
 		if !options.DisableMetrics {
-			this.pubMetrics.PubFail(appid, topic, ver)
+			this.pubMetrics.QuotaExceeded(appid, topic, ver)
 		}
+		this.writeFastQuotaExceeded(ctx, retryAfter)
+		return
+	}
+
+	if !due.IsZero() {
+		err = store.DefaultPubStore.DelayPub(cluster, rawTopic,
+			pm.Key, payload, due)
+		chain.PostPub(pm, err)
+		if err != nil {
+			this.quotas.Refund(false, appid, topic, 1, int64(msgLen), time.Now())
+			if err == store.ErrDelayDisabled {
+				log.Warn("%s: %v", ctx.RemoteAddr(), err)
+
+				ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+				return
+			}
+
+			log.Error("%s: %v", ctx.RemoteAddr(), err)
 
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+
+		ctx.SetStatusCode(fasthttp.StatusAccepted)
+		ctx.Write(ResponseOk)
+		return
+	}
+
+	pm.Partition, pm.Offset, err = pubMethod(cluster, rawTopic, pm.Key, payload)
+	chain.PostPub(pm, err)
+	if err != nil {
+		this.quotas.Refund(false, appid, topic, 1, int64(msgLen), time.Now())
 		log.Error("%s: %v", ctx.RemoteAddr(), err)
 
 		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
@@ -96,10 +179,91 @@ func (this *Gateway) pubHandler(ctx *fasthttp.RequestCtx, params fasthttprouter.
 
 	// write the reponse
 	ctx.Write(ResponseOk)
-	if !options.DisableMetrics {
-		this.pubMetrics.PubOk(appid, topic, ver)
-		this.pubMetrics.PubLatency.Update(time.Since(t1).Nanoseconds() / 1e6) // in ms
+}
+
+// /batch/topics/:topic/:ver
+func (this *Gateway) pubBatchHandler(ctx *fasthttp.RequestCtx, params fasthttprouter.Params) {
+	topic := params.ByName(UrlParamTopic)
+	header := ctx.Request.Header
+	appid := string(header.Peek(HttpHeaderAppid))
+	pubkey := string(header.Peek(HttpHeaderPubkey))
+	ver := params.ByName(UrlParamVersion)
+	now := time.Now()
+	chain := this.plugins.Chain(newPubPluginRequest(appid, pubkey, topic, ver,
+		ctx.RemoteAddr().String(), now).WithFastRequest(ctx))
+	if err := chain.PrePub(nil); err != nil {
+		log.Error("app[%s] %s %+v: %v", appid, ctx.RemoteAddr(), params, err)
+
+		this.writeFastPluginError(ctx, err)
+		return
 	}
+
+	bodyLen := ctx.Request.Header.ContentLength()
+	switch {
+	case bodyLen == -1:
+		log.Warn("batch pub[%s] %s %+v invalid content length", appid, ctx.RemoteAddr(), params)
+		ctx.Error("invalid content length", fasthttp.StatusBadRequest)
+		return
+
+	case int64(bodyLen) > options.MaxPubBatchSize:
+		log.Warn("batch pub[%s] %s %+v too big content length:%d", appid, ctx.RemoteAddr(), params, bodyLen)
+		ctx.Error(ErrTooBigBatch.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	if err := chain.req.Signature.verifyBody(ctx.PostBody()); err != nil {
+		log.Warn("batch pub[%s] %s %+v %v", appid, ctx.RemoteAddr(), params, err)
+		ctx.Error(err.Error(), fasthttp.StatusUnauthorized)
+		return
+	}
+
+	msgs, err := decodeBatchMessages(ctx.PostBody())
+	if err != nil {
+		log.Warn("batch pub[%s] %s %+v %v", appid, ctx.RemoteAddr(), params, err)
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	cluster, found := manager.Default.LookupCluster(appid)
+	if !found {
+		log.Error("cluster not found for app: %s", appid)
+
+		ctx.Error("invalid appid", fasthttp.StatusBadRequest)
+		return
+	}
+
+	pms := prePubBatch(chain, msgs)
+	this.validateBatchMessages(cluster, appid+"."+topic+"."+ver, msgs)
+
+	// only the valid messages are charged, right before pub
+	n, bytes := batchUsage(msgs, pms)
+	if retryAfter := this.quotas.Take(false, appid, topic, n, bytes, time.Now()); retryAfter > 0 {
+		log.Warn("batch pub[%s] %s %+v quota exceeded, retry after %s", appid, ctx.RemoteAddr(), params, retryAfter)
+
+		if !options.DisableMetrics {
+			this.pubMetrics.QuotaExceeded(appid, topic, ver)
+		}
+		this.writeFastQuotaExceeded(ctx, retryAfter)
+		return
+	}
+
+	results, err := this.pubBatch(chain, cluster, msgs, pms)
+	published, publishedBytes := batchUsage(msgs, pms)
+	if err != nil {
+		published, publishedBytes = 0, 0
+	}
+	this.quotas.Refund(false, appid, topic, n-published, bytes-publishedBytes, time.Now())
+	if err != nil {
+		log.Error("%s: %v", ctx.RemoteAddr(), err)
+
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	b, _ := json.Marshal(results)
+	ctx.SetContentType(ContentTypeJson)
+	ctx.SetStatusCode(fasthttp.StatusCreated)
+	ctx.Write(b)
 }
 
 // /raw/topics/:topic/:ver
@@ -117,11 +281,12 @@ func (this *Gateway) pubRawHandler(ctx *fasthttp.RequestCtx, params fasthttprout
 	appid = string(header.Peek(HttpHeaderAppid))
 	pubkey = string(header.Peek(HttpHeaderPubkey))
 
-	if err := manager.Default.AuthPub(appid, pubkey, topic); err != nil {
+	chain := this.plugins.Chain(newPubPluginRequest(appid, pubkey, topic, ver,
+		ctx.RemoteAddr().String(), time.Now()))
+	if err := chain.PrePub(nil); err != nil {
 		log.Error("app[%s] %s %+v: %v", appid, ctx.RemoteAddr(), params, err)
 
-		ctx.SetConnectionClose()
-		ctx.Error("invalid secret", fasthttp.StatusUnauthorized)
+		this.writeFastPluginError(ctx, err)
 		return
 	}
 
@@ -152,3 +317,62 @@ func (this *Gateway) pubWsHandler(ctx *fasthttp.RequestCtx, params fasthttproute
 func (this *Gateway) pubCheckHandler(ctx *fasthttp.RequestCtx, params fasthttprouter.Params) {
 	ctx.Write(ResponseOk)
 }
+
+// WithFastRequest sets the client certificate and the signature of the
+// request, like WithRequest.
+func (this *PluginRequest) WithFastRequest(ctx *fasthttp.RequestCtx) *PluginRequest {
+	if conn, ok := ctx.Conn().(*tls.Conn); ok {
+		state := conn.ConnectionState()
+		this.Cert = peerCert(&state)
+	}
+	this.Signature = parseFastRequestSignature(this.Appid, ctx)
+	return this
+}
+
+// parseFastRequestSignature returns nil if the request is not signed.
+func parseFastRequestSignature(appid string, ctx *fasthttp.RequestCtx) *RequestSignature {
+	header := &ctx.Request.Header
+	signature := string(header.Peek(sign.HeaderSignature))
+	if signature == "" {
+		return nil
+	}
+
+	query := make(url.Values)
+	ctx.QueryArgs().VisitAll(func(k, v []byte) {
+		query.Add(string(k), string(v))
+	})
+	timestamp := string(header.Peek(sign.HeaderTimestamp))
+	nonce := string(header.Peek(sign.HeaderNonce))
+	digest := string(header.Peek(sign.HeaderDigest))
+	t, _ := strconv.ParseInt(timestamp, 10, 64)
+	return &RequestSignature{
+		StringToSign: sign.StringToSign(appid, string(ctx.Method()), string(ctx.Path()), query,
+			digest, timestamp, nonce),
+		Signature: signature,
+		Timestamp: t,
+		Nonce:     nonce,
+		Digest:    digest,
+	}
+}
+
+func (this *Gateway) writeFastQuotaExceeded(ctx *fasthttp.RequestCtx, retryAfter time.Duration) {
+	// Retry-After is in seconds
+	ctx.Response.Header.Set(HttpHeaderRetryAfter,
+		strconv.FormatInt(int64((retryAfter+time.Second-1)/time.Second), 10))
+	ctx.Error(ErrQuotaExceeded.Error(), HttpStatusTooManyRequests)
+}
+
+func (this *Gateway) writeFastPluginError(ctx *fasthttp.RequestCtx, err error) {
+	if pe, ok := err.(*PluginError); ok {
+		if pe.Status == fasthttp.StatusUnauthorized {
+			ctx.SetConnectionClose()
+			ctx.Error("invalid secret", fasthttp.StatusUnauthorized)
+			return
+		}
+
+		ctx.Error(pe.Error(), pe.Status)
+		return
+	}
+
+	ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+}
@@ -3,13 +3,18 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/funkygao/gafka/cmd/kateway/manager"
 	"github.com/funkygao/gafka/cmd/kateway/meta"
+	"github.com/funkygao/gafka/cmd/kateway/schema"
+	"github.com/funkygao/gafka/cmd/kateway/store"
 	log "github.com/funkygao/log4go"
 	"github.com/julienschmidt/httprouter"
 )
@@ -25,28 +30,48 @@ man server: %s
 dbg server: %s
 
 pub:
-POST /topics/:topic/:ver?key=msgkey&async=<0|1>
-POST /ws/topics/:topic/:ver
+POST /topics/:topic/:ver?key=msgkey&async=<0|1>&delay=<seconds>&deliverat=<unix timestamp>
+POST /batch/topics/:topic/:ver
+ GET /ws/topics/:topic/:ver
  GET /raw/topics/:topic/:ver
  GET /alive
 
 sub:
  GET /lag/:appid/:topic/:ver?group=xx
- GET /topics/:appid/:topic/:ver?group=xx&limit=1&reset=<newest|oldest>&autocommit=<1|0>
- GET /ws/topics/:appid/:topic/:ver?group=xx
+ GET /topics/:appid/:topic/:ver?group=xx&limit=1&reset=<newest|oldest>&autocommit=<1|0>&filter=<expr>&commit=<policy>
+ PUT /ack/:appid/:topic/:ver?group=xx&partition=0&offset=10
+ PUT /nack/:appid/:topic/:ver?group=xx&partition=0&offset=10
+ PUT /offsets/:appid/:topic/:ver?group=xx&partition=0&offset=100|delta=-10|ts=<unix timestamp>&force=<0|1>
+POST /webhooks/:appid/:topic/:ver?group=xx
+DELETE /webhooks/:appid/:topic/:ver?group=xx
+ GET /ws/topics/:appid/:topic/:ver?group=xx&filter=<expr>&commit=<policy>
+ GET /ws/subscriptions  {"op":"<sub|unsub>","id":"xx","appid":"xx","topic":"xx","ver":"xx","group":"xx"}
  GET /raw/topics/:appid/:topic/:ver
  GET /alive
 
-man:
+man: Appid/Pubkey headers of an admin, role=<readonly|topicadmin|superuser>
  GET /help
  GET /status
  GET /clusters
  GET /clients
+ GET /webhooks
+ GET /groups
+ GET /plugins
+ PUT /plugins/:target?plugins=<comma separated names>  target=<appid|appid.topic.ver>
+ GET /encryption
+ PUT /encryption/:appid/:topic/:ver?on=<0|1>
  GET /alive 
  PUT /options/:option/:value
  PUT /log/:level  level=<info|debug|trace|warn|alarm|error>
 POST /topics/:cluster/:appid/:topic/:ver
  GET /partitions/:cluster/:appid/:topic/:ver
+ PUT /deadletter/:appid/:group/:maxdelivery
+ PUT /commit/:appid/:group/:policy  policy=<atmostonce|atleastonce[:N][:T]|sync>
+POST /replay/:cluster/:appid/:topic/:ver?limit=1000
+ GET /schemas/:cluster
+ GET /schemas/:cluster/:appid/:topic/:ver?version=<latest if absent>
+POST /schemas/:cluster/:appid/:topic/:ver?force=<0|1>
+POST /tokens/:appid?pub=<topics>&sub=<topics>&ttl=<duration>  Pubkey header of the app, not admin
 
 dbg:
  GET /debug/pprof
@@ -105,7 +130,8 @@ func (this *Gateway) setOptionHandler(w http.ResponseWriter, r *http.Request,
 		options.DisableMetrics = boolVal
 
 	case "ratelimit":
-		options.Ratelimit = boolVal
+		// deprecated, replaced by the pub quota of each appid
+		log.Warn("option:%s is deprecated and ignored", option)
 
 	default:
 		log.Warn("invalid option:%s=%s", option, value)
@@ -144,13 +170,6 @@ func (this *Gateway) resetCounterHandler(w http.ResponseWriter, r *http.Request,
 	w.Write(ResponseOk)
 }
 
-func (this *Gateway) authAdmin(appid, pubkey string) (ok bool) {
-	if appid == "_psubAdmin_" && pubkey == "_wandafFan_" { // FIXME
-		ok = true
-	}
-	return
-}
-
 // /partitions/:cluster/:appid/:topic/:ver
 func (this *Gateway) partitionsHandler(w http.ResponseWriter, r *http.Request,
 	params httprouter.Params) {
@@ -159,16 +178,7 @@ func (this *Gateway) partitionsHandler(w http.ResponseWriter, r *http.Request,
 	topic := params.ByName(UrlParamTopic)
 	cluster := params.ByName(UrlParamCluster)
 	hisAppid := params.ByName(UrlParamAppid)
-	appid := r.Header.Get(HttpHeaderAppid)
-	pubkey := r.Header.Get(HttpHeaderPubkey)
 	ver := params.ByName(UrlParamVersion)
-	if !this.authAdmin(appid, pubkey) {
-		log.Warn("suspicous partitions call from %s(%s): {cluster:%s app:%s key:%s topic:%s ver:%s}",
-			r.RemoteAddr, getHttpRemoteIp(r), cluster, appid, pubkey, topic, ver)
-
-		this.writeAuthFailure(w, manager.ErrPermDenied)
-		return
-	}
 
 	zkcluster := meta.Default.ZkCluster(cluster)
 	kfk, err := sarama.NewClient(zkcluster.BrokerList(), sarama.NewConfig())
@@ -209,15 +219,7 @@ func (this *Gateway) addTopicHandler(w http.ResponseWriter, r *http.Request,
 	cluster := params.ByName(UrlParamCluster)
 	hisAppid := params.ByName(UrlParamAppid)
 	appid := r.Header.Get(HttpHeaderAppid)
-	pubkey := r.Header.Get(HttpHeaderPubkey)
 	ver := params.ByName(UrlParamVersion)
-	if !this.authAdmin(appid, pubkey) {
-		log.Warn("suspicous add topic from %s(s): {appid:%s, pubkey:%s, cluster:%s, topic:%s, ver:%s}",
-			r.RemoteAddr, getHttpRemoteIp(r), appid, pubkey, cluster, topic, ver)
-
-		this.writeAuthFailure(w, manager.ErrPermDenied)
-		return
-	}
 
 	zkcluster := meta.Default.ZkCluster(cluster)
 	info := zkcluster.RegisteredInfo()
@@ -266,3 +268,368 @@ func (this *Gateway) addTopicHandler(w http.ResponseWriter, r *http.Request,
 		http.Error(w, strings.Join(lines, "\n"), http.StatusInternalServerError)
 	}
 }
+
+// /deadletter/:appid/:group/:maxdelivery
+func (this *Gateway) setMaxDeliveriesHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	hisAppid := params.ByName(UrlParamAppid)
+	group := params.ByName("group")
+	appid := r.Header.Get(HttpHeaderAppid)
+
+	if this.deadLetters == nil {
+		http.Error(w, "sub server not enabled", http.StatusBadRequest)
+		return
+	}
+
+	maxDeliveries, err := strconv.Atoi(params.ByName("maxdelivery"))
+	if err != nil || maxDeliveries < 0 || !validateGroupName(group) {
+		http.Error(w, "invalid argument", http.StatusBadRequest)
+		return
+	}
+
+	if err = this.deadLetters.SetMaxDeliveries(hisAppid+"."+group, maxDeliveries); err != nil {
+		log.Error("set max delivery {app:%s, group:%s}: %v", hisAppid, group, err)
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("app[%s] from %s(%s) set max delivery {app:%s, group:%s} %d",
+		appid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, group, maxDeliveries)
+
+	this.writeKatewayHeader(w)
+	w.Write(ResponseOk)
+}
+
+// /commit/:appid/:group/:policy
+// sets the commit policy of the consumer group, which the subscribers must follow
+func (this *Gateway) setCommitPolicyHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	hisAppid := params.ByName(UrlParamAppid)
+	group := params.ByName("group")
+	appid := r.Header.Get(HttpHeaderAppid)
+
+	if this.commitPolicies == nil {
+		http.Error(w, "sub server not enabled", http.StatusBadRequest)
+		return
+	}
+
+	policy, err := parseCommitPolicy(params.ByName("policy"))
+	if err != nil || !validateGroupName(group) {
+		http.Error(w, "invalid argument", http.StatusBadRequest)
+		return
+	}
+
+	if err = this.commitPolicies.Set(hisAppid+"."+group, policy); err != nil {
+		log.Error("set commit policy {app:%s, group:%s}: %v", hisAppid, group, err)
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("app[%s] from %s(%s) set commit policy {app:%s, group:%s} %s",
+		appid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, group, policy)
+
+	this.writeKatewayHeader(w)
+	w.Write(ResponseOk)
+}
+
+// /replay/:cluster/:appid/:topic/:ver?limit=1000
+// moves the messages in dead letter topic back to the original topic
+func (this *Gateway) replayDeadLetterHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	topic := params.ByName(UrlParamTopic)
+	cluster := params.ByName(UrlParamCluster)
+	hisAppid := params.ByName(UrlParamAppid)
+	appid := r.Header.Get(HttpHeaderAppid)
+	ver := params.ByName(UrlParamVersion)
+
+	if this.deadLetters == nil {
+		http.Error(w, "sub server not enabled", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := getHttpQueryInt(&query, "limit", 1000)
+	if err != nil || limit <= 0 {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	n, err := this.deadLetters.Replay(cluster, meta.KafkaTopic(hisAppid, topic, ver), limit)
+	log.Info("app[%s] from %s(%s) replay {cluster:%s, app:%s, topic:%s, ver:%s} %d messages: %v",
+		appid, r.RemoteAddr, getHttpRemoteIp(r), cluster, hisAppid, topic, ver, n, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	this.writeKatewayHeader(w)
+	w.Header().Set(ContentTypeHeader, ContentTypeJson)
+	w.Write([]byte(fmt.Sprintf(`{"replayed": %d}`, n)))
+}
+
+func (this *Gateway) webhooksHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	if this.webhooks == nil {
+		http.Error(w, "sub server not enabled", http.StatusBadRequest)
+		return
+	}
+
+	this.writeKatewayHeader(w)
+	w.Header().Set(ContentTypeHeader, ContentTypeJson)
+	b, _ := json.Marshal(this.webhooks.Status())
+	w.Write(b)
+}
+
+// /groups
+// the state and members of each consumer group on this kateway
+func (this *Gateway) groupsHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	if store.DefaultSubStore == nil {
+		http.Error(w, "sub server not enabled", http.StatusBadRequest)
+		return
+	}
+
+	this.writeKatewayHeader(w)
+	w.Header().Set(ContentTypeHeader, ContentTypeJson)
+	b, _ := json.Marshal(store.DefaultSubStore.Groups())
+	w.Write(b)
+}
+
+func (this *Gateway) pluginsHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	output := map[string]interface{}{
+		"registered": this.plugins.Names(),
+		"defaults":   parsePluginNames(options.Plugins),
+		"enabled":    this.GetZkZone().KatewayPlugins(),
+	}
+
+	this.writeKatewayHeader(w)
+	w.Header().Set(ContentTypeHeader, ContentTypeJson)
+	b, _ := json.Marshal(output)
+	w.Write(b)
+}
+
+// /plugins/:target?plugins=a,b
+// enables the plugins for an appid or an appid.topic.ver, none if empty
+func (this *Gateway) setPluginsHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	target := params.ByName("target")
+	names := r.URL.Query().Get("plugins")
+	appid := r.Header.Get(HttpHeaderAppid)
+
+	if err := this.plugins.Enable(target, names); err != nil {
+		log.Error("set plugins {target:%s, plugins:%s}: %v", target, names, err)
+
+		if err == ErrUnknownPlugin {
+			this.writeBadRequest(w, err)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Info("app[%s] from %s(%s) set plugins {target:%s, plugins:%s}",
+		appid, r.RemoteAddr, getHttpRemoteIp(r), target, names)
+
+	this.writeKatewayHeader(w)
+	w.Write(ResponseOk)
+}
+
+func (this *Gateway) encryptionHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	output := map[string]interface{}{
+		"enabled": this.encryption.sealer != nil,
+		"topics":  this.encryption.Topics(),
+	}
+
+	this.writeKatewayHeader(w)
+	w.Header().Set(ContentTypeHeader, ContentTypeJson)
+	b, _ := json.Marshal(output)
+	w.Write(b)
+}
+
+// /encryption/:appid/:topic/:ver?on=1
+// enables or disables the payload encryption of a topic
+func (this *Gateway) setEncryptionHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	rawTopic := meta.KafkaTopic(params.ByName(UrlParamAppid), params.ByName(UrlParamTopic),
+		params.ByName(UrlParamVersion))
+	on := r.URL.Query().Get("on") == "1"
+	appid := r.Header.Get(HttpHeaderAppid)
+
+	if err := this.encryption.Encrypt(rawTopic, on); err != nil {
+		log.Error("set encryption {topic:%s, on:%v}: %v", rawTopic, on, err)
+
+		if err == ErrEncryptionDisabled {
+			this.writeBadRequest(w, err)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Info("app[%s] from %s(%s) set encryption {topic:%s, on:%v}",
+		appid, r.RemoteAddr, getHttpRemoteIp(r), rawTopic, on)
+
+	this.writeKatewayHeader(w)
+	w.Write(ResponseOk)
+}
+
+// /schemas/:cluster
+func (this *Gateway) schemasHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	cluster := params.ByName(UrlParamCluster)
+
+	this.writeKatewayHeader(w)
+	w.Header().Set(ContentTypeHeader, ContentTypeJson)
+	b, _ := json.Marshal(this.schemas.Topics(cluster))
+	w.Write(b)
+}
+
+// /schemas/:cluster/:appid/:topic/:ver?version=1
+func (this *Gateway) schemaHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	topic := params.ByName(UrlParamTopic)
+	cluster := params.ByName(UrlParamCluster)
+	hisAppid := params.ByName(UrlParamAppid)
+	ver := params.ByName(UrlParamVersion)
+
+	query := r.URL.Query()
+	version, err := getHttpQueryInt(&query, "version", 0)
+	if err != nil || version < 0 {
+		http.Error(w, "invalid version", http.StatusBadRequest)
+		return
+	}
+
+	version, raw, found := this.schemas.Get(cluster, meta.KafkaTopic(hisAppid, topic, ver), version)
+	if !found {
+		http.Error(w, "schema not found", http.StatusNotFound)
+		return
+	}
+
+	this.writeKatewayHeader(w)
+	w.Header().Set(ContentTypeHeader, ContentTypeJson)
+	b, _ := json.Marshal(struct {
+		Version int             `json:"version"`
+		Schema  json.RawMessage `json:"schema"`
+	}{version, raw})
+	w.Write(b)
+}
+
+// /schemas/:cluster/:appid/:topic/:ver?force=0
+// registers the request body as the next version of the topic schema
+func (this *Gateway) addSchemaHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	topic := params.ByName(UrlParamTopic)
+	cluster := params.ByName(UrlParamCluster)
+	hisAppid := params.ByName(UrlParamAppid)
+	appid := r.Header.Get(HttpHeaderAppid)
+	ver := params.ByName(UrlParamVersion)
+
+	raw, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxSchemaSize+1))
+	if err != nil {
+		this.writeBadRequest(w, err)
+		return
+	}
+	if len(raw) > MaxSchemaSize {
+		this.writeBadRequest(w, ErrTooBigSchema)
+		return
+	}
+	if _, err = schema.Parse(raw); err != nil {
+		this.writeBadRequest(w, err)
+		return
+	}
+
+	force := r.URL.Query().Get("force") == "1"
+	version, err := this.schemas.Register(cluster, meta.KafkaTopic(hisAppid, topic, ver), raw, force)
+	log.Info("app[%s] from %s(%s) add schema {cluster:%s, app:%s, topic:%s, ver:%s, force:%v} v%d: %v",
+		appid, r.RemoteAddr, getHttpRemoteIp(r), cluster, hisAppid, topic, ver, force, version, err)
+	if err != nil {
+		if _, incompatible := err.(*schema.Error); incompatible {
+			this.writeErrorResponse(w, err.Error(), http.StatusConflict)
+		} else {
+			this.writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	this.writeKatewayHeader(w)
+	w.Header().Set(ContentTypeHeader, ContentTypeJson)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(fmt.Sprintf(`{"version": %d}`, version)))
+}
+
+// /tokens/:appid?pub=t1,t2&sub=t3&ttl=10m
+// mints a short lived token of the app authenticated by its secret, the token
+// is scoped to the topics the app is allowed to pub/sub
+func (this *Gateway) mintTokenHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	appid := params.ByName(UrlParamAppid)
+	secret := r.Header.Get(HttpHeaderPubkey)
+	query := r.URL.Query()
+	token := manager.Token{
+		Appid: appid,
+		Pub:   parseTopicNames(query.Get("pub")),
+		Sub:   parseTopicNames(query.Get("sub")),
+	}
+
+	ttl := options.MaxTokenTTL
+	if ttlArg := query.Get("ttl"); ttlArg != "" {
+		var err error
+		if ttl, err = time.ParseDuration(ttlArg); err != nil || ttl <= 0 || ttl > options.MaxTokenTTL {
+			this.writeBadRequest(w, ErrInvalidTokenTTL)
+			return
+		}
+	}
+	if len(token.Pub) == 0 && len(token.Sub) == 0 {
+		http.Error(w, "empty topics", http.StatusBadRequest)
+		return
+	}
+
+	// a token can not mint tokens, otherwise a leaked token lives forever
+	err := manager.ErrAuthenticationFail
+	if r.Header.Get(HttpHeaderAppid) == appid && !manager.IsToken(secret) {
+		err = nil
+		for _, topic := range token.Pub {
+			if err = manager.Default.AuthPub(appid, secret, topic); err != nil {
+				break
+			}
+		}
+		for _, topic := range token.Sub {
+			if err != nil {
+				break
+			}
+			err = manager.Default.AuthSub(appid, secret, topic)
+		}
+	}
+	if err != nil {
+		log.Warn("suspicous mint token from %s(%s): {app:%s pub:%+v sub:%+v} %v",
+			r.RemoteAddr, getHttpRemoteIp(r), appid, token.Pub, token.Sub, err)
+
+		this.writeAuthFailure(w, err)
+		return
+	}
+
+	now := time.Now()
+	token.Iat, token.Exp = now.Unix(), now.Add(ttl).Unix()
+	raw, err := manager.Default.MintToken(token)
+	if err != nil {
+		log.Error("mint token {app:%s}: %v", appid, err)
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("app[%s] from %s(%s) mint token {pub:%+v sub:%+v ttl:%s}",
+		appid, r.RemoteAddr, getHttpRemoteIp(r), token.Pub, token.Sub, ttl)
+
+	this.writeKatewayHeader(w)
+	w.Header().Set(ContentTypeHeader, ContentTypeJson)
+	b, _ := json.Marshal(map[string]interface{}{
+		"token":   raw,
+		"expires": token.Exp,
+	})
+	w.Write(b)
+}
@@ -5,16 +5,19 @@ package main
 import (
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/funkygao/gafka/cmd/kateway/envelope"
 	"github.com/funkygao/gafka/cmd/kateway/manager"
 	"github.com/funkygao/gafka/cmd/kateway/meta"
 	"github.com/funkygao/gafka/cmd/kateway/store"
 	"github.com/funkygao/gafka/mpool"
 	log "github.com/funkygao/log4go"
+	"github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -27,19 +30,16 @@ func (this *Gateway) pubHandler(w http.ResponseWriter, r *http.Request,
 		this.clientStates.RegisterPubClient(r)
 	}
 
-	if options.Ratelimit && !this.leakyBuckets.Pour(r.RemoteAddr, 1) {
-		this.writeQuotaExceeded(w)
-		return
-	}
-
 	appid := r.Header.Get(HttpHeaderAppid)
 	topic := params.ByName(UrlParamTopic) // params[0].Value
 	ver := params.ByName(UrlParamVersion) // params[1].Value
-	if err := manager.Default.AuthPub(appid, r.Header.Get(HttpHeaderPubkey), topic); err != nil {
+	chain := this.plugins.Chain(newPubPluginRequest(appid, r.Header.Get(HttpHeaderPubkey),
+		topic, ver, r.RemoteAddr, t1).WithRequest(r))
+	if err := chain.PrePub(nil); err != nil {
 		log.Warn("pub[%s] %s(%s) {topic:%s, ver:%s} %s",
 			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, err)
 
-		this.writeAuthFailure(w, err)
+		this.writePluginError(w, err)
 		return
 	}
 
@@ -81,17 +81,20 @@ func (this *Gateway) pubHandler(w http.ResponseWriter, r *http.Request,
 		this.writeErrorResponse(w, ErrTooBigPubMessage.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := chain.req.Signature.verifyBody(msg.Body); err != nil {
+		msg.Free()
+
+		log.Warn("pub[%s] %s(%s) {topic:%s, ver:%s} %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, err)
+		this.writeAuthFailure(w, err)
+		return
+	}
 
 	if options.Debug {
 		log.Debug("pub[%s] %s(%s) {topic:%s, ver:%s} %s",
 			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, string(msg.Body))
 	}
 
-	if !options.DisableMetrics {
-		this.pubMetrics.PubQps.Mark(1)
-		this.pubMetrics.PubMsgSize.Update(int64(len(msg.Body)))
-	}
-
 	query := r.URL.Query() // reuse the query will save 100ns
 	partitionKey := query.Get(UrlQueryKey)
 	if len(partitionKey) > MaxPartitionKeyLen {
@@ -102,13 +105,61 @@ func (this *Gateway) pubHandler(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	pm := &PluginMessage{
+		Key:   []byte(partitionKey),
+		Body:  msg.Body,
+		Attrs: getHttpHeaderAttrs(r.Header),
+	}
+	if err := chain.PrePub(pm); err != nil {
+		msg.Free()
+
+		log.Warn("pub[%s] %s(%s) {topic:%s, ver:%s} %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, err)
+		this.writePluginError(w, err)
+		return
+	}
+
+	// the attributes go with the body in an envelope
+	payload, err := envelope.Encode(pm.Attrs, pm.Body)
+	if err != nil {
+		msg.Free()
+
+		log.Warn("pub[%s] %s(%s) {topic:%s, ver:%s} %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, err)
+		this.writeBadRequest(w, err)
+		return
+	}
+
+	due, err := parseDeliverTime(query.Get(UrlQueryDelay), query.Get(UrlQueryDueAt), t1)
+	if err != nil {
+		msg.Free()
+
+		log.Warn("pub[%s] %s(%s) {topic:%s, ver:%s} %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, err)
+		this.writeBadRequest(w, err)
+		return
+	}
+
+	idempotencyKey := r.Header.Get(HttpHeaderIdempotencyKey)
+	if len(idempotencyKey) > MaxIdempotencyKey {
+		msg.Free()
+
+		log.Warn("pub[%s] %s(%s) {topic:%s, ver:%s} too long idempotency key: %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, idempotencyKey)
+		this.writeBadRequest(w, ErrTooBigIdempotency)
+		return
+	}
+
 	pubMethod := store.DefaultPubStore.SyncPub
-	if query.Get(UrlQueryAsync) == "1" {
+	if query.Get(UrlQueryAsync) == "1" && idempotencyKey == "" {
+		// idempotent pub is always sync: it needs the partition/offset
 		pubMethod = store.DefaultPubStore.AsyncPub
 	}
 
 	cluster, found := manager.Default.LookupCluster(appid)
 	if !found {
+		msg.Free()
+
 		log.Warn("pub[%s] %s(%s) {topic:%s, ver:%s} cluster not found",
 			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver)
 
@@ -116,14 +167,109 @@ func (this *Gateway) pubHandler(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	partition, offset, err := pubMethod(cluster, appid+"."+topic+"."+ver,
-		[]byte(partitionKey), msg.Body)
-	if err != nil {
-		msg.Free() // defer is costly
+	rawTopic := appid + "." + topic + "." + ver
+	if err = this.schemas.Validate(cluster, rawTopic, pm.Body); err != nil {
+		msg.Free()
+
+		log.Warn("pub[%s] %s(%s) {topic:%s, ver:%s} schema: %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, err)
+		this.writeBadRequest(w, err)
+		return
+	}
+
+	if this.encryption.Encrypted(rawTopic) {
+		if payload, err = this.encryption.SealPayload(rawTopic, pm.Attrs, pm.Body); err != nil {
+			msg.Free()
+
+			log.Error("pub[%s] %s(%s) {topic:%s, ver:%s} seal: %s",
+				appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, err)
+			this.writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// charged right before pub, so that the rejected pubs are free
+	if retryAfter := this.quotas.Take(false, appid, topic, 1, int64(msgLen), time.Now()); retryAfter > 0 {
+		msg.Free()
+
+		log.Warn("pub[%s] %s(%s) {topic:%s, ver:%s} quota exceeded, retry after %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, retryAfter)
 
 		if !options.DisableMetrics {
-			this.pubMetrics.PubFail(appid, topic, ver)
+			this.pubMetrics.QuotaExceeded(appid, topic, ver)
+		}
+		this.writeQuotaExceeded(w, retryAfter)
+		return
+	}
+
+	if !due.IsZero() {
+		// delayed message has no partition/offset until it is due
+		err = store.DefaultPubStore.DelayPub(cluster, rawTopic,
+			pm.Key, payload, due)
+		chain.PostPub(pm, err)
+		msg.Free()
+		if err != nil {
+			this.quotas.Refund(false, appid, topic, 1, int64(msgLen), time.Now())
+
+			if err == store.ErrDelayDisabled {
+				log.Warn("pub[%s] %s(%s) {topic:%s, ver:%s} delay to %s: %s",
+					appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, due, err)
+				this.writeBadRequest(w, err)
+				return
+			}
+
+			log.Error("pub[%s] %s(%s) {topic:%s, ver:%s} delay to %s: %s",
+				appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, due, err)
+			this.writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		this.writeKatewayHeader(w)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(ResponseOk)
+		return
+	}
+
+	if idempotencyKey != "" {
+		partition, offset, dup, err := this.idempotency.Begin(cluster, rawTopic, idempotencyKey)
+		if err != nil || dup {
+			// not published
+			this.quotas.Refund(false, appid, topic, 1, int64(msgLen), time.Now())
+		}
+		if err != nil {
+			msg.Free()
+
+			log.Warn("pub[%s] %s(%s) {topic:%s, ver:%s, key:%s} %s",
+				appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, idempotencyKey, err)
+			this.writeErrorResponse(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if dup {
+			msg.Free()
+
+			log.Debug("pub[%s] %s(%s) {topic:%s, ver:%s, key:%s} duplicated {P:%d, O:%d}",
+				appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, idempotencyKey, partition, offset)
+
+			this.writeKatewayHeader(w)
+			w.Header().Set(HttpHeaderPartition, strconv.FormatInt(int64(partition), 10))
+			w.Header().Set(HttpHeaderOffset, strconv.FormatInt(offset, 10))
+			w.Header().Set(HttpHeaderIdempotentDup, "1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(ResponseOk)
+			return
 		}
+	}
+
+	partition, offset, err := pubMethod(cluster, rawTopic, pm.Key, payload)
+	if idempotencyKey != "" {
+		this.idempotency.Done(cluster, rawTopic, idempotencyKey, partition, offset, err)
+	}
+	pm.Partition, pm.Offset = partition, offset
+	chain.PostPub(pm, err)
+	if err != nil {
+		msg.Free() // defer is costly
+		this.quotas.Refund(false, appid, topic, 1, int64(msgLen), time.Now())
 
 		log.Error("pub[%s] %s(%s) {topic:%s, ver:%s} %s",
 			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, err)
@@ -142,11 +288,111 @@ func (this *Gateway) pubHandler(w http.ResponseWriter, r *http.Request,
 		this.pubMetrics.ClientError.Inc(1)
 	}
 
-	if !options.DisableMetrics {
-		this.pubMetrics.PubOk(appid, topic, ver)
-		this.pubMetrics.PubLatency.Update(time.Since(t1).Nanoseconds() / 1e6) // in ms
+}
+
+// /batch/topics/:topic/:ver
+func (this *Gateway) pubBatchHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	if options.EnableClientStats {
+		this.clientStates.RegisterPubClient(r)
+	}
+
+	appid := r.Header.Get(HttpHeaderAppid)
+	topic := params.ByName(UrlParamTopic)
+	ver := params.ByName(UrlParamVersion)
+	chain := this.plugins.Chain(newPubPluginRequest(appid, r.Header.Get(HttpHeaderPubkey),
+		topic, ver, r.RemoteAddr, time.Now()).WithRequest(r))
+	if err := chain.PrePub(nil); err != nil {
+		log.Warn("batch pub[%s] %s(%s) {topic:%s, ver:%s} %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, err)
+
+		this.writePluginError(w, err)
+		return
+	}
+
+	bodyLen := r.ContentLength
+	switch {
+	case bodyLen == -1:
+		log.Warn("batch pub[%s] %s(%s) {topic:%s, ver:%s} invalid content length: %d",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, bodyLen)
+		this.writeInvalidContentLength(w)
+		return
+
+	case bodyLen > options.MaxPubBatchSize:
+		log.Warn("batch pub[%s] %s(%s) {topic:%s, ver:%s} too big content length: %d",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, bodyLen)
+		this.writeErrorResponse(w, ErrTooBigBatch.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, options.MaxPubBatchSize+1))
+	if err != nil {
+		log.Error("batch pub[%s] %s(%s) {topic:%s, ver:%s} %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, err)
+		this.writeBadRequest(w, err)
+		return
+	}
+	if err = chain.req.Signature.verifyBody(body); err != nil {
+		log.Warn("batch pub[%s] %s(%s) {topic:%s, ver:%s} %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, err)
+		this.writeAuthFailure(w, err)
+		return
+	}
+
+	msgs, err := decodeBatchMessages(body)
+	if err != nil {
+		log.Warn("batch pub[%s] %s(%s) {topic:%s, ver:%s} %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, err)
+		this.writeBadRequest(w, err)
+		return
+	}
+
+	cluster, found := manager.Default.LookupCluster(appid)
+	if !found {
+		log.Warn("batch pub[%s] %s(%s) {topic:%s, ver:%s} cluster not found",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver)
+
+		http.Error(w, "invalid appid", http.StatusBadRequest)
+		return
 	}
 
+	pms := prePubBatch(chain, msgs)
+	this.validateBatchMessages(cluster, appid+"."+topic+"."+ver, msgs)
+
+	// only the valid messages are charged, right before pub
+	n, bytes := batchUsage(msgs, pms)
+	if retryAfter := this.quotas.Take(false, appid, topic, n, bytes, time.Now()); retryAfter > 0 {
+		log.Warn("batch pub[%s] %s(%s) {topic:%s, ver:%s} quota exceeded, retry after %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, retryAfter)
+
+		if !options.DisableMetrics {
+			this.pubMetrics.QuotaExceeded(appid, topic, ver)
+		}
+		this.writeQuotaExceeded(w, retryAfter)
+		return
+	}
+
+	results, err := this.pubBatch(chain, cluster, msgs, pms)
+	published, publishedBytes := batchUsage(msgs, pms)
+	if err != nil {
+		published, publishedBytes = 0, 0
+	}
+	this.quotas.Refund(false, appid, topic, n-published, bytes-publishedBytes, time.Now())
+	if err != nil {
+		log.Error("batch pub[%s] %s(%s) {topic:%s, ver:%s} %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, err)
+		this.writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, _ := json.Marshal(results)
+	this.writeKatewayHeader(w)
+	w.Header().Set(ContentTypeHeader, ContentTypeJson)
+	w.WriteHeader(http.StatusCreated)
+	if _, err = w.Write(b); err != nil {
+		log.Error("%s: %v", r.RemoteAddr, err)
+		this.pubMetrics.ClientError.Inc(1)
+	}
 }
 
 // /raw/topics/:topic/:ver
@@ -162,10 +408,12 @@ func (this *Gateway) pubRawHandler(w http.ResponseWriter, r *http.Request,
 	topic = params.ByName(UrlParamTopic)
 	appid = r.Header.Get(HttpHeaderAppid)
 
-	if err := manager.Default.AuthSub(appid, r.Header.Get(HttpHeaderPubkey), topic); err != nil {
+	chain := this.plugins.Chain(newPubPluginRequest(appid, r.Header.Get(HttpHeaderPubkey),
+		topic, ver, r.RemoteAddr, time.Now()).WithRequest(r))
+	if err := chain.PrePub(nil); err != nil {
 		log.Error("app[%s] %s %+v: %s", appid, r.RemoteAddr, params, err)
 
-		this.writeAuthFailure(w, err)
+		this.writePluginError(w, err)
 		return
 	}
 
@@ -190,13 +438,187 @@ func (this *Gateway) pubRawHandler(w http.ResponseWriter, r *http.Request,
 }
 
 // /ws/topics/:topic/:ver
+// each binary frame is a message: keyLen(2 bytes, big endian) key value
+// each frame is acked with a json text frame in order.
 func (this *Gateway) pubWsHandler(w http.ResponseWriter, r *http.Request,
 	params httprouter.Params) {
+	appid := r.Header.Get(HttpHeaderAppid)
+	topic := params.ByName(UrlParamTopic)
+	ver := params.ByName(UrlParamVersion)
+	chain := this.plugins.Chain(newPubPluginRequest(appid, r.Header.Get(HttpHeaderPubkey),
+		topic, ver, r.RemoteAddr, time.Now()).WithRequest(r))
+	if err := chain.PrePub(nil); err != nil {
+		log.Warn("ws pub[%s] %s(%s) {topic:%s, ver:%s} %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, err)
+
+		this.writePluginError(w, err)
+		return
+	}
+
+	cluster, found := manager.Default.LookupCluster(appid)
+	if !found {
+		log.Warn("ws pub[%s] %s(%s) {topic:%s, ver:%s} cluster not found",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver)
+
+		http.Error(w, "invalid appid", http.StatusBadRequest)
+		return
+	}
+
+	if retryAfter := this.quotas.Wait(false, appid, topic, time.Now()); retryAfter > 0 {
+		log.Warn("ws pub[%s] %s(%s) {topic:%s, ver:%s} quota exceeded, retry after %s",
+			appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver, retryAfter)
+
+		if !options.DisableMetrics {
+			this.pubMetrics.QuotaExceeded(appid, topic, ver)
+		}
+		this.writeQuotaExceeded(w, retryAfter)
+		return
+	}
+
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Error("%s: %v", r.RemoteAddr, err)
 		return
 	}
 
-	defer ws.Close()
+	if !options.DisableMetrics {
+		this.svrMetrics.ConcurrentPubWs.Inc(1)
+	}
+
+	log.Debug("ws pub[%s] %s(%s) {topic:%s, ver:%s} connected",
+		appid, r.RemoteAddr, getHttpRemoteIp(r), topic, ver)
+
+	clientGone := make(chan struct{})
+	go func() {
+		select {
+		case <-this.shutdownCh:
+			// unblock the reading
+			ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+				time.Now().Add(time.Second))
+			ws.Close()
+
+		case <-clientGone:
+		}
+	}()
+
+	this.wsPubPump(ws, chain, cluster)
+
+	close(clientGone)
+	ws.Close()
+	if !options.DisableMetrics {
+		this.svrMetrics.ConcurrentPubWs.Dec(1)
+	}
+}
+
+func (this *Gateway) wsPubPump(ws *websocket.Conn, chain *pluginChain, cluster string) {
+	ws.SetReadLimit(this.pubServer.wsReadLimit)
+	ws.SetReadDeadline(time.Now().Add(this.pubServer.wsPongWait))
+	ws.SetPongHandler(func(string) error {
+		ws.SetReadDeadline(time.Now().Add(this.pubServer.wsPongWait))
+		return nil
+	})
+
+	var (
+		appid, topic, ver = chain.req.Appid, chain.req.Topic, chain.req.Ver
+		rawTopic          = meta.KafkaTopic(appid, topic, ver)
+		retryDelay        time.Duration
+		seq               int64
+	)
+	for {
+		// the next frame will not be read until this frame is acked, so
+		// a busy store will push back to the client through tcp
+		_, frame, err := ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
+				log.Warn("ws pub[%s] %s: %v", appid, ws.RemoteAddr(), err)
+			} else {
+				log.Debug("ws pub[%s] %s: %v", appid, ws.RemoteAddr(), err)
+			}
+
+			return
+		}
+
+		t1 := time.Now()
+		chain.req.Start = t1 // the pub latency is per frame
+		ws.SetReadDeadline(t1.Add(this.pubServer.wsPongWait))
+		seq++
+		ack := wsPubAck{Seq: seq}
+
+		key, value, err := decodeWsPubFrame(frame)
+		var pm *PluginMessage
+		if err == nil {
+			pm = &PluginMessage{Key: key, Body: value}
+			err = chain.PrePub(pm)
+		}
+		if err == nil {
+			err = this.schemas.Validate(cluster, rawTopic, pm.Body)
+		}
+		if err == nil {
+			var payload []byte
+			if this.encryption.Encrypted(rawTopic) {
+				payload, err = this.encryption.SealPayload(rawTopic, pm.Attrs, pm.Body)
+			} else {
+				payload, err = envelope.Encode(pm.Attrs, pm.Body)
+			}
+			if err == nil {
+				// charged right before pub, so that the rejected frames are free
+				if retryAfter := this.quotas.Take(false, appid, topic, 1, int64(len(value)), t1); retryAfter > 0 {
+					err = ErrQuotaExceeded
+					ack.RetryAfter = int64(retryAfter / time.Millisecond)
+				}
+			}
+			if err == nil {
+				ack.Partition, ack.Offset, err = store.DefaultPubStore.SyncPub(cluster,
+					rawTopic, pm.Key, payload)
+				pm.Partition, pm.Offset = ack.Partition, ack.Offset
+				chain.PostPub(pm, err)
+				if err != nil {
+					this.quotas.Refund(false, appid, topic, 1, int64(len(value)), time.Now())
+				}
+			}
+		}
+
+		switch {
+		case err == ErrQuotaExceeded:
+			// the client should resend this frame after retryafter ms
+			log.Warn("ws pub[%s] %s {topic:%s, ver:%s} #%d: %v",
+				appid, ws.RemoteAddr(), topic, ver, seq, err)
+
+			ack.Errmsg = err.Error()
+			if !options.DisableMetrics {
+				this.pubMetrics.QuotaExceeded(appid, topic, ver)
+			}
+
+		case err != nil:
+			log.Error("ws pub[%s] %s {topic:%s, ver:%s} #%d: %v",
+				appid, ws.RemoteAddr(), topic, ver, seq, err)
+
+			ack.Errmsg = err.Error()
+		}
+
+		b, _ := json.Marshal(ack)
+		ws.SetWriteDeadline(time.Now().Add(time.Second * 10))
+		if err = ws.WriteMessage(websocket.TextMessage, b); err != nil {
+			log.Error("ws pub[%s] %s: %v", appid, ws.RemoteAddr(), err)
+			this.pubMetrics.ClientError.Inc(1)
+			return
+		}
+
+		if ack.Errmsg == store.ErrBusy.Error() {
+			// backpressure: slow down the client when store is busy
+			if retryDelay == 0 {
+				retryDelay = 50 * time.Millisecond
+			} else {
+				retryDelay = 2 * retryDelay
+			}
+			if maxDelay := time.Second; retryDelay > maxDelay {
+				retryDelay = maxDelay
+			}
+
+			time.Sleep(retryDelay)
+		} else {
+			retryDelay = 0
+		}
+	}
 }
@@ -3,14 +3,19 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/gafka/cmd/kateway/envelope"
 	"github.com/funkygao/gafka/cmd/kateway/manager"
 	"github.com/funkygao/gafka/cmd/kateway/meta"
+	"github.com/funkygao/gafka/cmd/kateway/seal"
 	"github.com/funkygao/gafka/cmd/kateway/store"
 	"github.com/funkygao/gafka/zk"
 	log "github.com/funkygao/log4go"
@@ -23,6 +28,7 @@ type SubStatus struct {
 	Partition string `json:"partition"`
 	Produced  int64  `json:"pubd"`
 	Consumed  int64  `json:"subd"`
+	Commit    string `json:"commit"`
 }
 
 // /status/:appid/:topic/:ver?group=xx
@@ -45,11 +51,12 @@ func (this *Gateway) subStatusHandler(w http.ResponseWriter, r *http.Request,
 	hisAppid = params.ByName(UrlParamAppid)
 	myAppid = r.Header.Get(HttpHeaderAppid)
 
-	if err = manager.Default.AuthSub(myAppid, r.Header.Get(HttpHeaderSubkey), topic); err != nil {
+	if err = this.plugins.Chain(newSubPluginRequest(myAppid, r.Header.Get(HttpHeaderSubkey),
+		hisAppid, topic, ver, group, r.RemoteAddr).WithRequest(r)).PreDeliver(nil); err != nil {
 		log.Error("status[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} %v",
 			myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group, err)
 
-		this.writeAuthFailure(w, err)
+		this.writePluginError(w, err)
 		return
 	}
 
@@ -107,6 +114,7 @@ func (this *Gateway) subStatusHandler(w http.ResponseWriter, r *http.Request,
 				Partition: consumer.PartitionId,
 				Produced:  consumer.ProducerOffset,
 				Consumed:  consumer.ConsumerOffset,
+				Commit:    this.commitPolicies.Of(grp).String(),
 			})
 		}
 	}
@@ -142,6 +150,11 @@ func (this *Gateway) subHandler(w http.ResponseWriter, r *http.Request,
 		this.writeBadRequest(w, err)
 		return
 	}
+	if options.StatelessSub && query.Get(UrlQueryAutoCommit) == "0" {
+		// the inflights live in the kateway that delivered them
+		this.writeBadRequest(w, ErrStatelessAck)
+		return
+	}
 	if !validateGroupName(group) {
 		log.Warn("sub[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} invalid group name",
 			myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group)
@@ -160,11 +173,13 @@ func (this *Gateway) subHandler(w http.ResponseWriter, r *http.Request,
 			myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group)
 	}
 
-	if err := manager.Default.AuthSub(myAppid, r.Header.Get(HttpHeaderSubkey), topic); err != nil {
+	chain := this.plugins.Chain(newSubPluginRequest(myAppid, r.Header.Get(HttpHeaderSubkey),
+		hisAppid, topic, ver, group, r.RemoteAddr).WithRequest(r))
+	if err := chain.PreDeliver(nil); err != nil {
 		log.Error("sub[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} %v",
 			myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group, err)
 
-		this.writeAuthFailure(w, err)
+		this.writePluginError(w, err)
 		return
 	}
 
@@ -184,6 +199,38 @@ func (this *Gateway) subHandler(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	filter, err := this.subFilters.Fix(rawTopic, myAppid+"."+group, query.Get(UrlQueryFilter))
+	if err != nil {
+		log.Warn("sub[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} filter: %v",
+			myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group, err)
+
+		switch err {
+		case ErrInvalidFilter:
+			this.writeBadRequest(w, err)
+		case ErrFilterMismatch:
+			this.writeErrorResponse(w, err.Error(), http.StatusConflict)
+		default:
+			this.writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	policy, err := this.commitPolicies.Resolve(myAppid+"."+group, query.Get(UrlQueryCommit))
+	if err == nil && query.Get(UrlQueryAutoCommit) == "0" && policy.mode != commitAtLeastOnce {
+		err = ErrCommitAck
+	}
+	if err != nil {
+		log.Warn("sub[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} commit: %v",
+			myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group, err)
+
+		if err == ErrCommitMismatch {
+			this.writeErrorResponse(w, err.Error(), http.StatusConflict)
+		} else {
+			this.writeBadRequest(w, err)
+		}
+		return
+	}
+
 	fetcher, err := store.DefaultSubStore.Fetch(cluster, rawTopic,
 		myAppid+"."+group, r.RemoteAddr, reset)
 	if err != nil {
@@ -193,99 +240,605 @@ func (this *Gateway) subHandler(w http.ResponseWriter, r *http.Request,
 		this.writeBadRequest(w, err)
 		return
 	}
+	committer := newOffsetCommitter(policy, fetcher)
+
+	var ack *subAck
+	if query.Get(UrlQueryAutoCommit) == "0" {
+		// the client will ack each message explicitly
+		ack = &subAck{
+			key:     inflightKey(cluster, rawTopic, myAppid+"."+group),
+			cluster: cluster,
+			group:   myAppid + "." + group,
+		}
+	}
 
-	err = this.fetchMessages(w, fetcher, limit, myAppid, hisAppid, topic, ver)
+	err = this.fetchMessages(w, committer, limit, chain, ack, filter, r.RemoteAddr)
+	if err == nil {
+		// the batch is the response
+		if err := committer.EndBatch(); err != nil {
+			log.Error("sub[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} commit: %v",
+				myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group, err)
+		}
+	}
 	if err != nil {
 		// e,g. broken pipe, io timeout, client gone
 		log.Error("sub[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} %v",
 			myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group, err)
 
+		this.inflights.forgetSubscription(inflightKey(cluster, rawTopic, myAppid+"."+group), r.RemoteAddr)
 		go fetcher.Close() // wait cf.ProcessingTimeout FIXME go?
+	} else if options.StatelessSub {
+		// release the partition lease for the next request of the group
+		fetcher.Close()
 	}
 
 }
 
-func (this *Gateway) fetchMessages(w http.ResponseWriter, fetcher store.Fetcher,
-	limit int, myAppid, hisAppid, topic, ver string) (err error) {
+// subAck is the context of a sub with autocommit=0.
+type subAck struct {
+	key     string // key of the inflights
+	cluster string
+	group   string
+}
+
+// fetchMessages writes at most limit messages to the client.
+// If ack is nil, the offset is committed by the commit policy,
+// else the message is inflight until acked by the client.
+// The messages that don't match the filter or are rejected by the plugins are
+// committed without being written, while a message that can't be opened fails
+// the request without being committed.
+func (this *Gateway) fetchMessages(w http.ResponseWriter, committer *offsetCommitter,
+	limit int, chain *pluginChain, ack *subAck, filter *subFilter,
+	remoteAddr string) (err error) {
 	clientGoneCh := w.(http.CloseNotifier).CloseNotify()
 
 	var (
+		fetcher              = committer.fetcher
+		myAppid, hisAppid    = chain.req.Appid, chain.req.TopicAppid
+		topic, ver           = chain.req.Topic, chain.req.Ver
 		chunkedBeforeTimeout = false
 		chunkedEver          = false
 		n                    = 0
 	)
 	for {
-		select {
-		case <-clientGoneCh:
-			return ErrClientGone
-
-		case <-this.shutdownCh:
+		var (
+			msg         *sarama.ConsumerMessage
+			pm          *PluginMessage
+			messages    = fetcher.Messages()
+			redelivered = false
+		)
+
+		if retryAfter := this.quotas.Wait(true, myAppid, topic, time.Now()); retryAfter > 0 {
+			log.Warn("sub[%s] %s: {app:%s, topic:%s, ver:%s} quota exceeded, retry after %s",
+				myAppid, remoteAddr, hisAppid, topic, ver, retryAfter)
+
+			if !options.DisableMetrics {
+				this.subMetrics.QuotaExceeded(myAppid, topic, ver)
+			}
 			if !chunkedEver {
-				w.WriteHeader(http.StatusNoContent)
-				w.Write([]byte{})
+				this.writeQuotaExceeded(w, retryAfter)
 			}
 			return nil
+		}
+
+		if ack != nil {
+			// redeliver the unacked messages first
+			msg = this.redeliver(ack, remoteAddr)
+			redelivered = msg != nil
+			if msg == nil && this.inflights.unacked(ack.key, remoteAddr) >= options.MaxSubInflight {
+				// wait for acks instead of consuming more
+				messages = nil
+			}
+		}
+
+		if msg == nil {
+			select {
+			case <-clientGoneCh:
+				return ErrClientGone
+
+			case <-this.shutdownCh:
+				if !chunkedEver {
+					w.WriteHeader(http.StatusNoContent)
+					w.Write([]byte{})
+				}
+				return nil
+
+			case msg = <-messages:
+
+			case <-this.timer.After(options.SubTimeout):
+				if chunkedBeforeTimeout {
+					log.Debug("await message timeout, chunked to next round")
+
+					chunkedBeforeTimeout = false
+					continue
+				}
 
-		case msg := <-fetcher.Messages():
-			// TODO when remote close silently, the write still ok
-			// which will lead to msg losing for sub
-			w.Header().Set(HttpHeaderPartition, strconv.FormatInt(int64(msg.Partition), 10))
-			w.Header().Set(HttpHeaderOffset, strconv.FormatInt(msg.Offset, 10))
-			if _, err := w.Write(msg.Value); err != nil {
-				// TODO if cf.ChannelBufferSize > 0, client may lose message
-				// got message in chan, client not recv it but offset commited.
+				if chunkedEver {
+					// response already sent in chunk
+					log.Debug("await message timeout, chunk finished")
+					return nil
+				}
+
+				// never chunked, so send empty data
+				log.Debug("await message timeout, writing empty data")
+				w.WriteHeader(http.StatusNoContent)
+				// TODO write might fail, remote client might have died
+				w.Write([]byte{}) // without this, client cant get response
+				return nil
+
+			case err = <-fetcher.Errors():
+				// e,g. consume a non-existent topic
+				return
+			}
+		}
+
+		// TODO when remote close silently, the write still ok
+		// which will lead to msg losing for sub
+		if pm, err = this.openMessage(msg); err != nil {
+			// never commit past it: it's consumed again once the key is available
+			log.Error("sub[%s] %s: {app:%s, topic:%s, ver:%s, P:%d, O:%d} open: %v",
+				myAppid, remoteAddr, hisAppid, topic, ver, msg.Partition, msg.Offset, err)
+
+			if !chunkedEver {
+				this.writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+			}
+			return err
+		}
+		if filter != nil && !redelivered && !filter.Match(msg.Key, pm.Attrs) {
+			this.commitFiltered(committer, msg, ack, remoteAddr)
+			continue
+		}
+
+		if err = chain.PreDeliver(pm); err != nil {
+			log.Warn("sub[%s] %s: {app:%s, topic:%s, ver:%s, P:%d, O:%d} rejected: %v",
+				myAppid, remoteAddr, hisAppid, topic, ver, msg.Partition, msg.Offset, err)
+
+			err = nil
+			this.commitFiltered(committer, msg, ack, remoteAddr)
+			continue
+		}
+
+		if ack == nil {
+			if err = committer.BeforeSend(msg); err != nil {
+				// not sent, it will be consumed again
 				return err
 			}
+		}
 
+		w.Header().Set(HttpHeaderPartition, strconv.FormatInt(int64(msg.Partition), 10))
+		w.Header().Set(HttpHeaderOffset, strconv.FormatInt(msg.Offset, 10))
+		setHttpHeaderAttrs(w.Header(), pm.Attrs)
+		if ack != nil && !redelivered {
+			// inflight before written: the client might ack before we return
+			this.inflights.deliver(ack.key, remoteAddr, fetcher, msg, time.Now())
+		}
+		if _, err := w.Write(pm.Body); err != nil {
+			// TODO if cf.ChannelBufferSize > 0, client may lose message
+			// got message in chan, client not recv it but offset commited.
+			chain.PostDeliver(pm, err)
+			return err
+		}
+
+		if ack == nil {
 			// client really got this msg, safe to commit
 			// TODO test case: client got chunk 2, then killed. should server commit offset?
 			log.Debug("commit offset: {T:%s, P:%d, O:%d}", msg.Topic, msg.Partition, msg.Offset)
-			if err = fetcher.CommitUpto(msg); err != nil {
+			if err := committer.AfterSend(msg); err != nil {
 				log.Error("commit offset {T:%s, P:%d, O:%d}: %v", msg.Topic, msg.Partition, msg.Offset, err)
 			}
+		}
 
-			this.subMetrics.ConsumeOk(myAppid, topic, ver)
-			this.subMetrics.ConsumedOk(hisAppid, topic, ver)
+		this.quotas.Consume(true, myAppid, topic, 1, int64(len(msg.Value)), time.Now())
+		chain.PostDeliver(pm, nil)
 
-			n++
-			if n >= limit {
-				return nil
-			}
+		n++
+		if n >= limit {
+			return nil
+		}
 
-			// http chunked: len in hex
-			// curl CURLOPT_HTTP_TRANSFER_DECODING will auto unchunk
-			w.(http.Flusher).Flush()
+		// http chunked: len in hex
+		// curl CURLOPT_HTTP_TRANSFER_DECODING will auto unchunk
+		w.(http.Flusher).Flush()
 
-			chunkedBeforeTimeout = true
-			chunkedEver = true
+		chunkedBeforeTimeout = true
+		chunkedEver = true
+	}
 
-		case <-this.timer.After(options.SubTimeout):
-			if chunkedBeforeTimeout {
-				log.Debug("await message timeout, chunked to next round")
+}
 
-				chunkedBeforeTimeout = false
-				continue
-			}
+// commitFiltered commits a message that doesn't match the filter.
+func (this *Gateway) commitFiltered(committer *offsetCommitter, msg *sarama.ConsumerMessage,
+	ack *subAck, remoteAddr string) {
+	if ack != nil {
+		// inflight and acked at once: the unacked before it are still inflight
+		this.inflights.deliver(ack.key, remoteAddr, committer.fetcher, msg, time.Now())
+		this.inflights.ack(ack.key, msg.Partition, msg.Offset)
+		return
+	}
 
-			if chunkedEver {
-				// response already sent in chunk
-				log.Debug("await message timeout, chunk finished")
-				return nil
-			}
+	if err := committer.Skip(msg); err != nil {
+		log.Error("commit offset {T:%s, P:%d, O:%d}: %v", msg.Topic, msg.Partition, msg.Offset, err)
+	}
+}
 
-			// never chunked, so send empty data
-			log.Debug("await message timeout, writing empty data")
-			w.WriteHeader(http.StatusNoContent)
-			// TODO write might fail, remote client might have died
-			w.Write([]byte{}) // without this, client cant get response
+// openMessage returns the plugin message of a fetched message, the sealed body
+// is decrypted. A corrupted envelope is delivered as is, while a sealed body
+// that can't be opened is an error: never deliver the ciphertext.
+func (this *Gateway) openMessage(msg *sarama.ConsumerMessage) (*PluginMessage, error) {
+	pm := &PluginMessage{Key: msg.Key, Partition: msg.Partition, Offset: msg.Offset}
+	attrs, body, err := envelope.Decode(msg.Value)
+	if err != nil {
+		log.Warn("{T:%s, P:%d, O:%d} %v", msg.Topic, msg.Partition, msg.Offset, err)
+		pm.Body = msg.Value
+		return pm, nil
+	}
+
+	if seal.IsSealed(body) {
+		if body, err = this.encryption.Open(body); err != nil {
+			return nil, err
+		}
+	}
+
+	pm.Attrs, pm.Body = attrs, body
+	return pm, nil
+}
+
+// redeliver returns the next unacked message of the client whose visibility
+// timeout expired, nil if none. The poison messages are buried instead.
+func (this *Gateway) redeliver(ack *subAck, remoteAddr string) *sarama.ConsumerMessage {
+	for {
+		m, ok := this.inflights.redeliver(ack.key, remoteAddr, time.Now())
+		if !ok {
 			return nil
+		}
 
-		case err = <-fetcher.Errors():
-			// e,g. consume a non-existent topic
+		// the last delivery failed: not acked within visibility timeout
+		if !this.buryPoison(ack, m, m.deliveries-1) {
+			return m.msg
+		}
+	}
+}
+
+// buryPoison moves the message to the dead letter topic and acks it if it
+// failed too many times.
+func (this *Gateway) buryPoison(ack *subAck, m inflightMessage, failures int) bool {
+	maxDeliveries := this.deadLetters.MaxDeliveries(ack.group)
+	if maxDeliveries <= 0 || failures < maxDeliveries {
+		return false
+	}
+
+	if err := this.deadLetters.Bury(ack.cluster, ack.group, m, failures); err != nil {
+		log.Error("cluster[%s] group[%s] bury {T:%s, P:%d, O:%d}: %v",
+			ack.cluster, ack.group, m.msg.Topic, m.msg.Partition, m.msg.Offset, err)
+		return false
+	}
+
+	// advance the offset
+	if err := this.inflights.ack(ack.key, m.msg.Partition, m.msg.Offset); err != nil {
+		log.Error("cluster[%s] group[%s] ack {T:%s, P:%d, O:%d}: %v",
+			ack.cluster, ack.group, m.msg.Topic, m.msg.Partition, m.msg.Offset, err)
+	}
+
+	return true
+}
+
+// /ack/:appid/:topic/:ver?group=xx&partition=0&offset=10
+// acks a message consumed with autocommit=0
+func (this *Gateway) ackHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	this.ackOrNack(w, r, params, false)
+}
+
+// /nack/:appid/:topic/:ver?group=xx&partition=0&offset=10
+// the body is the reason why the message failed, the message will be redelivered
+// or moved to the dead letter topic
+func (this *Gateway) nackHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	this.ackOrNack(w, r, params, true)
+}
+
+func (this *Gateway) ackOrNack(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params, nack bool) {
+	var (
+		topic    string
+		ver      string
+		myAppid  string
+		hisAppid string
+		group    string
+	)
+
+	query := r.URL.Query()
+	group = query.Get(UrlQueryGroup)
+	ver = params.ByName(UrlParamVersion)
+	topic = params.ByName(UrlParamTopic)
+	hisAppid = params.ByName(UrlParamAppid)
+	myAppid = r.Header.Get(HttpHeaderAppid)
+
+	partition, err := strconv.ParseInt(query.Get(UrlQueryPartition), 10, 32)
+	if err != nil {
+		this.writeBadRequest(w, err)
+		return
+	}
+	offset, err := strconv.ParseInt(query.Get(UrlQueryOffset), 10, 64)
+	if err != nil {
+		this.writeBadRequest(w, err)
+		return
+	}
+
+	if err = this.plugins.Chain(newSubPluginRequest(myAppid, r.Header.Get(HttpHeaderSubkey),
+		hisAppid, topic, ver, group, r.RemoteAddr).WithRequest(r)).PreDeliver(nil); err != nil {
+		log.Error("ack[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} %v",
+			myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group, err)
+
+		this.writePluginError(w, err)
+		return
+	}
+
+	cluster, found := manager.Default.LookupCluster(hisAppid)
+	if !found {
+		log.Error("ack[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} cluster not found",
+			myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group)
+
+		http.Error(w, "invalid appid", http.StatusBadRequest)
+		return
+	}
+
+	ack := &subAck{
+		key:     inflightKey(cluster, meta.KafkaTopic(hisAppid, topic, ver), myAppid+"."+group),
+		cluster: cluster,
+		group:   myAppid + "." + group,
+	}
+	if nack {
+		reason, _ := ioutil.ReadAll(io.LimitReader(r.Body, MaxNackReasonLen))
+		if err = parseRequestSignature(myAppid, r).verifyBody(reason); err != nil {
+			log.Warn("nack[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} %v",
+				myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group, err)
+
+			this.writeAuthFailure(w, err)
 			return
 		}
+
+		var m inflightMessage
+		if m, err = this.inflights.nack(ack.key, int32(partition), offset,
+			string(reason), time.Now()); err == nil {
+			this.buryPoison(ack, m, m.deliveries)
+		}
+	} else {
+		err = this.inflights.ack(ack.key, int32(partition), offset)
 	}
+	if err != nil {
+		log.Warn("ack[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s, P:%d, O:%d, nack:%v} %v",
+			myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group,
+			partition, offset, nack, err)
 
+		this.writeBadRequest(w, err)
+		return
+	}
+
+	this.writeKatewayHeader(w)
+	w.Write(ResponseOk)
+}
+
+// /webhooks/:appid/:topic/:ver?group=xx
+// body: {"endpoint": "http://host/path", "concurrency": 1}
+func (this *Gateway) addWebhookHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	hook, ok := this.parseWebhook(w, r, params)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Endpoint    string `json:"endpoint"`
+		Concurrency int    `json:"concurrency"`
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, 4<<10))
+	if err != nil {
+		this.writeBadRequest(w, err)
+		return
+	}
+	if err = parseRequestSignature(hook.Appid, r).verifyBody(b); err != nil {
+		this.writeAuthFailure(w, err)
+		return
+	}
+	if err = json.Unmarshal(b, &body); err != nil {
+		this.writeBadRequest(w, ErrInvalidWebhook)
+		return
+	}
+
+	if err = this.webhooks.checkEndpoint(body.Endpoint); err != nil {
+		log.Warn("webhook[%s] %s(%s): %s %v", hook.Appid, r.RemoteAddr, getHttpRemoteIp(r), body.Endpoint, err)
+
+		this.writeBadRequest(w, err)
+		return
+	}
+	if body.Concurrency <= 0 {
+		body.Concurrency = 1 // in order
+	} else if body.Concurrency > webhookMaxConcurrency {
+		body.Concurrency = webhookMaxConcurrency
+	}
+
+	hook.Endpoint = body.Endpoint
+	hook.Concurrency = body.Concurrency
+	if err = this.webhooks.Register(hook); err != nil {
+		log.Error("webhook[%s] %s(%s): %+v %v", hook.Appid, r.RemoteAddr, getHttpRemoteIp(r), hook, err)
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("webhook[%s] %s(%s) registered: %+v", hook.Appid, r.RemoteAddr, getHttpRemoteIp(r), hook)
+
+	this.writeKatewayHeader(w)
+	w.Write(ResponseOk)
+}
+
+// /webhooks/:appid/:topic/:ver?group=xx
+func (this *Gateway) delWebhookHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	hook, ok := this.parseWebhook(w, r, params)
+	if !ok {
+		return
+	}
+
+	if err := this.webhooks.Unregister(hook); err != nil {
+		log.Error("webhook[%s] %s(%s): %+v %v", hook.Appid, r.RemoteAddr, getHttpRemoteIp(r), hook, err)
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("webhook[%s] %s(%s) unregistered: %+v", hook.Appid, r.RemoteAddr, getHttpRemoteIp(r), hook)
+
+	this.writeKatewayHeader(w)
+	w.Write(ResponseOk)
+}
+
+func (this *Gateway) parseWebhook(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) (hook webhook, ok bool) {
+	hook = webhook{
+		Appid:    r.Header.Get(HttpHeaderAppid),
+		HisAppid: params.ByName(UrlParamAppid),
+		Topic:    params.ByName(UrlParamTopic),
+		Ver:      params.ByName(UrlParamVersion),
+		Group:    r.URL.Query().Get(UrlQueryGroup),
+	}
+
+	if !validateGroupName(hook.Group) {
+		http.Error(w, "invalid group name", http.StatusBadRequest)
+		return
+	}
+
+	if err := this.plugins.Chain(hook.pluginRequest(r.Header.Get(HttpHeaderSubkey),
+		r.RemoteAddr).WithRequest(r)).PreDeliver(nil); err != nil {
+		log.Error("webhook[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} %v",
+			hook.Appid, r.RemoteAddr, getHttpRemoteIp(r), hook.HisAppid, hook.Topic, hook.Ver, hook.Group, err)
+
+		this.writePluginError(w, err)
+		return
+	}
+
+	if _, found := manager.Default.LookupCluster(hook.HisAppid); !found {
+		http.Error(w, "invalid appid", http.StatusBadRequest)
+		return
+	}
+
+	return hook, true
+}
+
+// /offsets/:appid/:topic/:ver?group=xx&partition=0&offset=100|delta=-10|ts=1460000000&force=0
+// moves the consumer group to an absolute offset, a relative delta or the first
+// offset at or after the unix timestamp, all partitions if partition is absent
+func (this *Gateway) seekHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	var (
+		topic    string
+		ver      string
+		myAppid  string
+		hisAppid string
+		group    string
+	)
+
+	query := r.URL.Query()
+	group = query.Get(UrlQueryGroup)
+	ver = params.ByName(UrlParamVersion)
+	topic = params.ByName(UrlParamTopic)
+	hisAppid = params.ByName(UrlParamAppid)
+	myAppid = r.Header.Get(HttpHeaderAppid)
+	if !validateGroupName(group) {
+		http.Error(w, "invalid group name", http.StatusBadRequest)
+		return
+	}
+
+	seek, err := parseOffsetSeek(query)
+	if err != nil {
+		this.writeBadRequest(w, err)
+		return
+	}
+
+	var partitions []int32
+	if p := query.Get(UrlQueryPartition); p != "" {
+		partition, err := strconv.ParseInt(p, 10, 32)
+		if err != nil {
+			this.writeBadRequest(w, err)
+			return
+		}
+
+		partitions = []int32{int32(partition)}
+	}
+
+	if err = this.plugins.Chain(newSubPluginRequest(myAppid, r.Header.Get(HttpHeaderSubkey),
+		hisAppid, topic, ver, group, r.RemoteAddr).WithRequest(r)).PreDeliver(nil); err != nil {
+		log.Error("seek[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} %v",
+			myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group, err)
+
+		this.writePluginError(w, err)
+		return
+	}
+
+	cluster, found := manager.Default.LookupCluster(hisAppid)
+	if !found {
+		log.Error("seek[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} cluster not found",
+			myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group)
+
+		http.Error(w, "invalid appid", http.StatusBadRequest)
+		return
+	}
+
+	zkcluster := meta.Default.ZkCluster(cluster)
+	rawTopic := meta.KafkaTopic(hisAppid, topic, ver)
+	var offsets map[int32]int64
+	if kafkaOffsets(cluster) {
+		offsets, err = zkcluster.ResolveKafkaConsumerGroupOffset(rawTopic, myAppid+"."+group,
+			partitions, seek)
+		if err == nil {
+			err = zkcluster.ResetKafkaConsumerGroupOffset(rawTopic, myAppid+"."+group,
+				offsets, query.Get("force") == "1")
+		}
+	} else {
+		offsets, err = zkcluster.ResolveConsumerGroupOffset(rawTopic, myAppid+"."+group,
+			partitions, seek)
+		if err == nil {
+			err = zkcluster.ResetConsumerGroupOffset(rawTopic, myAppid+"."+group,
+				offsets, query.Get("force") == "1")
+		}
+	}
+	if err != nil {
+		log.Error("seek[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} %+v %v",
+			myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group, seek, err)
+
+		if err == zk.ErrConsumerGroupOnline {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Info("seek[%s] %s(%s): {app:%s, topic:%s, ver:%s, group:%s} %+v",
+		myAppid, r.RemoteAddr, getHttpRemoteIp(r), hisAppid, topic, ver, group, offsets)
+
+	type partitionOffset struct {
+		Partition int32 `json:"partition"`
+		Offset    int64 `json:"offset"`
+	}
+	sortedPartitions := make([]int, 0, len(offsets))
+	for partition, _ := range offsets {
+		sortedPartitions = append(sortedPartitions, int(partition))
+	}
+	sort.Ints(sortedPartitions)
+	out := make([]partitionOffset, 0, len(offsets))
+	for _, partition := range sortedPartitions {
+		out = append(out, partitionOffset{
+			Partition: int32(partition),
+			Offset:    offsets[int32(partition)],
+		})
+	}
+
+	this.writeKatewayHeader(w)
+	w.Header().Set(ContentTypeHeader, ContentTypeJson)
+	b, _ := json.Marshal(out)
+	w.Write(b)
 }
 
 // /raw/topics/:appid/:topic/:ver
@@ -304,11 +857,12 @@ func (this *Gateway) subRawHandler(w http.ResponseWriter, r *http.Request,
 	hisAppid = params.ByName(UrlParamAppid)
 	myAppid = r.Header.Get(HttpHeaderAppid)
 
-	if err := manager.Default.AuthSub(myAppid, r.Header.Get(HttpHeaderSubkey), topic); err != nil {
+	if err := this.plugins.Chain(newSubPluginRequest(myAppid, r.Header.Get(HttpHeaderSubkey),
+		hisAppid, topic, ver, "", r.RemoteAddr).WithRequest(r)).PreDeliver(nil); err != nil {
 		log.Error("consumer[%s] %s {topic:%s, ver:%s, hisapp:%s}: %s",
 			myAppid, r.RemoteAddr, topic, ver, hisAppid, err)
 
-		this.writeAuthFailure(w, err)
+		this.writePluginError(w, err)
 		return
 	}
 
@@ -375,11 +929,17 @@ func (this *Gateway) subWsHandler(w http.ResponseWriter, r *http.Request,
 	topic = params.ByName(UrlParamTopic)
 	hisAppid = params.ByName(UrlParamAppid)
 	myAppid = r.Header.Get(HttpHeaderAppid)
-	if err := manager.Default.AuthSub(myAppid, r.Header.Get(HttpHeaderSubkey), topic); err != nil {
+	chain := this.plugins.Chain(newSubPluginRequest(myAppid, r.Header.Get(HttpHeaderSubkey),
+		hisAppid, topic, ver, group, r.RemoteAddr).WithRequest(r))
+	if err := chain.PreDeliver(nil); err != nil {
 		log.Error("consumer[%s] %s {hisapp:%s, topic:%s, ver:%s, group:%s, limit:%d}: %s",
 			myAppid, r.RemoteAddr, hisAppid, topic, ver, group, limit, err)
 
-		this.writeWsError(ws, "auth fail")
+		if pe, ok := err.(*PluginError); ok && pe.Status == http.StatusUnauthorized {
+			this.writeWsError(ws, "auth fail")
+		} else {
+			this.writeWsError(ws, err.Error())
+		}
 		return
 	}
 
@@ -394,6 +954,22 @@ func (this *Gateway) subWsHandler(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	filter, err := this.subFilters.Fix(rawTopic, myAppid+"."+group, query.Get(UrlQueryFilter))
+	if err != nil {
+		log.Warn("sub[%s] %s: %+v filter: %v", myAppid, r.RemoteAddr, params, err)
+
+		this.writeWsError(ws, err.Error())
+		return
+	}
+
+	policy, err := this.commitPolicies.Resolve(myAppid+"."+group, query.Get(UrlQueryCommit))
+	if err != nil {
+		log.Warn("sub[%s] %s: %+v commit: %v", myAppid, r.RemoteAddr, params, err)
+
+		this.writeWsError(ws, err.Error())
+		return
+	}
+
 	fetcher, err := store.DefaultSubStore.Fetch(cluster, rawTopic,
 		myAppid+"."+group, r.RemoteAddr, resetOffset)
 	if err != nil {
@@ -414,7 +990,7 @@ func (this *Gateway) subWsHandler(w http.ResponseWriter, r *http.Request,
 	//
 
 	clientGone := make(chan struct{})
-	go this.wsWritePump(clientGone, ws, fetcher)
+	go this.wsWritePump(clientGone, ws, newOffsetCommitter(policy, fetcher), filter, chain)
 	this.wsReadPump(clientGone, ws)
 }
 
@@ -445,24 +1021,93 @@ func (this *Gateway) wsReadPump(clientGone chan struct{}, ws *websocket.Conn) {
 	}
 }
 
-func (this *Gateway) wsWritePump(clientGone chan struct{}, ws *websocket.Conn, fetcher store.Fetcher) {
+func (this *Gateway) wsWritePump(clientGone chan struct{}, ws *websocket.Conn,
+	committer *offsetCommitter, filter *subFilter, chain *pluginChain) {
+	fetcher := committer.fetcher
 	defer fetcher.Close()
 
-	var err error
+	var (
+		myAppid, topic, ver = chain.req.Appid, chain.req.Topic, chain.req.Ver
+		err                 error
+	)
 	for {
+		var (
+			messages  = fetcher.Messages()
+			throttled <-chan time.Time
+		)
+		if retryAfter := this.quotas.Wait(true, myAppid, topic, time.Now()); retryAfter > 0 {
+			// stop consuming until the quota is available
+			messages = nil
+			throttled = time.After(retryAfter)
+			if !options.DisableMetrics {
+				this.subMetrics.QuotaExceeded(myAppid, topic, ver)
+			}
+		}
+
 		select {
-		case msg := <-fetcher.Messages():
+		case <-throttled:
+
+		case msg := <-messages:
+			var pm *PluginMessage
+			if pm, err = this.openMessage(msg); err != nil {
+				// never commit past it: it's consumed again once the key is available
+				log.Error("ws sub[%s] %s: {topic:%s, ver:%s, P:%d, O:%d} open: %v",
+					myAppid, ws.RemoteAddr(), topic, ver, msg.Partition, msg.Offset, err)
+
+				this.writeWsError(ws, err.Error())
+				return
+			}
+			if filter != nil && !filter.Match(msg.Key, pm.Attrs) {
+				this.commitFiltered(committer, msg, nil, "")
+				continue
+			}
+
+			if err = chain.PreDeliver(pm); err != nil {
+				log.Warn("ws sub[%s] %s: {topic:%s, ver:%s, P:%d, O:%d} rejected: %v",
+					myAppid, ws.RemoteAddr(), topic, ver, msg.Partition, msg.Offset, err)
+
+				this.commitFiltered(committer, msg, nil, "")
+				continue
+			}
+
+			if err = committer.BeforeSend(msg); err != nil {
+				// not sent, it will be consumed again
+				log.Error("%s: %v", ws.RemoteAddr(), err)
+				return
+			}
+
 			ws.SetWriteDeadline(time.Now().Add(time.Second * 10))
+			if len(pm.Attrs) > 0 {
+				// the metadata text frame goes before the message binary frame
+				b, _ := json.Marshal(wsSubMeta{
+					Partition: msg.Partition,
+					Offset:    msg.Offset,
+					Attrs:     pm.Attrs,
+				})
+				if err = ws.WriteMessage(websocket.TextMessage, b); err != nil {
+					log.Error("%s: %v", ws.RemoteAddr(), err)
+					return
+				}
+			}
+
 			// FIXME because of buffer, client recv 10, but kateway written 100, then
 			// client quit...
-			if err = ws.WriteMessage(websocket.BinaryMessage, msg.Value); err != nil {
+			err = ws.WriteMessage(websocket.BinaryMessage, pm.Body)
+			chain.PostDeliver(pm, err)
+			if err != nil {
 				log.Error("%s: %v", ws.RemoteAddr(), err)
 				return
 			}
 
-			if err := fetcher.CommitUpto(msg); err != nil {
-				log.Error(err) // TODO add more ctx
+			// each message is a batch
+			if err = committer.AfterSend(msg); err == nil {
+				err = committer.EndBatch()
 			}
+			if err != nil {
+				log.Error("%s: {T:%s, P:%d, O:%d} %v", ws.RemoteAddr(), msg.Topic, msg.Partition, msg.Offset, err)
+			}
+
+			this.quotas.Consume(true, myAppid, topic, 1, int64(len(msg.Value)), time.Now())
 
 		case err = <-fetcher.Errors():
 			// TODO
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/gafka/cmd/kateway/meta"
+	"github.com/funkygao/gafka/cmd/kateway/store"
+	log "github.com/funkygao/log4go"
+)
+
+const (
+	// idempotencyTopic is the log of idempotent pubs in each cluster, which
+	// all kateway instances tail to share the dedup windows.
+	idempotencyTopic = "__kateway_idempotency"
+
+	idempotencyMinBackoff = time.Second
+	idempotencyMaxBackoff = time.Minute
+)
+
+// idempotentPub is the message of the idempotency log.
+type idempotentPub struct {
+	Topic     string `json:"topic"`
+	Key       string `json:"key"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Ctime     int64  `json:"ctime"` // in ms
+}
+
+type dedupEntry struct {
+	key       string
+	partition int32
+	offset    int64
+	ctime     time.Time
+	pending   bool // being published
+}
+
+// dedupWindow remembers the pub result of the latest idempotency keys of a
+// topic within ttl.
+type dedupWindow struct {
+	capacity int
+	ttl      time.Duration
+
+	lru     *list.List // front is the newest
+	entries map[string]*list.Element
+}
+
+func newDedupWindow(capacity int, ttl time.Duration) *dedupWindow {
+	return &dedupWindow{
+		capacity: capacity,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (this *dedupWindow) get(key string, now time.Time) (*dedupEntry, bool) {
+	elem, present := this.entries[key]
+	if !present {
+		return nil, false
+	}
+
+	e := elem.Value.(*dedupEntry)
+	if !e.pending && now.Sub(e.ctime) > this.ttl {
+		this.lru.Remove(elem)
+		delete(this.entries, key)
+		return nil, false
+	}
+
+	return e, true
+}
+
+func (this *dedupWindow) put(e *dedupEntry, now time.Time) {
+	if elem, present := this.entries[e.key]; present {
+		this.lru.Remove(elem)
+	}
+	this.entries[e.key] = this.lru.PushFront(e)
+
+	// evict the oldest
+	for this.lru.Len() > 0 {
+		elem := this.lru.Back()
+		oldest := elem.Value.(*dedupEntry)
+		if this.lru.Len() <= this.capacity && (oldest.pending || now.Sub(oldest.ctime) <= this.ttl) {
+			break
+		}
+
+		this.lru.Remove(elem)
+		delete(this.entries, oldest.key)
+	}
+}
+
+func (this *dedupWindow) remove(key string) {
+	if elem, present := this.entries[key]; present {
+		this.lru.Remove(elem)
+		delete(this.entries, key)
+	}
+}
+
+// idempotency dedups the pubs with the same idempotency key of a topic, and
+// the duplicated pub gets the partition and offset of the original one.
+//
+// Each kateway instance appends the idempotent pubs to the idempotency log
+// of the cluster and tails the log, so that a client retrying on another
+// instance is deduped too. The log is replayed within ttl in background
+// since startup, the pubs are never blocked by it.
+//
+// The dedup is best effort, not exactly-once: the log is appended async and
+// tailed, so a retry that reaches another instance before its tail catches
+// up, usually within milliseconds and at most the replay of the log after
+// startup, is written twice.
+type idempotency struct {
+	gw *Gateway
+
+	mu      sync.Mutex
+	windows map[string]*dedupWindow // key is kafka topic
+	logs    map[string]bool         // key is cluster, true if being tailed
+}
+
+func newIdempotency(gw *Gateway) *idempotency {
+	return &idempotency{
+		gw:      gw,
+		windows: make(map[string]*dedupWindow),
+		logs:    make(map[string]bool),
+	}
+}
+
+// Start tails the idempotency log of each cluster in background.
+func (this *idempotency) Start() {
+	for _, cluster := range meta.Default.ClusterNames() {
+		this.tail(cluster)
+	}
+}
+
+func (this *idempotency) window(topic string) *dedupWindow {
+	w, present := this.windows[topic]
+	if !present {
+		w = newDedupWindow(options.IdempotencyWindow, options.IdempotencyTTL)
+		this.windows[topic] = w
+	}
+
+	return w
+}
+
+// Begin reserves the idempotency key of a pub. If the key is already
+// published, dup is true with the original partition and offset.
+func (this *idempotency) Begin(cluster, topic, key string) (partition int32, offset int64, dup bool, err error) {
+	// a cluster added after startup
+	this.tail(cluster)
+
+	now := time.Now()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	w := this.window(topic)
+	if e, present := w.get(key, now); present {
+		if e.pending {
+			err = ErrPubInProgress
+			return
+		}
+
+		return e.partition, e.offset, true, nil
+	}
+
+	w.put(&dedupEntry{key: key, ctime: now, pending: true}, now)
+	return
+}
+
+// Done records the result of a pub reserved by Begin.
+func (this *idempotency) Done(cluster, topic, key string, partition int32, offset int64, err error) {
+	now := time.Now()
+	this.mu.Lock()
+	w := this.window(topic)
+	if err != nil {
+		// the client might retry
+		w.remove(key)
+		this.mu.Unlock()
+		return
+	}
+
+	w.put(&dedupEntry{key: key, partition: partition, offset: offset, ctime: now}, now)
+	this.mu.Unlock()
+
+	b, _ := json.Marshal(idempotentPub{
+		Topic:     topic,
+		Key:       key,
+		Partition: partition,
+		Offset:    offset,
+		Ctime:     now.UnixNano() / int64(time.Millisecond),
+	})
+	if _, _, err = store.DefaultPubStore.AsyncPub(cluster, idempotencyTopic, nil, b); err != nil {
+		log.Error("cluster[%s] idempotency log {T:%s, key:%s}: %v", cluster, topic, key, err)
+	}
+}
+
+// tail replays and tails the idempotency log of the cluster in background
+// if not yet. Until the log is available, the dedup works only within this
+// instance.
+func (this *idempotency) tail(cluster string) {
+	this.mu.Lock()
+	if this.logs[cluster] {
+		this.mu.Unlock()
+		return
+	}
+	this.logs[cluster] = true
+	this.mu.Unlock()
+
+	this.gw.wg.Add(1)
+	go this.tailLoop(cluster)
+}
+
+// tailLoop retries tailing the idempotency log with backoff, e,g. the
+// brokers hiccuped at startup.
+func (this *idempotency) tailLoop(cluster string) {
+	defer this.gw.wg.Done()
+
+	backoff := idempotencyMinBackoff
+	for {
+		err := this.ensureTopic(cluster)
+		if err == nil {
+			err = this.replay(cluster)
+		}
+		if err == nil {
+			// shutdown
+			return
+		}
+
+		log.Error("cluster[%s] idempotency log: %v, retry in %s", cluster, err, backoff)
+
+		select {
+		case <-this.gw.shutdownCh:
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > idempotencyMaxBackoff {
+			backoff = idempotencyMaxBackoff
+		}
+	}
+}
+
+func (this *idempotency) ensureTopic(cluster string) error {
+	if len(meta.Default.TopicPartitions(cluster, idempotencyTopic)) > 0 {
+		return nil
+	}
+
+	// 1 partition keeps the log in order
+	lines, err := meta.Default.ZkCluster(cluster).AddTopic(idempotencyTopic, clusterReplicas(cluster), 1)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range lines {
+		log.Trace("cluster[%s] add idempotency topic: %s", cluster, l)
+	}
+	if !strings.Contains(strings.Join(lines, "\n"), "Created topic") {
+		return ErrIdempotencyTopic
+	}
+
+	return nil
+}
+
+// replay loads the log within ttl and keeps tailing it till shutdown.
+func (this *idempotency) replay(cluster string) error {
+	client, err := sarama.NewClient(meta.Default.BrokerList(cluster), sarama.NewConfig())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	since := time.Now().Add(-options.IdempotencyTTL).UnixNano() / int64(time.Millisecond)
+	offset, err := client.GetOffset(idempotencyTopic, 0, since)
+	if err != nil {
+		return err
+	}
+	newest, err := client.GetOffset(idempotencyTopic, 0, sarama.OffsetNewest)
+	if err != nil {
+		return err
+	}
+	if offset == -1 {
+		// no message after since
+		offset = newest
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	pc, err := consumer.ConsumePartition(idempotencyTopic, 0, offset)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	if offset >= newest {
+		log.Trace("cluster[%s] idempotency log replayed up to %d", cluster, newest)
+	}
+	for {
+		select {
+		case msg := <-pc.Messages():
+			this.load(msg)
+			if msg.Offset+1 == newest {
+				log.Trace("cluster[%s] idempotency log replayed up to %d", cluster, newest)
+			}
+
+		case err := <-pc.Errors():
+			log.Error("cluster[%s] idempotency log: %v", cluster, err)
+
+		case <-this.gw.shutdownCh:
+			return nil
+		}
+	}
+}
+
+// load puts an idempotency log message into the dedup window.
+func (this *idempotency) load(msg *sarama.ConsumerMessage) {
+	var pub idempotentPub
+	if err := json.Unmarshal(msg.Value, &pub); err != nil {
+		log.Error("idempotency log {P:%d, O:%d}: %v", msg.Partition, msg.Offset, err)
+		return
+	}
+
+	now := time.Now()
+	this.mu.Lock()
+	w := this.window(pub.Topic)
+	if e, present := w.get(pub.Key, now); !present || !e.pending {
+		w.put(&dedupEntry{
+			key:       pub.Key,
+			partition: pub.Partition,
+			offset:    pub.Offset,
+			ctime:     time.Unix(0, pub.Ctime*int64(time.Millisecond)),
+		}, now)
+	}
+	this.mu.Unlock()
+}
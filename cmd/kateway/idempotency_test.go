@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/funkygao/assert"
+)
+
+func TestDedupWindow(t *testing.T) {
+	now := time.Now()
+	w := newDedupWindow(2, time.Minute)
+	_, present := w.get("a", now)
+	assert.Equal(t, false, present)
+
+	w.put(&dedupEntry{key: "a", pending: true, ctime: now}, now)
+	e, present := w.get("a", now)
+	assert.Equal(t, true, present)
+	assert.Equal(t, true, e.pending)
+
+	w.put(&dedupEntry{key: "a", partition: 1, offset: 10, ctime: now}, now)
+	e, _ = w.get("a", now)
+	assert.Equal(t, false, e.pending)
+	assert.Equal(t, int32(1), e.partition)
+	assert.Equal(t, int64(10), e.offset)
+	assert.Equal(t, 1, w.lru.Len())
+
+	// capacity evicts the oldest
+	w.put(&dedupEntry{key: "b", ctime: now}, now)
+	w.put(&dedupEntry{key: "c", ctime: now}, now)
+	_, present = w.get("a", now)
+	assert.Equal(t, false, present)
+	_, present = w.get("c", now)
+	assert.Equal(t, true, present)
+
+	// expired
+	_, present = w.get("b", now.Add(time.Minute*2))
+	assert.Equal(t, false, present)
+
+	w.remove("c")
+	assert.Equal(t, 0, w.lru.Len())
+	assert.Equal(t, 0, len(w.entries))
+}
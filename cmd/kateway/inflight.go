@@ -0,0 +1,240 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/gafka/cmd/kateway/store"
+	log "github.com/funkygao/log4go"
+)
+
+// inflights tracks the messages delivered to subscribers in explicit ack
+// mode(autocommit=0).
+//
+// An unacked message is redelivered to the client that owns its partition
+// after the visibility timeout, and the offset of a partition is committed
+// only up to the lowest unacked offset: if the client dies after receiving
+// a message, it will be consumed again instead of being lost.
+type inflights struct {
+	visibilityTimeout time.Duration
+
+	mu     sync.Mutex
+	groups map[string]map[int32]*inflightPartition // key is cluster/topic/group
+}
+
+type inflightPartition struct {
+	topic   string
+	owner   string // remote addr of the client consuming this partition
+	fetcher store.Fetcher
+
+	pending   []int64 // sorted unacked offsets
+	messages  map[int64]*inflightMessage
+	highest   int64 // highest delivered offset
+	committed int64
+}
+
+type inflightMessage struct {
+	msg        *sarama.ConsumerMessage
+	deadline   time.Time
+	deliveries int
+	lastErr    string // reason of the last nack
+}
+
+func newInflights(visibilityTimeout time.Duration) *inflights {
+	return &inflights{
+		visibilityTimeout: visibilityTimeout,
+		groups:            make(map[string]map[int32]*inflightPartition),
+	}
+}
+
+func inflightKey(cluster, topic, group string) string {
+	return cluster + "/" + topic + "/" + group
+}
+
+// deliver records a message that is being written to the client.
+func (this *inflights) deliver(key, remoteAddr string, fetcher store.Fetcher,
+	msg *sarama.ConsumerMessage, now time.Time) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	partitions, present := this.groups[key]
+	if !present {
+		partitions = make(map[int32]*inflightPartition)
+		this.groups[key] = partitions
+	}
+
+	p, present := partitions[msg.Partition]
+	if !present || p.owner != remoteAddr {
+		// the partition is rebalanced to this client: what the previous owner
+		// has not acked is not committed and will be consumed from kafka again
+		p = &inflightPartition{
+			topic:     msg.Topic,
+			owner:     remoteAddr,
+			messages:  make(map[int64]*inflightMessage),
+			highest:   msg.Offset - 1,
+			committed: msg.Offset - 1,
+		}
+		partitions[msg.Partition] = p
+	}
+	p.fetcher = fetcher
+
+	if im, present := p.messages[msg.Offset]; present {
+		// consumed from kafka again
+		im.deadline = now.Add(this.visibilityTimeout)
+		im.deliveries++
+		return
+	}
+
+	i := sort.Search(len(p.pending), func(i int) bool { return p.pending[i] >= msg.Offset })
+	p.pending = append(p.pending, 0)
+	copy(p.pending[i+1:], p.pending[i:])
+	p.pending[i] = msg.Offset
+	p.messages[msg.Offset] = &inflightMessage{
+		msg:        msg,
+		deadline:   now.Add(this.visibilityTimeout),
+		deliveries: 1,
+	}
+	if msg.Offset > p.highest {
+		p.highest = msg.Offset
+	}
+}
+
+// redeliver returns an unacked message of the client whose visibility
+// timeout expired.
+func (this *inflights) redeliver(key, remoteAddr string, now time.Time) (m inflightMessage, ok bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, p := range this.groups[key] {
+		if p.owner != remoteAddr {
+			continue
+		}
+
+		for _, offset := range p.pending {
+			im := p.messages[offset]
+			if im.deadline.After(now) {
+				continue
+			}
+
+			im.deadline = now.Add(this.visibilityTimeout)
+			im.deliveries++
+			return *im, true
+		}
+	}
+
+	return
+}
+
+// nack tells that the client failed to process a message, which will be
+// redelivered right now.
+func (this *inflights) nack(key string, partition int32, offset int64,
+	reason string, now time.Time) (m inflightMessage, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	p, present := this.groups[key][partition]
+	if !present {
+		err = ErrNotInflight
+		return
+	}
+	im, present := p.messages[offset]
+	if !present {
+		err = ErrNotInflight
+		return
+	}
+
+	im.deadline = now
+	im.lastErr = reason
+	return *im, nil
+}
+
+// unacked returns number of unacked messages of the client.
+func (this *inflights) unacked(key, remoteAddr string) (n int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, p := range this.groups[key] {
+		if p.owner == remoteAddr {
+			n += len(p.pending)
+		}
+	}
+	return
+}
+
+// ack acknowledges a delivered message and commits the offset of its
+// partition up to the lowest unacked one.
+func (this *inflights) ack(key string, partition int32, offset int64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	p, present := this.groups[key][partition]
+	if !present {
+		return ErrNotInflight
+	}
+	if _, present = p.messages[offset]; !present {
+		return ErrNotInflight
+	}
+
+	delete(p.messages, offset)
+	i := sort.Search(len(p.pending), func(i int) bool { return p.pending[i] >= offset })
+	p.pending = append(p.pending[:i], p.pending[i+1:]...)
+
+	upto := p.highest
+	if len(p.pending) > 0 {
+		upto = p.pending[0] - 1
+	}
+	if upto <= p.committed {
+		return nil
+	}
+
+	log.Debug("commit offset: {T:%s, P:%d, O:%d}", p.topic, partition, upto)
+	if err := p.fetcher.CommitUpto(&sarama.ConsumerMessage{
+		Topic:     p.topic,
+		Partition: partition,
+		Offset:    upto,
+	}); err != nil {
+		log.Error("commit offset {T:%s, P:%d, O:%d}: %v", p.topic, partition, upto, err)
+		return err
+	}
+
+	p.committed = upto
+	return nil
+}
+
+// forget discards all the inflight messages of a gone client.
+func (this *inflights) forget(remoteAddr string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for key, partitions := range this.groups {
+		for partition, p := range partitions {
+			if p.owner == remoteAddr {
+				delete(partitions, partition)
+			}
+		}
+
+		if len(partitions) == 0 {
+			delete(this.groups, key)
+		}
+	}
+}
+
+// forgetSubscription discards the inflight messages of a subscription of a
+// client, the other subscriptions of the client are kept.
+func (this *inflights) forgetSubscription(key, remoteAddr string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	partitions := this.groups[key]
+	for partition, p := range partitions {
+		if p.owner == remoteAddr {
+			delete(partitions, partition)
+		}
+	}
+
+	if len(partitions) == 0 {
+		delete(this.groups, key)
+	}
+}
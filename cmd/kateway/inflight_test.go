@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/assert"
+)
+
+type ackFetcher struct {
+	commits []int64
+	flushes int
+}
+
+func (this *ackFetcher) Messages() <-chan *sarama.ConsumerMessage { return nil }
+func (this *ackFetcher) Errors() <-chan *sarama.ConsumerError     { return nil }
+func (this *ackFetcher) Close()                                   {}
+func (this *ackFetcher) FlushOffsets() error                      { this.flushes++; return nil }
+func (this *ackFetcher) CommitUpto(msg *sarama.ConsumerMessage) error {
+	this.commits = append(this.commits, msg.Offset)
+	return nil
+}
+
+func TestInflightsAckContiguous(t *testing.T) {
+	f := &ackFetcher{}
+	ifs := newInflights(time.Minute)
+	key := inflightKey("me", "app1.foo.v1", "app2.group1")
+	now := time.Now()
+	for offset := int64(10); offset < 14; offset++ {
+		ifs.deliver(key, "1.1.1.1:1000", f, &sarama.ConsumerMessage{
+			Topic:  "app1.foo.v1",
+			Offset: offset,
+		}, now)
+	}
+	assert.Equal(t, 4, ifs.unacked(key, "1.1.1.1:1000"))
+	assert.Equal(t, 0, ifs.unacked(key, "1.1.1.1:1001"))
+
+	assert.Equal(t, ErrNotInflight, ifs.ack(key, 0, 9))
+	assert.Equal(t, ErrNotInflight, ifs.ack(key, 1, 10))
+
+	// 11 acked but 10 not yet: nothing committed
+	assert.Equal(t, nil, ifs.ack(key, 0, 11))
+	assert.Equal(t, 0, len(f.commits))
+	assert.Equal(t, ErrNotInflight, ifs.ack(key, 0, 11))
+
+	assert.Equal(t, nil, ifs.ack(key, 0, 10))
+	assert.Equal(t, []int64{11}, f.commits)
+
+	assert.Equal(t, nil, ifs.ack(key, 0, 13))
+	assert.Equal(t, []int64{11}, f.commits)
+	assert.Equal(t, nil, ifs.ack(key, 0, 12))
+	assert.Equal(t, []int64{11, 13}, f.commits)
+	assert.Equal(t, 0, ifs.unacked(key, "1.1.1.1:1000"))
+}
+
+func TestInflightsRedeliver(t *testing.T) {
+	f := &ackFetcher{}
+	ifs := newInflights(time.Minute)
+	key := inflightKey("me", "app1.foo.v1", "app2.group1")
+	now := time.Now()
+	ifs.deliver(key, "1.1.1.1:1000", f, &sarama.ConsumerMessage{Offset: 5}, now)
+	_, ok := ifs.redeliver(key, "1.1.1.1:1000", now)
+	assert.Equal(t, false, ok)
+
+	later := now.Add(time.Minute)
+	_, ok = ifs.redeliver(key, "1.1.1.1:1001", later)
+	assert.Equal(t, false, ok)
+	m, ok := ifs.redeliver(key, "1.1.1.1:1000", later)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, int64(5), m.msg.Offset)
+	assert.Equal(t, 2, m.deliveries)
+
+	// visibility timeout restarts after redelivery
+	_, ok = ifs.redeliver(key, "1.1.1.1:1000", later)
+	assert.Equal(t, false, ok)
+
+	// nack makes it visible again
+	_, err := ifs.nack(key, 0, 6, "bad", later)
+	assert.Equal(t, ErrNotInflight, err)
+	m, err = ifs.nack(key, 0, 5, "bad", later)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "bad", m.lastErr)
+	m, ok = ifs.redeliver(key, "1.1.1.1:1000", later)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 3, m.deliveries)
+
+	// partition rebalanced to another client
+	ifs.deliver(key, "1.1.1.1:1001", f, &sarama.ConsumerMessage{Offset: 5}, later)
+	assert.Equal(t, 0, ifs.unacked(key, "1.1.1.1:1000"))
+	assert.Equal(t, 1, ifs.unacked(key, "1.1.1.1:1001"))
+
+	ifs.forget("1.1.1.1:1001")
+	assert.Equal(t, ErrNotInflight, ifs.ack(key, 0, 5))
+}
+
+func TestInflightsForgetSubscription(t *testing.T) {
+	f := &ackFetcher{}
+	ifs := newInflights(time.Minute)
+	foo := inflightKey("me", "app1.foo.v1", "app2.group1")
+	bar := inflightKey("me", "app1.bar.v1", "app2.group1")
+	now := time.Now()
+	ifs.deliver(foo, "1.1.1.1:1000", f, &sarama.ConsumerMessage{Offset: 1}, now)
+	ifs.deliver(bar, "1.1.1.1:1000", f, &sarama.ConsumerMessage{Offset: 1}, now)
+
+	// the subscriptions over the same connection are torn down each
+	ifs.forgetSubscription(foo, "1.1.1.1:1000")
+	assert.Equal(t, 0, ifs.unacked(foo, "1.1.1.1:1000"))
+	assert.Equal(t, 1, ifs.unacked(bar, "1.1.1.1:1000"))
+}
@@ -0,0 +1,56 @@
+package manager
+
+import (
+	"time"
+)
+
+// Role is the permission of an admin principal on the man server, a role
+// has all the permissions of the roles below it.
+type Role int
+
+const (
+	RoleNone       Role = iota
+	RoleReadOnly        // query only
+	RoleTopicAdmin      // manage topics, schemas, dead letters and encryption
+	RoleSuperuser       // everything, including the kateway runtime
+)
+
+var roleNames = map[Role]string{
+	RoleNone:       "none",
+	RoleReadOnly:   "readonly",
+	RoleTopicAdmin: "topicadmin",
+	RoleSuperuser:  "superuser",
+}
+
+func (this Role) String() string {
+	if name, present := roleNames[this]; present {
+		return name
+	}
+	return "none"
+}
+
+// ParseRole returns RoleNone for unknown role name.
+func ParseRole(name string) Role {
+	for role, n := range roleNames {
+		if n == name {
+			return role
+		}
+	}
+	return RoleNone
+}
+
+// Allows tells whether the role has the permissions of the required role.
+func (this Role) Allows(required Role) bool {
+	return this >= required
+}
+
+// AuditRecord is who did what and when through the man server.
+type AuditRecord struct {
+	Principal  string
+	Role       Role
+	Method     string
+	Uri        string
+	RemoteAddr string
+	Status     int
+	Ctime      time.Time
+}
@@ -1,5 +1,9 @@
 package dummy
 
+import (
+	"github.com/funkygao/gafka/cmd/kateway/manager"
+)
+
 type dummyStore struct {
 }
 
@@ -19,10 +23,42 @@ func (this *dummyStore) AuthSub(appid, subkey, topic string) error {
 	return nil
 }
 
+func (this *dummyStore) AuthPubByCert(appid string, identities []string, topic string) error {
+	return nil
+}
+
+func (this *dummyStore) AuthSubByCert(appid string, identities []string, topic string) error {
+	return nil
+}
+
 func (this *dummyStore) LookupCluster(appid string) (string, bool) {
 	return "me", true
 }
 
+func (this *dummyStore) LookupQuota(appid, topic string) (manager.Quota, bool) {
+	return manager.Quota{}, false
+}
+
+func (this *dummyStore) AuthPubBySignature(appid, stringToSign, signature, topic string) error {
+	return nil
+}
+
+func (this *dummyStore) AuthSubBySignature(appid, stringToSign, signature, topic string) error {
+	return nil
+}
+
+func (this *dummyStore) MintToken(token manager.Token) (string, error) {
+	return manager.SignToken(token, "dummy", []byte("dummy"))
+}
+
+func (this *dummyStore) AuthAdmin(principal, secret string) (manager.Role, error) {
+	return manager.RoleSuperuser, nil
+}
+
+func (this *dummyStore) Audit(record manager.AuditRecord) error {
+	return nil
+}
+
 func (this *dummyStore) Start() {}
 
 func (this *dummyStore) Stop() {}
@@ -9,4 +9,7 @@ var (
 	ErrPermDenied         = errors.New("permission denied")
 	ErrAuthenticationFail = errors.New("authentication fails")
 	ErrAuthorizationFial  = errors.New("authorization fails")
+	ErrInvalidToken       = errors.New("invalid token")
+	ErrTokenExpired       = errors.New("token expired")
+	ErrNoSigningKey       = errors.New("no token signing key")
 )
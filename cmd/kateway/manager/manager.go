@@ -6,9 +6,38 @@ type Manager interface {
 	Start()
 	Stop()
 
+	// AuthPub and AuthSub accept either the secret or a token minted by
+	// MintToken as the key.
 	AuthPub(appid, pubkey, topic string) error
 	AuthSub(appid, subkey, topic string) error
+
+	// MintToken signs the token with the current signing key.
+	MintToken(token Token) (string, error)
+
+	// AuthPubByCert and AuthSubByCert are AuthPub and AuthSub of the clients
+	// authenticated by certificate instead of key: one of the identities of
+	// the verified client certificate must map to the appid.
+	AuthPubByCert(appid string, identities []string, topic string) error
+	AuthSubByCert(appid string, identities []string, topic string) error
+
+	// AuthPubBySignature and AuthSubBySignature are AuthPub and AuthSub of
+	// the signed requests: the signature must be of the string to sign by
+	// the secret of the appid.
+	AuthPubBySignature(appid, stringToSign, signature, topic string) error
+	AuthSubBySignature(appid, stringToSign, signature, topic string) error
+
 	LookupCluster(appid string) (cluster string, found bool)
+
+	// LookupQuota returns the quota of a topic of the appid, or of the appid
+	// as a whole if topic is empty.
+	LookupQuota(appid, topic string) (quota Quota, found bool)
+
+	// AuthAdmin authenticates an admin principal of the man server and
+	// returns its role.
+	AuthAdmin(principal, secret string) (Role, error)
+
+	// Audit saves the record of a mutating admin call.
+	Audit(record AuditRecord) error
 }
 
 var Default Manager
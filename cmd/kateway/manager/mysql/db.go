@@ -1,10 +1,13 @@
 package mysql
 
 import (
+	"crypto/subtle"
 	"database/sql"
+	"sync"
 	"time"
 
 	"github.com/funkygao/gafka/cmd/kateway/manager"
+	"github.com/funkygao/gafka/cmd/kateway/sign"
 	"github.com/funkygao/gafka/ctx"
 	"github.com/funkygao/gafka/zk"
 	log "github.com/funkygao/log4go"
@@ -17,11 +20,22 @@ type mysqlStore struct {
 
 	shutdownCh chan struct{}
 
+	// pooled connections shared by the refreshes and the audits, reopened
+	// when the dsn in zk changes
+	dbLock sync.Mutex
+	db     *sql.DB
+	dsn    string
+
 	// mysql store, initialized on refresh
-	appClusterMap map[string]string              // appid:cluster
-	appSecretMap  map[string]string              // appid:secret
-	appSubMap     map[string]map[string]struct{} // appid:topics
-	appPubMap     map[string]map[string]struct{} // appid:subscribed topics
+	appClusterMap map[string]string                   // appid:cluster
+	appSecretMap  map[string]string                   // appid:secret
+	certAppMap    map[string]string                   // cert identity:appid
+	appSubMap     map[string]map[string]struct{}      // appid:topics
+	appPubMap     map[string]map[string]struct{}      // appid:subscribed topics
+	appQuotaMap   map[string]map[string]manager.Quota // appid:topic:quota, topic "" is the appid
+	adminMap      map[string]adminRecord              // principal:admin
+	tokenKeys     map[string][]byte                   // kid:signing key
+	tokenKid      string                              // current signing key
 }
 
 func New(cf *config) *mysqlStore {
@@ -56,6 +70,24 @@ type appSubscribeRecord struct {
 	AppId, TopicName string
 }
 
+type appCertRecord struct {
+	AppId, Identity string
+}
+
+type adminRecord struct {
+	Principal, Secret string
+	Role              manager.Role
+}
+
+type tokenKeyRecord struct {
+	KeyId, Secret string
+}
+
+type appQuotaRecord struct {
+	AppId, TopicName               string
+	PubQps, PubBps, SubQps, SubBps int64
+}
+
 func (this *mysqlStore) Start() {
 	if err := this.refreshFromMysql(); err != nil {
 		// refuse to start if mysql conn fails
@@ -82,6 +114,34 @@ func (this *mysqlStore) Start() {
 
 func (this *mysqlStore) Stop() {
 	close(this.shutdownCh)
+
+	this.dbLock.Lock()
+	if this.db != nil {
+		this.db.Close()
+	}
+	this.dbLock.Unlock()
+}
+
+// openDB returns the pooled connections to the dsn.
+func (this *mysqlStore) openDB(dsn string) (*sql.DB, error) {
+	this.dbLock.Lock()
+	defer this.dbLock.Unlock()
+
+	if this.db != nil && this.dsn == dsn {
+		return this.db, nil
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if this.db != nil {
+		// the queries in progress finish before it closes
+		this.db.Close()
+	}
+	this.db, this.dsn = db, dsn
+	return db, nil
 }
 
 func (this *mysqlStore) refreshFromMysql() error {
@@ -91,12 +151,11 @@ func (this *mysqlStore) refreshFromMysql() error {
 		return err
 	}
 
-	db, err := sql.Open("mysql", dsn)
+	db, err := this.openDB(dsn)
 	if err != nil {
 		log.Error("mysql manager store: %v", err)
 		return err
 	}
-	defer db.Close()
 
 	if err = this.fetchApplicationRecords(db); err != nil {
 		log.Error("mysql manager store: %v", err)
@@ -113,6 +172,26 @@ func (this *mysqlStore) refreshFromMysql() error {
 		return err
 	}
 
+	if err = this.fetchQuotaRecords(db); err != nil {
+		log.Error("mysql manager store: %v", err)
+		return err
+	}
+
+	if err = this.fetchCertRecords(db); err != nil {
+		log.Error("mysql manager store: %v", err)
+		return err
+	}
+
+	if err = this.fetchAdminRecords(db); err != nil {
+		log.Error("mysql manager store: %v", err)
+		return err
+	}
+
+	if err = this.fetchTokenKeyRecords(db); err != nil {
+		log.Error("mysql manager store: %v", err)
+		return err
+	}
+
 	return nil
 }
 
@@ -198,13 +277,136 @@ func (this *mysqlStore) fetchTopicRecords(db *sql.DB) error {
 	return nil
 }
 
+func (this *mysqlStore) fetchQuotaRecords(db *sql.DB) error {
+	rows, err := db.Query("SELECT AppId,TopicName,PubQps,PubBps,SubQps,SubBps FROM app_quota WHERE Status=1")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var app appQuotaRecord
+	m := make(map[string]map[string]manager.Quota)
+	for rows.Next() {
+		err = rows.Scan(&app.AppId, &app.TopicName, &app.PubQps, &app.PubBps,
+			&app.SubQps, &app.SubBps)
+		if err != nil {
+			log.Error("mysql manager store: %v", err)
+			continue
+		}
+
+		if _, present := m[app.AppId]; !present {
+			m[app.AppId] = make(map[string]manager.Quota)
+		}
+
+		m[app.AppId][app.TopicName] = manager.Quota{
+			PubMsgs:  app.PubQps,
+			PubBytes: app.PubBps,
+			SubMsgs:  app.SubQps,
+			SubBytes: app.SubBps,
+		}
+	}
+
+	this.appQuotaMap = m
+
+	return nil
+}
+
+func (this *mysqlStore) fetchCertRecords(db *sql.DB) error {
+	rows, err := db.Query("SELECT AppId,Identity FROM app_cert WHERE Status=1")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var app appCertRecord
+	m := make(map[string]string)
+	for rows.Next() {
+		err = rows.Scan(&app.AppId, &app.Identity)
+		if err != nil {
+			log.Error("mysql manager store: %v", err)
+			continue
+		}
+
+		m[app.Identity] = app.AppId
+	}
+
+	this.certAppMap = m
+
+	return nil
+}
+
+func (this *mysqlStore) fetchAdminRecords(db *sql.DB) error {
+	rows, err := db.Query("SELECT Principal,Secret,Role FROM admin WHERE Status=1")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var (
+		admin adminRecord
+		role  string
+	)
+	m := make(map[string]adminRecord)
+	for rows.Next() {
+		err = rows.Scan(&admin.Principal, &admin.Secret, &role)
+		if err != nil {
+			log.Error("mysql manager store: %v", err)
+			continue
+		}
+
+		admin.Role = manager.ParseRole(role)
+		m[admin.Principal] = admin
+	}
+
+	this.adminMap = m
+
+	return nil
+}
+
+func (this *mysqlStore) fetchTokenKeyRecords(db *sql.DB) error {
+	rows, err := db.Query("SELECT KeyId,Secret FROM token_key WHERE Status=1 ORDER BY CreateTime")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var (
+		key tokenKeyRecord
+		kid string
+	)
+	m := make(map[string][]byte)
+	for rows.Next() {
+		err = rows.Scan(&key.KeyId, &key.Secret)
+		if err != nil {
+			log.Error("mysql manager store: %v", err)
+			continue
+		}
+
+		m[key.KeyId] = []byte(key.Secret)
+		kid = key.KeyId // the latest key signs
+	}
+
+	this.tokenKeys = m
+	this.tokenKid = kid
+
+	return nil
+}
+
 func (this *mysqlStore) AuthPub(appid, pubkey, topic string) error {
 	if appid == "" || topic == "" {
 		return manager.ErrEmptyParam
 	}
 
 	// authentication
-	if secret, present := this.appSecretMap[appid]; !present || pubkey != secret {
+	if manager.IsToken(pubkey) {
+		token, err := this.parseToken(appid, pubkey)
+		if err != nil {
+			return err
+		}
+		if !token.CanPub(topic) {
+			return manager.ErrAuthorizationFial
+		}
+	} else if secret, present := this.appSecretMap[appid]; !present || pubkey != secret {
 		return manager.ErrAuthenticationFail
 	}
 
@@ -224,7 +426,15 @@ func (this *mysqlStore) AuthSub(appid, subkey, topic string) error {
 	}
 
 	// authentication
-	if secret, present := this.appSecretMap[appid]; !present || subkey != secret {
+	if manager.IsToken(subkey) {
+		token, err := this.parseToken(appid, subkey)
+		if err != nil {
+			return err
+		}
+		if !token.CanSub(topic) {
+			return manager.ErrAuthorizationFial
+		}
+	} else if secret, present := this.appSecretMap[appid]; !present || subkey != secret {
 		return manager.ErrAuthenticationFail
 	}
 
@@ -238,6 +448,130 @@ func (this *mysqlStore) AuthSub(appid, subkey, topic string) error {
 	return manager.ErrAuthorizationFial
 }
 
+func (this *mysqlStore) parseToken(appid, raw string) (*manager.Token, error) {
+	keys := this.tokenKeys
+	token, err := manager.ParseToken(raw, func(kid string) ([]byte, bool) {
+		key, present := keys[kid]
+		return key, present
+	}, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if token.Appid != appid {
+		return nil, manager.ErrAuthenticationFail
+	}
+
+	return token, nil
+}
+
+func (this *mysqlStore) MintToken(token manager.Token) (string, error) {
+	kid := this.tokenKid
+	key, present := this.tokenKeys[kid]
+	if !present {
+		return "", manager.ErrNoSigningKey
+	}
+
+	return manager.SignToken(token, kid, key)
+}
+
+func (this *mysqlStore) authCert(appid string, identities []string) error {
+	for _, identity := range identities {
+		if this.certAppMap[identity] == appid {
+			return nil
+		}
+	}
+
+	return manager.ErrAuthenticationFail
+}
+
+func (this *mysqlStore) AuthPubByCert(appid string, identities []string, topic string) error {
+	if appid == "" || topic == "" {
+		return manager.ErrEmptyParam
+	}
+
+	// authentication
+	if err := this.authCert(appid, identities); err != nil {
+		return err
+	}
+
+	// authorization
+	if topics, present := this.appPubMap[appid]; present {
+		if _, present := topics[topic]; present {
+			return nil
+		}
+	}
+
+	return manager.ErrAuthorizationFial
+}
+
+func (this *mysqlStore) AuthSubByCert(appid string, identities []string, topic string) error {
+	if appid == "" || topic == "" {
+		return manager.ErrEmptyParam
+	}
+
+	// authentication
+	if err := this.authCert(appid, identities); err != nil {
+		return err
+	}
+
+	// authorization
+	if topics, present := this.appSubMap[appid]; present {
+		if _, present := topics[topic]; present {
+			return nil
+		}
+	}
+
+	return manager.ErrAuthorizationFial
+}
+
+func (this *mysqlStore) authSignature(appid, stringToSign, signature string) error {
+	if secret, present := this.appSecretMap[appid]; present && sign.Verify(secret, stringToSign, signature) {
+		return nil
+	}
+
+	return manager.ErrAuthenticationFail
+}
+
+func (this *mysqlStore) AuthPubBySignature(appid, stringToSign, signature, topic string) error {
+	if appid == "" || topic == "" {
+		return manager.ErrEmptyParam
+	}
+
+	// authentication
+	if err := this.authSignature(appid, stringToSign, signature); err != nil {
+		return err
+	}
+
+	// authorization
+	if topics, present := this.appPubMap[appid]; present {
+		if _, present := topics[topic]; present {
+			return nil
+		}
+	}
+
+	return manager.ErrAuthorizationFial
+}
+
+func (this *mysqlStore) AuthSubBySignature(appid, stringToSign, signature, topic string) error {
+	if appid == "" || topic == "" {
+		return manager.ErrEmptyParam
+	}
+
+	// authentication
+	if err := this.authSignature(appid, stringToSign, signature); err != nil {
+		return err
+	}
+
+	// authorization
+	if topics, present := this.appSubMap[appid]; present {
+		if _, present := topics[topic]; present {
+			return nil
+		}
+	}
+
+	return manager.ErrAuthorizationFial
+}
+
 func (this *mysqlStore) LookupCluster(appid string) (string, bool) {
 	if cluster, present := this.appClusterMap[appid]; present {
 		return cluster, present
@@ -245,3 +579,47 @@ func (this *mysqlStore) LookupCluster(appid string) (string, bool) {
 
 	return "", false
 }
+
+func (this *mysqlStore) LookupQuota(appid, topic string) (manager.Quota, bool) {
+	if quotas, present := this.appQuotaMap[appid]; present {
+		if quota, present := quotas[topic]; present {
+			return quota, true
+		}
+	}
+
+	return manager.Quota{}, false
+}
+
+func (this *mysqlStore) AuthAdmin(principal, secret string) (manager.Role, error) {
+	if principal == "" {
+		return manager.RoleNone, manager.ErrEmptyParam
+	}
+
+	if admin, present := this.adminMap[principal]; present &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(admin.Secret)) == 1 {
+		return admin.Role, nil
+	}
+
+	return manager.RoleNone, manager.ErrAuthenticationFail
+}
+
+// Audit writes the record through the pooled connections of the last refresh.
+func (this *mysqlStore) Audit(record manager.AuditRecord) error {
+	this.dbLock.Lock()
+	db := this.db
+	this.dbLock.Unlock()
+	if db == nil {
+		dsn, err := this.zkzone.KatewayMysqlDsn()
+		if err != nil {
+			return err
+		}
+		if db, err = this.openDB(dsn); err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec("INSERT INTO admin_audit(Principal,Role,Method,Uri,RemoteAddr,Status,CreateTime) VALUES(?,?,?,?,?,?,?)",
+		record.Principal, record.Role.String(), record.Method, record.Uri,
+		record.RemoteAddr, record.Status, record.Ctime)
+	return err
+}
@@ -112,3 +112,64 @@ CREATE TABLE `user_role` (
   KEY `UserName` (`UserName`,`Role`,`ResourceType`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 
+
+DROP TABLE IF EXISTS `app_quota`;
+CREATE TABLE `app_quota` (
+  `AppId` bigint(18) NOT NULL,
+  `TopicName` varchar(64) NOT NULL DEFAULT '' COMMENT '主题名称，空表示整个应用',
+  `PubQps` bigint(20) NOT NULL DEFAULT '0' COMMENT '每秒发布消息数，0不限制',
+  `PubBps` bigint(20) NOT NULL DEFAULT '0' COMMENT '每秒发布字节数，0不限制',
+  `SubQps` bigint(20) NOT NULL DEFAULT '0' COMMENT '每秒消费消息数，0不限制',
+  `SubBps` bigint(20) NOT NULL DEFAULT '0' COMMENT '每秒消费字节数，0不限制',
+  `CreateById` bigint(18) NOT NULL DEFAULT '0',
+  `CreateBy` varchar(64) NOT NULL,
+  `CreateTime` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `Status` tinyint(2) NOT NULL DEFAULT '1' COMMENT '1有效|0无效',
+  PRIMARY KEY (`AppId`,`TopicName`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+DROP TABLE IF EXISTS `app_cert`;
+CREATE TABLE `app_cert` (
+  `AppId` bigint(18) NOT NULL,
+  `Identity` varchar(255) NOT NULL COMMENT '客户端证书的CN或SAN',
+  `CreateById` bigint(18) NOT NULL DEFAULT '0',
+  `CreateBy` varchar(64) NOT NULL,
+  `CreateTime` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `Status` tinyint(2) NOT NULL DEFAULT '1' COMMENT '1有效|0无效',
+  PRIMARY KEY (`Identity`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+DROP TABLE IF EXISTS `admin`;
+CREATE TABLE `admin` (
+  `Principal` varchar(64) NOT NULL,
+  `Secret` varchar(64) NOT NULL,
+  `Role` varchar(16) NOT NULL DEFAULT 'readonly' COMMENT 'readonly|topicadmin|superuser',
+  `CreateBy` varchar(64) NOT NULL,
+  `CreateTime` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `Status` tinyint(2) NOT NULL DEFAULT '1' COMMENT '1有效|0无效',
+  PRIMARY KEY (`Principal`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+DROP TABLE IF EXISTS `admin_audit`;
+CREATE TABLE `admin_audit` (
+  `Id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `Principal` varchar(64) NOT NULL,
+  `Role` varchar(16) NOT NULL,
+  `Method` varchar(8) NOT NULL,
+  `Uri` varchar(512) NOT NULL,
+  `RemoteAddr` varchar(64) NOT NULL DEFAULT '',
+  `Status` int(11) NOT NULL DEFAULT '0' COMMENT 'http status',
+  `CreateTime` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`Id`),
+  KEY `Principal` (`Principal`,`CreateTime`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+DROP TABLE IF EXISTS `token_key`;
+CREATE TABLE `token_key` (
+  `KeyId` varchar(32) NOT NULL,
+  `Secret` varchar(128) NOT NULL COMMENT '签发token的HMAC密钥',
+  `CreateBy` varchar(64) NOT NULL,
+  `CreateTime` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '最新的有效密钥签发',
+  `Status` tinyint(2) NOT NULL DEFAULT '1' COMMENT '1有效|0无效',
+  PRIMARY KEY (`KeyId`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,9 @@
+package manager
+
+// Quota is the throughput limit per second, 0 means unlimited.
+type Quota struct {
+	PubMsgs  int64
+	PubBytes int64
+	SubMsgs  int64
+	SubBytes int64
+}
@@ -0,0 +1,112 @@
+package manager
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Token is the claims of a short lived JWT(HS256) that a client uses in
+// place of its secret in the Pubkey/Subkey header.
+type Token struct {
+	Appid string   `json:"app"`
+	Pub   []string `json:"pub,omitempty"` // topics allowed to pub
+	Sub   []string `json:"sub,omitempty"` // topics allowed to sub
+	Iat   int64    `json:"iat"`
+	Exp   int64    `json:"exp"`
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+var tokenEncoding = base64.RawURLEncoding
+
+// IsToken tells whether a key is a token instead of a secret.
+func IsToken(key string) bool {
+	return strings.Count(key, ".") == 2
+}
+
+// SignToken signs the token with the signing key identified by kid.
+func SignToken(token Token, kid string, key []byte) (string, error) {
+	header, err := json.Marshal(tokenHeader{Alg: "HS256", Typ: "JWT", Kid: kid})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+
+	signing := tokenEncoding.EncodeToString(header) + "." + tokenEncoding.EncodeToString(claims)
+	return signing + "." + tokenEncoding.EncodeToString(tokenSignature(signing, key)), nil
+}
+
+// ParseToken verifies the signature and expiry of a token, keys returns the
+// signing key by kid.
+func ParseToken(raw string, keys func(kid string) ([]byte, bool), now time.Time) (*Token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	b, err := tokenEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var header tokenHeader
+	if err = json.Unmarshal(b, &header); err != nil || header.Alg != "HS256" {
+		return nil, ErrInvalidToken
+	}
+
+	key, present := keys(header.Kid)
+	if !present {
+		return nil, ErrInvalidToken
+	}
+	signature, err := tokenEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, tokenSignature(parts[0]+"."+parts[1], key)) {
+		return nil, ErrInvalidToken
+	}
+
+	b, err = tokenEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	token := &Token{}
+	if err = json.Unmarshal(b, token); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if now.Unix() >= token.Exp {
+		return nil, ErrTokenExpired
+	}
+
+	return token, nil
+}
+
+func tokenSignature(signing string, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signing))
+	return mac.Sum(nil)
+}
+
+func (this *Token) CanPub(topic string) bool {
+	return tokenScoped(this.Pub, topic)
+}
+
+func (this *Token) CanSub(topic string) bool {
+	return tokenScoped(this.Sub, topic)
+}
+
+func tokenScoped(topics []string, topic string) bool {
+	for _, t := range topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
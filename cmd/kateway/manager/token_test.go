@@ -0,0 +1,55 @@
+package manager
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/funkygao/assert"
+)
+
+func TestToken(t *testing.T) {
+	keys := func(kid string) ([]byte, bool) {
+		switch kid {
+		case "k1":
+			return []byte("secret1"), true
+		case "k2":
+			return []byte("secret2"), true
+		}
+		return nil, false
+	}
+
+	now := time.Now()
+	raw, err := SignToken(Token{Appid: "app1", Pub: []string{"orders"}, Exp: now.Add(time.Minute).Unix()},
+		"k1", []byte("secret1"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, IsToken(raw))
+	assert.Equal(t, false, IsToken("0b34cd2e1b7f4ac5a1b5e6cb5c1d29a0"))
+
+	token, err := ParseToken(raw, keys, now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "app1", token.Appid)
+	assert.Equal(t, true, token.CanPub("orders"))
+	assert.Equal(t, false, token.CanSub("orders"))
+
+	_, err = ParseToken(raw, keys, now.Add(time.Minute))
+	assert.Equal(t, ErrTokenExpired, err)
+
+	// signed by another key
+	parts := strings.Split(raw, ".")
+	forged, _ := SignToken(Token{Appid: "app1", Pub: []string{"orders"}, Exp: now.Add(time.Minute).Unix()},
+		"k1", []byte("secret2"))
+	_, err = ParseToken(forged, keys, now)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	// claims tampered
+	other, _ := SignToken(Token{Appid: "app2", Pub: []string{"orders"}, Exp: now.Add(time.Minute).Unix()},
+		"k1", []byte("secret1"))
+	_, err = ParseToken(parts[0]+"."+strings.Split(other, ".")[1]+"."+parts[2], keys, now)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	// unknown kid
+	raw, _ = SignToken(Token{Appid: "app1", Exp: now.Add(time.Minute).Unix()}, "k3", []byte("secret1"))
+	_, err = ParseToken(raw, keys, now)
+	assert.Equal(t, ErrInvalidToken, err)
+}
@@ -32,6 +32,7 @@ type serverMetrics struct {
 	ConcurrentPub   metrics.Counter
 	ConcurrentSub   metrics.Counter
 	ConcurrentSubWs metrics.Counter
+	ConcurrentPubWs metrics.Counter
 }
 
 func NewServerMetrics(interval time.Duration, gw *Gateway) *serverMetrics {
@@ -42,6 +43,7 @@ func NewServerMetrics(interval time.Duration, gw *Gateway) *serverMetrics {
 		ConcurrentPub:   metrics.NewRegisteredCounter("server.conns.pub", metrics.DefaultRegistry),
 		ConcurrentSub:   metrics.NewRegisteredCounter("server.conns.sub", metrics.DefaultRegistry),
 		ConcurrentSubWs: metrics.NewRegisteredCounter("server.conns.subws", metrics.DefaultRegistry),
+		ConcurrentPubWs: metrics.NewRegisteredCounter("server.conns.pubws", metrics.DefaultRegistry),
 	}
 
 	if options.DebugHttpAddr != "" {
@@ -97,6 +99,8 @@ type subMetrics struct {
 	consumeMapMu  sync.RWMutex
 	ConsumedMap   map[string]metrics.Counter // my msgs are consumed by others
 	consumedMapMu sync.RWMutex               // TODO who are consuming my msgs
+	QuotaMap      map[string]metrics.Counter // sub quota exceeded
+	quotaMapMu    sync.RWMutex
 }
 
 func NewSubMetrics(gw *Gateway) *subMetrics {
@@ -104,6 +108,7 @@ func NewSubMetrics(gw *Gateway) *subMetrics {
 		gw:          gw,
 		ConsumeMap:  make(map[string]metrics.Counter),
 		ConsumedMap: make(map[string]metrics.Counter),
+		QuotaMap:    make(map[string]metrics.Counter),
 	}
 
 	if options.DebugHttpAddr != "" {
@@ -169,6 +174,10 @@ func (this *subMetrics) ConsumedOk(appid, topic, ver string) {
 	updateCounter(appid, topic, ver, "subd.ok", 1, &this.consumedMapMu, this.ConsumedMap)
 }
 
+func (this *subMetrics) QuotaExceeded(appid, topic, ver string) {
+	updateCounter(appid, topic, ver, "sub.quota", 1, &this.quotaMapMu, this.QuotaMap)
+}
+
 type pubMetrics struct {
 	gw *Gateway
 
@@ -182,11 +191,15 @@ type pubMetrics struct {
 	pubOkMu    sync.RWMutex
 	PubFailMap map[string]metrics.Counter
 	pubFailMu  sync.RWMutex
+	QuotaMap   map[string]metrics.Counter // pub quota exceeded
+	quotaMu    sync.RWMutex
 
 	ClientError metrics.Counter
 	PubQps      metrics.Meter // FIXME if 2 servers run on 1 host, the metrics will be wrong
 	PubLatency  metrics.Histogram
 	PubMsgSize  metrics.Histogram
+
+	PubBatchSize metrics.Histogram
 }
 
 func NewPubMetrics(gw *Gateway) *pubMetrics {
@@ -194,11 +207,14 @@ func NewPubMetrics(gw *Gateway) *pubMetrics {
 		gw:         gw,
 		PubOkMap:   make(map[string]metrics.Counter),
 		PubFailMap: make(map[string]metrics.Counter),
+		QuotaMap:   make(map[string]metrics.Counter),
 
 		ClientError: metrics.NewRegisteredCounter("pub.clienterr", metrics.DefaultRegistry),
 		PubQps:      metrics.NewRegisteredMeter("pub.qps", metrics.DefaultRegistry),
 		PubMsgSize:  metrics.NewRegisteredHistogram("pub.msgsize", metrics.DefaultRegistry, metrics.NewExpDecaySample(1028, 0.015)),
 		PubLatency:  metrics.NewRegisteredHistogram("pub.latency", metrics.DefaultRegistry, metrics.NewExpDecaySample(1028, 0.015)),
+
+		PubBatchSize: metrics.NewRegisteredHistogram("pub.batchsize", metrics.DefaultRegistry, metrics.NewExpDecaySample(1028, 0.015)),
 	}
 
 	if options.DebugHttpAddr != "" {
@@ -268,3 +284,7 @@ func (this *pubMetrics) PubOk(appid, topic, ver string) {
 	}
 	updateCounter(appid, topic, ver, "pub.ok", 1, &this.pubOkMu, this.PubOkMap)
 }
+
+func (this *pubMetrics) QuotaExceeded(appid, topic, ver string) {
+	updateCounter(appid, topic, ver, "pub.quota", 1, &this.quotaMu, this.QuotaMap)
+}
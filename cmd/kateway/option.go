@@ -26,28 +26,52 @@ var (
 		PidFile                string
 		CertFile               string
 		KeyFile                string
+		ClientCAFile           string
+		CrlFile                string
 		LogFile                string
 		LogLevel               string
 		CrashLogFile           string
 		InfluxServer           string
 		InfluxDbName           string
 		KillFile               string
+		Plugins                string
+		Keystore               string
+		OffsetStore            string
+		KafkaOffsets           string
+		WebhookAllow           string
 		ShowVersion            bool
-		Ratelimit              bool
 		DisableMetrics         bool
 		DryRun                 bool
+		DelayedPub             bool
+		RequireClientCert      bool
+		StatelessSub           bool
 		CpuAffinity            bool
 		EnableClientStats      bool
 		GolangTrace            bool
 		Debug                  bool
 		HttpHeaderMaxBytes     int
 		MaxPubSize             int64
+		MaxPubBatchSize        int64
+		MaxPubBatch            int
 		MinPubSize             int
 		MaxPubRetries          int
+		MaxSubInflight         int
+		MaxDeliveries          int
 		MaxClients             int
+		IdempotencyWindow      int
 		PubPoolCapcity         int
 		PubPoolIdleTimeout     time.Duration
 		SubTimeout             time.Duration
+		SubVisibilityTimeout   time.Duration
+		SubLeaseTTL            time.Duration
+		WebhookTimeout         time.Duration
+		QuotaSyncInterval      time.Duration
+		IdempotencyTTL         time.Duration
+		DataKeyTTL             time.Duration
+		CrlRefresh             time.Duration
+		MaxTokenTTL            time.Duration
+		SignatureSkew          time.Duration
+		MaxPubDelay            time.Duration
 		OffsetCommitInterval   time.Duration
 		ReporterInterval       time.Duration
 		ConsoleMetricsInterval time.Duration
@@ -87,6 +111,8 @@ func parseFlags() {
 	flag.StringVar(&options.CertFile, "certfile", "", "cert file path")
 	flag.StringVar(&options.PidFile, "pid", "", "pid file")
 	flag.StringVar(&options.KeyFile, "keyfile", "", "key file path")
+	flag.StringVar(&options.ClientCAFile, "clientca", "", "CA file to verify the client certificates of pub/sub https, empty means mTLS disabled")
+	flag.StringVar(&options.CrlFile, "crl", "", "CRL file of the revoked client certificates, reloaded on change")
 	flag.StringVar(&options.DebugHttpAddr, "debughttp", "", "debug http bind addr")
 	flag.StringVar(&options.Store, "store", "kafka", "backend store")
 	flag.StringVar(&options.ManagerStore, "mstore", "mysql", "store integration with manager")
@@ -94,24 +120,47 @@ func parseFlags() {
 	flag.StringVar(&options.KillFile, "kill", "", "kill running kateway by pid file")
 	flag.StringVar(&options.InfluxServer, "influxdbaddr", "http://10.77.144.193:10036", "influxdb server address for the metrics reporter")
 	flag.StringVar(&options.InfluxDbName, "influxdbname", "pubsub", "influxdb db name")
+	flag.StringVar(&options.Plugins, "plugins", "metrics", "comma separated default plugins in order, after the auth plugin")
+	flag.StringVar(&options.Keystore, "keystore", "", "master keys file of payload encryption, empty means encryption disabled")
+	flag.StringVar(&options.OffsetStore, "offsetstore", "zk", "offset store of stateless sub: <zk|kafka>")
+	flag.StringVar(&options.KafkaOffsets, "kafkaoffsets", "", "comma separated clusters whose consumer groups are managed by kafka group coordinator instead of zk")
 	flag.BoolVar(&options.ShowVersion, "version", false, "show version and exit")
 	flag.BoolVar(&options.Debug, "debug", false, "enable debug mode")
 	flag.BoolVar(&options.GolangTrace, "gotrace", false, "go tool trace")
 	flag.BoolVar(&options.EnableClientStats, "clientsmap", false, "record online pub/sub clients")
 	flag.BoolVar(&options.DryRun, "dryrun", false, "dry run mode")
+	flag.BoolVar(&options.DelayedPub, "delayed", false, "enable delayed pub and run the delay scheduler")
+	flag.BoolVar(&options.RequireClientCert, "clientcertrequired", false, "reject pub/sub https clients without certificate")
+	flag.BoolVar(&options.StatelessSub, "statelesssub", false, "any kateway serves any sub request by partition leases, no sticky session needed")
 	flag.BoolVar(&options.CpuAffinity, "cpuaffinity", false, "enable cpu affinity")
-	flag.BoolVar(&options.Ratelimit, "raltelimit", false, "enable rate limit")
+	flag.Bool("raltelimit", false, "deprecated and ignored, the pub quota of each appid limits the rate")
 	flag.BoolVar(&options.DisableMetrics, "metricsoff", false, "disable metrics reporter")
 	flag.IntVar(&options.HttpHeaderMaxBytes, "maxheader", 4<<10, "http header max size in bytes")
 	flag.Int64Var(&options.MaxPubSize, "maxpub", 1<<20, "max Pub message size")
 	flag.IntVar(&options.MinPubSize, "minpub", 1, "min Pub message size")
+	flag.Int64Var(&options.MaxPubBatchSize, "maxbatchsize", 4<<20, "max batch Pub request body size in bytes")
+	flag.IntVar(&options.MaxPubBatch, "maxbatch", 100, "max messages in a batch Pub")
 	flag.IntVar(&options.MaxPubRetries, "pubretry", 5, "max retries when Pub fails")
+	flag.IntVar(&options.MaxSubInflight, "maxinflight", 1000, "max unacked messages of a sub client with autocommit=0")
+	flag.IntVar(&options.MaxDeliveries, "maxdelivery", 0, "default max failed deliveries of a message before moved to dead letter topic, 0 means never")
 	flag.IntVar(&options.PubPoolCapcity, "pubpool", 100, "pub connection pool capacity")
 	flag.IntVar(&options.MaxClients, "maxclient", 100000, "max concurrent connections")
-	flag.DurationVar(&options.OffsetCommitInterval, "offsetcommit", time.Minute, "consumer offset commit interval")
+	flag.DurationVar(&options.OffsetCommitInterval, "offsetcommit", time.Minute, "flush interval of the consumer offsets not flushed by the commit policy")
 	flag.DurationVar(&options.HttpReadTimeout, "httprtimeout", time.Minute*5, "http server read timeout")
 	flag.DurationVar(&options.HttpWriteTimeout, "httpwtimeout", time.Minute, "http server write timeout")
+	flag.DurationVar(&options.MaxPubDelay, "maxdelay", time.Hour*24, "max delay of a delayed pub message")
 	flag.DurationVar(&options.SubTimeout, "subtimeout", time.Second*30, "sub timeout before send http 204")
+	flag.DurationVar(&options.SubVisibilityTimeout, "visibility", time.Minute, "unacked message is redelivered after this timeout with autocommit=0")
+	flag.DurationVar(&options.SubLeaseTTL, "sublease", time.Second*30, "partition lease ttl of stateless sub, a crashed kateway blocks its partitions for at most this long")
+	flag.DurationVar(&options.WebhookTimeout, "webhooktimeout", time.Second*10, "timeout of each webhook push")
+	flag.StringVar(&options.WebhookAllow, "webhookallow", "", "comma separated CIDRs of the internal networks webhook endpoints may reach")
+	flag.DurationVar(&options.QuotaSyncInterval, "quotasync", time.Second*5, "share quota usage with other kateway instances interval, 0 means quota is per instance")
+	flag.IntVar(&options.IdempotencyWindow, "idemwindow", 100000, "max idempotency keys remembered of each topic")
+	flag.DurationVar(&options.IdempotencyTTL, "idemttl", time.Minute*10, "how long an idempotency key is remembered")
+	flag.DurationVar(&options.DataKeyTTL, "datakeyttl", time.Hour, "how long a data key of payload encryption is used for a topic")
+	flag.DurationVar(&options.CrlRefresh, "crlrefresh", time.Second*30, "check CRL file change interval")
+	flag.DurationVar(&options.MaxTokenTTL, "maxtokenttl", time.Hour, "max ttl of a minted client token")
+	flag.DurationVar(&options.SignatureSkew, "signskew", time.Minute*5, "max clock skew of a signed request, the nonces are remembered for this window, each signed request creates a znode synchronously")
 	flag.DurationVar(&options.ReporterInterval, "report", time.Second*10, "reporter flush interval")
 	flag.DurationVar(&options.MetaRefresh, "metarefresh", time.Minute*10, "meta data refresh interval")
 	flag.DurationVar(&options.ManagerRefresh, "manrefresh", time.Minute*5, "manager integration refresh interval")
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/funkygao/gafka/cmd/kateway/meta"
+	log "github.com/funkygao/log4go"
+)
+
+// PluginRequest is the pub/sub request a plugin hooks into.
+type PluginRequest struct {
+	Sub        bool
+	Appid      string // the client
+	Key        string // pubkey or subkey
+	TopicAppid string // owner of the topic, same as Appid for pub
+	Topic      string
+	Ver        string
+	Group      string // sub only
+	RemoteAddr string
+	Start      time.Time
+
+	// Cert is the verified client certificate of mTLS, nil if none.
+	Cert *x509.Certificate
+
+	// Signature is the signature of a signed request, nil if not signed.
+	Signature *RequestSignature
+}
+
+func newPubPluginRequest(appid, pubkey, topic, ver, remoteAddr string,
+	start time.Time) *PluginRequest {
+	return &PluginRequest{
+		Appid:      appid,
+		Key:        pubkey,
+		TopicAppid: appid,
+		Topic:      topic,
+		Ver:        ver,
+		RemoteAddr: remoteAddr,
+		Start:      start,
+	}
+}
+
+func newSubPluginRequest(myAppid, subkey, hisAppid, topic, ver, group,
+	remoteAddr string) *PluginRequest {
+	return &PluginRequest{
+		Sub:        true,
+		Appid:      myAppid,
+		Key:        subkey,
+		TopicAppid: hisAppid,
+		Topic:      topic,
+		Ver:        ver,
+		Group:      group,
+		RemoteAddr: remoteAddr,
+		Start:      time.Now(),
+	}
+}
+
+// WithRequest sets the client certificate and the signature of the request.
+func (this *PluginRequest) WithRequest(r *http.Request) *PluginRequest {
+	this.Cert = peerCert(r.TLS)
+	this.Signature = parseRequestSignature(this.Appid, r)
+	return this
+}
+
+func (this *PluginRequest) rawTopic() string {
+	return meta.KafkaTopic(this.TopicAppid, this.Topic, this.Ver)
+}
+
+// PluginMessage is a pub/sub message that the plugins can mutate.
+type PluginMessage struct {
+	Key       []byte
+	Body      []byte
+	Attrs     map[string]string
+	Partition int32 // after pub, or of the delivering message
+	Offset    int64
+}
+
+// Plugin hooks into the pub/sub flow. The Pre hooks can mutate or enrich
+// the message, or reject it by returning an error.
+//
+// The Pre hooks are first called with nil msg for the request as a whole,
+// before any message is read or fetched, then for each message. A rejected
+// request gets the http status of PluginError, 400 for other errors; a
+// rejected pub message is not published, and a rejected delivering message
+// is committed without being delivered.
+type Plugin interface {
+	PrePub(req *PluginRequest, msg *PluginMessage) error
+	PostPub(req *PluginRequest, msg *PluginMessage, err error)
+	PreDeliver(req *PluginRequest, msg *PluginMessage) error
+	PostDeliver(req *PluginRequest, msg *PluginMessage, err error)
+}
+
+// NopPlugin can be embedded by the plugins that implement only some hooks.
+type NopPlugin struct{}
+
+func (NopPlugin) PrePub(req *PluginRequest, msg *PluginMessage) error           { return nil }
+func (NopPlugin) PostPub(req *PluginRequest, msg *PluginMessage, err error)     {}
+func (NopPlugin) PreDeliver(req *PluginRequest, msg *PluginMessage) error       { return nil }
+func (NopPlugin) PostDeliver(req *PluginRequest, msg *PluginMessage, err error) {}
+
+// PluginError rejects a request with the http status.
+type PluginError struct {
+	Status int
+	Err    error
+}
+
+func (this *PluginError) Error() string {
+	return this.Err.Error()
+}
+
+var pluginFactories = make(map[string]func(gw *Gateway) Plugin)
+
+// RegisterPlugin makes a plugin available by name, it should be called in
+// init of the plugin.
+func RegisterPlugin(name string, factory func(gw *Gateway) Plugin) {
+	if _, present := pluginFactories[name]; present {
+		panic("plugin registered twice: " + name)
+	}
+
+	pluginFactories[name] = factory
+}
+
+// authPluginName is the plugin that always heads the chain, it can't be left
+// out of the default plugins.
+const authPluginName = "auth"
+
+// plugins holds the plugin chains: the auth plugin and the default plugins
+// apply to all the requests, followed by the plugins enabled in zk for the
+// client appid and then for the topic.
+type plugins struct {
+	gw *Gateway
+
+	instances map[string]Plugin
+	defaults  []Plugin
+
+	mu      sync.RWMutex
+	enabled map[string][]Plugin // key is appid or appid.topic.ver
+}
+
+func newPlugins(gw *Gateway, defaults string) *plugins {
+	this := &plugins{
+		gw:        gw,
+		instances: make(map[string]Plugin, len(pluginFactories)),
+		enabled:   make(map[string][]Plugin),
+	}
+	for name, factory := range pluginFactories {
+		this.instances[name] = factory(gw)
+	}
+
+	auth, present := this.instances[authPluginName]
+	if !present {
+		panic("auth plugin not registered")
+	}
+	this.defaults = append(this.defaults, auth)
+
+	for _, name := range parsePluginNames(defaults) {
+		if name == authPluginName {
+			// already the head of chain
+			continue
+		}
+
+		p, present := this.instances[name]
+		if !present {
+			panic("unknown plugin: " + name)
+		}
+
+		this.defaults = append(this.defaults, p)
+	}
+
+	return this
+}
+
+func parsePluginNames(s string) []string {
+	return splitNames(s)
+}
+
+func (this *plugins) Start() {
+	this.refresh()
+
+	this.gw.wg.Add(1)
+	go func() {
+		defer this.gw.wg.Done()
+
+		ticker := time.NewTicker(options.ManagerRefresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				this.refresh()
+
+			case <-this.gw.shutdownCh:
+				log.Trace("plugins stopped")
+				return
+			}
+		}
+	}()
+}
+
+func (this *plugins) refresh() {
+	enabled := make(map[string][]Plugin)
+	for target, names := range this.gw.GetZkZone().KatewayPlugins() {
+		for _, name := range parsePluginNames(names) {
+			p, present := this.instances[name]
+			if !present {
+				log.Error("plugins[%s] unknown plugin: %s", target, name)
+				continue
+			}
+
+			enabled[target] = append(enabled[target], p)
+		}
+	}
+
+	this.mu.Lock()
+	this.enabled = enabled
+	this.mu.Unlock()
+}
+
+// Names returns the sorted registered plugin names.
+func (this *plugins) Names() []string {
+	names := make([]string, 0, len(this.instances))
+	for name := range this.instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Enable saves the plugins of an appid or an appid.topic.ver in zk, which
+// take effect on all kateway instances after their next refresh.
+func (this *plugins) Enable(target, names string) error {
+	list := parsePluginNames(names)
+	for _, name := range list {
+		if _, present := this.instances[name]; !present {
+			return ErrUnknownPlugin
+		}
+	}
+
+	if err := this.gw.GetZkZone().SetKatewayPlugins(target, strings.Join(list, ",")); err != nil {
+		return err
+	}
+
+	this.refresh()
+	return nil
+}
+
+// Chain returns the plugin chain of a request.
+func (this *plugins) Chain(req *PluginRequest) *pluginChain {
+	this.mu.RLock()
+	byApp, byTopic := this.enabled[req.Appid], this.enabled[req.rawTopic()]
+	this.mu.RUnlock()
+
+	chain := &pluginChain{req: req, plugins: this.defaults}
+	if len(byApp) == 0 && len(byTopic) == 0 {
+		return chain
+	}
+
+	chain.plugins = make([]Plugin, 0, len(this.defaults)+len(byApp)+len(byTopic))
+	seen := make(map[Plugin]bool)
+	for _, list := range [][]Plugin{this.defaults, byApp, byTopic} {
+		for _, p := range list {
+			if !seen[p] {
+				seen[p] = true
+				chain.plugins = append(chain.plugins, p)
+			}
+		}
+	}
+
+	return chain
+}
+
+// pluginChain calls the hooks of the plugins in order, and the first
+// rejection stops the chain.
+type pluginChain struct {
+	req     *PluginRequest
+	plugins []Plugin
+}
+
+func (this *pluginChain) PrePub(msg *PluginMessage) error {
+	for _, p := range this.plugins {
+		if err := p.PrePub(this.req, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *pluginChain) PostPub(msg *PluginMessage, err error) {
+	for _, p := range this.plugins {
+		p.PostPub(this.req, msg, err)
+	}
+}
+
+func (this *pluginChain) PreDeliver(msg *PluginMessage) error {
+	for _, p := range this.plugins {
+		if err := p.PreDeliver(this.req, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *pluginChain) PostDeliver(msg *PluginMessage, err error) {
+	for _, p := range this.plugins {
+		p.PostDeliver(this.req, msg, err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/funkygao/gafka/cmd/kateway/manager"
+)
+
+func init() {
+	RegisterPlugin(authPluginName, func(gw *Gateway) Plugin { return &authPlugin{gw: gw} })
+}
+
+// authPlugin authenticates and authorizes the pub/sub requests against the
+// manager store, by the client certificate if any, else by the signature if
+// signed, else by the key.
+type authPlugin struct {
+	NopPlugin
+
+	gw *Gateway
+}
+
+func (this *authPlugin) PrePub(req *PluginRequest, msg *PluginMessage) error {
+	if msg != nil {
+		return nil
+	}
+
+	var err error
+	if req.Cert != nil {
+		if err = this.revoked(req); err == nil {
+			err = manager.Default.AuthPubByCert(req.Appid, certIdentities(req.Cert), req.Topic)
+		}
+	} else if req.Signature != nil {
+		err = this.signed(req, manager.Default.AuthPubBySignature)
+	} else {
+		err = manager.Default.AuthPub(req.Appid, req.Key, req.Topic)
+	}
+	if err != nil {
+		return &PluginError{Status: http.StatusUnauthorized, Err: err}
+	}
+	return nil
+}
+
+func (this *authPlugin) PreDeliver(req *PluginRequest, msg *PluginMessage) error {
+	if msg != nil {
+		return nil
+	}
+
+	var err error
+	if req.Cert != nil {
+		if err = this.revoked(req); err == nil {
+			err = manager.Default.AuthSubByCert(req.Appid, certIdentities(req.Cert), req.Topic)
+		}
+	} else if req.Signature != nil {
+		err = this.signed(req, manager.Default.AuthSubBySignature)
+	} else {
+		err = manager.Default.AuthSub(req.Appid, req.Key, req.Topic)
+	}
+	if err != nil {
+		return &PluginError{Status: http.StatusUnauthorized, Err: err}
+	}
+	return nil
+}
+
+// revoked checks the client certificate against the latest CRL, because the
+// connection might be established before the certificate is revoked.
+func (this *authPlugin) revoked(req *PluginRequest) error {
+	if this.gw.clientCerts != nil && this.gw.clientCerts.Revoked(req.Cert) {
+		return ErrCertRevoked
+	}
+	return nil
+}
+
+// signed authenticates a signed request by auth, and refuses its replay.
+func (this *authPlugin) signed(req *PluginRequest,
+	auth func(appid, stringToSign, signature, topic string) error) error {
+	now := time.Now()
+	if !req.Signature.checked {
+		if err := this.gw.signatures.Fresh(req.Signature, now); err != nil {
+			return err
+		}
+	}
+
+	if err := auth(req.Appid, req.Signature.StringToSign, req.Signature.Signature, req.Topic); err != nil {
+		return err
+	}
+
+	if req.Signature.checked {
+		// another subscription over the same connection
+		return nil
+	}
+
+	if err := this.gw.signatures.Once(req.Appid, req.Signature, now); err != nil {
+		return err
+	}
+	req.Signature.checked = true
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"time"
+)
+
+func init() {
+	RegisterPlugin("metrics", func(gw *Gateway) Plugin { return &metricsPlugin{gw: gw} })
+}
+
+// metricsPlugin counts the pub/sub messages and the pub latency.
+type metricsPlugin struct {
+	NopPlugin
+
+	gw *Gateway
+}
+
+func (this *metricsPlugin) PrePub(req *PluginRequest, msg *PluginMessage) error {
+	if msg == nil || options.DisableMetrics {
+		return nil
+	}
+
+	this.gw.pubMetrics.PubQps.Mark(1)
+	this.gw.pubMetrics.PubMsgSize.Update(int64(len(msg.Body)))
+	return nil
+}
+
+func (this *metricsPlugin) PostPub(req *PluginRequest, msg *PluginMessage, err error) {
+	if options.DisableMetrics {
+		return
+	}
+
+	if err != nil {
+		this.gw.pubMetrics.PubFail(req.Appid, req.Topic, req.Ver)
+		return
+	}
+
+	this.gw.pubMetrics.PubOk(req.Appid, req.Topic, req.Ver)
+	this.gw.pubMetrics.PubLatency.Update(time.Since(req.Start).Nanoseconds() / 1e6) // in ms
+}
+
+func (this *metricsPlugin) PostDeliver(req *PluginRequest, msg *PluginMessage, err error) {
+	if err != nil || options.DisableMetrics {
+		return
+	}
+
+	this.gw.subMetrics.ConsumeOk(req.Appid, req.Topic, req.Ver)
+	this.gw.subMetrics.ConsumedOk(req.TopicAppid, req.Topic, req.Ver)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/funkygao/assert"
+)
+
+type tracePlugin struct {
+	NopPlugin
+
+	name   string
+	trace  *[]string
+	reject bool
+}
+
+func (this *tracePlugin) PrePub(req *PluginRequest, msg *PluginMessage) error {
+	*this.trace = append(*this.trace, this.name)
+	if this.reject {
+		return errors.New(this.name)
+	}
+
+	msg.Body = append(msg.Body, this.name...)
+	return nil
+}
+
+func TestParsePluginNames(t *testing.T) {
+	assert.Equal(t, []string{"auth", "metrics"}, parsePluginNames(" auth, ,metrics,"))
+	assert.Equal(t, 0, len(parsePluginNames("")))
+}
+
+func TestNewPluginsAuthFirst(t *testing.T) {
+	for _, defaults := range []string{"", "metrics", "metrics,auth"} {
+		p := newPlugins(nil, defaults)
+		assert.Equal(t, p.instances[authPluginName], p.defaults[0])
+		assert.Equal(t, len(parsePluginNames(defaults)) > 0, len(p.defaults) == 2)
+	}
+}
+
+func TestPluginChain(t *testing.T) {
+	var trace []string
+	a := &tracePlugin{name: "a", trace: &trace}
+	b := &tracePlugin{name: "b", trace: &trace}
+	c := &tracePlugin{name: "c", trace: &trace}
+	d := &tracePlugin{name: "d", trace: &trace, reject: true}
+	p := &plugins{
+		defaults: []Plugin{a, b},
+		enabled: map[string][]Plugin{
+			"app1":           {c, a},
+			"app1.orders.v1": {b, d},
+		},
+	}
+
+	chain := p.Chain(newPubPluginRequest("app2", "", "orders", "v1", "", time.Now()))
+	msg := &PluginMessage{}
+	assert.Equal(t, nil, chain.PrePub(msg))
+	assert.Equal(t, "ab", string(msg.Body))
+
+	chain = p.Chain(newPubPluginRequest("app1", "", "pays", "v1", "", time.Now()))
+	msg = &PluginMessage{}
+	assert.Equal(t, nil, chain.PrePub(msg))
+	assert.Equal(t, "abc", string(msg.Body))
+
+	// the topic plugins follow the appid plugins, and the rejection stops the chain
+	trace = nil
+	chain = p.Chain(newPubPluginRequest("app1", "", "orders", "v1", "", time.Now()))
+	msg = &PluginMessage{}
+	assert.Equal(t, "d", chain.PrePub(msg).Error())
+	assert.Equal(t, "a,b,c,d", strings.Join(trace, ","))
+	assert.Equal(t, "abc", string(msg.Body))
+}
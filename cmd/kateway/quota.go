@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/funkygao/gafka/cmd/kateway/manager"
+	log "github.com/funkygao/log4go"
+)
+
+// quotaBucket is a token bucket refilled every second with the quota, and
+// it can go into debt: a message larger than the quota still passes, but the
+// following ones will wait until the debt is paid.
+type quotaBucket struct {
+	rate   int64 // quota of the whole kateway fleet
+	tokens float64
+	last   time.Time
+	used   float64 // consumed since last sync
+}
+
+func (this *quotaBucket) refill(rate float64, now time.Time) {
+	if this.last.IsZero() {
+		this.tokens = rate
+	} else {
+		this.tokens += now.Sub(this.last).Seconds() * rate
+		if this.tokens > rate {
+			// burst at most 1s
+			this.tokens = rate
+		}
+	}
+	this.last = now
+}
+
+// wait returns how long it takes to get any token, 0 if available now.
+func (this *quotaBucket) wait(rate float64) time.Duration {
+	if this.tokens > 0 {
+		return 0
+	}
+
+	return time.Duration((1 - this.tokens) / rate * float64(time.Second))
+}
+
+// quotaCoordinator shares the quota usage among the kateway instances, so
+// that a quota holds for the whole fleet instead of each instance.
+type quotaCoordinator interface {
+	// Sync reports the usage of this instance and returns the usage of all
+	// the live instances including this one: {instance id: {key: usage/sec}}.
+	Sync(usage map[string]float64) (map[string]map[string]float64, error)
+}
+
+// zkQuotaCoordinator shares the quota usage through the ephemeral znodes of
+// the registered kateway instances.
+type zkQuotaCoordinator struct {
+	gw *Gateway
+}
+
+func (this *zkQuotaCoordinator) Sync(usage map[string]float64) (map[string]map[string]float64, error) {
+	b, _ := json.Marshal(usage)
+	if err := this.gw.GetZkZone().FlushKatewayQuotaUsage(this.gw.id, b); err != nil {
+		return nil, err
+	}
+
+	all := make(map[string]map[string]float64)
+	for id, data := range this.gw.GetZkZone().KatewayQuotaUsages() {
+		var u map[string]float64
+		if err := json.Unmarshal(data, &u); err != nil {
+			log.Error("quota usage of kateway[%s]: %v", id, err)
+			continue
+		}
+
+		all[id] = u
+	}
+	all[this.gw.id] = usage
+
+	return all, nil
+}
+
+// fairShare returns the share of a quota for the instance whose usage is
+// mine. Each instance is weighted by its usage plus an equal part of the
+// quota, so the shares add up to 1, the busy instances get more and an idle
+// or new instance still gets some.
+func fairShare(rate int64, key string, mine float64, all map[string]map[string]float64) float64 {
+	if len(all) <= 1 {
+		return 1
+	}
+
+	var total float64
+	for _, usage := range all {
+		total += usage[key]
+	}
+
+	return (mine + float64(rate)/float64(len(all))) / (total + float64(rate))
+}
+
+// quotas enforces the per appid and per topic msgs/sec and bytes/sec quotas
+// defined in the manager store.
+//
+// With a coordinator, each instance gets its fair share of the quotas
+// recalculated every sync interval, so the quotas hold for the whole fleet
+// within the error of 1 sync interval when instances join or leave.
+type quotas struct {
+	gw          *Gateway
+	coordinator quotaCoordinator
+
+	mu       sync.Mutex
+	buckets  map[string]*quotaBucket
+	shares   map[string]float64 // share of the quota for this instance
+	peers    int                // live instances at last sync
+	lastSync time.Time
+}
+
+func newQuotas(gw *Gateway, coordinator quotaCoordinator) *quotas {
+	return &quotas{
+		gw:          gw,
+		coordinator: coordinator,
+		buckets:     make(map[string]*quotaBucket),
+		shares:      make(map[string]float64),
+		lastSync:    time.Now(),
+	}
+}
+
+func (this *quotas) Start() {
+	this.sync(time.Now())
+
+	this.gw.wg.Add(1)
+	go func() {
+		defer this.gw.wg.Done()
+
+		ticker := time.NewTicker(options.QuotaSyncInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				this.sync(now)
+
+			case <-this.gw.shutdownCh:
+				log.Trace("quota coordinator stopped")
+				return
+			}
+		}
+	}()
+}
+
+// sync reports the usage since last sync and recalculates the shares.
+func (this *quotas) sync(now time.Time) {
+	this.mu.Lock()
+	elapsed := now.Sub(this.lastSync).Seconds()
+	usage := make(map[string]float64, len(this.buckets))
+	rates := make(map[string]int64, len(this.buckets))
+	for key, b := range this.buckets {
+		if elapsed > 0 {
+			usage[key] = b.used / elapsed
+		}
+		b.used = 0
+		rates[key] = b.rate
+	}
+	this.lastSync = now
+	this.mu.Unlock()
+
+	all, err := this.coordinator.Sync(usage)
+	if err != nil {
+		// keep the last shares
+		log.Error("quota sync: %v", err)
+		return
+	}
+
+	shares := make(map[string]float64, len(rates))
+	for key, rate := range rates {
+		shares[key] = fairShare(rate, key, usage[key], all)
+	}
+
+	this.mu.Lock()
+	this.shares = shares
+	this.peers = len(all)
+	this.mu.Unlock()
+}
+
+type quotaLimit struct {
+	key   string // bucket key
+	rate  int64
+	bytes bool // bytes/sec or msgs/sec
+}
+
+// limits returns the quota limits that apply to pub/sub the topic.
+func (this *quotas) limits(sub bool, appid, topic string) (limits []quotaLimit) {
+	dir := "pub"
+	if sub {
+		dir = "sub"
+	}
+
+	// the appid as a whole, then the topic
+	for _, t := range []string{"", topic} {
+		quota, found := manager.Default.LookupQuota(appid, t)
+		if !found {
+			continue
+		}
+
+		msgs, bytes := quota.PubMsgs, quota.PubBytes
+		if sub {
+			msgs, bytes = quota.SubMsgs, quota.SubBytes
+		}
+		prefix := dir + "/" + appid + "/" + t
+		if msgs > 0 {
+			limits = append(limits, quotaLimit{key: prefix + "/msgs", rate: msgs})
+		}
+		if bytes > 0 {
+			limits = append(limits, quotaLimit{key: prefix + "/bytes", rate: bytes, bytes: true})
+		}
+	}
+
+	return
+}
+
+// rate returns the quota of this instance.
+func (this *quotas) rate(l quotaLimit) float64 {
+	if share, present := this.shares[l.key]; present {
+		return float64(l.rate) * share
+	}
+
+	if this.peers > 1 {
+		// not synced yet
+		return float64(l.rate) / float64(this.peers)
+	}
+
+	return float64(l.rate)
+}
+
+func (this *quotas) bucket(l quotaLimit, now time.Time) (*quotaBucket, float64) {
+	b, present := this.buckets[l.key]
+	if !present {
+		b = &quotaBucket{}
+		this.buckets[l.key] = b
+	}
+
+	b.rate = l.rate
+	rate := this.rate(l)
+	b.refill(rate, now)
+	return b, rate
+}
+
+// Wait returns how long the appid must wait before it can pub/sub the
+// topic, 0 if within quota.
+func (this *quotas) Wait(sub bool, appid, topic string, now time.Time) (d time.Duration) {
+	limits := this.limits(sub, appid, topic)
+	if len(limits) == 0 {
+		return
+	}
+
+	this.mu.Lock()
+	for _, l := range limits {
+		b, rate := this.bucket(l, now)
+		if w := b.wait(rate); w > d {
+			d = w
+		}
+	}
+	this.mu.Unlock()
+
+	return
+}
+
+// Take charges the quota with the messages to pub if within quota, else
+// returns how long to wait without charging. The check and the charge are
+// atomic, so the concurrent requests never overshoot the quota.
+func (this *quotas) Take(sub bool, appid, topic string, msgs, bytes int64, now time.Time) (d time.Duration) {
+	limits := this.limits(sub, appid, topic)
+	if len(limits) == 0 {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, l := range limits {
+		b, rate := this.bucket(l, now)
+		if w := b.wait(rate); w > d {
+			d = w
+		}
+	}
+	if d == 0 {
+		this.charge(limits, float64(msgs), float64(bytes), now)
+	}
+
+	return
+}
+
+// Refund gives back the quota taken by the messages that failed to pub.
+func (this *quotas) Refund(sub bool, appid, topic string, msgs, bytes int64, now time.Time) {
+	if msgs == 0 && bytes == 0 {
+		return
+	}
+
+	limits := this.limits(sub, appid, topic)
+	if len(limits) == 0 {
+		return
+	}
+
+	this.mu.Lock()
+	this.charge(limits, -float64(msgs), -float64(bytes), now)
+	this.mu.Unlock()
+}
+
+// Consume charges the quota with the messages that are pub/sub.
+func (this *quotas) Consume(sub bool, appid, topic string, msgs, bytes int64, now time.Time) {
+	limits := this.limits(sub, appid, topic)
+	if len(limits) == 0 {
+		return
+	}
+
+	this.mu.Lock()
+	this.charge(limits, float64(msgs), float64(bytes), now)
+	this.mu.Unlock()
+}
+
+// charge must hold mu.
+func (this *quotas) charge(limits []quotaLimit, msgs, bytes float64, now time.Time) {
+	for _, l := range limits {
+		b, _ := this.bucket(l, now)
+		n := msgs
+		if l.bytes {
+			n = bytes
+		}
+
+		b.tokens -= n
+		b.used += n
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/funkygao/assert"
+	"github.com/funkygao/gafka/cmd/kateway/manager"
+	"github.com/funkygao/gafka/cmd/kateway/manager/dummy"
+)
+
+type quotaManager struct {
+	manager.Manager
+
+	quotas map[string]manager.Quota // key is appid/topic
+}
+
+func (this *quotaManager) LookupQuota(appid, topic string) (manager.Quota, bool) {
+	q, present := this.quotas[appid+"/"+topic]
+	return q, present
+}
+
+type fleetCoordinator struct {
+	others map[string]map[string]float64
+}
+
+func (this *fleetCoordinator) Sync(usage map[string]float64) (map[string]map[string]float64, error) {
+	all := map[string]map[string]float64{"me": usage}
+	for id, u := range this.others {
+		all[id] = u
+	}
+	return all, nil
+}
+
+func TestQuotaBucket(t *testing.T) {
+	now := time.Now()
+	b := &quotaBucket{}
+	b.refill(10, now)
+	assert.Equal(t, float64(10), b.tokens)
+	assert.Equal(t, time.Duration(0), b.wait(10))
+
+	// debt
+	b.tokens -= 20
+	assert.Equal(t, time.Duration(1100)*time.Millisecond, b.wait(10))
+	b.refill(10, now.Add(time.Second))
+	assert.Equal(t, float64(0), b.tokens)
+	assert.Equal(t, time.Duration(100)*time.Millisecond, b.wait(10))
+
+	// burst at most 1s
+	b.refill(10, now.Add(time.Minute))
+	assert.Equal(t, float64(10), b.tokens)
+}
+
+func TestQuotasWaitAndConsume(t *testing.T) {
+	defer func(m manager.Manager) { manager.Default = m }(manager.Default)
+	manager.Default = &quotaManager{
+		Manager: dummy.New(),
+		quotas: map[string]manager.Quota{
+			"app1/":    {PubMsgs: 100},
+			"app1/foo": {PubMsgs: 1000, PubBytes: 10},
+			"app2/":    {SubMsgs: 2},
+		},
+	}
+
+	now := time.Now()
+	q := newQuotas(nil, nil)
+	assert.Equal(t, time.Duration(0), q.Wait(false, "app1", "foo", now))
+	q.Consume(false, "app1", "foo", 1, 30, now)
+	// bytes/sec of topic foo: 10 - 30 = -20
+	assert.Equal(t, time.Duration(2100)*time.Millisecond, q.Wait(false, "app1", "foo", now))
+	// other topics of app1 are not affected
+	assert.Equal(t, time.Duration(0), q.Wait(false, "app1", "bar", now))
+	assert.Equal(t, time.Duration(0), q.Wait(true, "app1", "foo", now))
+
+	// unlimited
+	q.Consume(false, "app3", "foo", 1000000, 1000000, now)
+	assert.Equal(t, time.Duration(0), q.Wait(false, "app3", "foo", now))
+
+	q.Consume(true, "app2", "foo", 1, 100, now)
+	assert.Equal(t, time.Duration(0), q.Wait(true, "app2", "bar", now))
+	q.Consume(true, "app2", "bar", 1, 100, now)
+	assert.Equal(t, time.Duration(500)*time.Millisecond, q.Wait(true, "app2", "foo", now))
+	assert.Equal(t, time.Duration(0), q.Wait(false, "app2", "foo", now))
+}
+
+func TestQuotasTakeAndRefund(t *testing.T) {
+	defer func(m manager.Manager) { manager.Default = m }(manager.Default)
+	manager.Default = &quotaManager{
+		Manager: dummy.New(),
+		quotas: map[string]manager.Quota{
+			"app1/foo": {PubMsgs: 2},
+		},
+	}
+
+	now := time.Now()
+	q := newQuotas(nil, nil)
+	assert.Equal(t, time.Duration(0), q.Take(false, "app1", "foo", 1, 10, now))
+	assert.Equal(t, time.Duration(0), q.Take(false, "app1", "foo", 1, 10, now))
+	// not charged when exceeded
+	assert.Equal(t, time.Duration(500)*time.Millisecond, q.Take(false, "app1", "foo", 1, 10, now))
+	assert.Equal(t, time.Duration(500)*time.Millisecond, q.Wait(false, "app1", "foo", now))
+
+	// a failed pub is refunded
+	q.Refund(false, "app1", "foo", 1, 10, now)
+	assert.Equal(t, time.Duration(0), q.Take(false, "app1", "foo", 1, 10, now))
+}
+
+func TestFairShare(t *testing.T) {
+	all := map[string]map[string]float64{
+		"1": {"k": 0},
+	}
+	assert.Equal(t, float64(1), fairShare(100, "k", 0, all))
+
+	// idle fleet: equal shares
+	all["2"] = map[string]float64{}
+	all["3"] = map[string]float64{"k": 0}
+	assert.Equal(t, float64(1)/3, fairShare(90, "k", 0, all))
+
+	// busy instances get more, and the shares add up to 1
+	all["1"]["k"] = 60
+	all["2"]["k"] = 30
+	s1 := fairShare(90, "k", 60, all)
+	s2 := fairShare(90, "k", 30, all)
+	s3 := fairShare(90, "k", 0, all)
+	assert.Equal(t, float64(90)/180, s1)
+	assert.Equal(t, float64(60)/180, s2)
+	assert.Equal(t, float64(30)/180, s3)
+	assert.Equal(t, true, s1+s2+s3 > 0.999999 && s1+s2+s3 < 1.000001)
+}
+
+func TestQuotasSync(t *testing.T) {
+	defer func(m manager.Manager) { manager.Default = m }(manager.Default)
+	manager.Default = &quotaManager{
+		Manager: dummy.New(),
+		quotas: map[string]manager.Quota{
+			"app1/": {PubMsgs: 100},
+		},
+	}
+
+	coordinator := &fleetCoordinator{
+		others: map[string]map[string]float64{
+			"other": {"pub/app1//msgs": 50},
+		},
+	}
+	q := newQuotas(nil, coordinator)
+	now := q.lastSync
+	q.Consume(false, "app1", "foo", 100, 0, now)
+
+	q.sync(now.Add(time.Second * 2))
+	// usage: me 50/s, other 50/s
+	assert.Equal(t, 2, q.peers)
+	assert.Equal(t, float64(100)/200, q.shares["pub/app1//msgs"])
+
+	// a new key before the next sync gets an equal share
+	assert.Equal(t, float64(50), q.rate(quotaLimit{key: "pub/app1/foo/msgs", rate: 100}))
+
+	// the other instance is gone
+	coordinator.others = nil
+	q.sync(now.Add(time.Second * 3))
+	assert.Equal(t, float64(1), q.shares["pub/app1//msgs"])
+}
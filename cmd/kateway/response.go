@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func (this *Gateway) writeErrorResponse(w http.ResponseWriter, err string, code int) {
@@ -31,12 +33,29 @@ func (this *Gateway) writeAuthFailure(w http.ResponseWriter, err error) {
 	this.writeErrorResponse(w, err.Error(), http.StatusUnauthorized)
 }
 
-func (this *Gateway) writeQuotaExceeded(w http.ResponseWriter) {
-	w.Header().Set("Connection", "close")
+func (this *Gateway) writeQuotaExceeded(w http.ResponseWriter, retryAfter time.Duration) {
+	// Retry-After is in seconds
+	w.Header().Set(HttpHeaderRetryAfter,
+		strconv.FormatInt(int64((retryAfter+time.Second-1)/time.Second), 10))
 
-	this.writeErrorResponse(w, "quota exceeded", http.StatusNotAcceptable)
+	this.writeErrorResponse(w, ErrQuotaExceeded.Error(), HttpStatusTooManyRequests)
 }
 
 func (this *Gateway) writeBadRequest(w http.ResponseWriter, err error) {
 	this.writeErrorResponse(w, err.Error(), http.StatusBadRequest)
 }
+
+// writePluginError writes the error of a plugin that rejects the request.
+func (this *Gateway) writePluginError(w http.ResponseWriter, err error) {
+	e, ok := err.(*PluginError)
+	switch {
+	case !ok:
+		this.writeBadRequest(w, err)
+
+	case e.Status == http.StatusUnauthorized:
+		this.writeAuthFailure(w, e.Err)
+
+	default:
+		this.writeErrorResponse(w, e.Err.Error(), e.Status)
+	}
+}
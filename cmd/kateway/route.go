@@ -3,25 +3,40 @@ package main
 import (
 	"net/http"
 
+	"github.com/funkygao/gafka/cmd/kateway/manager"
 	"github.com/julienschmidt/httprouter"
 )
 
 func (this *Gateway) buildRouting() {
-	this.manServer.Router().GET("/alive", this.checkAliveHandler)
-	this.manServer.Router().GET("/clusters", this.clustersHandler)
-	this.manServer.Router().GET("/clients", this.clientsHandler)
-	this.manServer.Router().GET("/help", this.helpHandler)
-	this.manServer.Router().GET("/status", this.statusHandler)
-	this.manServer.Router().PUT("/options/:option/:value", this.setOptionHandler)
-	this.manServer.Router().PUT("/log/:level", this.setlogHandler)
-	this.manServer.Router().GET("/partitions/:cluster/:appid/:topic/:ver", this.partitionsHandler)
-	this.manServer.Router().POST("/topics/:cluster/:appid/:topic/:ver", this.addTopicHandler)
-	this.manServer.Router().DELETE("/counter/:name", this.resetCounterHandler)
+	this.manServer.Router().GET("/alive", this.adminHandler(manager.RoleNone, this.checkAliveHandler))
+	this.manServer.Router().GET("/clusters", this.adminHandler(manager.RoleReadOnly, this.clustersHandler))
+	this.manServer.Router().GET("/clients", this.adminHandler(manager.RoleReadOnly, this.clientsHandler))
+	this.manServer.Router().GET("/webhooks", this.adminHandler(manager.RoleReadOnly, this.webhooksHandler))
+	this.manServer.Router().GET("/groups", this.adminHandler(manager.RoleReadOnly, this.groupsHandler))
+	this.manServer.Router().GET("/plugins", this.adminHandler(manager.RoleReadOnly, this.pluginsHandler))
+	this.manServer.Router().PUT("/plugins/:target", this.adminHandler(manager.RoleSuperuser, this.setPluginsHandler))
+	this.manServer.Router().GET("/encryption", this.adminHandler(manager.RoleReadOnly, this.encryptionHandler))
+	this.manServer.Router().PUT("/encryption/:appid/:topic/:ver", this.adminHandler(manager.RoleTopicAdmin, this.setEncryptionHandler))
+	this.manServer.Router().GET("/help", this.adminHandler(manager.RoleNone, this.helpHandler))
+	this.manServer.Router().GET("/status", this.adminHandler(manager.RoleReadOnly, this.statusHandler))
+	this.manServer.Router().PUT("/options/:option/:value", this.adminHandler(manager.RoleSuperuser, this.setOptionHandler))
+	this.manServer.Router().PUT("/log/:level", this.adminHandler(manager.RoleSuperuser, this.setlogHandler))
+	this.manServer.Router().GET("/partitions/:cluster/:appid/:topic/:ver", this.adminHandler(manager.RoleReadOnly, this.partitionsHandler))
+	this.manServer.Router().POST("/topics/:cluster/:appid/:topic/:ver", this.adminHandler(manager.RoleTopicAdmin, this.addTopicHandler))
+	this.manServer.Router().DELETE("/counter/:name", this.adminHandler(manager.RoleSuperuser, this.resetCounterHandler))
+	this.manServer.Router().PUT("/deadletter/:appid/:group/:maxdelivery", this.adminHandler(manager.RoleTopicAdmin, this.setMaxDeliveriesHandler))
+	this.manServer.Router().PUT("/commit/:appid/:group/:policy", this.adminHandler(manager.RoleTopicAdmin, this.setCommitPolicyHandler))
+	this.manServer.Router().POST("/replay/:cluster/:appid/:topic/:ver", this.adminHandler(manager.RoleTopicAdmin, this.replayDeadLetterHandler))
+	this.manServer.Router().GET("/schemas/:cluster", this.adminHandler(manager.RoleReadOnly, this.schemasHandler))
+	this.manServer.Router().GET("/schemas/:cluster/:appid/:topic/:ver", this.adminHandler(manager.RoleReadOnly, this.schemaHandler))
+	this.manServer.Router().POST("/schemas/:cluster/:appid/:topic/:ver", this.adminHandler(manager.RoleTopicAdmin, this.addSchemaHandler))
+	this.manServer.Router().POST("/tokens/:appid", this.adminHandler(manager.RoleNone, this.mintTokenHandler))
 
 	if this.pubServer != nil {
 		this.pubServer.Router().GET("/raw/topics/:topic/:ver", this.pubRawHandler)
 		this.pubServer.Router().POST("/topics/:topic/:ver", this.pubHandler)
-		this.pubServer.Router().POST("/ws/topics/:topic/:ver", this.pubWsHandler)
+		this.pubServer.Router().POST("/batch/topics/:topic/:ver", this.pubBatchHandler)
+		this.pubServer.Router().GET("/ws/topics/:topic/:ver", this.pubWsHandler)
 		this.pubServer.Router().GET("/alive", this.checkAliveHandler)
 	}
 
@@ -29,7 +44,13 @@ func (this *Gateway) buildRouting() {
 		this.subServer.Router().GET("/raw/topics/:appid/:topic/:ver", this.subRawHandler)
 		this.subServer.Router().GET("/topics/:appid/:topic/:ver", this.subHandler)
 		this.subServer.Router().GET("/status/:appid/:topic/:ver", this.subStatusHandler)
+		this.subServer.Router().PUT("/ack/:appid/:topic/:ver", this.ackHandler)
+		this.subServer.Router().PUT("/nack/:appid/:topic/:ver", this.nackHandler)
+		this.subServer.Router().POST("/webhooks/:appid/:topic/:ver", this.addWebhookHandler)
+		this.subServer.Router().PUT("/offsets/:appid/:topic/:ver", this.seekHandler)
+		this.subServer.Router().DELETE("/webhooks/:appid/:topic/:ver", this.delWebhookHandler)
 		this.subServer.Router().GET("/ws/topics/:appid/:topic/:ver", this.subWsHandler)
+		this.subServer.Router().GET("/ws/subscriptions", this.subWsMuxHandler)
 		this.subServer.Router().GET("/alive", this.checkAliveHandler)
 	}
 
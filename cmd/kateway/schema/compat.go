@@ -0,0 +1,136 @@
+package schema
+
+import (
+	"reflect"
+)
+
+// Compatible checks that every message valid against the new version of a
+// schema is also valid against the old one, so that the consumers written
+// for the old version will not break when the producers switch to the new.
+//
+// So a new version can add optional properties when the old one allows
+// additional properties, make an optional property required, or tighten
+// the constraints, but not the other way around.
+func Compatible(old, new *Schema) error {
+	return compatible(old, new, "$")
+}
+
+func compatible(old, new *Schema, path string) error {
+	if len(old.Types) > 0 {
+		if len(new.Types) == 0 {
+			return &Error{Path: path, Reason: "type removed"}
+		}
+
+		for _, t := range new.Types {
+			if !old.hasType(t) {
+				return &Error{Path: path, Reason: "type " + t + " added"}
+			}
+		}
+	}
+
+	for _, name := range old.Required {
+		if !contains(new.Required, name) {
+			return &Error{Path: path + "." + name, Reason: "no longer required"}
+		}
+	}
+
+	oldClosed := old.AdditionalProperties != nil && !*old.AdditionalProperties
+	newClosed := new.AdditionalProperties != nil && !*new.AdditionalProperties
+	if oldClosed && !newClosed {
+		return &Error{Path: path, Reason: "additional properties allowed"}
+	}
+
+	for name, op := range old.Properties {
+		np, present := new.Properties[name]
+		if !present {
+			if !newClosed {
+				return &Error{Path: path + "." + name, Reason: "property removed"}
+			}
+
+			continue
+		}
+
+		if err := compatible(op, np, path+"."+name); err != nil {
+			return err
+		}
+	}
+
+	if oldClosed {
+		for name := range new.Properties {
+			if _, present := old.Properties[name]; !present {
+				return &Error{Path: path + "." + name, Reason: "property added"}
+			}
+		}
+	}
+
+	if old.Items != nil {
+		if new.Items == nil {
+			return &Error{Path: path + "[]", Reason: "items removed"}
+		}
+
+		if err := compatible(old.Items, new.Items, path+"[]"); err != nil {
+			return err
+		}
+	}
+
+	if len(old.Enum) > 0 {
+		if len(new.Enum) == 0 {
+			return &Error{Path: path, Reason: "enum removed"}
+		}
+
+		for _, e := range new.Enum {
+			found := false
+			for _, oe := range old.Enum {
+				if reflect.DeepEqual(e, oe) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return &Error{Path: path, Reason: "enum value added"}
+			}
+		}
+	}
+
+	if old.Pattern != "" && new.Pattern != old.Pattern {
+		return &Error{Path: path, Reason: "pattern changed"}
+	}
+
+	if old.Minimum != nil && (new.Minimum == nil || *new.Minimum < *old.Minimum) ||
+		old.Maximum != nil && (new.Maximum == nil || *new.Maximum > *old.Maximum) {
+		return &Error{Path: path, Reason: "range loosened"}
+	}
+
+	if looser(old.MinLength, new.MinLength, true) || looser(old.MaxLength, new.MaxLength, false) {
+		return &Error{Path: path, Reason: "length loosened"}
+	}
+
+	if looser(old.MinItems, new.MinItems, true) || looser(old.MaxItems, new.MaxItems, false) {
+		return &Error{Path: path, Reason: "items loosened"}
+	}
+
+	return nil
+}
+
+// looser tells if the new bound accepts more than the old one.
+func looser(old, new *int, min bool) bool {
+	switch {
+	case old == nil:
+		return false
+	case new == nil:
+		return true
+	case min:
+		return *new < *old
+	default:
+		return *new > *old
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
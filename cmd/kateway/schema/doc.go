@@ -0,0 +1,8 @@
+// Package schema validates the messages of a topic against its JSON Schema,
+// and checks the compatibility between the versions of a schema.
+//
+// Only a subset of JSON Schema draft 4 is supported:
+// type, properties, required, additionalProperties(bool), items, enum,
+// minimum, maximum, minLength, maxLength, minItems, maxItems and pattern.
+// Other keywords are ignored.
+package schema
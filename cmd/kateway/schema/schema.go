@@ -0,0 +1,263 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"unicode/utf8"
+)
+
+// Error tells where a message violates the schema, or where a new version
+// of the schema is incompatible with the old one.
+type Error struct {
+	Path   string // e,g. $.items[2].name
+	Reason string
+}
+
+func (this *Error) Error() string {
+	return fmt.Sprintf("%s: %s", this.Path, this.Reason)
+}
+
+// Schema is a parsed JSON Schema.
+type Schema struct {
+	Types                []string
+	Properties           map[string]*Schema
+	Required             []string
+	AdditionalProperties *bool
+	Items                *Schema
+	Enum                 []interface{}
+	Minimum              *float64
+	Maximum              *float64
+	MinLength            *int
+	MaxLength            *int
+	MinItems             *int
+	MaxItems             *int
+	Pattern              string
+
+	pattern *regexp.Regexp
+}
+
+type rawSchema struct {
+	Type                 json.RawMessage       `json:"type"`
+	Properties           map[string]*rawSchema `json:"properties"`
+	Required             []string              `json:"required"`
+	AdditionalProperties *bool                 `json:"additionalProperties"`
+	Items                *rawSchema            `json:"items"`
+	Enum                 []interface{}         `json:"enum"`
+	Minimum              *float64              `json:"minimum"`
+	Maximum              *float64              `json:"maximum"`
+	MinLength            *int                  `json:"minLength"`
+	MaxLength            *int                  `json:"maxLength"`
+	MinItems             *int                  `json:"minItems"`
+	MaxItems             *int                  `json:"maxItems"`
+	Pattern              string                `json:"pattern"`
+}
+
+var validTypes = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"integer": true,
+	"string":  true,
+}
+
+// Parse compiles a JSON Schema document.
+func Parse(b []byte) (*Schema, error) {
+	var raw rawSchema
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, &Error{Path: "$", Reason: err.Error()}
+	}
+
+	return compile(&raw, "$")
+}
+
+func compile(raw *rawSchema, path string) (*Schema, error) {
+	s := &Schema{
+		Required:             raw.Required,
+		AdditionalProperties: raw.AdditionalProperties,
+		Enum:                 raw.Enum,
+		Minimum:              raw.Minimum,
+		Maximum:              raw.Maximum,
+		MinLength:            raw.MinLength,
+		MaxLength:            raw.MaxLength,
+		MinItems:             raw.MinItems,
+		MaxItems:             raw.MaxItems,
+		Pattern:              raw.Pattern,
+	}
+
+	if len(raw.Type) > 0 {
+		var t string
+		if err := json.Unmarshal(raw.Type, &t); err == nil {
+			s.Types = []string{t}
+		} else if err = json.Unmarshal(raw.Type, &s.Types); err != nil {
+			return nil, &Error{Path: path, Reason: "type must be a string or an array of strings"}
+		}
+
+		for _, t := range s.Types {
+			if !validTypes[t] {
+				return nil, &Error{Path: path, Reason: "unknown type " + t}
+			}
+		}
+	}
+
+	if s.Pattern != "" {
+		var err error
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return nil, &Error{Path: path, Reason: err.Error()}
+		}
+	}
+
+	if len(raw.Properties) > 0 {
+		s.Properties = make(map[string]*Schema, len(raw.Properties))
+		for name, p := range raw.Properties {
+			if p == nil {
+				return nil, &Error{Path: path + "." + name, Reason: "null schema"}
+			}
+
+			ps, err := compile(p, path+"."+name)
+			if err != nil {
+				return nil, err
+			}
+
+			s.Properties[name] = ps
+		}
+	}
+
+	if raw.Items != nil {
+		items, err := compile(raw.Items, path+"[]")
+		if err != nil {
+			return nil, err
+		}
+
+		s.Items = items
+	}
+
+	return s, nil
+}
+
+// Validate checks a JSON message against the schema.
+func (this *Schema) Validate(msg []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(msg, &v); err != nil {
+		return &Error{Path: "$", Reason: "invalid json"}
+	}
+
+	return this.validate(v, "$")
+}
+
+func typeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+func (this *Schema) hasType(t string) bool {
+	if len(this.Types) == 0 {
+		return true
+	}
+
+	for _, st := range this.Types {
+		if st == t || (st == "number" && t == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Schema) validate(v interface{}, path string) error {
+	t := typeOf(v)
+	if !this.hasType(t) {
+		return &Error{Path: path, Reason: fmt.Sprintf("%s not allowed, expect %v", t, this.Types)}
+	}
+
+	if len(this.Enum) > 0 {
+		found := false
+		for _, e := range this.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &Error{Path: path, Reason: "not in enum"}
+		}
+	}
+
+	switch v := v.(type) {
+	case float64:
+		if this.Minimum != nil && v < *this.Minimum {
+			return &Error{Path: path, Reason: fmt.Sprintf("less than %v", *this.Minimum)}
+		}
+		if this.Maximum != nil && v > *this.Maximum {
+			return &Error{Path: path, Reason: fmt.Sprintf("greater than %v", *this.Maximum)}
+		}
+
+	case string:
+		n := utf8.RuneCountInString(v)
+		if this.MinLength != nil && n < *this.MinLength {
+			return &Error{Path: path, Reason: fmt.Sprintf("shorter than %d", *this.MinLength)}
+		}
+		if this.MaxLength != nil && n > *this.MaxLength {
+			return &Error{Path: path, Reason: fmt.Sprintf("longer than %d", *this.MaxLength)}
+		}
+		if this.pattern != nil && !this.pattern.MatchString(v) {
+			return &Error{Path: path, Reason: "not match " + this.Pattern}
+		}
+
+	case []interface{}:
+		if this.MinItems != nil && len(v) < *this.MinItems {
+			return &Error{Path: path, Reason: fmt.Sprintf("less than %d items", *this.MinItems)}
+		}
+		if this.MaxItems != nil && len(v) > *this.MaxItems {
+			return &Error{Path: path, Reason: fmt.Sprintf("more than %d items", *this.MaxItems)}
+		}
+		if this.Items != nil {
+			for i, item := range v {
+				if err := this.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+
+	case map[string]interface{}:
+		for _, name := range this.Required {
+			if _, present := v[name]; !present {
+				return &Error{Path: path + "." + name, Reason: "required"}
+			}
+		}
+		for name, pv := range v {
+			ps, present := this.Properties[name]
+			if !present {
+				if this.AdditionalProperties != nil && !*this.AdditionalProperties {
+					return &Error{Path: path + "." + name, Reason: "additional property not allowed"}
+				}
+
+				continue
+			}
+
+			if err := ps.validate(pv, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/funkygao/assert"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "status"],
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"status": {"enum": ["created", "paid"]},
+		"sku": {"type": "string", "pattern": "^[A-Z]+-[0-9]+$", "maxLength": 10},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2}
+	}
+}`
+
+func validateError(s *Schema, msg string) string {
+	if err := s.Validate([]byte(msg)); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func TestValidate(t *testing.T) {
+	s, err := Parse([]byte(orderSchema))
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, "", validateError(s, `{"id": 1, "status": "paid"}`))
+	assert.Equal(t, "", validateError(s, `{"id": 1, "status": "paid", "sku": "AB-12", "tags": ["a"], "extra": null}`))
+	assert.Equal(t, "$: invalid json", validateError(s, `{"id": 1,`))
+	assert.Equal(t, "$: array not allowed, expect [object]", validateError(s, `[]`))
+	assert.Equal(t, "$.status: required", validateError(s, `{"id": 1}`))
+	assert.Equal(t, "$.id: number not allowed, expect [integer]", validateError(s, `{"id": 1.5, "status": "paid"}`))
+	assert.Equal(t, "$.id: less than 1", validateError(s, `{"id": 0, "status": "paid"}`))
+	assert.Equal(t, "$.status: not in enum", validateError(s, `{"id": 1, "status": "shipped"}`))
+	assert.Equal(t, "$.sku: not match ^[A-Z]+-[0-9]+$", validateError(s, `{"id": 1, "status": "paid", "sku": "ab"}`))
+	assert.Equal(t, "$.sku: longer than 10", validateError(s, `{"id": 1, "status": "paid", "sku": "ABCDEFGH-12"}`))
+	assert.Equal(t, "$.tags[1]: integer not allowed, expect [string]", validateError(s, `{"id": 1, "status": "paid", "tags": ["a", 2]}`))
+	assert.Equal(t, "$.tags: more than 2 items", validateError(s, `{"id": 1, "status": "paid", "tags": ["a", "b", "c"]}`))
+
+	s, _ = Parse([]byte(`{"type": ["number", "null"]}`))
+	assert.Equal(t, "", validateError(s, `1`))
+	assert.Equal(t, "", validateError(s, `null`))
+	assert.Equal(t, "$: string not allowed, expect [number null]", validateError(s, `"1"`))
+
+	s, _ = Parse([]byte(`{"additionalProperties": false, "properties": {"a": {}}}`))
+	assert.Equal(t, "", validateError(s, `{"a": [1]}`))
+	assert.Equal(t, "$.b: additional property not allowed", validateError(s, `{"b": 1}`))
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, raw := range []string{
+		`{"type": "date"}`,
+		`{"type": 1}`,
+		`{"pattern": "("}`,
+		`{"properties": {"a": {"type": "int"}}}`,
+		`[]`,
+	} {
+		_, err := Parse([]byte(raw))
+		assert.Equal(t, true, err != nil)
+	}
+}
+
+func compatError(old, new string) string {
+	o, _ := Parse([]byte(old))
+	n, _ := Parse([]byte(new))
+	if err := Compatible(o, n); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func TestCompatible(t *testing.T) {
+	assert.Equal(t, "", compatError(orderSchema, orderSchema))
+
+	// add an optional property
+	assert.Equal(t, "", compatError(`{"type": "object"}`,
+		`{"type": "object", "properties": {"a": {"type": "string"}}}`))
+	// make a property required
+	assert.Equal(t, "", compatError(`{"properties": {"a": {}}}`,
+		`{"required": ["a"], "properties": {"a": {}}}`))
+	// tighten
+	assert.Equal(t, "", compatError(`{"type": ["number", "null"], "maximum": 10}`,
+		`{"type": "integer", "minimum": 0, "maximum": 5}`))
+
+	assert.Equal(t, "$.a: no longer required", compatError(`{"required": ["a"]}`, `{}`))
+	assert.Equal(t, "$: type string added", compatError(`{"type": "number"}`, `{"type": ["number", "string"]}`))
+	assert.Equal(t, "$: type removed", compatError(`{"type": "number"}`, `{}`))
+	assert.Equal(t, "$.a: type string added", compatError(`{"properties": {"a": {"type": "integer"}}}`,
+		`{"properties": {"a": {"type": "string"}}}`))
+	assert.Equal(t, "$.a: property removed", compatError(`{"properties": {"a": {"type": "integer"}}}`, `{}`))
+	assert.Equal(t, "$.b: property added", compatError(`{"additionalProperties": false, "properties": {"a": {}}}`,
+		`{"additionalProperties": false, "properties": {"a": {}, "b": {}}}`))
+	assert.Equal(t, "$: additional properties allowed", compatError(`{"additionalProperties": false}`, `{}`))
+	assert.Equal(t, "$: enum value added", compatError(`{"enum": [1, 2]}`, `{"enum": [2, 3]}`))
+	assert.Equal(t, "$: range loosened", compatError(`{"maximum": 5}`, `{"maximum": 6}`))
+	assert.Equal(t, "$: length loosened", compatError(`{"minLength": 2}`, `{}`))
+	assert.Equal(t, "$[]: type integer added", compatError(`{"items": {"type": "string"}}`, `{"items": {"type": "integer"}}`))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/funkygao/gafka/cmd/kateway/meta"
+	"github.com/funkygao/gafka/cmd/kateway/schema"
+	log "github.com/funkygao/log4go"
+)
+
+// topicSchema is the latest version of the schema of a topic.
+type topicSchema struct {
+	version int
+	schema  *schema.Schema
+}
+
+// schemas is the registry of topic schemas, which are stored in zk next to
+// the topic config of each cluster. The pub messages of a topic that has a
+// schema must be valid against its latest version.
+type schemas struct {
+	gw *Gateway
+
+	mu     sync.RWMutex
+	topics map[string]*topicSchema // key is cluster/topic, nil means no schema
+}
+
+func newSchemas(gw *Gateway) *schemas {
+	return &schemas{
+		gw:     gw,
+		topics: make(map[string]*topicSchema),
+	}
+}
+
+func (this *schemas) Start() {
+	this.gw.wg.Add(1)
+	go func() {
+		defer this.gw.wg.Done()
+
+		ticker := time.NewTicker(options.ManagerRefresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				this.refresh()
+
+			case <-this.gw.shutdownCh:
+				log.Trace("schemas stopped")
+				return
+			}
+		}
+	}()
+}
+
+// refresh drops the cached schemas, so that the schemas registered through
+// other kateway instances take effect on the next pub.
+func (this *schemas) refresh() {
+	this.mu.Lock()
+	this.topics = make(map[string]*topicSchema)
+	this.mu.Unlock()
+}
+
+// load returns the versions of the schema of a topic sorted ascending.
+func (this *schemas) load(cluster, topic string) (versions []int, raw map[int][]byte) {
+	raw = meta.Default.ZkCluster(cluster).TopicSchemas(topic)
+	for v := range raw {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	return
+}
+
+// Latest returns the latest schema of a topic, nil if none.
+func (this *schemas) Latest(cluster, topic string) *topicSchema {
+	key := cluster + "/" + topic
+	this.mu.RLock()
+	ts, present := this.topics[key]
+	this.mu.RUnlock()
+	if present {
+		return ts
+	}
+
+	versions, raw := this.load(cluster, topic)
+	// a broken version should never be registered, skip it anyway
+	for i := len(versions) - 1; i >= 0; i-- {
+		s, err := schema.Parse(raw[versions[i]])
+		if err != nil {
+			log.Error("schema[%s/%s] v%d: %v", cluster, topic, versions[i], err)
+			continue
+		}
+
+		ts = &topicSchema{version: versions[i], schema: s}
+		break
+	}
+
+	this.mu.Lock()
+	this.topics[key] = ts
+	this.mu.Unlock()
+	return ts
+}
+
+// Validate checks a pub message against the latest schema of the topic.
+func (this *schemas) Validate(cluster, topic string, msg []byte) error {
+	ts := this.Latest(cluster, topic)
+	if ts == nil {
+		return nil
+	}
+
+	return ts.schema.Validate(msg)
+}
+
+// Register adds a new version of the schema of a topic, which must be
+// compatible with the latest version unless force.
+func (this *schemas) Register(cluster, topic string, raw []byte, force bool) (version int, err error) {
+	s, err := schema.Parse(raw)
+	if err != nil {
+		return 0, err
+	}
+
+	versions, all := this.load(cluster, topic)
+	if len(versions) > 0 {
+		version = versions[len(versions)-1]
+		if !force {
+			latest, err := schema.Parse(all[version])
+			if err != nil {
+				return 0, err
+			}
+
+			if err = schema.Compatible(latest, s); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	version++
+	if err = meta.Default.ZkCluster(cluster).RegisterTopicSchema(topic, version, raw); err != nil {
+		return 0, err
+	}
+
+	this.mu.Lock()
+	this.topics[cluster+"/"+topic] = &topicSchema{version: version, schema: s}
+	this.mu.Unlock()
+	return
+}
+
+// Get returns the raw schema of a topic of the version, the latest if
+// version is 0.
+func (this *schemas) Get(cluster, topic string, version int) (int, []byte, bool) {
+	versions, raw := this.load(cluster, topic)
+	if len(versions) == 0 {
+		return 0, nil, false
+	}
+
+	if version == 0 {
+		version = versions[len(versions)-1]
+	}
+	b, present := raw[version]
+	return version, b, present
+}
+
+// Topics returns {topic: versions} of the topics that have schemas in the
+// cluster.
+func (this *schemas) Topics(cluster string) map[string][]int {
+	r := make(map[string][]int)
+	for _, topic := range meta.Default.ZkCluster(cluster).SchemaTopics() {
+		r[topic], _ = this.load(cluster, topic)
+	}
+	return r
+}
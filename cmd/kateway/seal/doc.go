@@ -0,0 +1,9 @@
+// Package seal encrypts the message bodies of a topic at rest with envelope
+// encryption: each body is encrypted with a data key of the topic, and the
+// data key is wrapped by a master key from a KeyProvider and stored along
+// with the body.
+//
+// A master key is never used to encrypt a body directly, so rotating the
+// master key only affects the new data keys: the old bodies are still opened
+// by the master key id they carry, as long as the provider keeps that key.
+package seal
@@ -0,0 +1,92 @@
+package seal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+)
+
+// KeyProvider provides the master keys by id.
+type KeyProvider interface {
+	// Current returns the master key used to wrap the new data keys.
+	Current() (id string, key []byte, err error)
+
+	// Key returns the master key of the id.
+	Key(id string) ([]byte, error)
+}
+
+// FileKeystore is a KeyProvider that loads the master keys from a local json
+// file:
+//
+//	{"current": "k2", "keys": {"k1": "<base64 of 32 bytes>", "k2": "..."}}
+//
+// To rotate, add a new key and make it current, keep the old keys until no
+// message wrapped by them is retained.
+type FileKeystore struct {
+	path string
+
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+func NewFileKeystore(path string) (*FileKeystore, error) {
+	this := &FileKeystore{path: path}
+	if err := this.Reload(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// Reload reloads the keystore file, the keys are kept if the file is invalid.
+func (this *FileKeystore) Reload() error {
+	b, err := ioutil.ReadFile(this.path)
+	if err != nil {
+		return err
+	}
+
+	var v struct {
+		Current string            `json:"current"`
+		Keys    map[string]string `json:"keys"`
+	}
+	if err = json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	keys := make(map[string][]byte, len(v.Keys))
+	for id, s := range v.Keys {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(key) != KeyLen || len(id) > maxKeyIdLen {
+			return ErrInvalidKey
+		}
+
+		keys[id] = key
+	}
+	if _, present := keys[v.Current]; !present {
+		return ErrUnknownKey
+	}
+
+	this.mu.Lock()
+	this.current, this.keys = v.Current, keys
+	this.mu.Unlock()
+	return nil
+}
+
+func (this *FileKeystore) Current() (string, []byte, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.current, this.keys[this.current], nil
+}
+
+func (this *FileKeystore) Key(id string) ([]byte, error) {
+	this.mu.RLock()
+	key, present := this.keys[id]
+	this.mu.RUnlock()
+	if !present {
+		return nil, ErrUnknownKey
+	}
+
+	return key, nil
+}
@@ -0,0 +1,219 @@
+package seal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// A sealed body is:
+// magic(0xff 'k' 'e') version(1 byte) keyIdLen(1 byte) keyId
+// wrappedLen(2 bytes, big endian) wrapped data key nonce(12 bytes) ciphertext
+//
+// Both the data key and the body are encrypted with AES-256-GCM, the header
+// is authenticated together with the body.
+const (
+	Version = 1
+
+	// KeyLen is the length of the master keys and data keys.
+	KeyLen = 32
+
+	maxKeyIdLen   = 255
+	nonceLen      = 12
+	maxOpenedKeys = 10000
+)
+
+var (
+	magic = []byte{0xff, 'k', 'e'}
+
+	ErrCorrupted  = errors.New("corrupted sealed body")
+	ErrVersion    = errors.New("unsupported sealed body version")
+	ErrUnknownKey = errors.New("unknown master key")
+	ErrInvalidKey = errors.New("invalid master key")
+)
+
+// IsSealed tells whether a body is sealed.
+func IsSealed(body []byte) bool {
+	return len(body) > len(magic)+2 && bytes.Equal(body[:len(magic)], magic)
+}
+
+type dataKey struct {
+	masterId string
+	header   []byte
+	aead     cipher.AEAD
+	ctime    time.Time
+}
+
+// Sealer seals and opens the message bodies. Each topic has its own data key
+// in a Sealer, which is renewed after ttl or when the current master key
+// changes.
+type Sealer struct {
+	provider KeyProvider
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	sealing map[string]*dataKey    // key is topic
+	opening map[string]cipher.AEAD // key is the wrapped data key
+}
+
+func NewSealer(provider KeyProvider, ttl time.Duration) *Sealer {
+	return &Sealer{
+		provider: provider,
+		ttl:      ttl,
+		sealing:  make(map[string]*dataKey),
+		opening:  make(map[string]cipher.AEAD),
+	}
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeyLen {
+		return nil, ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (this *Sealer) dataKey(topic string, now time.Time) (*dataKey, error) {
+	masterId, master, err := this.provider.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	dk := this.sealing[topic]
+	if dk != nil && dk.masterId == masterId && now.Sub(dk.ctime) < this.ttl {
+		return dk, nil
+	}
+
+	masterAEAD, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+
+	key, nonce := make([]byte, KeyLen), make([]byte, nonceLen)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the nonce goes before the wrapped data key
+	wrapped := masterAEAD.Seal(nonce, nonce, key, []byte(masterId))
+	header := make([]byte, 0, len(magic)+2+len(masterId)+2+len(wrapped))
+	header = append(header, magic...)
+	header = append(header, Version, byte(len(masterId)))
+	header = append(header, masterId...)
+	header = append(header, byte(len(wrapped)>>8), byte(len(wrapped)))
+	header = append(header, wrapped...)
+
+	dk = &dataKey{masterId: masterId, header: header, aead: aead, ctime: now}
+	this.sealing[topic] = dk
+	return dk, nil
+}
+
+// Seal encrypts the body of a message of the topic.
+func (this *Sealer) Seal(topic string, body []byte) ([]byte, error) {
+	dk, err := this.dataKey(topic, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, len(dk.header)+nonceLen, len(dk.header)+nonceLen+len(body)+dk.aead.Overhead())
+	copy(sealed, dk.header)
+	nonce := sealed[len(dk.header):]
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return dk.aead.Seal(sealed, nonce, body, dk.header), nil
+}
+
+// Open decrypts a sealed body.
+func (this *Sealer) Open(sealed []byte) ([]byte, error) {
+	if !IsSealed(sealed) {
+		return nil, ErrCorrupted
+	}
+	if sealed[len(magic)] != Version {
+		return nil, ErrVersion
+	}
+
+	p := len(magic) + 2
+	keyIdLen := int(sealed[p-1])
+	if len(sealed) < p+keyIdLen+2 {
+		return nil, ErrCorrupted
+	}
+	masterId := string(sealed[p : p+keyIdLen])
+	p += keyIdLen
+	wrappedLen := int(binary.BigEndian.Uint16(sealed[p:]))
+	p += 2
+	if wrappedLen <= nonceLen || len(sealed) < p+wrappedLen+nonceLen {
+		return nil, ErrCorrupted
+	}
+	wrapped := sealed[p : p+wrappedLen]
+	header := sealed[:p+wrappedLen]
+	p += wrappedLen
+
+	aead, err := this.opener(masterId, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := aead.Open(nil, sealed[p:p+nonceLen], sealed[p+nonceLen:], header)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+
+	return body, nil
+}
+
+// opener unwraps a data key.
+func (this *Sealer) opener(masterId string, wrapped []byte) (cipher.AEAD, error) {
+	this.mu.Lock()
+	aead, present := this.opening[string(wrapped)]
+	this.mu.Unlock()
+	if present {
+		return aead, nil
+	}
+
+	master, err := this.provider.Key(masterId)
+	if err != nil {
+		return nil, err
+	}
+	masterAEAD, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := masterAEAD.Open(nil, wrapped[:nonceLen], wrapped[nonceLen:], []byte(masterId))
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	if aead, err = newAEAD(key); err != nil {
+		return nil, err
+	}
+
+	this.mu.Lock()
+	if len(this.opening) >= maxOpenedKeys {
+		this.opening = make(map[string]cipher.AEAD)
+	}
+	this.opening[string(wrapped)] = aead
+	this.mu.Unlock()
+	return aead, nil
+}
@@ -0,0 +1,118 @@
+package seal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/funkygao/assert"
+)
+
+type staticKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (this *staticKeys) Current() (string, []byte, error) {
+	return this.current, this.keys[this.current], nil
+}
+
+func (this *staticKeys) Key(id string) ([]byte, error) {
+	key, present := this.keys[id]
+	if !present {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+func TestSealOpen(t *testing.T) {
+	keys := &staticKeys{
+		current: "k1",
+		keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, KeyLen)},
+	}
+	s := NewSealer(keys, time.Hour)
+
+	body := []byte(`{"card": "4111111111111111"}`)
+	sealed, err := s.Seal("app1.orders.v1", body)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, IsSealed(sealed))
+	assert.Equal(t, false, bytes.Contains(sealed, body))
+	assert.Equal(t, false, IsSealed(body))
+
+	b, err := s.Open(sealed)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, body, b)
+
+	// the data key is reused within ttl, but the nonce is not
+	sealed2, _ := s.Seal("app1.orders.v1", body)
+	assert.Equal(t, false, bytes.Equal(sealed, sealed2))
+
+	// another sealer opens it with the same master key
+	b, err = NewSealer(keys, time.Hour).Open(sealed)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, body, b)
+
+	// rotate the master key: the old bodies are still opened
+	keys.keys["k2"] = bytes.Repeat([]byte{2}, KeyLen)
+	keys.current = "k2"
+	sealed2, _ = s.Seal("app1.orders.v1", body)
+	assert.Equal(t, "k2", string(sealed2[5:7]))
+	for _, c := range [][]byte{sealed, sealed2} {
+		b, err = NewSealer(keys, time.Hour).Open(c)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, body, b)
+	}
+
+	// the master key is gone
+	delete(keys.keys, "k1")
+	_, err = NewSealer(keys, time.Hour).Open(sealed)
+	assert.Equal(t, ErrUnknownKey, err)
+}
+
+func TestOpenInvalid(t *testing.T) {
+	keys := &staticKeys{
+		current: "k1",
+		keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, KeyLen)},
+	}
+	s := NewSealer(keys, time.Hour)
+	sealed, _ := s.Seal("t", []byte("hello"))
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	_, err := s.Open(tampered)
+	assert.Equal(t, ErrCorrupted, err)
+
+	_, err = s.Open(sealed[:20])
+	assert.Equal(t, ErrCorrupted, err)
+
+	tampered = append([]byte{}, sealed...)
+	tampered[3] = 2
+	_, err = s.Open(tampered)
+	assert.Equal(t, ErrVersion, err)
+
+	_, err = s.Open([]byte("hello"))
+	assert.Equal(t, ErrCorrupted, err)
+}
+
+func TestFileKeystore(t *testing.T) {
+	f, _ := ioutil.TempFile("", "keystore")
+	defer os.Remove(f.Name())
+
+	f.WriteString(`{"current": "k1", "keys": {"k1": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}}`)
+	f.Close()
+	ks, err := NewFileKeystore(f.Name())
+	assert.Equal(t, nil, err)
+	id, key, _ := ks.Current()
+	assert.Equal(t, "k1", id)
+	assert.Equal(t, bytes.Repeat([]byte{1}, KeyLen), key)
+
+	// invalid keys are not loaded
+	ioutil.WriteFile(f.Name(), []byte(`{"current": "k2", "keys": {"k1": "AQE="}}`), 0600)
+	assert.Equal(t, ErrInvalidKey, ks.Reload())
+	ioutil.WriteFile(f.Name(), []byte(`{"current": "k2", "keys": {}}`), 0600)
+	assert.Equal(t, ErrUnknownKey, ks.Reload())
+	id, _, _ = ks.Current()
+	assert.Equal(t, "k1", id)
+}
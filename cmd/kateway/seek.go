@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/funkygao/gafka/zk"
+)
+
+// parseOffsetSeek parses where to move a consumer group from the query, exactly
+// one of offset, delta and ts(unix timestamp in seconds) is required.
+func parseOffsetSeek(query url.Values) (seek zk.OffsetSeek, err error) {
+	var n int
+	for _, arg := range []struct {
+		key    string
+		whence int
+	}{
+		{UrlQueryOffset, zk.SeekAbsolute},
+		{UrlQueryDelta, zk.SeekDelta},
+		{UrlQueryTimestamp, zk.SeekTime},
+	} {
+		v := query.Get(arg.key)
+		if v == "" {
+			continue
+		}
+
+		var val int64
+		if val, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return seek, ErrInvalidSeek
+		}
+
+		switch arg.whence {
+		case zk.SeekAbsolute:
+			if val < 0 {
+				return seek, ErrInvalidSeek
+			}
+
+		case zk.SeekTime:
+			val = val * int64(time.Second/time.Millisecond)
+		}
+
+		seek = zk.OffsetSeek{Whence: arg.whence, Value: val}
+		n++
+	}
+
+	if n != 1 {
+		return seek, ErrInvalidSeek
+	}
+
+	return
+}
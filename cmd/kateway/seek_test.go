@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/funkygao/assert"
+	"github.com/funkygao/gafka/zk"
+)
+
+func TestParseOffsetSeek(t *testing.T) {
+	_, err := parseOffsetSeek(url.Values{})
+	assert.Equal(t, ErrInvalidSeek, err)
+
+	_, err = parseOffsetSeek(url.Values{"offset": {"10"}, "delta": {"-1"}})
+	assert.Equal(t, ErrInvalidSeek, err)
+
+	_, err = parseOffsetSeek(url.Values{"offset": {"-1"}})
+	assert.Equal(t, ErrInvalidSeek, err)
+
+	_, err = parseOffsetSeek(url.Values{"delta": {"abc"}})
+	assert.Equal(t, ErrInvalidSeek, err)
+
+	seek, err := parseOffsetSeek(url.Values{"offset": {"10"}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, zk.OffsetSeek{Whence: zk.SeekAbsolute, Value: 10}, seek)
+
+	seek, err = parseOffsetSeek(url.Values{"delta": {"-100"}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, zk.OffsetSeek{Whence: zk.SeekDelta, Value: -100}, seek)
+
+	seek, err = parseOffsetSeek(url.Values{"ts": {"1460000000"}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, zk.OffsetSeek{Whence: zk.SeekTime, Value: 1460000000000}, seek)
+}
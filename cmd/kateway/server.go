@@ -11,7 +11,10 @@ type connStateFunc func(c net.Conn, cs http.ConnState)
 type onConnNewFunc func(net.Conn)
 type onConnCloseFunc func(net.Conn)
 
-func setupHttpsListener(listener net.Listener, certFile, keyFile string) (net.Listener, error) {
+// setupHttpsListener wraps the listener with tls, the client certificates are
+// verified if clientCerts is not nil, and HTTP/2 is negotiated if http2.
+func setupHttpsListener(listener net.Listener, certFile, keyFile string,
+	clientCerts *clientCerts, http2 bool) (net.Listener, error) {
 	cer, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
 		return nil, err
@@ -21,6 +24,12 @@ func setupHttpsListener(listener net.Listener, certFile, keyFile string) (net.Li
 		NextProtos:   []string{"http/1.1"},
 		Certificates: []tls.Certificate{cer},
 	}
+	if http2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if clientCerts != nil {
+		clientCerts.setupTLS(config)
+	}
 
 	tlsListener := tls.NewListener(listener, config)
 	return tlsListener, nil
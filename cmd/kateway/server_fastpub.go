@@ -50,7 +50,7 @@ func newPubServer(httpAddr, httpsAddr string, maxClients int, gw *Gateway) *pubS
 				MaxKeepaliveDuration: options.HttpReadTimeout,
 				ReadTimeout:          options.HttpReadTimeout,
 				WriteTimeout:         options.HttpWriteTimeout,
-				MaxRequestBodySize:   int(options.MaxPubSize + 1),
+				MaxRequestBodySize:   int(maxPubRequestBodySize() + 1),
 				ReduceMemoryUsage:    false, // TODO
 				Handler:              this.router.Handler,
 				Logger:               logger,
@@ -69,7 +69,7 @@ func newPubServer(httpAddr, httpsAddr string, maxClients int, gw *Gateway) *pubS
 				MaxKeepaliveDuration: options.HttpReadTimeout,
 				ReadTimeout:          options.HttpReadTimeout,
 				WriteTimeout:         options.HttpWriteTimeout,
-				MaxRequestBodySize:   int(options.MaxPubSize + 1),
+				MaxRequestBodySize:   int(maxPubRequestBodySize() + 1),
 				ReduceMemoryUsage:    false, // TODO
 				Handler:              this.router.Handler,
 				Logger:               logger,
@@ -113,7 +113,7 @@ func (this *pubServer) startServer(https bool) {
 		if https {
 			this.httpsListener, err = net.Listen("tcp", this.httpsServer.Addr)
 			this.httpsListener, err = setupHttpsListener(this.httpsListener,
-				this.gw.certFile, this.gw.keyFile)
+				this.gw.certFile, this.gw.keyFile, this.gw.clientCerts, false)
 			if err != nil {
 				panic(err)
 			}
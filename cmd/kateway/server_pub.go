@@ -4,16 +4,24 @@ package main
 
 import (
 	"net"
+	"time"
 )
 
 type pubServer struct {
 	*webServer
+
+	// websocket heartbeat configuration
+	wsReadLimit int64
+	wsPongWait  time.Duration
 }
 
 func newPubServer(httpAddr, httpsAddr string, maxClients int, gw *Gateway) *pubServer {
 	this := &pubServer{
-		webServer: newWebServer("pub", httpAddr, httpsAddr, maxClients, gw),
+		webServer:   newWebServer("pub", httpAddr, httpsAddr, maxClients, gw),
+		wsReadLimit: options.MaxPubSize + MaxPartitionKeyLen + 2,
+		wsPongWait:  time.Minute,
 	}
+	this.clientCerts = gw.clientCerts
 	this.onConnNewFunc = this.onConnNew
 	this.onConnCloseFunc = this.onConnClose
 
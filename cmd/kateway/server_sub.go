@@ -30,6 +30,8 @@ func newSubServer(httpAddr, httpsAddr string, maxClients int, gw *Gateway) *subS
 		wsReadLimit:  8 << 10,
 		wsPongWait:   time.Minute,
 	}
+	this.clientCerts = gw.clientCerts
+	this.http2 = true // a client multiplexes its subscriptions over one connection
 	this.waitExitFunc = this.waitExit
 	this.connStateFunc = this.connStateHandler
 
@@ -98,7 +100,14 @@ func (this *subServer) connStateHandler(c net.Conn, cs http.ConnState) {
 			this.gw.clientStates.UnregisterSubClient(c)
 		}
 
-		this.closedConnCh <- c.RemoteAddr().String()
+		remoteAddr := c.RemoteAddr().String()
+		if this.gw != nil && this.gw.inflights != nil {
+			// the consumers of the client are killed by the sub store, whose
+			// unacked messages will be redelivered to the other clients
+			this.gw.inflights.forget(remoteAddr)
+		}
+
+		this.closedConnCh <- remoteAddr
 		this.idleConnsWg.Done()
 	}
 }
@@ -25,6 +25,9 @@ type webServer struct {
 
 	router *httprouter.Router
 
+	clientCerts *clientCerts // nil if the clients are not verified by certificate
+	http2       bool         // negotiate HTTP/2 over https
+
 	waitExitFunc    waitExitFunc
 	connStateFunc   connStateFunc
 	onConnNewFunc   onConnNewFunc
@@ -121,7 +124,7 @@ func (this *webServer) startServer(https bool) {
 				}
 
 				this.httpsListener, err = setupHttpsListener(this.httpsListener,
-					this.gw.certFile, this.gw.keyFile)
+					this.gw.certFile, this.gw.keyFile, this.clientCerts, this.http2)
 				if err != nil {
 					panic(err)
 				}
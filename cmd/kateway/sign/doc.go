@@ -0,0 +1,17 @@
+// Package sign signs kateway http requests with the app secret, so that the
+// secret never goes on the wire.
+//
+// The signature is the base64 HMAC-SHA256 by the secret of the string to
+// sign, which is the newline joined:
+//
+//	appid
+//	method
+//	path
+//	sorted query
+//	hex sha256 of the body
+//	unix timestamp
+//	nonce
+//
+// The server rejects the requests whose timestamp is out of the clock skew
+// window, and the replay of a nonce within the window.
+package sign
@@ -0,0 +1,76 @@
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderTimestamp = "X-Kateway-Timestamp"
+	HeaderNonce     = "X-Kateway-Nonce"
+	HeaderDigest    = "X-Kateway-Content-Sha256"
+	HeaderSignature = "X-Kateway-Signature"
+)
+
+// Digest returns the hex sha256 of a request body.
+func Digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// StringToSign returns the canonical form of a request to sign.
+func StringToSign(appid, method, path string, query url.Values, digest, timestamp, nonce string) string {
+	return strings.Join([]string{appid, method, path, query.Encode(), digest, timestamp, nonce}, "\n")
+}
+
+// Signature returns the signature of the string to sign by the secret.
+func Signature(secret, stringToSign string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify tells whether the signature is of the string to sign by the secret.
+func Verify(secret, stringToSign, signature string) bool {
+	return hmac.Equal([]byte(signature), []byte(Signature(secret, stringToSign)))
+}
+
+// Signed tells whether a request is signed.
+func Signed(h http.Header) bool {
+	return h.Get(HeaderSignature) != ""
+}
+
+// SignRequest sets the signing headers of a request, the body is that of the
+// request. Each request must be signed again before being sent, even retries.
+func SignRequest(req *http.Request, appid, secret string, body []byte) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
+	nonce := hex.EncodeToString(b)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	digest := Digest(body)
+	stringToSign := StringToSign(appid, req.Method, req.URL.Path, req.URL.Query(), digest,
+		timestamp, nonce)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderDigest, digest)
+	req.Header.Set(HeaderSignature, Signature(secret, stringToSign))
+	return nil
+}
+
+// RequestStringToSign returns the string to sign of a received request, by
+// the signed digest of the body.
+func RequestStringToSign(appid string, r *http.Request) string {
+	return StringToSign(appid, r.Method, r.URL.Path, r.URL.Query(), r.Header.Get(HeaderDigest),
+		r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderNonce))
+}
@@ -0,0 +1,32 @@
+package sign
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/funkygao/assert"
+)
+
+func TestSignRequest(t *testing.T) {
+	body := []byte("hello world")
+	req, _ := http.NewRequest("POST", "http://localhost:9191/topics/foo/v1?key=k&async=1", nil)
+	assert.Equal(t, false, Signed(req.Header))
+	assert.Equal(t, nil, SignRequest(req, "app1", "secret", body))
+	assert.Equal(t, true, Signed(req.Header))
+	assert.Equal(t, Digest(body), req.Header.Get(HeaderDigest))
+
+	stringToSign := RequestStringToSign("app1", req)
+	assert.Equal(t, "app1\nPOST\n/topics/foo/v1\nasync=1&key=k\n"+Digest(body)+"\n"+
+		req.Header.Get(HeaderTimestamp)+"\n"+req.Header.Get(HeaderNonce), stringToSign)
+	assert.Equal(t, true, Verify("secret", stringToSign, req.Header.Get(HeaderSignature)))
+	assert.Equal(t, false, Verify("wrong", stringToSign, req.Header.Get(HeaderSignature)))
+
+	// tampered query
+	req.URL.RawQuery = "key=k&async=0"
+	assert.Equal(t, false, Verify("secret", RequestStringToSign("app1", req), req.Header.Get(HeaderSignature)))
+
+	// each signing has its own nonce
+	nonce := req.Header.Get(HeaderNonce)
+	SignRequest(req, "app1", "secret", body)
+	assert.Equal(t, false, nonce == req.Header.Get(HeaderNonce))
+}
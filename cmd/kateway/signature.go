@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/funkygao/gafka/cmd/kateway/sign"
+	log "github.com/funkygao/log4go"
+)
+
+// RequestSignature is the HMAC signature of a signed pub/sub request, which
+// authenticates the client in place of the key header.
+type RequestSignature struct {
+	StringToSign string
+	Signature    string
+	Timestamp    int64
+	Nonce        string
+	Digest       string // signed hex sha256 of the body
+
+	// checked is set once the timestamp and nonce are checked, so that the
+	// subscriptions of a multiplexed connection can share the signature.
+	checked bool
+}
+
+// parseRequestSignature returns nil if the request is not signed.
+func parseRequestSignature(appid string, r *http.Request) *RequestSignature {
+	if !sign.Signed(r.Header) {
+		return nil
+	}
+
+	timestamp, _ := strconv.ParseInt(r.Header.Get(sign.HeaderTimestamp), 10, 64)
+	return &RequestSignature{
+		StringToSign: sign.RequestStringToSign(appid, r),
+		Signature:    r.Header.Get(sign.HeaderSignature),
+		Timestamp:    timestamp,
+		Nonce:        r.Header.Get(sign.HeaderNonce),
+		Digest:       r.Header.Get(sign.HeaderDigest),
+	}
+}
+
+// nonceStore shares the nonces of the signed requests among the kateway
+// instances, so that a request replayed to another instance behind the load
+// balancer is rejected too.
+type nonceStore interface {
+	// Once records the key in the bucket, and returns false if it's already
+	// recorded by any instance.
+	Once(bucket int64, key string) (bool, error)
+
+	// Prune forgets the buckets before the bucket.
+	Prune(before int64)
+}
+
+// zkNonceStore keeps the nonces in zk, bucketed by the request timestamp so
+// that the expired ones are pruned by bucket.
+type zkNonceStore struct {
+	gw *Gateway
+}
+
+func (this *zkNonceStore) Once(bucket int64, key string) (bool, error) {
+	// the nonce is chosen by the client, never use it as a znode name
+	return this.gw.GetZkZone().CreateKatewayNonce(bucket, fmt.Sprintf("%x", sha1.Sum([]byte(key))))
+}
+
+func (this *zkNonceStore) Prune(before int64) {
+	this.gw.GetZkZone().PruneKatewayNonces(before)
+}
+
+// signatures rejects the signed requests out of the clock skew window, and
+// the replay of a nonce within the window.
+//
+// The nonces are remembered by each kateway instance, and shared by the
+// nonce store if any: a nonce is checked locally first, then fleet wide.
+type signatures struct {
+	gw     *Gateway
+	skew   time.Duration
+	shared nonceStore // nil if the nonces are local to this instance
+
+	mu     sync.Mutex
+	nonces map[string]int64 // appid.nonce:timestamp
+	pruned time.Time
+}
+
+func newSignatures(gw *Gateway, skew time.Duration, shared nonceStore) *signatures {
+	return &signatures{
+		gw:     gw,
+		skew:   skew,
+		shared: shared,
+		nonces: make(map[string]int64),
+		pruned: time.Now(),
+	}
+}
+
+// Start prunes the shared nonces out of the window periodically.
+func (this *signatures) Start() {
+	if this.shared == nil {
+		return
+	}
+
+	this.gw.wg.Add(1)
+	go func() {
+		defer this.gw.wg.Done()
+
+		ticker := time.NewTicker(this.skew)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				// the nonces of the previous bucket are valid till the end
+				// of the current bucket
+				this.shared.Prune(this.bucket(now.Unix()) - 1)
+
+			case <-this.gw.shutdownCh:
+				log.Trace("signatures stopped")
+				return
+			}
+		}
+	}()
+}
+
+// bucket returns the nonce bucket of a request timestamp, each bucket spans
+// the skew window.
+func (this *signatures) bucket(timestamp int64) int64 {
+	window := int64(this.skew / time.Second)
+	if window < 1 {
+		window = 1
+	}
+	return timestamp / window
+}
+
+// Fresh checks the timestamp of a signed request.
+func (this *signatures) Fresh(s *RequestSignature, now time.Time) error {
+	if s.Nonce == "" {
+		// can not be told from a replay
+		return ErrSignatureReplay
+	}
+
+	skew := now.Sub(time.Unix(s.Timestamp, 0))
+	if skew > this.skew || skew < -this.skew {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+// Once remembers the nonce of an authenticated signed request, and rejects
+// it if seen within the window by this instance or any other.
+// The nonce is remembered locally only after the shared check succeeds, so
+// that the retry of a request failed by the nonce store is not a replay.
+func (this *signatures) Once(appid string, s *RequestSignature, now time.Time) error {
+	key := appid + "." + s.Nonce
+
+	this.mu.Lock()
+	if now.Sub(this.pruned) > this.skew {
+		// a nonce expires when its timestamp is out of the window
+		expired := now.Add(-this.skew).Unix()
+		for k, timestamp := range this.nonces {
+			if timestamp < expired {
+				delete(this.nonces, k)
+			}
+		}
+		this.pruned = now
+	}
+
+	if _, present := this.nonces[key]; present {
+		this.mu.Unlock()
+		return ErrSignatureReplay
+	}
+	if this.shared == nil {
+		this.nonces[key] = s.Timestamp
+		this.mu.Unlock()
+		return nil
+	}
+	this.mu.Unlock()
+
+	// the concurrent requests of the same nonce race in the shared store
+	first, err := this.shared.Once(this.bucket(s.Timestamp), key)
+	if err != nil {
+		log.Error("signature nonce[%s]: %v", key, err)
+		return err
+	}
+
+	this.mu.Lock()
+	this.nonces[key] = s.Timestamp
+	this.mu.Unlock()
+	if !first {
+		return ErrSignatureReplay
+	}
+	return nil
+}
+
+// verifyBody checks the body of a signed request against the signed digest.
+func (this *RequestSignature) verifyBody(body []byte) error {
+	if this == nil || sign.Digest(body) == this.Digest {
+		return nil
+	}
+
+	return ErrBodyDigest
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/funkygao/assert"
+	"github.com/funkygao/gafka/cmd/kateway/sign"
+)
+
+func TestRequestSignature(t *testing.T) {
+	r, _ := http.NewRequest("POST", "http://localhost:9191/topics/foo/v1?key=k", nil)
+	assert.Equal(t, true, parseRequestSignature("app1", r) == nil)
+
+	body := []byte("hello")
+	sign.SignRequest(r, "app1", "secret", body)
+	s := parseRequestSignature("app1", r)
+	assert.Equal(t, true, sign.Verify("secret", s.StringToSign, s.Signature))
+	assert.Equal(t, nil, s.verifyBody(body))
+	assert.Equal(t, ErrBodyDigest, s.verifyBody([]byte("hello!")))
+
+	// not signed
+	s = nil
+	assert.Equal(t, nil, s.verifyBody(body))
+}
+
+func TestSignatures(t *testing.T) {
+	now := time.Now()
+	sigs := newSignatures(nil, time.Minute, nil)
+	s := &RequestSignature{Timestamp: now.Unix(), Nonce: "n1"}
+	assert.Equal(t, nil, sigs.Fresh(s, now))
+	assert.Equal(t, nil, sigs.Fresh(s, now.Add(-time.Minute)))
+	assert.Equal(t, ErrSignatureExpired, sigs.Fresh(s, now.Add(time.Minute*2)))
+	assert.Equal(t, ErrSignatureReplay, sigs.Fresh(&RequestSignature{Timestamp: now.Unix()}, now))
+
+	assert.Equal(t, nil, sigs.Once("app1", s, now))
+	assert.Equal(t, ErrSignatureReplay, sigs.Once("app1", s, now))
+	assert.Equal(t, nil, sigs.Once("app2", s, now))
+
+	// the nonce is forgotten after the window, when the timestamp is stale too
+	sigs.Once("app1", &RequestSignature{Timestamp: now.Unix(), Nonce: "n2"}, now.Add(time.Minute*3))
+	assert.Equal(t, 1, len(sigs.nonces))
+}
+
+type memNonceStore map[string]bool
+
+func (this memNonceStore) Once(bucket int64, key string) (bool, error) {
+	k := fmt.Sprintf("%d/%s", bucket, key)
+	if this[k] {
+		return false, nil
+	}
+
+	this[k] = true
+	return true, nil
+}
+
+func (this memNonceStore) Prune(before int64) {}
+
+var errNonceStore = errors.New("nonce store down")
+
+// brokenNonceStore fails till ok, then remembers nothing.
+type brokenNonceStore struct {
+	ok bool
+}
+
+func (this *brokenNonceStore) Once(bucket int64, key string) (bool, error) {
+	if !this.ok {
+		return false, errNonceStore
+	}
+	return true, nil
+}
+
+func (this *brokenNonceStore) Prune(before int64) {}
+
+func TestSignaturesShared(t *testing.T) {
+	now := time.Now()
+	shared := make(memNonceStore)
+	sigs1 := newSignatures(nil, time.Minute, shared)
+	sigs2 := newSignatures(nil, time.Minute, shared)
+	s := &RequestSignature{Timestamp: now.Unix(), Nonce: "n1"}
+	assert.Equal(t, nil, sigs1.Once("app1", s, now))
+
+	// replayed to another instance
+	assert.Equal(t, ErrSignatureReplay, sigs2.Once("app1", s, now))
+	assert.Equal(t, nil, sigs2.Once("app2", s, now))
+
+	// the nonce store fails, the retry is not a replay
+	broken := &brokenNonceStore{}
+	sigs3 := newSignatures(nil, time.Minute, broken)
+	assert.Equal(t, errNonceStore, sigs3.Once("app1", s, now))
+	broken.ok = true
+	assert.Equal(t, nil, sigs3.Once("app1", s, now))
+	assert.Equal(t, ErrSignatureReplay, sigs3.Once("app1", s, now))
+
+	assert.Equal(t, int64(2), sigs1.bucket(120))
+	assert.Equal(t, int64(120), newSignatures(nil, time.Millisecond, nil).bucket(120))
+}
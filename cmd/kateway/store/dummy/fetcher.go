@@ -20,4 +20,8 @@ func (this *consumerFetcher) CommitUpto(*sarama.ConsumerMessage) error {
 	return nil
 }
 
+func (this *consumerFetcher) FlushOffsets() error {
+	return nil
+}
+
 func (this *consumerFetcher) Close() {}
@@ -2,6 +2,9 @@ package dummy
 
 import (
 	"sync"
+	"time"
+
+	"github.com/funkygao/gafka/cmd/kateway/store"
 )
 
 type pubStore struct {
@@ -31,3 +34,13 @@ func (this *pubStore) AsyncPub(cluster string, topic string, key,
 
 	return
 }
+
+func (this *pubStore) SyncPubBatch(cluster string, topic string,
+	msgs []*store.PubMessage) (err error) {
+	return
+}
+
+func (this *pubStore) DelayPub(cluster string, topic string, key,
+	msg []byte, due time.Time) (err error) {
+	return
+}
@@ -44,3 +44,7 @@ func (this *subStore) Name() string {
 func (this *subStore) Fetch(cluster, topic, group, remoteAddr, reset string) (store.Fetcher, error) {
 	return this.fetcher, nil
 }
+
+func (this *subStore) Groups() []store.GroupStatus {
+	return nil
+}
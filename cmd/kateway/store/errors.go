@@ -9,6 +9,10 @@ var (
 	ErrBusy             = errors.New("server too busy")
 	ErrTooManyConsumers = errors.New("consumers larger than available partitions")
 	ErrRebalancing      = errors.New("rebalancing, please retry after a while")
+	ErrClientGone       = errors.New("client gone while joining the group")
 	ErrInvalidCluster   = errors.New("invalid cluster")
 	ErrEmptyBrokers     = errors.New("empty broker list")
+	ErrDelayDisabled    = errors.New("delayed pub disabled")
+	ErrDelayTopic       = errors.New("fail to create delay topic")
+	ErrLeaseLost        = errors.New("partition lease lost, offset not committed")
 )
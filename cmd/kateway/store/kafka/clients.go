@@ -0,0 +1,69 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/gafka/cmd/kateway/meta"
+	"github.com/funkygao/gafka/cmd/kateway/store"
+	log "github.com/funkygao/log4go"
+)
+
+// saramaClients is the kafka clients of each cluster that are shared by the
+// partition consumers and the offset commits.
+type saramaClients struct {
+	clientID string
+
+	mu      sync.Mutex
+	clients map[string]sarama.Client // cluster:client
+}
+
+func newSaramaClients(clientID string) *saramaClients {
+	return &saramaClients{
+		clientID: clientID,
+		clients:  make(map[string]sarama.Client),
+	}
+}
+
+func (this *saramaClients) Get(cluster string) (sarama.Client, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if client, present := this.clients[cluster]; present && !client.Closed() {
+		return client, nil
+	}
+
+	brokerList := meta.Default.BrokerList(cluster)
+	if len(brokerList) == 0 {
+		return nil, store.ErrEmptyBrokers
+	}
+
+	cf := sarama.NewConfig()
+	cf.Net.DialTimeout = time.Second * 10
+	cf.Net.ReadTimeout = time.Second * 10
+	cf.Net.WriteTimeout = time.Second * 10
+	cf.Metadata.RefreshFrequency = time.Minute * 10
+	cf.Consumer.Return.Errors = true
+	cf.ChannelBufferSize = 0 // the prefetched messages are refetched by the next lease owner
+	cf.ClientID = this.clientID
+
+	client, err := sarama.NewClient(brokerList, cf)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Trace("cluster[%s] kafka client connected: %+v", cluster, brokerList)
+	this.clients[cluster] = client
+	return client, nil
+}
+
+func (this *saramaClients) Close() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for cluster, client := range this.clients {
+		client.Close()
+		delete(this.clients, cluster)
+	}
+}
@@ -0,0 +1,459 @@
+package kafka
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/gafka/cmd/kateway/meta"
+	"github.com/funkygao/gafka/cmd/kateway/store"
+	"github.com/funkygao/gafka/ctx"
+	"github.com/funkygao/gafka/zk"
+	log "github.com/funkygao/log4go"
+)
+
+const (
+	// DelayTopic is the internal topic of each cluster where delayed messages
+	// are parked before they are due.
+	DelayTopic = "__kateway_delay"
+
+	// DelayBuriedTopic is the internal topic of each cluster where the due
+	// messages that can't be published to their target topic are buried, e,g.
+	// the target topic is deleted.
+	DelayBuriedTopic = "__kateway_delay_buried"
+
+	delayGroup = "__kateway_delay"
+
+	// the delay topic spreads among the schedulers by partition
+	delayTopicPartitions = 8
+
+	delayEnvelopeVer        = 1
+	delaySpilledEnvelopeVer = 2
+
+	// max parked messages in memory of a single cluster scheduler, when
+	// exceeded the messages not due soon are spilled back to the delay topic.
+	maxPendingDelayedMessages = 100000
+
+	// a spilled message is parked again no sooner than this interval, so the
+	// spilled messages are cycled through at most once per interval, and a
+	// message behind them is late by at most the interval.
+	delaySpillInterval = time.Minute
+
+	// a due message is buried after failing to pub this many times
+	maxDelayedPubAttempts = 10
+	delayMinBackoff       = time.Second
+	delayMaxBackoff       = time.Minute
+)
+
+var (
+	ErrInvalidDelayEnvelope = errors.New("invalid delay envelope")
+)
+
+// delayedMessage is a message parked in the delay topic.
+type delayedMessage struct {
+	Due     time.Time
+	Spilled time.Time // zero unless spilled back to the delay topic
+	Topic   string
+	Key     []byte
+	Value   []byte
+
+	// where the envelope resides in the delay topic
+	partition int32
+	offset    int64
+
+	attempts int // failed pubs to the target topic
+	backoff  time.Duration
+}
+
+// encodeDelayEnvelope wraps a message into the delay topic payload:
+// ver(1) due(8, unix ms) topicLen(2) topic keyLen(2) key value
+func encodeDelayEnvelope(due time.Time, topic string, key, value []byte) []byte {
+	return encodeEnvelope(delayEnvelopeVer, due, time.Time{}, topic, key, value)
+}
+
+// encodeSpilledDelayEnvelope wraps a spilled message into the delay topic payload:
+// ver(1) due(8, unix ms) spilled(8, unix ms) topicLen(2) topic keyLen(2) key value
+func encodeSpilledDelayEnvelope(dm *delayedMessage) []byte {
+	return encodeEnvelope(delaySpilledEnvelopeVer, dm.Due, dm.Spilled, dm.Topic, dm.Key, dm.Value)
+}
+
+func encodeEnvelope(ver byte, due, spilled time.Time, topic string, key, value []byte) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 21+len(topic)+len(key)+len(value)))
+	buf.WriteByte(ver)
+	binary.Write(buf, binary.BigEndian, due.UnixNano()/int64(time.Millisecond))
+	if ver == delaySpilledEnvelopeVer {
+		binary.Write(buf, binary.BigEndian, spilled.UnixNano()/int64(time.Millisecond))
+	}
+	binary.Write(buf, binary.BigEndian, uint16(len(topic)))
+	buf.WriteString(topic)
+	binary.Write(buf, binary.BigEndian, uint16(len(key)))
+	buf.Write(key)
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+func decodeDelayEnvelope(b []byte) (*delayedMessage, error) {
+	if len(b) < 13 || (b[0] != delayEnvelopeVer && b[0] != delaySpilledEnvelopeVer) {
+		return nil, ErrInvalidDelayEnvelope
+	}
+
+	dm := &delayedMessage{}
+	dm.Due = unixMs(int64(binary.BigEndian.Uint64(b[1:9])))
+	ver := b[0]
+	b = b[9:]
+	if ver == delaySpilledEnvelopeVer {
+		if len(b) < 12 {
+			return nil, ErrInvalidDelayEnvelope
+		}
+		dm.Spilled = unixMs(int64(binary.BigEndian.Uint64(b[:8])))
+		b = b[8:]
+	}
+
+	topicLen := int(binary.BigEndian.Uint16(b[:2]))
+	b = b[2:]
+	if len(b) < topicLen+2 {
+		return nil, ErrInvalidDelayEnvelope
+	}
+	dm.Topic = string(b[:topicLen])
+	b = b[topicLen:]
+	keyLen := int(binary.BigEndian.Uint16(b[:2]))
+	b = b[2:]
+	if len(b) < keyLen {
+		return nil, ErrInvalidDelayEnvelope
+	}
+
+	dm.Key, dm.Value = b[:keyLen], b[keyLen:]
+	return dm, nil
+}
+
+func unixMs(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// delayQueue is a min heap of delayed messages ordered by due time.
+type delayQueue []*delayedMessage
+
+func (q delayQueue) Len() int            { return len(q) }
+func (q delayQueue) Less(i, j int) bool  { return q[i].Due.Before(q[j].Due) }
+func (q delayQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *delayQueue) Push(x interface{}) { *q = append(*q, x.(*delayedMessage)) }
+func (q *delayQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	m := old[n-1]
+	*q = old[:n-1]
+	return m
+}
+
+// delayScheduler consumes the delay topic of a cluster and re-publishes
+// each parked message into its target topic when due.
+//
+// Offset of the delay topic is committed only up to the lowest offset
+// that is still pending, so a kateway restart or rebalance will resume the
+// parked messages from kafka: a message might be delivered more than once
+// but never earlier than due.
+//
+// The delay group is a member of the kafka group coordinator, so that the
+// scheduler drops the parked messages of the previous generation on each
+// rebalance instead of delivering the partitions of the other members.
+type delayScheduler struct {
+	store   *pubStore
+	cluster string
+
+	clients    *saramaClients
+	cg         *kafkaGroup
+	rebalanced chan struct{}
+
+	queue   delayQueue
+	pending map[int32][]int64 // {partition: sorted pending offsets}
+	highest map[int32]int64   // {partition: highest consumed offset}
+	commits map[int32]int64   // {partition: committed offset}
+
+	// read again too soon after it was spilled: the scheduler has cycled
+	// through the spilled messages, and waits for the spill interval
+	held *sarama.ConsumerMessage
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newDelayScheduler(store *pubStore, cluster string) *delayScheduler {
+	return &delayScheduler{
+		store:      store,
+		cluster:    cluster,
+		clients:    newSaramaClients(ctx.Hostname()),
+		rebalanced: make(chan struct{}),
+		queue:      make(delayQueue, 0, 1000),
+		pending:    make(map[int32][]int64),
+		highest:    make(map[int32]int64),
+		commits:    make(map[int32]int64),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func (this *delayScheduler) Start() (err error) {
+	zkcluster := meta.Default.ZkCluster(this.cluster)
+	if zkcluster == nil {
+		return store.ErrInvalidCluster
+	}
+	if err = this.adoptZkOffsets(zkcluster); err != nil && err != zk.ErrConsumerGroupOnline {
+		return
+	}
+
+	client, err := this.clients.Get(this.cluster)
+	if err != nil {
+		return
+	}
+
+	this.cg, err = joinKafkaGroup(client, this.cluster, DelayTopic, delayGroup,
+		sarama.OffsetOldest, false, time.Second*10, this.rebalanced)
+	if err != nil {
+		this.clients.Close()
+		return
+	}
+
+	go this.run()
+
+	log.Trace("cluster[%s] delay scheduler started", this.cluster)
+	return
+}
+
+// adoptZkOffsets copies the offsets that the delay group committed to zk
+// before it moved to the kafka group coordinator, so that the parked messages
+// are neither replayed from the oldest nor skipped. The first scheduler to
+// join does it, the online members have adopted them already.
+func (this *delayScheduler) adoptZkOffsets(zkcluster *zk.ZkCluster) error {
+	offsets, err := zkcluster.KafkaConsumerOffsetsOfTopic(delayGroup, DelayTopic)
+	if err != nil || len(offsets) > 0 {
+		return err
+	}
+
+	if offsets = zkcluster.ConsumerOffsetsOfTopic(delayGroup, DelayTopic); len(offsets) == 0 {
+		return nil
+	}
+
+	log.Info("cluster[%s] delay group adopts zk offsets %+v", this.cluster, offsets)
+	return zkcluster.CommitKafkaConsumerOffsets(delayGroup, map[string]map[int32]int64{DelayTopic: offsets})
+}
+
+func (this *delayScheduler) Stop() {
+	close(this.quit)
+	<-this.done
+
+	// will flush the committed offsets
+	this.cg.Close()
+	this.clients.Close()
+
+	log.Trace("cluster[%s] delay scheduler stopped with %d pending",
+		this.cluster, len(this.queue))
+}
+
+func (this *delayScheduler) run() {
+	defer close(this.done)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		// the held message is parked before the next one
+		messages := this.cg.Messages()
+		if this.held != nil {
+			messages = nil
+		}
+
+		timer.Reset(this.nextWait())
+
+		select {
+		case <-this.quit:
+			return
+
+		case msg := <-messages:
+			this.park(msg, time.Now())
+
+		case err := <-this.cg.Errors():
+			log.Error("cluster[%s] delay scheduler: %v", this.cluster, err)
+
+		case <-this.rebalanced:
+			this.reset()
+
+		case <-timer.C:
+			this.deliverDue()
+
+			if msg := this.held; msg != nil {
+				this.held = nil
+				this.park(msg, time.Now())
+			}
+		}
+	}
+}
+
+func (this *delayScheduler) nextWait() time.Duration {
+	wait := time.Minute
+	if len(this.queue) > 0 {
+		wait = this.queue[0].Due.Sub(time.Now())
+	}
+	if this.held != nil {
+		if dm, err := decodeDelayEnvelope(this.held.Value); err == nil {
+			if held := dm.Spilled.Add(delaySpillInterval).Sub(time.Now()); held < wait {
+				wait = held
+			}
+		}
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// reset drops the parked messages on rebalance: the partitions kept by this
+// member are consumed again from the committed offsets, and the revoked ones
+// by their new owners.
+func (this *delayScheduler) reset() {
+	log.Trace("cluster[%s] delay scheduler rebalanced, %d parked dropped", this.cluster, len(this.queue))
+
+	this.queue = make(delayQueue, 0, 1000)
+	this.pending = make(map[int32][]int64)
+	this.highest = make(map[int32]int64)
+	this.commits = make(map[int32]int64)
+	this.held = nil
+}
+
+func (this *delayScheduler) park(msg *sarama.ConsumerMessage, now time.Time) {
+	dm, err := decodeDelayEnvelope(msg.Value)
+	if err != nil {
+		// poison message, skip it
+		log.Error("cluster[%s] delay P:%d O:%d %v", this.cluster, msg.Partition, msg.Offset, err)
+		this.consumed(msg)
+		this.commit(msg.Partition)
+		return
+	}
+
+	offsets := this.pending[msg.Partition]
+	i := sort.Search(len(offsets), func(i int) bool { return offsets[i] >= msg.Offset })
+	if i < len(offsets) && offsets[i] == msg.Offset {
+		// a message of the previous generation consumed again
+		return
+	}
+
+	if len(this.queue) >= maxPendingDelayedMessages && dm.Due.After(now.Add(delaySpillInterval)) {
+		if now.Sub(dm.Spilled) < delaySpillInterval {
+			this.held = msg
+			return
+		}
+
+		if this.spill(dm, now) {
+			this.consumed(msg)
+			this.commit(msg.Partition)
+			return
+		}
+	}
+
+	this.consumed(msg)
+	dm.partition, dm.offset = msg.Partition, msg.Offset
+	offsets = append(offsets, 0)
+	copy(offsets[i+1:], offsets[i:])
+	offsets[i] = msg.Offset
+	this.pending[msg.Partition] = offsets
+	heap.Push(&this.queue, dm)
+}
+
+func (this *delayScheduler) consumed(msg *sarama.ConsumerMessage) {
+	if highest, present := this.highest[msg.Partition]; !present || msg.Offset > highest {
+		this.highest[msg.Partition] = msg.Offset
+	}
+}
+
+// spill appends the message to the tail of the delay topic instead of
+// parking it in memory, so that the scheduler keeps consuming the messages
+// behind it that might be due sooner.
+func (this *delayScheduler) spill(dm *delayedMessage, now time.Time) bool {
+	dm.Spilled = now
+	if _, _, err := this.store.SyncPub(this.cluster, DelayTopic, dm.Key, encodeSpilledDelayEnvelope(dm)); err != nil {
+		log.Error("cluster[%s] delayed topic:%s spill: %v", this.cluster, dm.Topic, err)
+		return false
+	}
+
+	return true
+}
+
+func (this *delayScheduler) deliverDue() {
+	now := time.Now()
+	for len(this.queue) > 0 && !this.queue[0].Due.After(now) {
+		dm := heap.Pop(&this.queue).(*delayedMessage)
+		_, _, err := this.store.SyncPub(this.cluster, dm.Topic, dm.Key, dm.Value)
+		if err != nil {
+			dm.attempts++
+			if dm.attempts >= maxDelayedPubAttempts {
+				err = this.bury(dm, err)
+			}
+		}
+		if err != nil {
+			// park it again and retry later
+			if dm.backoff *= 2; dm.backoff < delayMinBackoff {
+				dm.backoff = delayMinBackoff
+			} else if dm.backoff > delayMaxBackoff {
+				dm.backoff = delayMaxBackoff
+			}
+			log.Error("cluster[%s] delayed topic:%s %v, retry in %s", this.cluster, dm.Topic, err, dm.backoff)
+			dm.Due = now.Add(dm.backoff)
+			heap.Push(&this.queue, dm)
+			continue
+		}
+
+		this.ack(dm.partition, dm.offset)
+	}
+}
+
+// bury moves a due message that keeps failing to pub into the buried topic,
+// otherwise it would pin the committed offset of its partition forever.
+func (this *delayScheduler) bury(dm *delayedMessage, cause error) error {
+	_, _, err := this.store.SyncPub(this.cluster, DelayBuriedTopic, dm.Key,
+		encodeDelayEnvelope(dm.Due, dm.Topic, dm.Key, dm.Value))
+	if err != nil {
+		return err
+	}
+
+	log.Warn("cluster[%s] delayed topic:%s P:%d O:%d buried after %d attempts: %v",
+		this.cluster, dm.Topic, dm.partition, dm.offset, dm.attempts, cause)
+	return nil
+}
+
+// ack removes an offset from pending and advances the committed offset
+// up to the lowest pending one.
+func (this *delayScheduler) ack(partition int32, offset int64) {
+	offsets := this.pending[partition]
+	i := sort.Search(len(offsets), func(i int) bool { return offsets[i] >= offset })
+	if i < len(offsets) && offsets[i] == offset {
+		this.pending[partition] = append(offsets[:i], offsets[i+1:]...)
+	}
+
+	this.commit(partition)
+}
+
+func (this *delayScheduler) commit(partition int32) {
+	upto := this.highest[partition]
+	if offsets := this.pending[partition]; len(offsets) > 0 {
+		upto = offsets[0] - 1
+	}
+
+	if committed, present := this.commits[partition]; present && committed >= upto {
+		return
+	}
+
+	if err := this.cg.CommitUpto(&sarama.ConsumerMessage{
+		Topic:     DelayTopic,
+		Partition: partition,
+		Offset:    upto,
+	}); err != nil {
+		log.Error("cluster[%s] delay commit P:%d O:%d %v", this.cluster, partition, upto, err)
+		return
+	}
+
+	this.commits[partition] = upto
+}
@@ -0,0 +1,70 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/assert"
+)
+
+func TestDelayEnvelope(t *testing.T) {
+	due := time.Unix(1460000000, 123*int64(time.Millisecond))
+	b := encodeDelayEnvelope(due, "app1.foobar.v1", []byte("key"), []byte("hello world"))
+	dm, err := decodeDelayEnvelope(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, due.UnixNano(), dm.Due.UnixNano())
+	assert.Equal(t, "app1.foobar.v1", dm.Topic)
+	assert.Equal(t, "key", string(dm.Key))
+	assert.Equal(t, "hello world", string(dm.Value))
+
+	// keyless
+	b = encodeDelayEnvelope(due, "app1.foobar.v1", nil, []byte("hello"))
+	dm, err = decodeDelayEnvelope(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(dm.Key))
+	assert.Equal(t, "hello", string(dm.Value))
+
+	_, err = decodeDelayEnvelope([]byte("hello"))
+	assert.Equal(t, ErrInvalidDelayEnvelope, err)
+	_, err = decodeDelayEnvelope(b[:15])
+	assert.Equal(t, ErrInvalidDelayEnvelope, err)
+}
+
+func TestDelaySpilledEnvelope(t *testing.T) {
+	dm := &delayedMessage{
+		Due:     time.Unix(1460000000, 0),
+		Spilled: time.Unix(1450000000, 456*int64(time.Millisecond)),
+		Topic:   "app1.foobar.v1",
+		Key:     []byte("key"),
+		Value:   []byte("hello world"),
+	}
+	got, err := decodeDelayEnvelope(encodeSpilledDelayEnvelope(dm))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, dm.Due.UnixNano(), got.Due.UnixNano())
+	assert.Equal(t, dm.Spilled.UnixNano(), got.Spilled.UnixNano())
+	assert.Equal(t, "app1.foobar.v1", got.Topic)
+	assert.Equal(t, "key", string(got.Key))
+	assert.Equal(t, "hello world", string(got.Value))
+
+	// never spilled
+	got, err = decodeDelayEnvelope(encodeDelayEnvelope(dm.Due, dm.Topic, nil, dm.Value))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, got.Spilled.IsZero())
+}
+
+func TestDelaySchedulerParkDedupAndReset(t *testing.T) {
+	s := newDelayScheduler(nil, "c1")
+	now := time.Now()
+	payload := encodeDelayEnvelope(now.Add(time.Hour), "app1.foobar.v1", nil, []byte("hello"))
+	for _, offset := range []int64{5, 3, 5, 4} {
+		s.park(&sarama.ConsumerMessage{Topic: DelayTopic, Partition: 1, Offset: offset, Value: payload}, now)
+	}
+	assert.Equal(t, 3, len(s.queue))
+	assert.Equal(t, []int64{3, 4, 5}, s.pending[1])
+	assert.Equal(t, int64(5), s.highest[1])
+
+	s.reset()
+	assert.Equal(t, 0, len(s.queue))
+	assert.Equal(t, 0, len(s.pending))
+}
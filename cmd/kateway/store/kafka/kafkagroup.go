@@ -0,0 +1,512 @@
+package kafka
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/gafka/ctx"
+	log "github.com/funkygao/log4go"
+)
+
+// groupConsumer is a consumer of a consumer group: kafka-cg whose membership
+// and offsets are in zk, or kafkaGroup whose membership and offsets are managed
+// by the kafka group coordinator.
+type groupConsumer interface {
+	Messages() <-chan *sarama.ConsumerMessage
+	Errors() <-chan *sarama.ConsumerError
+	CommitUpto(*sarama.ConsumerMessage) error
+	FlushOffsets() error
+	Close() error
+}
+
+const (
+	kafkaGroupSessionTimeout = time.Second * 30
+	kafkaGroupProtocol       = "range"
+)
+
+// kafkaGroup consumes a topic as a member of a consumer group by the kafka
+// group coordinator: JoinGroup/SyncGroup/Heartbeat for the partitions, and
+// OffsetFetch/OffsetCommit for the offsets.
+type kafkaGroup struct {
+	client   sarama.Client
+	consumer sarama.Consumer
+
+	cluster, topic, group string
+	initial               int64 // where to consume if the group never committed
+	reset                 bool  // consume from initial regardless of the committed offsets
+	commitInterval        time.Duration
+
+	// written under mu by the loop goroutine, FlushOffsets reads them too
+	memberID   string
+	generation int32
+
+	messages chan *sarama.ConsumerMessage
+	errors   chan *sarama.ConsumerError
+
+	mu      sync.Mutex
+	pcs     map[int32]sarama.PartitionConsumer // assigned partitions of current generation
+	marked  map[int32]int64                    // next offset to commit of each assigned partition
+	flushed map[int32]int64
+	revoke  chan struct{} // closed when the partitions of current generation are revoked
+
+	// if not nil, told after the partitions are revoked and before rejoin,
+	// so that the receiver drops the state of the previous generation
+	rebalanced chan<- struct{}
+
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func joinKafkaGroup(client sarama.Client, cluster, topic, group string,
+	initial int64, reset bool, commitInterval time.Duration, rebalanced chan<- struct{}) (*kafkaGroup, error) {
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &kafkaGroup{
+		client:         client,
+		consumer:       consumer,
+		cluster:        cluster,
+		topic:          topic,
+		group:          group,
+		initial:        initial,
+		reset:          reset,
+		commitInterval: commitInterval,
+		rebalanced:     rebalanced,
+		messages:       make(chan *sarama.ConsumerMessage),
+		errors:         make(chan *sarama.ConsumerError),
+		quit:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	if err = this.join(); err != nil {
+		// no ghost member nor leaked consumer left by the retries
+		this.leave()
+		consumer.Close()
+		return nil, err
+	}
+
+	go this.loop()
+	return this, nil
+}
+
+func (this *kafkaGroup) Messages() <-chan *sarama.ConsumerMessage {
+	return this.messages
+}
+
+func (this *kafkaGroup) Errors() <-chan *sarama.ConsumerError {
+	return this.errors
+}
+
+// CommitUpto marks the message consumed, the offsets are committed each
+// commit interval, on rebalance and on close.
+func (this *kafkaGroup) CommitUpto(msg *sarama.ConsumerMessage) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// revoked partitions are ignored: the new owner consumes them again, and
+	// so are the offsets below the mark, e.g. of an earlier generation
+	if marked, present := this.marked[msg.Partition]; present && msg.Offset+1 > marked {
+		this.marked[msg.Partition] = msg.Offset + 1
+	}
+	return nil
+}
+
+// FlushOffsets commits the marked offsets now.
+func (this *kafkaGroup) FlushOffsets() error {
+	return this.commit()
+}
+
+// Close commits the offsets and leaves the group.
+func (this *kafkaGroup) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.quit)
+		<-this.done
+	})
+	return nil
+}
+
+func (this *kafkaGroup) coordinator() (*sarama.Broker, error) {
+	return this.client.Coordinator(this.group)
+}
+
+// join joins the group and consumes the partitions assigned to this member.
+func (this *kafkaGroup) join() error {
+	coordinator, err := this.coordinator()
+	if err != nil {
+		return err
+	}
+
+	joinReq := &sarama.JoinGroupRequest{
+		GroupId:        this.group,
+		SessionTimeout: int32(kafkaGroupSessionTimeout / time.Millisecond),
+		MemberId:       this.memberID,
+		ProtocolType:   "consumer",
+	}
+	joinReq.AddGroupProtocolMetadata(kafkaGroupProtocol, &sarama.ConsumerGroupMemberMetadata{
+		Topics:   []string{this.topic},
+		UserData: []byte(ctx.Hostname()),
+	})
+	joinResp, err := coordinator.JoinGroup(joinReq)
+	if err != nil {
+		return err
+	}
+	switch joinResp.Err {
+	case sarama.ErrNoError:
+	case sarama.ErrUnknownMemberId:
+		this.mu.Lock()
+		this.memberID = ""
+		this.mu.Unlock()
+		return joinResp.Err
+	case sarama.ErrNotCoordinatorForConsumer:
+		this.client.RefreshCoordinator(this.group)
+		return joinResp.Err
+	default:
+		return joinResp.Err
+	}
+	this.mu.Lock()
+	this.memberID, this.generation = joinResp.MemberId, joinResp.GenerationId
+	this.mu.Unlock()
+
+	syncReq := &sarama.SyncGroupRequest{
+		GroupId:      this.group,
+		GenerationId: this.generation,
+		MemberId:     this.memberID,
+	}
+	if joinResp.LeaderId == this.memberID {
+		// the leader assigns the partitions to all the members
+		members, err := joinResp.GetMembers()
+		if err != nil {
+			return err
+		}
+		memberIDs := make([]string, 0, len(members))
+		for memberID := range members {
+			memberIDs = append(memberIDs, memberID)
+		}
+
+		partitions, err := this.client.Partitions(this.topic)
+		if err != nil {
+			return err
+		}
+		for memberID, assigned := range rangeAssign(memberIDs, partitions) {
+			syncReq.AddGroupAssignmentMember(memberID, &sarama.ConsumerGroupMemberAssignment{
+				Topics: map[string][]int32{this.topic: assigned},
+			})
+		}
+	}
+	syncResp, err := coordinator.SyncGroup(syncReq)
+	if err != nil {
+		return err
+	}
+	if syncResp.Err != sarama.ErrNoError {
+		return syncResp.Err
+	}
+	assignment, err := syncResp.GetMemberAssignment()
+	if err != nil {
+		return err
+	}
+
+	if err = this.consume(coordinator, assignment.Topics[this.topic]); err != nil {
+		// give the assigned partitions back to the group instead of stalling them
+		this.leave()
+		return err
+	}
+	return nil
+}
+
+// leave leaves the group so that the coordinator rebalances the partitions of
+// this member to the others. The next heartbeat fails with unknown member,
+// which rejoins.
+func (this *kafkaGroup) leave() {
+	this.mu.Lock()
+	memberID := this.memberID
+	this.memberID, this.generation = "", 0
+	this.mu.Unlock()
+	if memberID == "" {
+		return
+	}
+
+	coordinator, err := this.coordinator()
+	if err == nil {
+		_, err = coordinator.LeaveGroup(&sarama.LeaveGroupRequest{
+			GroupId:  this.group,
+			MemberId: memberID,
+		})
+	}
+	if err != nil {
+		log.Error("cluster[%s] %s group[%s] member %s leave: %v", this.cluster, this.topic, this.group, memberID, err)
+	}
+}
+
+// consume starts consuming the assigned partitions from the committed offsets.
+func (this *kafkaGroup) consume(coordinator *sarama.Broker, partitions []int32) error {
+	offsets := make(map[int32]int64, len(partitions))
+	if !this.reset {
+		req := &sarama.OffsetFetchRequest{ConsumerGroup: this.group, Version: 1}
+		for _, partition := range partitions {
+			req.AddPartition(this.topic, partition)
+		}
+		resp, err := coordinator.FetchOffset(req)
+		if err != nil {
+			return err
+		}
+		for _, partition := range partitions {
+			if block := resp.GetBlock(this.topic, partition); block != nil && block.Err == sarama.ErrNoError && block.Offset >= 0 {
+				offsets[partition] = block.Offset
+			}
+		}
+	}
+	// reset once, not on each rebalance
+	this.reset = false
+
+	pcs := make(map[int32]sarama.PartitionConsumer, len(partitions))
+	marked := make(map[int32]int64, len(partitions))
+	for _, partition := range partitions {
+		offset, present := offsets[partition]
+		if !present {
+			offset = this.initial
+		}
+
+		pc, err := this.consumer.ConsumePartition(this.topic, partition, offset)
+		if err == sarama.ErrOffsetOutOfRange {
+			pc, err = this.consumer.ConsumePartition(this.topic, partition, this.initial)
+		}
+		if err != nil {
+			for _, pc := range pcs {
+				pc.Close()
+			}
+			return err
+		}
+
+		pcs[partition] = pc
+		marked[partition] = offset
+	}
+
+	revoke := make(chan struct{})
+	this.mu.Lock()
+	this.pcs, this.marked, this.revoke = pcs, marked, revoke
+	this.flushed = make(map[int32]int64, len(partitions))
+	for partition, offset := range marked {
+		this.flushed[partition] = offset
+	}
+	this.mu.Unlock()
+
+	for _, pc := range pcs {
+		go this.forward(pc, revoke)
+	}
+
+	log.Trace("cluster[%s] %s group[%s] member %s generation %d assigned %+v",
+		this.cluster, this.topic, this.group, this.memberID, this.generation, partitions)
+	return nil
+}
+
+func (this *kafkaGroup) forward(pc sarama.PartitionConsumer, revoke chan struct{}) {
+	for {
+		select {
+		case msg, ok := <-pc.Messages():
+			if !ok {
+				return
+			}
+
+			select {
+			case this.messages <- msg:
+			case <-revoke:
+				return
+			}
+
+		case err, ok := <-pc.Errors():
+			if !ok {
+				return
+			}
+
+			select {
+			case this.errors <- err:
+			case <-revoke:
+				return
+			}
+
+		case <-revoke:
+			return
+		}
+	}
+}
+
+// release commits the offsets and stops consuming the assigned partitions.
+func (this *kafkaGroup) release() {
+	this.commit()
+
+	this.mu.Lock()
+	pcs, revoke := this.pcs, this.revoke
+	this.pcs, this.marked, this.flushed, this.revoke = nil, nil, nil, nil
+	this.mu.Unlock()
+
+	if revoke != nil {
+		close(revoke)
+	}
+	for partition, pc := range pcs {
+		if err := pc.Close(); err != nil {
+			log.Error("cluster[%s] %s/%d group[%s] %v", this.cluster, this.topic, partition, this.group, err)
+		}
+	}
+}
+
+// commit commits the marked offsets that changed since last commit.
+func (this *kafkaGroup) commit() error {
+	req := &sarama.OffsetCommitRequest{
+		ConsumerGroup: this.group,
+		RetentionTime: -1, // broker default
+		Version:       2,
+	}
+
+	this.mu.Lock()
+	req.ConsumerGroupGeneration, req.ConsumerID = this.generation, this.memberID
+	dirty := make(map[int32]int64)
+	for partition, offset := range this.marked {
+		if offset > this.flushed[partition] {
+			dirty[partition] = offset
+			req.AddBlock(this.topic, partition, offset, 0, "")
+		}
+	}
+	this.mu.Unlock()
+
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	coordinator, err := this.coordinator()
+	if err != nil {
+		log.Error("cluster[%s] %s group[%s] commit %+v: %v", this.cluster, this.topic, this.group, dirty, err)
+		return err
+	}
+	resp, err := coordinator.CommitOffset(req)
+	if err != nil {
+		log.Error("cluster[%s] %s group[%s] commit %+v: %v", this.cluster, this.topic, this.group, dirty, err)
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for partition, offset := range dirty {
+		if kerr := resp.Errors[this.topic][partition]; kerr != sarama.ErrNoError {
+			log.Error("cluster[%s] %s/%d group[%s] commit %d: %v", this.cluster, this.topic, partition, this.group, offset, kerr)
+			err = kerr
+			continue
+		}
+		if this.flushed != nil && offset > this.flushed[partition] {
+			this.flushed[partition] = offset
+		}
+	}
+	return err
+}
+
+func (this *kafkaGroup) heartbeat() error {
+	coordinator, err := this.coordinator()
+	if err != nil {
+		return err
+	}
+
+	resp, err := coordinator.Heartbeat(&sarama.HeartbeatRequest{
+		GroupId:      this.group,
+		GenerationId: this.generation,
+		MemberId:     this.memberID,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Err != sarama.ErrNoError {
+		return resp.Err
+	}
+	return nil
+}
+
+func (this *kafkaGroup) loop() {
+	defer close(this.done)
+
+	heartbeatTicker := time.NewTicker(kafkaGroupSessionTimeout / 10)
+	defer heartbeatTicker.Stop()
+	commitTicker := time.NewTicker(this.commitInterval)
+	defer commitTicker.Stop()
+
+	for {
+		select {
+		case <-heartbeatTicker.C:
+			switch err := this.heartbeat(); err {
+			case nil:
+
+			case sarama.ErrRebalanceInProgress, sarama.ErrIllegalGeneration, sarama.ErrUnknownMemberId:
+				log.Trace("cluster[%s] %s group[%s] member %s rebalance: %v",
+					this.cluster, this.topic, this.group, this.memberID, err)
+
+				this.release()
+				if this.rebalanced != nil {
+					select {
+					case this.rebalanced <- struct{}{}:
+					case <-this.quit:
+					}
+				}
+				if err == sarama.ErrUnknownMemberId {
+					this.mu.Lock()
+					this.memberID = ""
+					this.mu.Unlock()
+				}
+				if err = this.join(); err != nil {
+					// retry on next heartbeat, which fails without generation
+					log.Error("cluster[%s] %s group[%s] rejoin: %v", this.cluster, this.topic, this.group, err)
+				}
+
+			case sarama.ErrNotCoordinatorForConsumer:
+				this.client.RefreshCoordinator(this.group)
+
+			default:
+				log.Error("cluster[%s] %s group[%s] heartbeat: %v", this.cluster, this.topic, this.group, err)
+			}
+
+		case <-commitTicker.C:
+			this.commit()
+
+		case <-this.quit:
+			this.release()
+			this.leave()
+
+			if err := this.consumer.Close(); err != nil {
+				log.Error("cluster[%s] %s group[%s] %v", this.cluster, this.topic, this.group, err)
+			}
+			return
+		}
+	}
+}
+
+// rangeAssign assigns the partitions to the members in ranges, the first
+// members get one more partition if not evenly divided.
+func rangeAssign(members []string, partitions []int32) map[string][]int32 {
+	r := make(map[string][]int32, len(members))
+	if len(members) == 0 {
+		return r
+	}
+
+	members = append([]string(nil), members...)
+	sort.Strings(members)
+	partitions = append([]int32(nil), partitions...)
+	sort.Sort(int32Slice(partitions))
+
+	n, extra := len(partitions)/len(members), len(partitions)%len(members)
+	start := 0
+	for i, member := range members {
+		size := n
+		if i < extra {
+			size++
+		}
+		r[member] = partitions[start : start+size]
+		start += size
+	}
+	return r
+}
+
+type int32Slice []int32
+
+func (this int32Slice) Len() int           { return len(this) }
+func (this int32Slice) Less(i, j int) bool { return this[i] < this[j] }
+func (this int32Slice) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
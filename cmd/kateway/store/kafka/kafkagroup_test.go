@@ -0,0 +1,22 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/funkygao/assert"
+)
+
+func TestRangeAssign(t *testing.T) {
+	r := rangeAssign([]string{"m2", "m1", "m3"}, []int32{4, 3, 2, 1, 0})
+	assert.Equal(t, []int32{0, 1}, r["m1"])
+	assert.Equal(t, []int32{2, 3}, r["m2"])
+	assert.Equal(t, []int32{4}, r["m3"])
+
+	// more members than partitions
+	r = rangeAssign([]string{"m1", "m2", "m3"}, []int32{0})
+	assert.Equal(t, []int32{0}, r["m1"])
+	assert.Equal(t, 0, len(r["m2"]))
+	assert.Equal(t, 0, len(r["m3"]))
+
+	assert.Equal(t, 0, len(rangeAssign(nil, []int32{0, 1})))
+}
@@ -0,0 +1,112 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/gafka/cmd/kateway/meta"
+	"github.com/funkygao/gafka/cmd/kateway/store"
+)
+
+// kafkaOffsetStore commits the offsets to the group coordinator by the
+// kafka offset commit API.
+type kafkaOffsetStore struct {
+	clients *saramaClients
+}
+
+func NewKafkaOffsetStore(clientID string) *kafkaOffsetStore {
+	return &kafkaOffsetStore{clients: newSaramaClients(clientID)}
+}
+
+func (this *kafkaOffsetStore) Name() string {
+	return "kafka"
+}
+
+func (this *kafkaOffsetStore) Offset(cluster, topic, group string, partition int32) (offset int64, present bool, err error) {
+	err = this.withCoordinator(cluster, group, func(coordinator *sarama.Broker) error {
+		req := &sarama.OffsetFetchRequest{ConsumerGroup: group, Version: 1}
+		req.AddPartition(topic, partition)
+		resp, err := coordinator.FetchOffset(req)
+		if err != nil {
+			return err
+		}
+
+		block := resp.GetBlock(topic, partition)
+		if block == nil {
+			return sarama.ErrIncompleteResponse
+		}
+		if block.Err != sarama.ErrNoError {
+			return block.Err
+		}
+
+		// -1 if never committed
+		offset, present = block.Offset, block.Offset >= 0
+		return nil
+	})
+	return
+}
+
+func (this *kafkaOffsetStore) Commit(cluster, topic, group string, partition int32, offset int64) error {
+	return this.withCoordinator(cluster, group, func(coordinator *sarama.Broker) error {
+		req := &sarama.OffsetCommitRequest{
+			ConsumerGroup:           group,
+			ConsumerGroupGeneration: -1, // not a member of the group management
+			Version:                 1,
+		}
+		req.AddBlock(topic, partition, offset, sarama.ReceiveTime, "")
+		resp, err := coordinator.CommitOffset(req)
+		if err != nil {
+			return err
+		}
+
+		if kerr, present := resp.Errors[topic][partition]; present && kerr != sarama.ErrNoError {
+			return kerr
+		}
+		return nil
+	})
+}
+
+// CommitLeased checks the lease version right before the commit: the group
+// coordinator can't make a commit conditional on a zk version, so a holder
+// whose lease is taken over in between the two can still commit once.
+func (this *kafkaOffsetStore) CommitLeased(cluster, topic, group string, partition int32,
+	offset int64, leaseVersion int32) error {
+	zkcluster := meta.Default.ZkCluster(cluster)
+	if zkcluster == nil {
+		return store.ErrInvalidCluster
+	}
+
+	if zkcluster.PartitionLeaseVersion(topic, group, partition) != leaseVersion {
+		return store.ErrLeaseLost
+	}
+	return this.Commit(cluster, topic, group, partition, offset)
+}
+
+// withCoordinator calls fn with the coordinator of the group, and retries once
+// with the refreshed coordinator if it moved.
+func (this *kafkaOffsetStore) withCoordinator(cluster, group string, fn func(*sarama.Broker) error) error {
+	client, err := this.clients.Get(cluster)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; ; i++ {
+		coordinator, err := client.Coordinator(group)
+		if err != nil {
+			return err
+		}
+
+		err = fn(coordinator)
+		switch err {
+		case sarama.ErrNotCoordinatorForConsumer, sarama.ErrConsumerCoordinatorNotAvailable, sarama.ErrOffsetsLoadInProgress:
+			if i == 0 {
+				client.RefreshCoordinator(group)
+				continue
+			}
+		}
+
+		return err
+	}
+}
+
+func (this *kafkaOffsetStore) Close() {
+	this.clients.Close()
+}
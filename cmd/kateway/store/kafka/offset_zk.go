@@ -0,0 +1,56 @@
+package kafka
+
+import (
+	"github.com/funkygao/gafka/cmd/kateway/meta"
+	"github.com/funkygao/gafka/cmd/kateway/store"
+	zklib "github.com/samuel/go-zookeeper/zk"
+)
+
+// zkOffsetStore commits the offsets to the zk paths where the consumer groups
+// commit: /consumers/$group/offsets/$topic/$partition.
+type zkOffsetStore struct{}
+
+func NewZkOffsetStore() *zkOffsetStore {
+	return &zkOffsetStore{}
+}
+
+func (this *zkOffsetStore) Name() string {
+	return "zk"
+}
+
+func (this *zkOffsetStore) Offset(cluster, topic, group string, partition int32) (int64, bool, error) {
+	zkcluster := meta.Default.ZkCluster(cluster)
+	if zkcluster == nil {
+		return 0, false, store.ErrInvalidCluster
+	}
+
+	return zkcluster.ConsumerOffset(topic, group, partition)
+}
+
+func (this *zkOffsetStore) Commit(cluster, topic, group string, partition int32, offset int64) error {
+	zkcluster := meta.Default.ZkCluster(cluster)
+	if zkcluster == nil {
+		return store.ErrInvalidCluster
+	}
+
+	return zkcluster.CommitConsumerOffset(topic, group, partition, offset)
+}
+
+// CommitLeased checks the lease version and writes the offset in a single zk
+// transaction.
+func (this *zkOffsetStore) CommitLeased(cluster, topic, group string, partition int32,
+	offset int64, leaseVersion int32) error {
+	zkcluster := meta.Default.ZkCluster(cluster)
+	if zkcluster == nil {
+		return store.ErrInvalidCluster
+	}
+
+	switch err := zkcluster.CommitLeasedConsumerOffset(topic, group, partition, offset, leaseVersion); err {
+	case zklib.ErrBadVersion, zklib.ErrNoNode:
+		return store.ErrLeaseLost
+	default:
+		return err
+	}
+}
+
+func (this *zkOffsetStore) Close() {}
@@ -3,6 +3,7 @@ package kafka
 import (
 	l "log"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,13 +29,16 @@ type pubStore struct {
 	poolsLock    sync.RWMutex
 	idleTimeout  time.Duration
 
+	delayed         bool
+	delaySchedulers map[string]*delayScheduler // key is cluster
+
 	// to avoid too frequent refresh
 	// TODO refresh by cluster: current implementation will refresh zone
 	lastRefreshedAt time.Time
 }
 
 func NewPubStore(poolCapcity int, maxRetries int, idleTimeout time.Duration,
-	wg *sync.WaitGroup, debug bool, dryRun bool) *pubStore {
+	wg *sync.WaitGroup, debug bool, dryRun bool, delayed bool) *pubStore {
 	if debug {
 		sarama.Logger = l.New(os.Stdout, color.Green("[Sarama]"),
 			l.LstdFlags|l.Lshortfile)
@@ -49,6 +53,9 @@ func NewPubStore(poolCapcity int, maxRetries int, idleTimeout time.Duration,
 		wg:           wg,
 		dryRun:       dryRun,
 		shutdownCh:   make(chan struct{}),
+
+		delayed:         delayed,
+		delaySchedulers: make(map[string]*delayScheduler),
 	}
 }
 
@@ -66,6 +73,12 @@ func (this *pubStore) Start() (err error) {
 			meta.Default.BrokerList(cluster), this.poolsCapcity)
 	}
 
+	if this.delayed {
+		for _, cluster := range meta.Default.ClusterNames() {
+			this.startDelayScheduler(cluster)
+		}
+	}
+
 	go func() {
 		for {
 			select {
@@ -83,6 +96,15 @@ func (this *pubStore) Start() (err error) {
 }
 
 func (this *pubStore) Stop() {
+	// the schedulers need pools to re-publish the due messages, stop them first
+	this.poolsLock.Lock()
+	schedulers := this.delaySchedulers
+	this.delaySchedulers = make(map[string]*delayScheduler)
+	this.poolsLock.Unlock()
+	for _, scheduler := range schedulers {
+		scheduler.Stop()
+	}
+
 	this.poolsLock.Lock()
 	defer this.poolsLock.Unlock()
 
@@ -97,13 +119,14 @@ func (this *pubStore) Stop() {
 func (this *pubStore) doRefresh() {
 	// TODO the lock is too big, should consider cluster level refresh
 	this.poolsLock.Lock()
-	defer this.poolsLock.Unlock()
 
 	if time.Since(this.lastRefreshedAt) <= time.Second*5 {
+		this.poolsLock.Unlock()
 		log.Warn("ignored too frequent refresh: %s", time.Since(this.lastRefreshedAt))
 		return
 	}
 
+	var newSchedulers []string // joining the delay group is zk I/O, done outside the lock
 	activeClusters := make(map[string]struct{})
 	for _, cluster := range meta.Default.ClusterNames() {
 		activeClusters[cluster] = struct{}{}
@@ -113,6 +136,12 @@ func (this *pubStore) doRefresh() {
 		} else {
 			this.pubPools[cluster].RefreshBrokerList(meta.Default.BrokerList(cluster))
 		}
+
+		if this.delayed {
+			if _, present := this.delaySchedulers[cluster]; !present {
+				newSchedulers = append(newSchedulers, cluster)
+			}
+		}
 	}
 
 	// shutdown the dead clusters
@@ -121,10 +150,20 @@ func (this *pubStore) doRefresh() {
 			// this cluster is dead or removed forever
 			pool.Close()
 			delete(this.pubPools, cluster)
+
+			if scheduler, present := this.delaySchedulers[cluster]; present {
+				go scheduler.Stop()
+				delete(this.delaySchedulers, cluster)
+			}
 		}
 	}
 
 	this.lastRefreshedAt = time.Now()
+	this.poolsLock.Unlock()
+
+	for _, cluster := range newSchedulers {
+		this.startDelayScheduler(cluster)
+	}
 }
 
 func (this *pubStore) SyncPub(cluster, topic string, key, msg []byte) (partition int32, offset int64, err error) {
@@ -250,3 +289,168 @@ func (this *pubStore) AsyncPub(cluster string, topic string, key []byte,
 	producer.Recycle()
 	return
 }
+
+// SyncPubBatch relies on the sarama internal retry mechanism and will not
+// retry the failed messages by itself.
+func (this *pubStore) SyncPubBatch(cluster, topic string, msgs []*store.PubMessage) (err error) {
+	this.poolsLock.RLock()
+	pool, present := this.pubPools[cluster]
+	this.poolsLock.RUnlock()
+	if !present {
+		err = store.ErrInvalidCluster
+		return
+	}
+
+	producerMsgs := make([]*sarama.ProducerMessage, len(msgs))
+	msgIndex := make(map[*sarama.ProducerMessage]int, len(msgs))
+	for i, m := range msgs {
+		var keyEncoder sarama.Encoder = nil // will use random partitioner
+		if len(m.Key) > 0 {
+			keyEncoder = sarama.ByteEncoder(m.Key) // will use hash partition
+		}
+
+		producerMsgs[i] = &sarama.ProducerMessage{
+			Topic: topic,
+			Key:   keyEncoder,
+			Value: sarama.ByteEncoder(m.Value),
+		}
+		msgIndex[producerMsgs[i]] = i
+	}
+
+	producer, err := pool.GetSyncProducer()
+	if err != nil {
+		if producer != nil {
+			// should never happen
+			producer.CloseAndRecycle()
+		}
+
+		return
+	}
+
+	if this.dryRun {
+		// ignore kafka I/O
+		producer.Recycle()
+		return
+	}
+
+	err = producer.SendMessages(producerMsgs)
+	switch e := err.(type) {
+	case nil:
+		producer.Recycle()
+
+	case sarama.ProducerErrors:
+		// partial failure, the producer is still healthy
+		producer.Recycle()
+		for _, pe := range e {
+			if i, present := msgIndex[pe.Msg]; present {
+				msgs[i].Err = pe.Err
+			}
+		}
+		log.Warn("cluster[%s] topic:%s batch %d/%d failed: %v",
+			cluster, topic, len(e), len(msgs), e[0].Err)
+		err = nil
+
+	default:
+		log.Warn("cluster[%s] topic:%s batch %v", cluster, topic, err)
+
+		producer.CloseAndRecycle()
+		if err == breaker.ErrBreakerOpen || err == sarama.ErrOutOfBrokers {
+			err = store.ErrBusy
+		}
+		return
+	}
+
+	for i, pm := range producerMsgs {
+		if msgs[i].Err == nil {
+			msgs[i].Partition = pm.Partition
+			msgs[i].Offset = pm.Offset
+		}
+	}
+
+	return
+}
+
+// startDelayScheduler must be called without holding poolsLock.
+func (this *pubStore) startDelayScheduler(cluster string) {
+	if err := ensureDelayTopics(cluster); err != nil {
+		// will retry on next meta refresh
+		log.Error("cluster[%s] delay topics: %v", cluster, err)
+		return
+	}
+
+	scheduler := newDelayScheduler(this, cluster)
+	if err := scheduler.Start(); err != nil {
+		// will retry on next meta refresh
+		log.Error("cluster[%s] delay scheduler: %v", cluster, err)
+		return
+	}
+
+	this.poolsLock.Lock()
+	_, alive := this.pubPools[cluster]
+	select {
+	case <-this.shutdownCh:
+		alive = false
+	default:
+	}
+	_, present := this.delaySchedulers[cluster]
+	if alive && !present {
+		this.delaySchedulers[cluster] = scheduler
+	}
+	this.poolsLock.Unlock()
+
+	if !alive || present {
+		// the cluster is gone or the store stopped while joining
+		scheduler.Stop()
+	}
+}
+
+// DelayPub parks the message in the delay topic of the cluster, and the
+// delay scheduler will pub it to the target topic when due.
+func (this *pubStore) DelayPub(cluster, topic string, key, msg []byte, due time.Time) (err error) {
+	if !this.delayed {
+		return store.ErrDelayDisabled
+	}
+	if err = ensureDelayTopics(cluster); err != nil {
+		return
+	}
+
+	_, _, err = this.SyncPub(cluster, DelayTopic, key, encodeDelayEnvelope(due, topic, key, msg))
+	return
+}
+
+// ensureDelayTopics creates the delay topics of the cluster with the
+// replication of the cluster, instead of relying on the broker auto creation
+// with its default replication.
+func ensureDelayTopics(cluster string) error {
+	zkcluster := meta.Default.ZkCluster(cluster)
+	if zkcluster == nil {
+		return store.ErrInvalidCluster
+	}
+
+	replicas := zkcluster.RegisteredInfo().Replicas
+	if replicas < 1 {
+		replicas = 1
+	}
+	for topic, partitions := range map[string]int{
+		DelayTopic:       delayTopicPartitions,
+		DelayBuriedTopic: 1,
+	} {
+		if len(meta.Default.TopicPartitions(cluster, topic)) > 0 {
+			continue
+		}
+
+		lines, err := zkcluster.AddTopic(topic, replicas, partitions)
+		if err != nil {
+			return err
+		}
+
+		for _, line := range lines {
+			log.Trace("cluster[%s] add delay topic[%s]: %s", cluster, topic, line)
+		}
+		if !strings.Contains(strings.Join(lines, "\n"), "Created topic") {
+			return store.ErrDelayTopic
+		}
+	}
+
+	return nil
+}
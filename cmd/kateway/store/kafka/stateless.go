@@ -0,0 +1,334 @@
+package kafka
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/gafka/cmd/kateway/meta"
+	"github.com/funkygao/gafka/cmd/kateway/store"
+	"github.com/funkygao/gafka/ctx"
+	"github.com/funkygao/gafka/zk"
+	log "github.com/funkygao/log4go"
+)
+
+// statelessSubStore lets any kateway serve any sub request of a group without
+// sticky sessions: each Fetcher leases a partition of the topic for the group
+// while it is open, and commits the offsets synchronously to the offset store.
+// The lease expires unless renewed, so the partitions of a crashed kateway are
+// taken over after the lease ttl.
+type statelessSubStore struct {
+	shutdownCh   chan struct{}
+	closedConnCh <-chan string // remote addr
+	wg           *sync.WaitGroup
+	owner        string // prefix of the lease owners
+	seq          uint64
+
+	leaseTTL time.Duration
+	offsets  store.OffsetStore
+	clients  *saramaClients
+}
+
+func NewStatelessSubStore(wg *sync.WaitGroup, closedConnCh <-chan string,
+	offsets store.OffsetStore, leaseTTL time.Duration) *statelessSubStore {
+	hostname := ctx.Hostname()
+	return &statelessSubStore{
+		shutdownCh:   make(chan struct{}),
+		closedConnCh: closedConnCh,
+		wg:           wg,
+		owner:        fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		leaseTTL:     leaseTTL,
+		offsets:      offsets,
+		clients:      newSaramaClients(hostname),
+	}
+}
+
+func (this *statelessSubStore) Name() string {
+	return "kafka"
+}
+
+func (this *statelessSubStore) Start() (err error) {
+	this.wg.Add(1)
+	defer this.wg.Done()
+
+	go func() {
+		for {
+			select {
+			case <-this.shutdownCh:
+				log.Trace("sub store[%s] stopped", this.Name())
+				return
+
+			case <-this.closedConnCh:
+				// nothing is bound to the client connection
+			}
+		}
+	}()
+
+	return
+}
+
+func (this *statelessSubStore) Stop() {
+	close(this.shutdownCh)
+	this.offsets.Close()
+	this.clients.Close()
+}
+
+func (this *statelessSubStore) Fetch(cluster, topic, group, remoteAddr, resetOffset string) (store.Fetcher, error) {
+	zkcluster := meta.Default.ZkCluster(cluster)
+	if zkcluster == nil {
+		return nil, store.ErrInvalidCluster
+	}
+
+	client, err := this.clients.Get(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := meta.Default.TopicPartitions(cluster, topic)
+	seq := atomic.AddUint64(&this.seq, 1)
+	owner := fmt.Sprintf("%s-%d-%s", this.owner, seq, remoteAddr)
+	var fetcher *statelessFetcher
+	lagFirst(partitions, int(seq), func(partition int32) bool {
+		return this.lagging(client, cluster, topic, group, partition)
+	}, func(partition int32) bool {
+		now := time.Now()
+		leased, version, e := zkcluster.AcquirePartitionLease(topic, group, partition, owner, this.leaseTTL, now)
+		if e != nil {
+			log.Error("cluster[%s] %s/%d group[%s] lease: %v", cluster, topic, partition, group, e)
+			return false
+		}
+		if !leased {
+			return false
+		}
+
+		fetcher, err = this.newFetcher(client, zkcluster, cluster, topic, group, partition, owner, resetOffset, now, version)
+		if err != nil {
+			zkcluster.ReleasePartitionLease(topic, group, partition, owner)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if fetcher == nil {
+		// all the partitions are leased to the other consumers
+		return nil, store.ErrTooManyConsumers
+	}
+
+	return fetcher, nil
+}
+
+// lagging tells whether the group has unconsumed messages in the partition.
+func (this *statelessSubStore) lagging(client sarama.Client, cluster, topic, group string, partition int32) bool {
+	committed, present, err := this.offsets.Offset(cluster, topic, group, partition)
+	if err != nil || !present {
+		return true
+	}
+
+	newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	return err != nil || newest > committed
+}
+
+// lagFirst visits the partitions till visit returns true: the lagging ones
+// first, and each round starts from a different partition so that the
+// consumers spread among the partitions. The lag is checked lazily, so that
+// the common request checks a single partition.
+func lagFirst(partitions []int32, start int, lagging func(int32) bool, visit func(int32) bool) {
+	idle := make([]int32, 0, len(partitions))
+	for i := range partitions {
+		partition := partitions[(start+i)%len(partitions)]
+		if !lagging(partition) {
+			idle = append(idle, partition)
+			continue
+		}
+
+		if visit(partition) {
+			return
+		}
+	}
+
+	for _, partition := range idle {
+		if visit(partition) {
+			return
+		}
+	}
+}
+
+func (this *statelessSubStore) newFetcher(client sarama.Client, zkcluster *zk.ZkCluster,
+	cluster, topic, group string, partition int32, owner, resetOffset string,
+	leasedAt time.Time, leaseVersion int32) (*statelessFetcher, error) {
+	// the reset applies only to a group that has never committed, otherwise
+	// each request would reset the group
+	offset, present, err := this.offsets.Offset(cluster, topic, group, partition)
+	if err != nil {
+		return nil, err
+	}
+	if !present {
+		initial := sarama.OffsetOldest
+		if resetOffset == "newest" {
+			initial = sarama.OffsetNewest
+		}
+
+		// pin where the group starts, otherwise with newest the messages
+		// between two requests are skipped until the first commit
+		if offset, err = client.GetOffset(topic, partition, initial); err != nil {
+			return nil, err
+		}
+		if err = this.offsets.Commit(cluster, topic, group, partition, offset); err != nil {
+			return nil, err
+		}
+	}
+
+	// a consumer is created for each fetcher because a sarama consumer can't
+	// consume a partition twice, while many groups can consume the partition
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := consumer.ConsumePartition(topic, partition, offset)
+	if err == sarama.ErrOffsetOutOfRange {
+		log.Warn("cluster[%s] %s/%d group[%s] offset %d out of range, consume from oldest",
+			cluster, topic, partition, group, offset)
+
+		pc, err = consumer.ConsumePartition(topic, partition, sarama.OffsetOldest)
+	}
+	if err != nil {
+		consumer.Close()
+		return nil, err
+	}
+
+	fetcher := &statelessFetcher{
+		PartitionConsumer: pc,
+		consumer:          consumer,
+		store:             this,
+		zkcluster:         zkcluster,
+		cluster:           cluster,
+		topic:             topic,
+		group:             group,
+		partition:         partition,
+		owner:             owner,
+		leaseDeadline:     leasedAt.Add(this.leaseTTL).UnixNano(),
+		leaseVersion:      leaseVersion,
+		quit:              make(chan struct{}),
+	}
+	go fetcher.renewLease()
+
+	log.Debug("cluster[%s] %s/%d group[%s] leased to %s from offset %d",
+		cluster, topic, partition, group, owner, offset)
+	return fetcher, nil
+}
+
+// statelessFetcher consumes the leased partition, it must be closed to release
+// the lease as soon as the request is done.
+type statelessFetcher struct {
+	sarama.PartitionConsumer
+	consumer sarama.Consumer
+
+	store     *statelessSubStore
+	zkcluster *zk.ZkCluster
+	cluster   string
+	topic     string
+	group     string
+	partition int32
+	owner     string
+
+	// the lease expires at this unix nano unless renewed, 0 after the lease
+	// is lost, atomic
+	leaseDeadline int64
+
+	// renewing the lease bumps its znode version, so the commits wait for it
+	mu           sync.Mutex
+	leaseVersion int32
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func (this *statelessFetcher) renewLease() {
+	ticker := time.NewTicker(this.store.leaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			this.mu.Lock()
+			leased, version, err := this.zkcluster.AcquirePartitionLease(this.topic, this.group, this.partition,
+				this.owner, this.store.leaseTTL, now)
+			if leased {
+				this.leaseVersion = version
+			}
+			this.mu.Unlock()
+			if err != nil {
+				// retry on next tick, the lease is still valid till the deadline
+				log.Error("cluster[%s] %s/%d group[%s] renew lease: %v",
+					this.cluster, this.topic, this.partition, this.group, err)
+				continue
+			}
+			if !leased {
+				log.Warn("cluster[%s] %s/%d group[%s] lease of %s lost",
+					this.cluster, this.topic, this.partition, this.group, this.owner)
+
+				atomic.StoreInt64(&this.leaseDeadline, 0)
+				return
+			}
+
+			atomic.StoreInt64(&this.leaseDeadline, now.Add(this.store.leaseTTL).UnixNano())
+
+		case <-this.quit:
+			return
+		}
+	}
+}
+
+// CommitUpto commits the offset before returning, refused after the lease is
+// lost or expired because the new owner of the partition is in charge.
+// The commit is fenced by the lease znode version: once the lease is taken
+// over, the commit fails even if the deadline is not yet reached locally.
+func (this *statelessFetcher) CommitUpto(msg *sarama.ConsumerMessage) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if time.Now().UnixNano() >= atomic.LoadInt64(&this.leaseDeadline) {
+		return store.ErrLeaseLost
+	}
+
+	err := this.store.offsets.CommitLeased(this.cluster, msg.Topic, this.group, msg.Partition,
+		msg.Offset+1, this.leaseVersion)
+	if err == store.ErrLeaseLost {
+		atomic.StoreInt64(&this.leaseDeadline, 0)
+	}
+	return err
+}
+
+// FlushOffsets does nothing: CommitUpto commits synchronously.
+func (this *statelessFetcher) FlushOffsets() error {
+	return nil
+}
+
+// Close stops consuming and releases the lease, the messages fetched but not
+// committed will be consumed again.
+func (this *statelessFetcher) Close() {
+	this.closeOnce.Do(func() {
+		close(this.quit)
+
+		if err := this.PartitionConsumer.Close(); err != nil {
+			log.Error("cluster[%s] %s/%d group[%s] %v", this.cluster, this.topic, this.partition, this.group, err)
+		}
+		this.consumer.Close()
+
+		if err := this.zkcluster.ReleasePartitionLease(this.topic, this.group, this.partition, this.owner); err != nil {
+			log.Error("cluster[%s] %s/%d group[%s] release lease: %v",
+				this.cluster, this.topic, this.partition, this.group, err)
+		}
+	})
+}
+
+// Groups returns nil: no consumer group lives in a stateless kateway, the
+// partition leases are in zk.
+func (this *statelessSubStore) Groups() []store.GroupStatus {
+	return nil
+}
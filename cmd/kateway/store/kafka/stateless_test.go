@@ -0,0 +1,36 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/funkygao/assert"
+)
+
+func TestLagFirst(t *testing.T) {
+	partitions := []int32{0, 1, 2, 3}
+	lagging := func(partition int32) bool { return partition == 1 || partition == 3 }
+	order := func(start int) []int32 {
+		var r []int32
+		lagFirst(partitions, start, lagging, func(partition int32) bool {
+			r = append(r, partition)
+			return false
+		})
+		return r
+	}
+	assert.Equal(t, []int32{1, 3, 0, 2}, order(0))
+	assert.Equal(t, []int32{3, 1, 2, 0}, order(2))
+	assert.Equal(t, []int32{3, 1, 0, 2}, order(3))
+
+	// the lag is checked till the first visited partition is taken
+	var checked []int32
+	lagFirst(partitions, 0, func(partition int32) bool {
+		checked = append(checked, partition)
+		return lagging(partition)
+	}, func(partition int32) bool { return true })
+	assert.Equal(t, []int32{0, 1}, checked)
+
+	lagFirst(nil, 1, lagging, func(partition int32) bool {
+		t.Fatal("no partition")
+		return true
+	})
+}
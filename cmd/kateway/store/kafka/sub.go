@@ -4,6 +4,7 @@ import (
 	l "log"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/funkygao/gafka/cmd/kateway/store"
@@ -18,10 +19,15 @@ type subStore struct {
 	wg           *sync.WaitGroup
 	hostname     string
 
+	// clusters whose consumer groups are managed by the kafka group coordinator
+	kafkaOffsetClusters []string
+	commitInterval      time.Duration
+
 	subPool *subPool
 }
 
-func NewSubStore(wg *sync.WaitGroup, closedConnCh <-chan string, debug bool) *subStore {
+func NewSubStore(wg *sync.WaitGroup, closedConnCh <-chan string, kafkaOffsetClusters []string,
+	commitInterval time.Duration, debug bool) *subStore {
 	if debug {
 		sarama.Logger = l.New(os.Stdout, color.Blue("[Sarama]"),
 			l.LstdFlags|l.Lshortfile)
@@ -32,6 +38,9 @@ func NewSubStore(wg *sync.WaitGroup, closedConnCh <-chan string, debug bool) *su
 		wg:           wg,
 		shutdownCh:   make(chan struct{}),
 		closedConnCh: closedConnCh,
+
+		kafkaOffsetClusters: kafkaOffsetClusters,
+		commitInterval:      commitInterval,
 	}
 }
 
@@ -43,7 +52,7 @@ func (this *subStore) Start() (err error) {
 	this.wg.Add(1)
 	defer this.wg.Done()
 
-	this.subPool = newSubPool()
+	this.subPool = newSubPool(this.kafkaOffsetClusters, this.commitInterval)
 
 	go func() {
 		var remoteAddr string
@@ -68,6 +77,10 @@ func (this *subStore) Stop() {
 	close(this.shutdownCh)
 }
 
+func (this *subStore) Groups() []store.GroupStatus {
+	return this.subPool.Groups()
+}
+
 func (this *subStore) Fetch(cluster, topic, group, remoteAddr, resetOffset string) (store.Fetcher, error) {
 	cg, err := this.subPool.PickConsumerGroup(cluster, topic, group, remoteAddr, resetOffset)
 	if err != nil {
@@ -75,8 +88,9 @@ func (this *subStore) Fetch(cluster, topic, group, remoteAddr, resetOffset strin
 	}
 
 	return &consumerFetcher{
-		ConsumerGroup: cg,
+		groupConsumer: cg,
 		remoteAddr:    remoteAddr,
+		subscription:  subscriptionKey(cluster, topic, group),
 		store:         this,
 	}, nil
 }
@@ -1,15 +1,14 @@
 package kafka
 
-import (
-	"github.com/funkygao/kafka-cg/consumergroup"
-)
-
 type consumerFetcher struct {
-	*consumergroup.ConsumerGroup
-	remoteAddr string
-	store      *subStore
+	groupConsumer
+	remoteAddr   string
+	subscription string
+	store        *subStore
 }
 
+// Close tears down the subscription only, the other subscriptions over the
+// same client connection go on.
 func (this *consumerFetcher) Close() {
-	this.store.subPool.killClient(this.remoteAddr)
+	this.store.subPool.killSubscription(this.remoteAddr, this.subscription)
 }
@@ -1,59 +1,324 @@
 package kafka
 
 import (
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/funkygao/gafka/cmd/kateway/meta"
 	"github.com/funkygao/gafka/cmd/kateway/store"
+	"github.com/funkygao/gafka/ctx"
 	"github.com/funkygao/gafka/zk"
 	"github.com/funkygao/kafka-cg/consumergroup"
 	log "github.com/funkygao/log4go"
 )
 
+// subPool holds the consumer groups of the sub clients. A client connection
+// can carry many subscriptions, each of which has its own consumer group and
+// thus its own offset commit.
+//
+// Each (cluster, topic, group) has its own lifecycle and lock, so that the
+// rebalance of a group never stalls the joins and fetches of the others.
 type subPool struct {
-	clientMap     map[string]*consumergroup.ConsumerGroup // key is client remote addr, a client can only sub 1 topic
-	clientMapLock sync.RWMutex                            // TODO the lock is too big
+	mu      sync.RWMutex                   // guards the maps only, never held while joining or closing
+	groups  map[string]*subGroup           // subscription:group, pruned once idle
+	clients map[string]map[string]struct{} // remote addr:subscriptions, registered before joining
 
-	rebalancing bool // FIXME 1 topic rebalance should not affect other topics
+	// the consumer groups of these clusters are managed by the kafka group
+	// coordinator instead of zk
+	kafkaOffsets map[string]bool
+	kafkaClients *saramaClients
+
+	commitInterval time.Duration // of the offsets not flushed by the fetchers
 }
 
-func newSubPool() *subPool {
-	return &subPool{
-		clientMap: make(map[string]*consumergroup.ConsumerGroup, 500),
+func newSubPool(kafkaOffsetClusters []string, commitInterval time.Duration) *subPool {
+	this := &subPool{
+		groups:         make(map[string]*subGroup, 100),
+		clients:        make(map[string]map[string]struct{}, 500),
+		kafkaOffsets:   make(map[string]bool, len(kafkaOffsetClusters)),
+		kafkaClients:   newSaramaClients(ctx.Hostname()),
+		commitInterval: commitInterval,
+	}
+	for _, cluster := range kafkaOffsetClusters {
+		this.kafkaOffsets[cluster] = true
 	}
+	return this
+}
+
+func subscriptionKey(cluster, topic, group string) string {
+	return cluster + "/" + topic + "/" + group
 }
 
 func (this *subPool) PickConsumerGroup(cluster, topic, group,
-	remoteAddr, resetOffset string) (cg *consumergroup.ConsumerGroup, err error) {
-	this.clientMapLock.Lock()
-	defer this.clientMapLock.Unlock()
-
-	for retries := 0; retries < 5; retries++ {
-		if this.rebalancing {
-			time.Sleep(time.Millisecond * 200)
-		} else {
-			break
+	remoteAddr, resetOffset string) (groupConsumer, error) {
+	subscription := subscriptionKey(cluster, topic, group)
+
+	// register the subscription before joining, so that the client killed
+	// during the join can be found
+	this.mu.Lock()
+	sg, present := this.groups[subscription]
+	if !present {
+		sg = newSubGroup(cluster, topic, group)
+		sg.commitInterval = this.commitInterval
+		if this.kafkaOffsets[cluster] {
+			sg.kafkaClients = this.kafkaClients
 		}
+		this.groups[subscription] = sg
 	}
-	if this.rebalancing {
-		err = store.ErrRebalancing
+	sg.picking++
+	if _, present = this.clients[remoteAddr]; !present {
+		this.clients[remoteAddr] = make(map[string]struct{})
+	}
+	this.clients[remoteAddr][subscription] = struct{}{}
+	this.mu.Unlock()
+
+	cg, err := sg.pick(remoteAddr, resetOffset)
+
+	this.mu.Lock()
+	sg.picking--
+	_, connected := this.clients[remoteAddr][subscription]
+	this.mu.Unlock()
+
+	if err == nil && !connected {
+		log.Warn("consumer %s %s gone while joining", remoteAddr, subscription)
+		sg.kill(remoteAddr)
+		cg, err = nil, store.ErrClientGone
+	}
+	if err != nil {
+		this.prune(subscription, sg)
+		return nil, err
+	}
+
+	return cg, nil
+}
+
+// prune forgets the group once it has no consumer on this kateway.
+func (this *subPool) prune(subscription string, sg *subGroup) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if sg.picking > 0 || this.groups[subscription] != sg || !sg.idle() {
+		return
+	}
+
+	delete(this.groups, subscription)
+}
+
+// For a given consumer client, it might be killed twice:
+// 1. on socket level, the socket is closed
+// 2. websocket/sub handler, conn closed or error occurs, explicitly kill the client
+//
+// killClient tears down all the subscriptions of the client.
+func (this *subPool) killClient(remoteAddr string) {
+	this.mu.Lock()
+	subscriptions, present := this.clients[remoteAddr]
+	delete(this.clients, remoteAddr)
+	groups := make(map[string]*subGroup, len(subscriptions))
+	for subscription := range subscriptions {
+		if sg, present := this.groups[subscription]; present {
+			groups[subscription] = sg
+		}
+	}
+	this.mu.Unlock()
+
+	if !present {
+		// client quit before getting the chance to consume
+		// e,g. 1 partition, 2 clients, the 2nd will not get consume chance, then quit
 		return
 	}
 
-	var present bool
-	cg, present = this.clientMap[remoteAddr]
+	for subscription, sg := range groups {
+		sg.kill(remoteAddr)
+		this.prune(subscription, sg)
+	}
+}
+
+// killSubscription tears down a subscription of the client, the other
+// subscriptions of the client go on.
+func (this *subPool) killSubscription(remoteAddr, subscription string) {
+	this.mu.Lock()
+	_, present := this.clients[remoteAddr][subscription]
 	if present {
+		delete(this.clients[remoteAddr], subscription)
+		if len(this.clients[remoteAddr]) == 0 {
+			delete(this.clients, remoteAddr)
+		}
+	}
+	sg, joined := this.groups[subscription]
+	this.mu.Unlock()
+
+	if present && joined {
+		sg.kill(remoteAddr)
+		this.prune(subscription, sg)
+	}
+}
+
+// Groups returns the status of the consumer groups sorted by subscription.
+func (this *subPool) Groups() []store.GroupStatus {
+	this.mu.RLock()
+	subscriptions := make([]string, 0, len(this.groups))
+	for subscription := range this.groups {
+		subscriptions = append(subscriptions, subscription)
+	}
+	sort.Strings(subscriptions)
+	groups := make([]*subGroup, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		groups = append(groups, this.groups[subscription])
+	}
+	this.mu.RUnlock()
+
+	r := make([]store.GroupStatus, 0, len(groups))
+	for _, sg := range groups {
+		r = append(r, sg.status())
+	}
+	return r
+}
+
+func (this *subPool) Stop() {
+	this.mu.RLock()
+	groups := make([]*subGroup, 0, len(this.groups))
+	for _, sg := range this.groups {
+		groups = append(groups, sg)
+	}
+	this.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, sg := range groups {
+		for _, remoteAddr := range sg.members() {
+			wg.Add(1)
+			go func(sg *subGroup, remoteAddr string) {
+				sg.kill(remoteAddr) // will commit inflight offsets
+				wg.Done()
+			}(sg, remoteAddr)
+		}
+	}
+
+	wg.Wait()
+	this.kafkaClients.Close()
+	log.Trace("all consumer offsets committed")
+}
+
+type groupState int
+
+const (
+	groupIdle        groupState = iota // no consumer on this kateway
+	groupJoining                       // a consumer is joining
+	groupStable                        // all the consumers are consuming
+	groupRebalancing                   // a consumer is closing, which flushes its offsets
+)
+
+var groupStateNames = [...]string{"idle", "joining", "stable", "rebalancing"}
+
+func (this groupState) String() string {
+	return groupStateNames[this]
+}
+
+// subGroup is the consumers of a (cluster, topic, group) on this kateway, one
+// for each client.
+type subGroup struct {
+	cluster, topic, group string
+	kafkaClients          *saramaClients // nil if the group is in zk
+	commitInterval        time.Duration
+
+	picking int // guarded by subPool.mu, the group is not pruned while picking
+
+	joinMu sync.Mutex // serializes the joins
+
+	mu        sync.Mutex
+	consumers map[string]groupConsumer // remote addr:consumer
+	joining   int
+	closing   int
+	state     groupState
+	since     time.Time
+}
+
+func newSubGroup(cluster, topic, group string) *subGroup {
+	return &subGroup{
+		cluster:        cluster,
+		topic:          topic,
+		group:          group,
+		consumers:      make(map[string]groupConsumer),
+		state:          groupIdle,
+		since:          time.Now(),
+		commitInterval: time.Minute,
+	}
+}
+
+// transit updates the state after the consumers change, must hold mu.
+func (this *subGroup) transit() {
+	state := groupIdle
+	switch {
+	case this.closing > 0:
+		state = groupRebalancing
+	case this.joining > 0:
+		state = groupJoining
+	case len(this.consumers) > 0:
+		state = groupStable
+	}
+
+	if state != this.state {
+		log.Trace("cluster[%s] topic=%s group=%s %s -> %s",
+			this.cluster, this.topic, this.group, this.state, state)
+
+		this.state = state
+		this.since = time.Now()
+	}
+}
+
+func (this *subGroup) pick(remoteAddr, resetOffset string) (cg groupConsumer, err error) {
+	this.mu.Lock()
+	cg, present := this.consumers[remoteAddr]
+	this.mu.Unlock()
+	if present {
+		return
+	}
+
+	this.joinMu.Lock()
+	defer this.joinMu.Unlock()
+
+	// wait for the closing consumers of the group to flush offsets
+	this.mu.Lock()
+	for retries := 0; retries < 5 && this.closing > 0; retries++ {
+		this.mu.Unlock()
+		time.Sleep(time.Millisecond * 200)
+		this.mu.Lock()
+	}
+	if this.closing > 0 {
+		this.mu.Unlock()
+		err = store.ErrRebalancing
 		return
 	}
+	if cg, present = this.consumers[remoteAddr]; present {
+		// joined by a concurrent request of the client
+		this.mu.Unlock()
+		return
+	}
+	this.joining++
+	this.transit()
+	this.mu.Unlock()
+
+	defer func() {
+		this.mu.Lock()
+		this.joining--
+		if err == nil {
+			this.consumers[remoteAddr] = cg
+		}
+		this.transit()
+		this.mu.Unlock()
+	}()
+
+	if this.kafkaClients != nil {
+		return this.joinKafka(resetOffset)
+	}
 
 	// FIXME what if client wants to consumer a non-existent topic?
-	onlineN := meta.Default.OnlineConsumersCount(cluster, topic, group)
-	partitionN := len(meta.Default.TopicPartitions(cluster, topic))
+	onlineN := meta.Default.OnlineConsumersCount(this.cluster, this.topic, this.group)
+	partitionN := len(meta.Default.TopicPartitions(this.cluster, this.topic))
 	if partitionN > 0 && onlineN >= partitionN {
 		log.Warn("cluster[%s] topic=%s group=%s online groups:%d >= partitions:%d, remote addr: %s",
-			cluster, topic, group,
+			this.cluster, this.topic, this.group,
 			onlineN, partitionN, remoteAddr)
 		err = store.ErrTooManyConsumers
 		return
@@ -67,7 +332,7 @@ func (this *subPool) PickConsumerGroup(cluster, topic, group,
 	cf.ChannelBufferSize = 0 // TODO
 	cf.Consumer.Return.Errors = true
 
-	cf.Zookeeper.Chroot = meta.Default.ZkChroot(cluster)
+	cf.Zookeeper.Chroot = meta.Default.ZkChroot(this.cluster)
 	cf.Zookeeper.Timeout = zk.DefaultZkSessionTimeout()
 
 	switch resetOffset {
@@ -81,7 +346,7 @@ func (this *subPool) PickConsumerGroup(cluster, topic, group,
 		cf.Offsets.ResetOffsets = false
 		cf.Offsets.Initial = sarama.OffsetOldest
 	}
-	cf.Offsets.CommitInterval = time.Minute
+	cf.Offsets.CommitInterval = this.commitInterval
 	// time to wait for all the offsets for a partition to be processed after stopping to consume from it.
 	cf.Offsets.ProcessingTimeout = time.Second * 10
 
@@ -89,59 +354,107 @@ func (this *subPool) PickConsumerGroup(cluster, topic, group,
 		// join group will async register zk owners znodes
 		// so, if many client concurrently connects to kateway, will not
 		// strictly throw ErrTooManyConsumers
-		cg, err = consumergroup.JoinConsumerGroup(group, []string{topic},
+		var zkcg *consumergroup.ConsumerGroup
+		zkcg, err = consumergroup.JoinConsumerGroup(this.group, []string{this.topic},
 			meta.Default.ZkAddrs(), cf)
 		if err == nil {
-			this.clientMap[remoteAddr] = cg
+			cg = zkcg
 			break
 		}
 
 		// backoff
 		log.Warn("cluster:%s topic:%s join group:%s %v, retry after 100ms",
-			cluster, topic, group, err)
+			this.cluster, this.topic, this.group, err)
 		time.Sleep(time.Millisecond * 100)
 	}
 
 	return
 }
 
-// For a given consumer client, it might be killed twice:
-// 1. on socket level, the socket is closed
-// 2. websocket/sub handler, conn closed or error occurs, explicitly kill the client
-func (this *subPool) killClient(remoteAddr string) {
-	this.clientMapLock.Lock()
-	defer this.clientMapLock.Unlock()
+// joinKafka joins the group by the kafka group coordinator. The members
+// beyond the partitions get no partition assigned instead of being refused.
+func (this *subGroup) joinKafka(resetOffset string) (cg groupConsumer, err error) {
+	client, err := this.kafkaClients.Get(this.cluster)
+	if err != nil {
+		return nil, err
+	}
 
-	this.rebalancing = true
-	if cg, present := this.clientMap[remoteAddr]; present {
-		cg.Close() // will flush offset, must wait, otherwise offset is not guanranteed
-	} else {
-		// client quit before getting the chance to consume
-		// e,g. 1 partition, 2 clients, the 2nd will not get consume chance, then quit
-		this.rebalancing = false
+	initial := sarama.OffsetOldest
+	if resetOffset == "newest" {
+		initial = sarama.OffsetNewest
+	}
+	reset := resetOffset == "newest" || resetOffset == "oldest"
+	for i := 0; i < 3; i++ {
+		var kcg *kafkaGroup
+		kcg, err = joinKafkaGroup(client, this.cluster, this.topic, this.group, initial, reset, this.commitInterval, nil)
+		if err == nil {
+			cg = kcg
+			break
+		}
+
+		// backoff
+		log.Warn("cluster:%s topic:%s join kafka group:%s %v, retry after 100ms",
+			this.cluster, this.topic, this.group, err)
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	return
+}
 
+// kill closes the consumer of the client, only the joins of this group wait
+// for it.
+func (this *subGroup) kill(remoteAddr string) {
+	this.mu.Lock()
+	cg, present := this.consumers[remoteAddr]
+	if !present {
+		this.mu.Unlock()
 		return
 	}
+	delete(this.consumers, remoteAddr)
+	this.closing++
+	this.transit()
+	this.mu.Unlock()
 
-	delete(this.clientMap, remoteAddr)
-	this.rebalancing = false
+	cg.Close() // will flush offset, must wait, otherwise offset is not guanranteed
 
-	log.Trace("consumer %s closed", remoteAddr)
+	this.mu.Lock()
+	this.closing--
+	this.transit()
+	this.mu.Unlock()
+
+	log.Trace("consumer %s %s closed", remoteAddr, subscriptionKey(this.cluster, this.topic, this.group))
 }
 
-func (this *subPool) Stop() {
-	this.clientMapLock.Lock()
-	defer this.clientMapLock.Unlock()
+func (this *subGroup) idle() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.state == groupIdle
+}
 
-	var wg sync.WaitGroup
-	for _, cg := range this.clientMap {
-		wg.Add(1)
-		go func() {
-			cg.Close() // will commit inflight offsets
-			wg.Done()
-		}()
+func (this *subGroup) members() []string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	r := make([]string, 0, len(this.consumers))
+	for remoteAddr := range this.consumers {
+		r = append(r, remoteAddr)
 	}
+	sort.Strings(r)
+	return r
+}
 
-	wg.Wait()
-	log.Trace("all consumer offsets committed")
+func (this *subGroup) status() store.GroupStatus {
+	members := this.members()
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return store.GroupStatus{
+		Cluster: this.cluster,
+		Topic:   this.topic,
+		Group:   this.group,
+		State:   this.state.String(),
+		Since:   this.since.Format(time.RFC3339),
+		Members: members,
+	}
 }
@@ -0,0 +1,72 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/funkygao/assert"
+)
+
+func TestSubGroupTransit(t *testing.T) {
+	sg := newSubGroup("c1", "app1.foo.v1", "app2.g1")
+	assert.Equal(t, "idle", sg.status().State)
+
+	sg.joining++
+	sg.transit()
+	assert.Equal(t, groupJoining, sg.state)
+
+	sg.joining--
+	sg.consumers["10.1.1.2:4567"] = nil
+	sg.consumers["10.1.1.1:1234"] = nil
+	sg.transit()
+	assert.Equal(t, groupStable, sg.state)
+
+	// a closing consumer of the group
+	delete(sg.consumers, "10.1.1.2:4567")
+	sg.closing++
+	sg.transit()
+	status := sg.status()
+	assert.Equal(t, "rebalancing", status.State)
+	assert.Equal(t, []string{"10.1.1.1:1234"}, status.Members)
+
+	sg.closing--
+	sg.transit()
+	assert.Equal(t, groupStable, sg.state)
+
+	// killing an unknown client is a nop
+	sg.kill("10.1.1.3:1111")
+	assert.Equal(t, groupStable, sg.state)
+}
+
+func TestSubPoolKillUnknown(t *testing.T) {
+	pool := newSubPool(nil, time.Minute)
+	pool.killClient("10.1.1.1:1234")
+	pool.killSubscription("10.1.1.1:1234", subscriptionKey("c1", "app1.foo.v1", "app2.g1"))
+	assert.Equal(t, 0, len(pool.Groups()))
+}
+
+func TestSubPoolPrune(t *testing.T) {
+	pool := newSubPool(nil, time.Minute)
+	subscription := subscriptionKey("c1", "app1.foo.v1", "app2.g1")
+	sg := newSubGroup("c1", "app1.foo.v1", "app2.g1")
+	pool.groups[subscription] = sg
+
+	// a client is joining
+	sg.picking++
+	pool.prune(subscription, sg)
+	assert.Equal(t, 1, len(pool.Groups()))
+
+	sg.picking--
+	sg.consumers["10.1.1.1:1234"] = nil
+	sg.transit()
+	pool.prune(subscription, sg)
+	assert.Equal(t, 1, len(pool.Groups()))
+
+	// the client registered but gone, its group is pruned once idle
+	pool.clients["10.1.1.1:1234"] = map[string]struct{}{subscription: {}}
+	delete(sg.consumers, "10.1.1.1:1234")
+	sg.transit()
+	pool.killClient("10.1.1.1:1234")
+	assert.Equal(t, 0, len(pool.Groups()))
+	assert.Equal(t, 0, len(pool.clients))
+}
@@ -0,0 +1,22 @@
+package store
+
+// An OffsetStore persists the consumer group offsets of the stateless sub.
+// The offset is that of the next message to consume, same as what the
+// consumer groups commit, so that a group can switch between the modes.
+type OffsetStore interface {
+	// Name returns the name of the underlying store.
+	Name() string
+
+	// Offset returns the committed offset of a partition, false if the
+	// group has never committed on the partition.
+	Offset(cluster, topic, group string, partition int32) (int64, bool, error)
+
+	// Commit persists the offset of a partition synchronously.
+	Commit(cluster, topic, group string, partition int32, offset int64) error
+
+	// CommitLeased is Commit on condition that the lease znode of the
+	// partition still has the version, ErrLeaseLost otherwise.
+	CommitLeased(cluster, topic, group string, partition int32, offset int64, leaseVersion int32) error
+
+	Close()
+}
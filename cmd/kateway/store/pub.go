@@ -1,5 +1,20 @@
 package store
 
+import (
+	"time"
+)
+
+// A PubMessage is a keyed message published within a batch, it carries
+// the result of its own publish.
+type PubMessage struct {
+	Key   []byte
+	Value []byte
+
+	Partition int32
+	Offset    int64
+	Err       error
+}
+
 // A PubStore is a generic store that can Pub sync/async.
 type PubStore interface {
 	// Name returns the name of the underlying store.
@@ -13,6 +28,15 @@ type PubStore interface {
 
 	// AsyncPub pub a keyed message to a topic of a cluster asynchronously.
 	AsyncPub(cluster, topic string, key, msg []byte) (partition int32, offset int64, err error)
+
+	// SyncPubBatch pub a batch of keyed messages to a topic of a cluster synchronously
+	// within a single producer call.
+	// The returned err is for the whole batch, each message records its own result.
+	SyncPubBatch(cluster, topic string, msgs []*PubMessage) error
+
+	// DelayPub durably parks a keyed message that will not be published to
+	// the topic of a cluster until due.
+	DelayPub(cluster, topic string, key, msg []byte, due time.Time) error
 }
 
 var DefaultPubStore PubStore
@@ -15,6 +15,10 @@ type Fetcher interface {
 	// CommitUpto records the cursor/offset of where messages are consumed.
 	CommitUpto(*sarama.ConsumerMessage) error
 
+	// FlushOffsets writes the recorded offsets to the offset storage before
+	// returning, instead of waiting for the periodical commit.
+	FlushOffsets() error
+
 	// Close the Fetcher and do all the cleanups.
 	Close()
 }
@@ -29,6 +33,19 @@ type SubStore interface {
 
 	// Fetch returns a Fetcher.
 	Fetch(cluster, topic, group, remoteAddr, resetOffset string) (Fetcher, error)
+
+	// Groups returns the status of the consumer groups on this kateway.
+	Groups() []GroupStatus
+}
+
+// GroupStatus is the state of a consumer group of a topic on this kateway.
+type GroupStatus struct {
+	Cluster string   `json:"cluster"`
+	Topic   string   `json:"topic"`
+	Group   string   `json:"group"`
+	State   string   `json:"state"`
+	Since   string   `json:"since"`   // when the state is entered
+	Members []string `json:"members"` // remote addr of the consumers
 }
 
 var DefaultSubStore SubStore
@@ -10,6 +10,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/funkygao/gafka/cmd/kateway/meta"
 	"github.com/funkygao/gafka/cmd/kateway/store"
 	"github.com/funkygao/go-metrics"
 )
@@ -19,13 +20,49 @@ var (
 )
 
 func isBrokerError(err error) bool {
-	if err != store.ErrTooManyConsumers && err != store.ErrRebalancing {
+	if err != store.ErrTooManyConsumers && err != store.ErrRebalancing &&
+		err != store.ErrClientGone {
 		return true
 	}
 
 	return false
 }
 
+// clusterReplicas returns the replication factor registered for the cluster,
+// which the topics kateway creates for itself use.
+func clusterReplicas(cluster string) int {
+	if replicas := meta.Default.ZkCluster(cluster).RegisteredInfo().Replicas; replicas > 0 {
+		return replicas
+	}
+
+	return 1
+}
+
+// splitNames splits the comma separated names, the blank ones are dropped.
+func splitNames(s string) (names []string) {
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+// kafkaOffsets tells whether the consumer groups of the cluster commit their
+// offsets to the kafka group coordinator instead of zk.
+func kafkaOffsets(cluster string) bool {
+	if options.StatelessSub {
+		return options.OffsetStore == "kafka"
+	}
+
+	for _, c := range splitNames(options.KafkaOffsets) {
+		if c == cluster {
+			return true
+		}
+	}
+	return false
+}
+
 func getHttpQueryInt(query *url.Values, key string, defaultVal int) (int, error) {
 	valStr := query.Get(key)
 	if valStr == "" {
@@ -45,10 +82,46 @@ func getHttpRemoteIp(r *http.Request) string {
 	return p[0]
 }
 
+// getHttpHeaderAttrs returns the message attributes in the http headers,
+// nil if none.
+func getHttpHeaderAttrs(h http.Header) map[string]string {
+	var attrs map[string]string
+	for k, v := range h {
+		if len(k) <= len(HttpHeaderAttrPrefix) || !strings.HasPrefix(k, HttpHeaderAttrPrefix) || len(v) == 0 {
+			continue
+		}
+
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[k[len(HttpHeaderAttrPrefix):]] = v[0]
+	}
+
+	return attrs
+}
+
+// setHttpHeaderAttrs sets the message attributes in the http headers.
+func setHttpHeaderAttrs(h http.Header, attrs map[string]string) {
+	for k, v := range attrs {
+		h.Set(HttpHeaderAttrPrefix+k, v)
+	}
+}
+
 func validateTopicName(topic string) bool {
 	return len(topicNameRegex.FindAllString(topic, -1)) == 1
 }
 
+// parseTopicNames parses the comma separated topic names, the invalid ones are
+// ignored.
+func parseTopicNames(s string) (topics []string) {
+	for _, topic := range strings.Split(s, ",") {
+		if validateTopicName(topic) {
+			topics = append(topics, topic)
+		}
+	}
+	return
+}
+
 func validateGroupName(group string) bool {
 	if len(group) == 0 {
 		return false
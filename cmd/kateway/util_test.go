@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http"
 	"testing"
 
 	"github.com/funkygao/assert"
@@ -10,6 +11,7 @@ import (
 func TestIsBrokerError(t *testing.T) {
 	assert.Equal(t, false, isBrokerError(store.ErrRebalancing))
 	assert.Equal(t, false, isBrokerError(store.ErrTooManyConsumers))
+	assert.Equal(t, false, isBrokerError(store.ErrClientGone))
 }
 
 func TestValidateGroupName(t *testing.T) {
@@ -89,3 +91,21 @@ func BenchmarkValidateTopicName(b *testing.B) {
 		validateTopicName("asdfasdf-1")
 	}
 }
+
+func TestHttpHeaderAttrs(t *testing.T) {
+	h := make(http.Header)
+	h.Set("Appid", "app1")
+	assert.Equal(t, 0, len(getHttpHeaderAttrs(h)))
+
+	h.Set("X-Attr-", "empty name")
+	h.Set("x-attr-trace-id", "abc")
+	h.Set("X-Attr-Content-Type", "text/plain")
+	assert.Equal(t, map[string]string{
+		"Trace-Id":     "abc",
+		"Content-Type": "text/plain",
+	}, getHttpHeaderAttrs(h))
+
+	r := make(http.Header)
+	setHttpHeaderAttrs(r, getHttpHeaderAttrs(h))
+	assert.Equal(t, "abc", r.Get("X-Attr-Trace-Id"))
+}
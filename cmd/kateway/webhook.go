@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/gafka/cmd/kateway/manager"
+	"github.com/funkygao/gafka/cmd/kateway/meta"
+	"github.com/funkygao/gafka/cmd/kateway/store"
+	log "github.com/funkygao/log4go"
+)
+
+const (
+	webhookMinBackoff     = time.Millisecond * 100
+	webhookMaxBackoff     = time.Second * 30
+	webhookMaxConcurrency = 100
+)
+
+// webhookDeniedNets are the internal networks a webhook endpoint can't reach
+// unless allowed by -webhookallow, otherwise any subscriber could make
+// kateway request the internal services.
+var webhookDeniedNets, _ = parseCIDRs("0.0.0.0/8,10.0.0.0/8,100.64.0.0/10,127.0.0.0/8," +
+	"169.254.0.0/16,172.16.0.0/12,192.168.0.0/16,::/128,::1/128,fc00::/7,fe80::/10")
+
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var r []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, ipnet)
+	}
+	return r, nil
+}
+
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhook is a push subscription: kateway consumes the topic and POSTs
+// each message to the endpoint.
+type webhook struct {
+	Appid       string `json:"appid"` // the subscriber
+	HisAppid    string `json:"hisappid"`
+	Topic       string `json:"topic"`
+	Ver         string `json:"ver"`
+	Group       string `json:"group"`
+	Endpoint    string `json:"endpoint"`
+	Concurrency int    `json:"concurrency"`
+}
+
+func (this *webhook) id() string {
+	return this.Appid + "." + this.Group + "@" + meta.KafkaTopic(this.HisAppid, this.Topic, this.Ver)
+}
+
+func (this *webhook) pluginRequest(subkey, remoteAddr string) *PluginRequest {
+	return newSubPluginRequest(this.Appid, subkey, this.HisAppid, this.Topic, this.Ver,
+		this.Group, remoteAddr)
+}
+
+// webhookStatus is the runtime status of a webhook in this kateway.
+type webhookStatus struct {
+	webhook
+
+	Running     bool      `json:"running"`
+	Inflight    int       `json:"inflight"`
+	Delivered   int64     `json:"delivered"`
+	Failures    int64     `json:"failures"`
+	LastError   string    `json:"lasterr,omitempty"`
+	LastErrorAt time.Time `json:"lasterrat"`
+	LastOkAt    time.Time `json:"lastokat"`
+}
+
+// webhookRunner pushes the messages of a webhook.
+type webhookRunner struct {
+	gw     *Gateway
+	hook   webhook
+	client *http.Client
+
+	quit  chan struct{}
+	done  chan struct{}
+	after <-chan struct{} // done of the stopping runner of the same webhook, if any
+
+	mu     sync.Mutex
+	status webhookStatus
+}
+
+func (this *webhookRunner) owner() string {
+	// kafka store identifies a consumer by remote addr
+	return "webhook:" + this.hook.id()
+}
+
+func (this *webhookRunner) setError(err error) {
+	this.mu.Lock()
+	this.status.Failures++
+	this.status.LastError = err.Error()
+	this.status.LastErrorAt = time.Now()
+	this.mu.Unlock()
+}
+
+func (this *webhookRunner) Status() webhookStatus {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.status
+}
+
+func (this *webhookRunner) Stop() {
+	close(this.quit)
+	<-this.done
+}
+
+func (this *webhookRunner) run() {
+	defer close(this.done)
+
+	if this.after != nil {
+		// the previous runner consumes as the same owner
+		<-this.after
+	}
+
+	cluster, found := manager.Default.LookupCluster(this.hook.HisAppid)
+	if !found {
+		log.Error("webhook[%s] cluster not found", this.hook.id())
+		this.setError(ErrInvalidWebhook)
+		<-this.quit
+		return
+	}
+
+	rawTopic := meta.KafkaTopic(this.hook.HisAppid, this.hook.Topic, this.hook.Ver)
+	group := this.hook.Appid + "." + this.hook.Group
+	ack := &subAck{
+		key:     inflightKey(cluster, rawTopic, group),
+		cluster: cluster,
+		group:   group,
+	}
+
+	chain := this.gw.plugins.Chain(this.hook.pluginRequest("", this.owner()))
+	backoff := webhookMinBackoff
+	for {
+		fetcher, err := store.DefaultSubStore.Fetch(cluster, rawTopic, group, this.owner(), "")
+		if err == nil {
+			backoff = webhookMinBackoff
+			if this.consume(fetcher, chain, ack) {
+				return
+			}
+		} else {
+			// e,g. too many consumers: other kateway instances are pushing
+			log.Warn("webhook[%s] %v, retry in %s", this.hook.id(), err, backoff)
+			this.setError(err)
+		}
+
+		select {
+		case <-this.quit:
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+// consume pushes the messages of the fetcher until quit or error.
+func (this *webhookRunner) consume(fetcher store.Fetcher, chain *pluginChain,
+	ack *subAck) (quit bool) {
+	this.mu.Lock()
+	this.status.Running = true
+	this.mu.Unlock()
+
+	var (
+		wg        sync.WaitGroup
+		workersCh = make(chan struct{}, this.hook.Concurrency)
+		cancel    = make(chan struct{}) // stops the retrying pushes
+	)
+	defer func() {
+		// the pushing messages will not be committed
+		close(cancel)
+		wg.Wait()
+		this.gw.inflights.forget(this.owner())
+		fetcher.Close()
+
+		this.mu.Lock()
+		this.status.Running = false
+		this.status.Inflight = 0
+		this.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-this.quit:
+			return true
+
+		case msg := <-fetcher.Messages():
+			this.gw.inflights.deliver(ack.key, this.owner(), fetcher, msg, time.Now())
+
+			select {
+			case workersCh <- struct{}{}:
+			case <-this.quit:
+				return true
+			}
+
+			this.mu.Lock()
+			this.status.Inflight++
+			this.mu.Unlock()
+
+			wg.Add(1)
+			go func(msg *sarama.ConsumerMessage) {
+				defer func() {
+					this.mu.Lock()
+					this.status.Inflight--
+					this.mu.Unlock()
+
+					<-workersCh
+					wg.Done()
+				}()
+
+				this.push(msg, chain, ack, cancel)
+			}(msg)
+
+		case err := <-fetcher.Errors():
+			log.Error("webhook[%s] %v", this.hook.id(), err)
+			this.setError(err)
+			return false
+		}
+	}
+}
+
+// push POSTs a message to the endpoint until 2xx or cancel, then acks it.
+// A message rejected by the plugins is acked without being pushed, while a
+// message that can't be opened is retried and never acked.
+func (this *webhookRunner) push(msg *sarama.ConsumerMessage, chain *pluginChain, ack *subAck,
+	cancel <-chan struct{}) {
+	pm, ok := this.open(msg, cancel)
+	if !ok {
+		return
+	}
+	if err := chain.PreDeliver(pm); err != nil {
+		log.Warn("webhook[%s] {P:%d, O:%d} rejected: %v", this.hook.id(), msg.Partition, msg.Offset, err)
+
+		this.gw.inflights.ack(ack.key, msg.Partition, msg.Offset)
+		return
+	}
+
+	backoff := webhookMinBackoff
+	for failures := 1; ; failures++ {
+		err := this.post(pm)
+		chain.PostDeliver(pm, err)
+		if err == nil {
+			this.mu.Lock()
+			this.status.Delivered++
+			this.status.LastOkAt = time.Now()
+			this.mu.Unlock()
+
+			this.gw.inflights.ack(ack.key, msg.Partition, msg.Offset)
+			return
+		}
+
+		log.Warn("webhook[%s] {P:%d, O:%d} #%d %v, retry in %s",
+			this.hook.id(), msg.Partition, msg.Offset, failures, err, backoff)
+		this.setError(err)
+
+		m, e := this.gw.inflights.nack(ack.key, msg.Partition, msg.Offset, err.Error(), time.Now())
+		if e == nil && this.gw.buryPoison(ack, m, failures) {
+			return
+		}
+
+		select {
+		case <-cancel:
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+// open opens a message with backoff until it succeeds or cancel: the key
+// might be missing on this kateway only.
+func (this *webhookRunner) open(msg *sarama.ConsumerMessage, cancel <-chan struct{}) (*PluginMessage, bool) {
+	backoff := webhookMinBackoff
+	for {
+		pm, err := this.gw.openMessage(msg)
+		if err == nil {
+			return pm, true
+		}
+
+		log.Error("webhook[%s] {P:%d, O:%d} open: %v, retry in %s",
+			this.hook.id(), msg.Partition, msg.Offset, err, backoff)
+		this.setError(err)
+
+		select {
+		case <-cancel:
+			return nil, false
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+func (this *webhookRunner) post(msg *PluginMessage) error {
+	req, err := http.NewRequest("POST", this.hook.Endpoint, bytes.NewReader(msg.Body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(HttpHeaderPartition, strconv.FormatInt(int64(msg.Partition), 10))
+	req.Header.Set(HttpHeaderOffset, strconv.FormatInt(msg.Offset, 10))
+	setHttpHeaderAttrs(req.Header, msg.Attrs)
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint responds %s", resp.Status)
+	}
+
+	return nil
+}
+
+// webhooks runs the push subscriptions registered in zk.
+// Each kateway instance joins the consumer group of every webhook, so the
+// partitions are pushed by different instances.
+type webhooks struct {
+	gw      *Gateway
+	client  *http.Client
+	allowed []*net.IPNet
+
+	mu       sync.Mutex
+	runners  map[string]*webhookRunner  // key is webhook id
+	stopping map[string]<-chan struct{} // key is webhook id, value is done of the runner
+	stopWg   sync.WaitGroup
+}
+
+func newWebhooks(gw *Gateway) *webhooks {
+	allowed, err := parseCIDRs(options.WebhookAllow)
+	if err != nil {
+		panic(err)
+	}
+
+	this := &webhooks{
+		gw:       gw,
+		allowed:  allowed,
+		runners:  make(map[string]*webhookRunner),
+		stopping: make(map[string]<-chan struct{}),
+	}
+	// dial checks the resolved addr again, the DNS record might change after register
+	this.client = &http.Client{
+		Timeout:   options.WebhookTimeout,
+		Transport: &http.Transport{Dial: this.dial},
+	}
+	return this
+}
+
+func (this *webhooks) permitted(ip net.IP) bool {
+	if inNets(ip, this.allowed) {
+		return true
+	}
+
+	return !ip.IsLoopback() && !ip.IsUnspecified() && !ip.IsMulticast() &&
+		!ip.IsLinkLocalUnicast() && !inNets(ip, webhookDeniedNets)
+}
+
+// checkEndpoint rejects the endpoints that are not http(s) or that resolve
+// to an internal address.
+func (this *webhooks) checkEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidWebhook
+	}
+
+	host := u.Host
+	if h, _, err := net.SplitHostPort(u.Host); err == nil {
+		host = h
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return ErrInvalidWebhook
+	}
+	for _, ip := range ips {
+		if !this.permitted(ip) {
+			return ErrWebhookForbidden
+		}
+	}
+
+	return nil
+}
+
+func (this *webhooks) dial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ErrWebhookForbidden
+	for _, ip := range ips {
+		if !this.permitted(ip) {
+			continue
+		}
+
+		var conn net.Conn
+		if conn, err = net.DialTimeout(network, net.JoinHostPort(ip.String(), port),
+			options.WebhookTimeout); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (this *webhooks) Start() {
+	this.refresh()
+
+	this.gw.wg.Add(1)
+	go func() {
+		defer this.gw.wg.Done()
+
+		ticker := time.NewTicker(options.ManagerRefresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				this.refresh()
+
+			case <-this.gw.shutdownCh:
+				this.stopAll()
+				log.Trace("webhooks stopped")
+				return
+			}
+		}
+	}()
+}
+
+// refresh reconciles the runners with the webhooks in zk.
+func (this *webhooks) refresh() {
+	hooks := make(map[string]webhook)
+	for id, data := range this.gw.GetZkZone().KatewayWebhooks() {
+		var hook webhook
+		if err := json.Unmarshal(data, &hook); err != nil {
+			log.Error("webhook[%s] %v", id, err)
+			continue
+		}
+
+		hooks[id] = hook
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// a runner might take long to stop, never wait for it with the lock held
+	for id, runner := range this.runners {
+		if hook, present := hooks[id]; !present || hook != runner.hook {
+			delete(this.runners, id)
+			this.stop(id, runner)
+		}
+	}
+
+	for id, hook := range hooks {
+		if _, present := this.runners[id]; present {
+			continue
+		}
+
+		runner := &webhookRunner{
+			gw:     this.gw,
+			hook:   hook,
+			client: this.client,
+			quit:   make(chan struct{}),
+			done:   make(chan struct{}),
+			after:  this.stopping[id],
+		}
+		runner.status.webhook = hook
+		this.runners[id] = runner
+		go runner.run()
+
+		log.Trace("webhook[%s] started: %s", id, hook.Endpoint)
+	}
+}
+
+// stop stops the runner in background, must be called with mu held.
+func (this *webhooks) stop(id string, runner *webhookRunner) {
+	this.stopping[id] = runner.done
+	this.stopWg.Add(1)
+	go func() {
+		defer this.stopWg.Done()
+
+		runner.Stop()
+		log.Trace("webhook[%s] stopped", id)
+
+		this.mu.Lock()
+		if this.stopping[id] == runner.done {
+			delete(this.stopping, id)
+		}
+		this.mu.Unlock()
+	}()
+}
+
+func (this *webhooks) stopAll() {
+	this.mu.Lock()
+	for id, runner := range this.runners {
+		delete(this.runners, id)
+		this.stop(id, runner)
+	}
+	this.mu.Unlock()
+
+	this.stopWg.Wait()
+}
+
+func (this *webhooks) Register(hook webhook) error {
+	b, _ := json.Marshal(hook)
+	if err := this.gw.GetZkZone().SetKatewayWebhook(hook.id(), b); err != nil {
+		return err
+	}
+
+	this.refresh()
+	return nil
+}
+
+func (this *webhooks) Unregister(hook webhook) error {
+	if err := this.gw.GetZkZone().DeleteKatewayWebhook(hook.id()); err != nil {
+		return err
+	}
+
+	this.refresh()
+	return nil
+}
+
+// Status returns the status of all running webhooks sorted by id.
+func (this *webhooks) Status() []webhookStatus {
+	this.mu.Lock()
+	ids := make([]string, 0, len(this.runners))
+	for id, _ := range this.runners {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	r := make([]webhookStatus, 0, len(ids))
+	for _, id := range ids {
+		r = append(r, this.runners[id].Status())
+	}
+	this.mu.Unlock()
+
+	return r
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/funkygao/assert"
+)
+
+func TestWebhookId(t *testing.T) {
+	hook := webhook{Appid: "app2", HisAppid: "app1", Topic: "foo", Ver: "v1", Group: "group1"}
+	assert.Equal(t, "app2.group1@app1.foo.v1", hook.id())
+}
+
+func TestWebhookPost(t *testing.T) {
+	var body, partition, offset string
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		partition = r.Header.Get(HttpHeaderPartition)
+		offset = r.Header.Get(HttpHeaderOffset)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	runner := &webhookRunner{
+		hook:   webhook{Endpoint: ts.URL},
+		client: http.DefaultClient,
+	}
+	msg := &PluginMessage{Partition: 1, Offset: 10, Body: []byte("hello")}
+	assert.Equal(t, nil, runner.post(msg))
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, "1", partition)
+	assert.Equal(t, "10", offset)
+
+	status = http.StatusInternalServerError
+	assert.Equal(t, true, runner.post(msg) != nil)
+}
+
+func TestWebhooksCheckEndpoint(t *testing.T) {
+	hooks := &webhooks{}
+	assert.Equal(t, nil, hooks.checkEndpoint("http://8.8.8.8/path"))
+	assert.Equal(t, ErrInvalidWebhook, hooks.checkEndpoint("ftp://8.8.8.8/path"))
+	assert.Equal(t, ErrWebhookForbidden, hooks.checkEndpoint("http://127.0.0.1:8080/path"))
+	assert.Equal(t, ErrWebhookForbidden, hooks.checkEndpoint("http://169.254.169.254/latest"))
+	assert.Equal(t, ErrWebhookForbidden, hooks.checkEndpoint("https://10.1.1.1/path"))
+	assert.Equal(t, ErrWebhookForbidden, hooks.checkEndpoint("http://[::1]:8080/path"))
+
+	hooks.allowed, _ = parseCIDRs("10.1.0.0/16")
+	assert.Equal(t, nil, hooks.checkEndpoint("https://10.1.1.1/path"))
+	assert.Equal(t, ErrWebhookForbidden, hooks.checkEndpoint("https://10.2.1.1/path"))
+}
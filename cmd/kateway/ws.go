@@ -1,6 +1,9 @@
 package main
 
 import (
+	"encoding/binary"
+	"encoding/json"
+
 	"github.com/gorilla/websocket"
 )
 
@@ -10,3 +13,98 @@ var (
 		WriteBufferSize: 1024,
 	}
 )
+
+// wsPubAck is the per frame ack of websocket pub.
+type wsPubAck struct {
+	Seq       int64  `json:"seq"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Errmsg    string `json:"errmsg,omitempty"`
+
+	// in ms, set when the frame is refused because of quota
+	RetryAfter int64 `json:"retryafter,omitempty"`
+}
+
+// wsSubMeta is the text frame sent before a websocket sub message which has
+// attributes, or before each message of a multiplexed websocket sub.
+type wsSubMeta struct {
+	Sub       string            `json:"sub,omitempty"` // subscription id of multiplexed sub
+	Partition int32             `json:"partition"`
+	Offset    int64             `json:"offset"`
+	Attrs     map[string]string `json:"attrs,omitempty"`
+}
+
+// wsSubCommand is the text frame a client sends over a multiplexed websocket
+// sub to add or remove a subscription.
+type wsSubCommand struct {
+	Op     string `json:"op"` // sub or unsub
+	Id     string `json:"id"` // chosen by the client to tag the messages
+	Appid  string `json:"appid"`
+	Topic  string `json:"topic"`
+	Ver    string `json:"ver"`
+	Group  string `json:"group"`
+	Reset  string `json:"reset,omitempty"`
+	Filter string `json:"filter,omitempty"`
+	Commit string `json:"commit,omitempty"`
+}
+
+// wsSubAck is the reply of a wsSubCommand.
+type wsSubAck struct {
+	Op     string `json:"op"`
+	Sub    string `json:"sub"`
+	Errmsg string `json:"errmsg,omitempty"`
+}
+
+func decodeWsSubCommand(frame []byte) (cmd wsSubCommand, err error) {
+	if err = json.Unmarshal(frame, &cmd); err != nil || cmd.Id == "" {
+		err = ErrInvalidSubCommand
+		return
+	}
+
+	switch cmd.Op {
+	case "sub":
+		if cmd.Appid == "" || cmd.Ver == "" || !validateTopicName(cmd.Topic) ||
+			!validateGroupName(cmd.Group) || len(cmd.Filter) > MaxSubFilterLen {
+			err = ErrInvalidSubCommand
+		}
+
+	case "unsub":
+
+	default:
+		err = ErrInvalidSubCommand
+	}
+
+	return
+}
+
+// decodeWsPubFrame decodes a websocket pub frame:
+// keyLen(2 bytes, big endian) key value
+func decodeWsPubFrame(frame []byte) (key, value []byte, err error) {
+	if len(frame) < 2 {
+		err = ErrInvalidWsFrame
+		return
+	}
+
+	keyLen := int(binary.BigEndian.Uint16(frame[:2]))
+	switch {
+	case keyLen > MaxPartitionKeyLen:
+		err = ErrTooBigPartitionKey
+		return
+
+	case len(frame) < 2+keyLen:
+		err = ErrInvalidWsFrame
+		return
+	}
+
+	key = frame[2 : 2+keyLen]
+	value = frame[2+keyLen:]
+	switch {
+	case int64(len(value)) > options.MaxPubSize:
+		err = ErrTooBigPubMessage
+
+	case len(value) < options.MinPubSize:
+		err = ErrTooSmallPubMessage
+	}
+
+	return
+}
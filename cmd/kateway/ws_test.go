@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/funkygao/assert"
+)
+
+func TestDecodeWsPubFrame(t *testing.T) {
+	options.MaxPubSize = 10
+	options.MinPubSize = 1
+
+	key, value, err := decodeWsPubFrame([]byte{0, 2, 'k', '1', 'h', 'e', 'l', 'l', 'o'})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "k1", string(key))
+	assert.Equal(t, "hello", string(value))
+
+	// keyless
+	key, value, err = decodeWsPubFrame([]byte{0, 0, 'h', 'i'})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(key))
+	assert.Equal(t, "hi", string(value))
+
+	_, _, err = decodeWsPubFrame([]byte{0})
+	assert.Equal(t, ErrInvalidWsFrame, err)
+	_, _, err = decodeWsPubFrame([]byte{0, 5, 'k'})
+	assert.Equal(t, ErrInvalidWsFrame, err)
+	_, _, err = decodeWsPubFrame([]byte{0xff, 0xff, 'k'})
+	assert.Equal(t, ErrTooBigPartitionKey, err)
+	_, _, err = decodeWsPubFrame([]byte{0, 1, 'k'})
+	assert.Equal(t, ErrTooSmallPubMessage, err)
+	_, _, err = decodeWsPubFrame([]byte{0, 0, '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a'})
+	assert.Equal(t, ErrTooBigPubMessage, err)
+}
+
+func TestDecodeWsSubCommand(t *testing.T) {
+	cmd, err := decodeWsSubCommand([]byte(`{"op":"sub","id":"s1","appid":"app1","topic":"orders","ver":"v1","group":"g1"}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "s1", cmd.Id)
+	assert.Equal(t, "orders", cmd.Topic)
+
+	cmd, err = decodeWsSubCommand([]byte(`{"op":"unsub","id":"s1"}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "unsub", cmd.Op)
+
+	_, err = decodeWsSubCommand([]byte(`{"op":"sub","appid":"app1","topic":"orders","ver":"v1","group":"g1"}`))
+	assert.Equal(t, ErrInvalidSubCommand, err)
+	_, err = decodeWsSubCommand([]byte(`{"op":"sub","id":"s1","appid":"app1","topic":"orders","ver":"v1"}`))
+	assert.Equal(t, ErrInvalidSubCommand, err)
+	_, err = decodeWsSubCommand([]byte(`{"op":"pub","id":"s1"}`))
+	assert.Equal(t, ErrInvalidSubCommand, err)
+	_, err = decodeWsSubCommand([]byte(`not json`))
+	assert.Equal(t, ErrInvalidSubCommand, err)
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/gafka/cmd/kateway/manager"
+	"github.com/funkygao/gafka/cmd/kateway/meta"
+	"github.com/funkygao/gafka/cmd/kateway/store"
+	log "github.com/funkygao/log4go"
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+)
+
+// /ws/subscriptions
+// multiplexes the subscriptions of a client over one websocket connection: the
+// client adds and removes the subscriptions by wsSubCommand text frames, and
+// each message is preceded by a wsSubMeta text frame tagged with the id of its
+// subscription
+func (this *Gateway) subWsMuxHandler(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error("%s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	defer func() {
+		ws.Close()
+
+		this.svrMetrics.ConcurrentSubWs.Dec(1)
+		this.subServer.idleConnsWg.Done()
+	}()
+
+	mux := &wsSubMux{
+		gw: this,
+		ws: ws,
+		// the subscriptions share the client identity of the upgrade request
+		base: newSubPluginRequest(r.Header.Get(HttpHeaderAppid), r.Header.Get(HttpHeaderSubkey),
+			"", "", "", "", r.RemoteAddr).WithRequest(r),
+		subscriptions: make(map[string]*wsSubscription),
+		commands:      make(chan []byte),
+		deliveries:    make(chan wsDelivery),
+		writerGone:    make(chan struct{}),
+	}
+
+	clientGone := make(chan struct{})
+	go mux.writePump(clientGone)
+	mux.readPump(clientGone)
+}
+
+// wsSubMux is a multiplexed websocket sub, all the writes to the websocket
+// are done in the write pump.
+type wsSubMux struct {
+	gw   *Gateway
+	ws   *websocket.Conn
+	base *PluginRequest
+
+	subscriptions map[string]*wsSubscription // key is subscription id
+
+	commands   chan []byte
+	deliveries chan wsDelivery
+	writerGone chan struct{}
+}
+
+// wsSubscription is a subscription of a multiplexed websocket sub, which has
+// its own consumer group and offset commit.
+type wsSubscription struct {
+	id        string
+	key       string // cluster/topic/group
+	fetcher   store.Fetcher
+	committer *offsetCommitter // used by the write pump only
+	filter    *subFilter
+	chain     *pluginChain
+	quit      chan struct{}
+}
+
+type wsDelivery struct {
+	sub *wsSubscription
+	msg *sarama.ConsumerMessage
+	err error // the subscription failed instead of a message
+}
+
+func (this *wsSubMux) readPump(clientGone chan struct{}) {
+	this.ws.SetReadLimit(this.gw.subServer.wsReadLimit)
+	this.ws.SetReadDeadline(time.Now().Add(this.gw.subServer.wsPongWait))
+	this.ws.SetPongHandler(func(string) error {
+		this.ws.SetReadDeadline(time.Now().Add(this.gw.subServer.wsPongWait))
+		return nil
+	})
+
+	for {
+		_, message, err := this.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
+				log.Warn("%s: %v", this.ws.RemoteAddr(), err)
+			} else {
+				log.Debug("%s: %v", this.ws.RemoteAddr(), err)
+			}
+
+			close(clientGone)
+			return
+		}
+
+		select {
+		case this.commands <- message:
+		case <-this.writerGone:
+			// wait for the read error after the writer closed the websocket
+		}
+	}
+}
+
+func (this *wsSubMux) writePump(clientGone chan struct{}) {
+	defer func() {
+		for id := range this.subscriptions {
+			this.unsub(id)
+		}
+
+		close(this.writerGone)
+		this.ws.Close()
+	}()
+
+	for {
+		select {
+		case frame := <-this.commands:
+			cmd, err := decodeWsSubCommand(frame)
+			if err == nil {
+				if cmd.Op == "sub" {
+					err = this.sub(cmd)
+				} else {
+					err = this.unsub(cmd.Id)
+				}
+			}
+
+			ack := wsSubAck{Op: cmd.Op, Sub: cmd.Id}
+			if err != nil {
+				log.Warn("ws mux sub[%s] %s: %+v %v", this.base.Appid, this.ws.RemoteAddr(), cmd, err)
+
+				ack.Errmsg = err.Error()
+			}
+			b, _ := json.Marshal(ack)
+			this.ws.SetWriteDeadline(time.Now().Add(time.Second * 10))
+			if err = this.ws.WriteMessage(websocket.TextMessage, b); err != nil {
+				log.Error("%s: %v", this.ws.RemoteAddr(), err)
+				return
+			}
+
+		case d := <-this.deliveries:
+			var err error
+			if d.err != nil {
+				err = this.abort(d.sub, d.err)
+			} else {
+				err = this.deliver(d.sub, d.msg)
+			}
+			if err != nil {
+				log.Error("%s: %v", this.ws.RemoteAddr(), err)
+				return
+			}
+
+		case <-this.gw.timer.After(this.gw.subServer.wsPongWait / 3):
+			this.ws.SetWriteDeadline(time.Now().Add(time.Second * 10))
+			if err := this.ws.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+				log.Error("%s: %v", this.ws.RemoteAddr(), err)
+				return
+			}
+
+		case <-this.gw.shutdownCh:
+			return
+
+		case <-clientGone:
+			return
+		}
+	}
+}
+
+func (this *wsSubMux) sub(cmd wsSubCommand) error {
+	if _, present := this.subscriptions[cmd.Id]; present {
+		return ErrDupSubscription
+	}
+	if len(this.subscriptions) >= MaxWsSubscriptions {
+		return ErrTooManySubs
+	}
+
+	req := *this.base
+	req.TopicAppid, req.Topic, req.Ver, req.Group = cmd.Appid, cmd.Topic, cmd.Ver, cmd.Group
+	req.Start = time.Now()
+	chain := this.gw.plugins.Chain(&req)
+	if err := chain.PreDeliver(nil); err != nil {
+		return err
+	}
+
+	cluster, found := manager.Default.LookupCluster(cmd.Appid)
+	if !found {
+		return store.ErrInvalidCluster
+	}
+
+	rawTopic := meta.KafkaTopic(cmd.Appid, cmd.Topic, cmd.Ver)
+	group := req.Appid + "." + cmd.Group
+	key := inflightKey(cluster, rawTopic, group)
+	for _, sub := range this.subscriptions {
+		if sub.key == key {
+			// they would share the same consumer group
+			return ErrDupSubscription
+		}
+	}
+
+	filter, err := this.gw.subFilters.Fix(rawTopic, group, cmd.Filter)
+	if err != nil {
+		return err
+	}
+
+	policy, err := this.gw.commitPolicies.Resolve(group, cmd.Commit)
+	if err != nil {
+		return err
+	}
+
+	fetcher, err := store.DefaultSubStore.Fetch(cluster, rawTopic, group, req.RemoteAddr, cmd.Reset)
+	if err != nil {
+		return err
+	}
+
+	sub := &wsSubscription{
+		id:        cmd.Id,
+		key:       key,
+		fetcher:   fetcher,
+		committer: newOffsetCommitter(policy, fetcher),
+		filter:    filter,
+		chain:     chain,
+		quit:      make(chan struct{}),
+	}
+	this.subscriptions[cmd.Id] = sub
+	go this.pump(sub)
+
+	log.Debug("ws mux sub[%s] %s: %+v", req.Appid, req.RemoteAddr, cmd)
+	return nil
+}
+
+// unsub tears down a subscription, its undelivered messages will be consumed
+// again.
+func (this *wsSubMux) unsub(id string) error {
+	sub, present := this.subscriptions[id]
+	if !present {
+		return ErrNoSubscription
+	}
+
+	delete(this.subscriptions, id)
+	close(sub.quit)
+	sub.fetcher.Close() // commits the offset of the subscription
+	return nil
+}
+
+// abort tears down a subscription on error and tells the client by an unsub
+// ack with the error, the other subscriptions go on.
+func (this *wsSubMux) abort(sub *wsSubscription, err error) error {
+	if this.subscriptions[sub.id] != sub {
+		// already torn down
+		return nil
+	}
+
+	this.unsub(sub.id)
+
+	b, _ := json.Marshal(wsSubAck{Op: "unsub", Sub: sub.id, Errmsg: err.Error()})
+	this.ws.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	return this.ws.WriteMessage(websocket.TextMessage, b)
+}
+
+// pump feeds the messages of a subscription to the write pump, and the error
+// of its fetcher which ends the subscription.
+func (this *wsSubMux) pump(sub *wsSubscription) {
+	req := sub.chain.req
+	for {
+		var (
+			messages  = sub.fetcher.Messages()
+			throttled <-chan time.Time
+		)
+		if retryAfter := this.gw.quotas.Wait(true, req.Appid, req.Topic, time.Now()); retryAfter > 0 {
+			// stop consuming until the quota is available
+			messages = nil
+			throttled = time.After(retryAfter)
+			if !options.DisableMetrics {
+				this.gw.subMetrics.QuotaExceeded(req.Appid, req.Topic, req.Ver)
+			}
+		}
+
+		select {
+		case <-throttled:
+
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			select {
+			case this.deliveries <- wsDelivery{sub: sub, msg: msg}:
+			case <-sub.quit:
+				return
+			}
+
+		case err, ok := <-sub.fetcher.Errors():
+			if !ok {
+				return
+			}
+
+			// e,g. the topic is gone, the write pump tears down the subscription
+			log.Error("ws mux sub[%s] %s: {sub:%s, topic:%s, ver:%s} %v",
+				req.Appid, req.RemoteAddr, sub.id, req.Topic, req.Ver, err)
+
+			select {
+			case this.deliveries <- wsDelivery{sub: sub, err: err}:
+			case <-sub.quit:
+			}
+			return
+
+		case <-sub.quit:
+			return
+		}
+	}
+}
+
+func (this *wsSubMux) deliver(sub *wsSubscription, msg *sarama.ConsumerMessage) error {
+	if this.subscriptions[sub.id] != sub {
+		// unsubscribed after the message is fetched, it will be consumed again
+		return nil
+	}
+
+	req := sub.chain.req
+	pm, err := this.gw.openMessage(msg)
+	if err != nil {
+		// never commit past it: it's consumed again once the key is available
+		log.Error("ws mux sub[%s] %s: {sub:%s, topic:%s, ver:%s, P:%d, O:%d} open: %v",
+			req.Appid, req.RemoteAddr, sub.id, req.Topic, req.Ver, msg.Partition, msg.Offset, err)
+
+		return this.abort(sub, err)
+	}
+	if sub.filter != nil && !sub.filter.Match(msg.Key, pm.Attrs) {
+		this.gw.commitFiltered(sub.committer, msg, nil, "")
+		return nil
+	}
+
+	if err := sub.chain.PreDeliver(pm); err != nil {
+		log.Warn("ws mux sub[%s] %s: {sub:%s, topic:%s, ver:%s, P:%d, O:%d} rejected: %v",
+			req.Appid, req.RemoteAddr, sub.id, req.Topic, req.Ver, msg.Partition, msg.Offset, err)
+
+		this.gw.commitFiltered(sub.committer, msg, nil, "")
+		return nil
+	}
+
+	if err := sub.committer.BeforeSend(msg); err != nil {
+		// not sent, it will be consumed again
+		return err
+	}
+
+	// the tag of the message goes before the message binary frame
+	b, _ := json.Marshal(wsSubMeta{
+		Sub:       sub.id,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Attrs:     pm.Attrs,
+	})
+	this.ws.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	if err := this.ws.WriteMessage(websocket.TextMessage, b); err != nil {
+		return err
+	}
+
+	err = this.ws.WriteMessage(websocket.BinaryMessage, pm.Body)
+	sub.chain.PostDeliver(pm, err)
+	if err != nil {
+		return err
+	}
+
+	// each message is a batch
+	if err = sub.committer.AfterSend(msg); err == nil {
+		err = sub.committer.EndBatch()
+	}
+	if err != nil {
+		log.Error("ws mux sub[%s] %s: {sub:%s, T:%s, P:%d, O:%d} %v",
+			req.Appid, req.RemoteAddr, sub.id, msg.Topic, msg.Partition, msg.Offset, err)
+	}
+
+	this.gw.quotas.Consume(true, req.Appid, req.Topic, 1, int64(len(msg.Value)), time.Now())
+	return nil
+}
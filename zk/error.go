@@ -5,5 +5,7 @@ import (
 )
 
 var (
-	ErrDupConnect = errors.New("connect while being connected")
+	ErrDupConnect          = errors.New("connect while being connected")
+	ErrConsumerGroupOnline = errors.New("consumer group has online members")
+	ErrInvalidOffsetSeek   = errors.New("invalid offset seek")
 )
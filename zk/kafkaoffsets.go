@@ -0,0 +1,347 @@
+package zk
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	log "github.com/funkygao/log4go"
+)
+
+// KafkaConsumerOffsets returns {consumerGroup: offsets} of the consumer groups
+// that commit offsets to kafka instead of zk: the groups are listed by the
+// brokers, and the offsets are fetched from the group coordinators.
+// The offsets are sorted by topic and partition.
+func (this *ZkCluster) KafkaConsumerOffsets(groupPattern string) (map[string][]PartitionOffset, error) {
+	kfk, err := sarama.NewClient(this.BrokerList(), sarama.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+	defer kfk.Close()
+
+	return this.kafkaConsumerOffsets(kfk, groupPattern, false)
+}
+
+func (this *ZkCluster) kafkaConsumerOffsets(kfk sarama.Client, groupPattern string,
+	onlineOnly bool) (map[string][]PartitionOffset, error) {
+	groups, err := kafkaGroups(kfk, groupPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var allPartitions map[string][]int32 // loaded for the first group without members
+	r := make(map[string][]PartitionOffset, len(groups))
+	for _, group := range groups {
+		members, err := kafkaGroupMembers(kfk, group)
+		if err != nil {
+			log.Error("kafka[%s] group[%s] %v", this.name, group, err)
+			continue
+		}
+
+		partitions := make(map[string][]int32)
+		for _, member := range members {
+			assignment, err := member.GetMemberAssignment()
+			if err != nil || assignment == nil {
+				continue
+			}
+			for topic, assigned := range assignment.Topics {
+				partitions[topic] = append(partitions[topic], assigned...)
+			}
+		}
+		if len(members) == 0 {
+			if onlineOnly {
+				continue
+			}
+
+			// what an offline group consumed is unknown, fetch all
+			if allPartitions == nil {
+				if allPartitions, err = kafkaTopicPartitions(kfk); err != nil {
+					return nil, err
+				}
+			}
+			partitions = allPartitions
+		}
+
+		offsets, err := kafkaConsumerOffsetsOf(kfk, group, partitions)
+		if err != nil {
+			log.Error("kafka[%s] group[%s] %v", this.name, group, err)
+			continue
+		}
+
+		topics := make([]string, 0, len(offsets))
+		for topic := range offsets {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		for _, topic := range topics {
+			sortedPartitions := make([]int, 0, len(offsets[topic]))
+			for partition := range offsets[topic] {
+				sortedPartitions = append(sortedPartitions, int(partition))
+			}
+			sort.Ints(sortedPartitions)
+
+			for _, partition := range sortedPartitions {
+				r[group] = append(r[group], PartitionOffset{
+					Cluster:   this.name,
+					Topic:     topic,
+					Partition: int32(partition),
+					Offset:    offsets[topic][int32(partition)],
+					Group:     group,
+				})
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// kafkaGroups returns the sorted consumer groups known to the group
+// coordinators, each broker coordinates a share of them. The groups that only
+// commit offsets without group management have empty protocol type.
+func kafkaGroups(kfk sarama.Client, groupPattern string) ([]string, error) {
+	var groups []string
+	for _, broker := range kfk.Brokers() {
+		if err := broker.Open(kfk.Config()); err != nil && err != sarama.ErrAlreadyConnected {
+			return nil, err
+		}
+
+		resp, err := broker.ListGroups(&sarama.ListGroupsRequest{})
+		if err != nil {
+			return nil, err
+		}
+		if resp.Err != sarama.ErrNoError {
+			return nil, resp.Err
+		}
+
+		for group, protocolType := range resp.Groups {
+			if (protocolType == "consumer" || protocolType == "") &&
+				(groupPattern == "" || strings.Contains(group, groupPattern)) {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// kafkaTopicPartitions returns {topic: partitions} of all the topics.
+func kafkaTopicPartitions(kfk sarama.Client) (map[string][]int32, error) {
+	topics, err := kfk.Topics()
+	if err != nil {
+		return nil, err
+	}
+
+	r := make(map[string][]int32, len(topics))
+	for _, topic := range topics {
+		partitions, err := kfk.Partitions(topic)
+		if err != nil {
+			return nil, err
+		}
+
+		r[topic] = partitions
+	}
+	return r, nil
+}
+
+// kafkaGroupMembers returns the online members of the consumer group from the
+// group coordinator.
+func kafkaGroupMembers(kfk sarama.Client, group string) (map[string]*sarama.GroupMemberDescription, error) {
+	coordinator, err := kfk.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := coordinator.DescribeGroups(&sarama.DescribeGroupsRequest{Groups: []string{group}})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Groups) == 0 {
+		return nil, nil
+	}
+	if resp.Groups[0].Err != sarama.ErrNoError {
+		return nil, resp.Groups[0].Err
+	}
+
+	return resp.Groups[0].Members, nil
+}
+
+// kafkaConsumerOffsetsOfTopic fetches {partition: offset} committed by the
+// consumer group on the partitions of the topic from the group coordinator.
+// The partitions never committed are absent.
+func kafkaConsumerOffsetsOfTopic(kfk sarama.Client, group, topic string,
+	partitions []int32) (map[int32]int64, error) {
+	offsets, err := kafkaConsumerOffsetsOf(kfk, group, map[string][]int32{topic: partitions})
+	if err != nil {
+		return nil, err
+	}
+
+	if offsets[topic] == nil {
+		return make(map[int32]int64), nil
+	}
+	return offsets[topic], nil
+}
+
+// kafkaConsumerOffsetsOf fetches {topic: {partition: offset}} committed by the
+// consumer group on the partitions from the group coordinator in a single
+// request. The partitions never committed are absent.
+func kafkaConsumerOffsetsOf(kfk sarama.Client, group string,
+	partitions map[string][]int32) (map[string]map[int32]int64, error) {
+	coordinator, err := kfk.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &sarama.OffsetFetchRequest{ConsumerGroup: group, Version: 1}
+	for topic, ps := range partitions {
+		for _, partition := range ps {
+			req.AddPartition(topic, partition)
+		}
+	}
+	resp, err := coordinator.FetchOffset(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r := make(map[string]map[int32]int64)
+	for topic, ps := range partitions {
+		for _, partition := range ps {
+			block := resp.GetBlock(topic, partition)
+			if block == nil {
+				return nil, sarama.ErrIncompleteResponse
+			}
+			if block.Err != sarama.ErrNoError {
+				return nil, block.Err
+			}
+
+			if block.Offset >= 0 {
+				// -1 if never committed
+				if r[topic] == nil {
+					r[topic] = make(map[int32]int64)
+				}
+				r[topic][partition] = block.Offset
+			}
+		}
+	}
+	return r, nil
+}
+
+// KafkaConsumerOffsetsOfTopic returns {partition: offset} committed by the
+// consumer group on the topic to the group coordinator.
+func (this *ZkCluster) KafkaConsumerOffsetsOfTopic(group, topic string) (map[int32]int64, error) {
+	kfk, err := sarama.NewClient(this.BrokerList(), sarama.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+	defer kfk.Close()
+
+	partitions, err := kfk.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+	return kafkaConsumerOffsetsOfTopic(kfk, group, topic, partitions)
+}
+
+// KafkaConsumerGroupMembers returns the sorted online members of the consumer
+// group from the group coordinator, each of which is clientId@clientHost.
+func (this *ZkCluster) KafkaConsumerGroupMembers(group string) ([]string, error) {
+	kfk, err := sarama.NewClient(this.BrokerList(), sarama.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+	defer kfk.Close()
+
+	members, err := kafkaGroupMembers(kfk, group)
+	if err != nil {
+		return nil, err
+	}
+
+	r := make([]string, 0, len(members))
+	for _, member := range members {
+		r = append(r, member.ClientId+"@"+strings.TrimPrefix(member.ClientHost, "/"))
+	}
+	sort.Strings(r)
+	return r, nil
+}
+
+// CommitKafkaConsumerOffsets commits {topic: {partitionId: offset}} of the
+// consumer group to the group coordinator. The group must have no online
+// members, otherwise the members will overwrite the offsets.
+func (this *ZkCluster) CommitKafkaConsumerOffsets(group string, offsets map[string]map[int32]int64) error {
+	kfk, err := sarama.NewClient(this.BrokerList(), sarama.NewConfig())
+	if err != nil {
+		return err
+	}
+	defer kfk.Close()
+
+	members, err := kafkaGroupMembers(kfk, group)
+	if err != nil {
+		return err
+	}
+	if len(members) > 0 {
+		return ErrConsumerGroupOnline
+	}
+
+	coordinator, err := kfk.Coordinator(group)
+	if err != nil {
+		return err
+	}
+
+	req := &sarama.OffsetCommitRequest{
+		ConsumerGroup:           group,
+		ConsumerGroupGeneration: -1, // not a member of the group management
+		Version:                 1,
+	}
+	for topic, partitionOffsets := range offsets {
+		for partition, offset := range partitionOffsets {
+			req.AddBlock(topic, partition, offset, sarama.ReceiveTime, "")
+		}
+	}
+	resp, err := coordinator.CommitOffset(req)
+	if err != nil {
+		return err
+	}
+
+	for topic, partitionErrors := range resp.Errors {
+		for partition, kerr := range partitionErrors {
+			if kerr != sarama.ErrNoError {
+				return fmt.Errorf("%s/%d: %v", topic, partition, kerr)
+			}
+		}
+	}
+	return nil
+}
+
+// addKafkaConsumersByGroup adds the online consumer groups that commit offsets
+// to kafka into {consumerGroup: consumerInfo}.
+func (this *ZkCluster) addKafkaConsumersByGroup(kfk sarama.Client, groupPattern string, r map[string][]ConsumerMeta) {
+	offsetsByGroup, err := this.kafkaConsumerOffsets(kfk, groupPattern, true)
+	if err != nil {
+		log.Error("kafka[%s] kafka groups: %v", this.name, err)
+		return
+	}
+
+	for group, offsets := range offsetsByGroup {
+		for _, po := range offsets {
+			producerOffset, err := kfk.GetOffset(po.Topic, po.Partition, sarama.OffsetNewest)
+			if err != nil {
+				log.Warn("kafka[%s] %s invalid topic[%s] partition:%d %v",
+					this.name, group, po.Topic, po.Partition, err)
+				continue
+			}
+
+			r[group] = append(r[group], ConsumerMeta{
+				Group:          group,
+				Online:         true,
+				Topic:          po.Topic,
+				PartitionId:    strconv.Itoa(int(po.Partition)),
+				ConsumerOffset: po.Offset,
+				ProducerOffset: producerOffset,
+				Lag:            producerOffset - po.Offset,
+				Kafka:          true,
+			})
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package zk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/funkygao/assert"
+)
+
+func encodeConsumerOffsetsString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+func TestProcessConsumerOffsetsMessage(t *testing.T) {
+	zkcluster := &ZkCluster{name: "me"}
+
+	key := new(bytes.Buffer)
+	binary.Write(key, binary.BigEndian, uint16(1))
+	encodeConsumerOffsetsString(key, "group1")
+	encodeConsumerOffsetsString(key, "topic1")
+	binary.Write(key, binary.BigEndian, uint32(3))
+
+	value := new(bytes.Buffer)
+	binary.Write(value, binary.BigEndian, uint16(1))
+	binary.Write(value, binary.BigEndian, uint64(100))
+	encodeConsumerOffsetsString(value, "")
+	binary.Write(value, binary.BigEndian, uint64(1461234567890))
+	binary.Write(value, binary.BigEndian, uint64(1461234567890))
+
+	po := zkcluster.processConsumerOffsetsMessage(&sarama.ConsumerMessage{Key: key.Bytes(), Value: value.Bytes()})
+	assert.Equal(t, "me", po.Cluster)
+	assert.Equal(t, "group1", po.Group)
+	assert.Equal(t, "topic1", po.Topic)
+	assert.Equal(t, int32(3), po.Partition)
+	assert.Equal(t, int64(100), po.Offset)
+	assert.Equal(t, int64(1461234567890), po.Timestamp)
+
+	// tombstone
+	po = zkcluster.processConsumerOffsetsMessage(&sarama.ConsumerMessage{Key: key.Bytes()})
+	assert.Equal(t, "group1", po.Group)
+	assert.Equal(t, int64(-1), po.Offset)
+
+	// group metadata
+	key = new(bytes.Buffer)
+	binary.Write(key, binary.BigEndian, uint16(2))
+	encodeConsumerOffsetsString(key, "group1")
+	assert.Equal(t, true, zkcluster.processConsumerOffsetsMessage(&sarama.ConsumerMessage{Key: key.Bytes()}) == nil)
+}
@@ -0,0 +1,163 @@
+package zk
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// partitionLease is the znode data of a partition leased to a consumer of a
+// consumer group, the lease is taken over by others after it expires.
+type partitionLease struct {
+	Owner  string `json:"owner"`
+	Expire int64  `json:"expire"` // unix ms
+}
+
+func (this partitionLease) availableTo(owner string, now time.Time) bool {
+	return this.Owner == owner || this.expired(now)
+}
+
+func (this partitionLease) expired(now time.Time) bool {
+	return this.Expire <= now.UnixNano()/int64(time.Millisecond)
+}
+
+// AcquirePartitionLease leases a partition of the topic to the owner within
+// the consumer group till now+ttl, and renews it if already held by the owner.
+// It returns false if the partition is leased to another owner, otherwise the
+// version of the lease znode that fences the commits of the owner.
+func (this *ZkCluster) AcquirePartitionLease(topic, group string, partition int32,
+	owner string, ttl time.Duration, now time.Time) (leased bool, version int32, err error) {
+	this.zone.connectIfNeccessary()
+
+	path := this.consumerGroupLeasePath(group, topic, partition)
+	data, _ := json.Marshal(partitionLease{
+		Owner:  owner,
+		Expire: now.Add(ttl).UnixNano() / int64(time.Millisecond),
+	})
+
+	old, stat, err := this.zone.conn.Get(path)
+	switch err {
+	case nil:
+		var lease partitionLease
+		if json.Unmarshal(old, &lease) == nil && !lease.availableTo(owner, now) {
+			return false, 0, nil
+		}
+
+		// the version guards against a concurrent acquirer
+		if stat, err = this.zone.conn.Set(path, data, stat.Version); err != nil {
+			if err == zk.ErrBadVersion {
+				return false, 0, nil
+			}
+			return false, 0, err
+		}
+		return true, stat.Version, nil
+
+	case zk.ErrNoNode:
+		if err = this.zone.ensureParentDirExists(path); err != nil {
+			return false, 0, err
+		}
+		if err = this.zone.createZnode(path, data); err == zk.ErrNodeExists {
+			return false, 0, nil
+		}
+		return err == nil, 0, err
+
+	default:
+		return false, 0, err
+	}
+}
+
+// CommitLeasedConsumerOffset is CommitConsumerOffset on condition that the
+// lease znode of the partition still has the version, so that a holder whose
+// lease is taken over never overwrites the commits of the new owner.
+// It returns zk.ErrBadVersion or zk.ErrNoNode if the lease is lost.
+func (this *ZkCluster) CommitLeasedConsumerOffset(topic, group string, partition int32,
+	offset int64, leaseVersion int32) error {
+	this.zone.connectIfNeccessary()
+
+	check := &zk.CheckVersionRequest{
+		Path:    this.consumerGroupLeasePath(group, topic, partition),
+		Version: leaseVersion,
+	}
+	path := fmt.Sprintf("%s/%d", this.consumerGroupOffsetOfTopicPath(group, topic), partition)
+	data := []byte(strconv.FormatInt(offset, 10))
+	err := this.multi(check, &zk.SetDataRequest{Path: path, Data: data, Version: -1})
+	if err != zk.ErrNoNode || this.PartitionLeaseVersion(topic, group, partition) != leaseVersion {
+		return err
+	}
+
+	// the offset znode is missing, not the lease
+	if err = this.zone.ensureParentDirExists(path); err != nil {
+		return err
+	}
+	return this.multi(check, &zk.CreateRequest{Path: path, Data: data, Acl: zk.WorldACL(zk.PermAll)})
+}
+
+// PartitionLeaseVersion returns the version of the lease znode of a partition,
+// -1 if it's not leased.
+func (this *ZkCluster) PartitionLeaseVersion(topic, group string, partition int32) int32 {
+	this.zone.connectIfNeccessary()
+
+	_, stat, err := this.zone.conn.Get(this.consumerGroupLeasePath(group, topic, partition))
+	if err != nil {
+		return -1
+	}
+	return stat.Version
+}
+
+// multi executes the ops all or none, and returns the first error.
+func (this *ZkCluster) multi(ops ...interface{}) error {
+	resps, err := this.zone.conn.Multi(ops...)
+	for _, resp := range resps {
+		if resp.Error != nil {
+			return resp.Error
+		}
+	}
+	return err
+}
+
+// PartitionLeasesHeld returns how many partitions of the topic are leased to
+// the consumers of the group and not expired yet.
+func (this *ZkCluster) PartitionLeasesHeld(topic, group string, now time.Time) (n int) {
+	root := this.consumerGroupLeasesOfTopicPath(group, topic)
+	for _, partition := range this.zone.children(root) {
+		data, _, err := this.zone.conn.Get(root + "/" + partition)
+		if err != nil {
+			continue
+		}
+
+		var lease partitionLease
+		if json.Unmarshal(data, &lease) == nil && !lease.expired(now) {
+			n++
+		}
+	}
+	return
+}
+
+// ReleasePartitionLease releases the lease of a partition if it is still held
+// by the owner.
+func (this *ZkCluster) ReleasePartitionLease(topic, group string, partition int32, owner string) error {
+	this.zone.connectIfNeccessary()
+
+	path := this.consumerGroupLeasePath(group, topic, partition)
+	old, stat, err := this.zone.conn.Get(path)
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return nil
+		}
+		return err
+	}
+
+	var lease partitionLease
+	if json.Unmarshal(old, &lease) == nil && lease.Owner != owner {
+		// already taken over
+		return nil
+	}
+
+	if err = this.zone.conn.Delete(path, stat.Version); err == zk.ErrNoNode || err == zk.ErrBadVersion {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,18 @@
+package zk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/funkygao/assert"
+)
+
+func TestPartitionLeaseAvailable(t *testing.T) {
+	now := time.Now()
+	lease := partitionLease{Owner: "host1", Expire: now.Add(time.Second).UnixNano() / int64(time.Millisecond)}
+	assert.Equal(t, true, lease.availableTo("host1", now))
+	assert.Equal(t, false, lease.availableTo("host2", now))
+
+	// expired
+	assert.Equal(t, true, lease.availableTo("host2", now.Add(time.Second)))
+}
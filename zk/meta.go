@@ -33,6 +33,34 @@ func (this *zkData) Ctime() time.Time {
 	return this.ctime.Time()
 }
 
+const (
+	SeekAbsolute = iota // Value is the offset, or sarama.OffsetOldest/OffsetNewest
+	SeekDelta           // Value is added to the committed offset
+	SeekTime            // Value is the unix timestamp in ms
+)
+
+// OffsetSeek tells where to move a consumer group offset.
+type OffsetSeek struct {
+	Whence int
+	Value  int64
+}
+
+// clamp fits the resolved offset of a partition into [oldest, newest].
+// A time seek resolves to -1 if no message is at/after the time, which means
+// newest instead of oldest.
+func (this OffsetSeek) clamp(offset, oldest, newest int64) int64 {
+	if this.Whence == SeekTime && offset == -1 {
+		return newest
+	}
+
+	if offset < oldest {
+		return oldest
+	} else if offset > newest {
+		return newest
+	}
+	return offset
+}
+
 type ConsumerMeta struct {
 	Group          string
 	Online         bool
@@ -43,6 +71,7 @@ type ConsumerMeta struct {
 	ProducerOffset int64
 	Lag            int64
 	ConsumerZnode  *ConsumerZnode
+	Kafka          bool // offsets committed to kafka instead of zk
 }
 
 type ControllerMeta struct {
@@ -29,3 +29,14 @@ func TestConsumerZnode(t *testing.T) {
 	c := newConsumerZnode("cloudparkingGroup_orderMsg_BJS0-D134-018-1447657979158-fa9d1dc8")
 	assert.Equal(t, "BJS0-D134-018", c.Host())
 }
+
+func TestOffsetSeekClamp(t *testing.T) {
+	seek := OffsetSeek{Whence: SeekTime, Value: 1447157138058}
+	assert.Equal(t, int64(120), seek.clamp(120, 100, 200))
+	// no message at/after the time
+	assert.Equal(t, int64(200), seek.clamp(-1, 100, 200))
+
+	seek = OffsetSeek{Whence: SeekDelta, Value: -1000}
+	assert.Equal(t, int64(100), seek.clamp(-1, 100, 200))
+	assert.Equal(t, int64(200), seek.clamp(300, 100, 200))
+}
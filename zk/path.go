@@ -11,6 +11,14 @@ const (
 	KatewayIdsRoot     = "/_kateway/ids"
 	katewayMetricsRoot = "/_kateway/metrics"
 	KatewayMysqlPath   = "/_kateway/mysql"
+	katewayDeadLetter  = "/_kateway/deadletter"
+	katewayWebhooks    = "/_kateway/webhooks"
+	katewayQuotaRoot   = "/_kateway/quota"
+	katewaySubFilters  = "/_kateway/filters"
+	katewayPlugins     = "/_kateway/plugins"
+	katewayEncryption  = "/_kateway/encryption"
+	katewayCommit      = "/_kateway/commit"
+	katewayNonces      = "/_kateway/nonces"
 
 	ConsumersPath           = "/consumers"
 	BrokerIdsPath           = "/brokers/ids"
@@ -20,6 +28,7 @@ const (
 	BrokerSequenceIdPath    = "/brokers/seqid"
 	EntityConfigChangesPath = "/config/changes"
 	TopicConfigPath         = "/config/topics"
+	TopicSchemaPath         = "/config/schemas"
 	EntityConfigPath        = "/config"
 	DeleteTopicsPath        = "/admin/delete_topics"
 )
@@ -28,6 +37,46 @@ func katewayMetricsRootByKey(id, key string) string {
 	return fmt.Sprintf("%s/%s/%s", katewayMetricsRoot, id, key)
 }
 
+func katewayDeadLetterByGroup(group string) string {
+	return fmt.Sprintf("%s/%s", katewayDeadLetter, group)
+}
+
+func katewayWebhookById(id string) string {
+	return fmt.Sprintf("%s/%s", katewayWebhooks, id)
+}
+
+func katewaySubFilterById(id string) string {
+	return fmt.Sprintf("%s/%s", katewaySubFilters, id)
+}
+
+func katewayPluginsByTarget(target string) string {
+	return fmt.Sprintf("%s/%s", katewayPlugins, target)
+}
+
+func katewayEncryptionByTopic(topic string) string {
+	return fmt.Sprintf("%s/%s", katewayEncryption, topic)
+}
+
+func katewayCommitByGroup(group string) string {
+	return fmt.Sprintf("%s/%s", katewayCommit, group)
+}
+
+func katewayNonceBucket(bucket int64) string {
+	return fmt.Sprintf("%s/%d", katewayNonces, bucket)
+}
+
+func katewayNonceByKey(bucket int64, key string) string {
+	return fmt.Sprintf("%s/%s", katewayNonceBucket(bucket), key)
+}
+
+func katewayQuotaUsageRoot(zone string) string {
+	return fmt.Sprintf("%s/%s", katewayQuotaRoot, zone)
+}
+
+func katewayQuotaUsageById(zone, id string) string {
+	return fmt.Sprintf("%s/%s", katewayQuotaUsageRoot(zone), id)
+}
+
 func ClusterPath(cluster string) string {
 	return fmt.Sprintf("%s/%s", clusterRoot, cluster)
 }
@@ -44,6 +93,18 @@ func (this *ZkCluster) GetTopicConfigPath(topic string) string {
 	return fmt.Sprintf("%s%s/%s", this.path, TopicConfigPath, topic)
 }
 
+func (this *ZkCluster) TopicSchemaRoot() string {
+	return fmt.Sprintf("%s%s", this.path, TopicSchemaPath)
+}
+
+func (this *ZkCluster) GetTopicSchemaPath(topic string) string {
+	return fmt.Sprintf("%s%s/%s", this.path, TopicSchemaPath, topic)
+}
+
+func (this *ZkCluster) getTopicSchemaVersionPath(topic string, version int) string {
+	return fmt.Sprintf("%s/%d", this.GetTopicSchemaPath(topic), version)
+}
+
 func (this *ZkCluster) ClusterInfoPath() string {
 	return fmt.Sprintf("%s/%s", clusterInfoRoot, this.name)
 }
@@ -95,3 +156,11 @@ func (this *ZkCluster) consumerGroupOffsetOfTopicPath(group, topic string) strin
 func (this *ZkCluster) consumerGroupOwnerOfTopicPath(group, topic string) string {
 	return this.ConsumerGroupRoot(group) + "/owners/" + topic
 }
+
+func (this *ZkCluster) consumerGroupLeasesOfTopicPath(group, topic string) string {
+	return fmt.Sprintf("%s/leases/%s", this.ConsumerGroupRoot(group), topic)
+}
+
+func (this *ZkCluster) consumerGroupLeasePath(group, topic string, partition int32) string {
+	return fmt.Sprintf("%s/%d", this.consumerGroupLeasesOfTopicPath(group, topic), partition)
+}
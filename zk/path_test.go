@@ -36,6 +36,8 @@ func TestZkClusterPath(t *testing.T) {
 		c.consumerGroupOffsetOfTopicPath("console-group", "t1"))
 	assert.Equal(t, "/test/consumers/console-group/owners/t1",
 		c.consumerGroupOwnerOfTopicPath("console-group", "t1"))
+	assert.Equal(t, "/test/config/schemas/t1", c.GetTopicSchemaPath("t1"))
+	assert.Equal(t, "/test/config/schemas/t1/2", c.getTopicSchemaVersionPath("t1", 2))
 
 }
 
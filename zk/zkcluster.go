@@ -79,6 +79,38 @@ func (this *ZkCluster) ConfiggedTopics() map[string]TopicConfigMeta {
 	return r
 }
 
+// SchemaTopics returns the topics that have registered schemas.
+func (this *ZkCluster) SchemaTopics() []string {
+	return this.zone.children(this.TopicSchemaRoot())
+}
+
+// TopicSchemas returns {version: schema} of a topic, versions start from 1.
+func (this *ZkCluster) TopicSchemas(topic string) map[int][]byte {
+	r := make(map[int][]byte)
+	for v, zdata := range this.zone.ChildrenWithData(this.GetTopicSchemaPath(topic)) {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+
+		r[version] = zdata.data
+	}
+	return r
+}
+
+// RegisterTopicSchema saves the schema of a topic as the given version, which
+// fails with zk.ErrNodeExists if the version is registered by others.
+func (this *ZkCluster) RegisterTopicSchema(topic string, version int, schema []byte) error {
+	this.zone.connectIfNeccessary()
+
+	path := this.getTopicSchemaVersionPath(topic, version)
+	if err := this.zone.ensureParentDirExists(path); err != nil {
+		return err
+	}
+
+	return this.zone.createZnode(path, schema)
+}
+
 func (this *ZkCluster) TopicsCtime() map[string]time.Time {
 	r := make(map[string]time.Time)
 	for name, data := range this.zone.ChildrenWithData(this.topicsRoot()) {
@@ -371,6 +403,8 @@ func (this *ZkCluster) ConsumersByGroup(groupPattern string) map[string][]Consum
 		}
 	}
 
+	this.addKafkaConsumersByGroup(kfk, groupPattern, r)
+
 	return r
 }
 
@@ -493,8 +527,239 @@ func (this *ZkCluster) TotalConsumerOffsets(topicPattern string) (total int64) {
 	return
 }
 
-func (this *ZkCluster) ResetConsumerGroupOffset(topic, group string) {
-	// TODO
+// Returns {partitionId: offset} of a consumer group on a topic.
+func (this *ZkCluster) ConsumerOffsetsOfTopic(group, topic string) map[int32]int64 {
+	r := make(map[int32]int64)
+	for partitionId, offsetData := range this.zone.ChildrenWithData(this.consumerGroupOffsetOfTopicPath(group, topic)) {
+		pid, err := strconv.Atoi(partitionId)
+		if err != nil {
+			log.Error("kafka[%s] %s P:%s %v", this.name, topic, partitionId, err)
+			continue
+		}
+
+		consumerOffset, err := strconv.ParseInt(string(offsetData.data), 10, 64)
+		if err != nil {
+			log.Error("kafka[%s] %s P:%s %v", this.name, topic, partitionId, err)
+			continue
+		}
+
+		r[int32(pid)] = consumerOffset
+	}
+
+	return r
+}
+
+// ConsumerGroupOnline checks whether the consumer group has online members
+// in zk or in the kafka group coordinator, or any partition of the topic is
+// owned or leased. If the coordinator is not reachable, the group is taken as online.
+func (this *ZkCluster) ConsumerGroupOnline(topic, group string) bool {
+	if len(this.zone.children(this.consumerGroupIdsPath(group))) > 0 ||
+		this.OnlineConsumersCount(topic, group) > 0 ||
+		this.PartitionLeasesHeld(topic, group, time.Now()) > 0 {
+		// the stateless sub consumers hold partition leases instead of ids
+		return true
+	}
+
+	members, err := this.KafkaConsumerGroupMembers(group)
+	if err != nil {
+		log.Warn("kafka[%s] group[%s] members: %v", this.name, group, err)
+		return true
+	}
+	return len(members) > 0
+}
+
+// ResolveConsumerGroupOffset resolves where to move the consumer group for
+// each partition of a topic, all partitions if partitions is empty.
+// The resolved offsets are within [oldest, newest] of each partition.
+func (this *ZkCluster) ResolveConsumerGroupOffset(topic, group string,
+	partitions []int32, seek OffsetSeek) (map[int32]int64, error) {
+	return this.resolveConsumerGroupOffset(topic, group, partitions, seek, false)
+}
+
+// ResolveKafkaConsumerGroupOffset is ResolveConsumerGroupOffset of a consumer
+// group that commits offsets to kafka instead of zk.
+func (this *ZkCluster) ResolveKafkaConsumerGroupOffset(topic, group string,
+	partitions []int32, seek OffsetSeek) (map[int32]int64, error) {
+	return this.resolveConsumerGroupOffset(topic, group, partitions, seek, true)
+}
+
+func (this *ZkCluster) resolveConsumerGroupOffset(topic, group string,
+	partitions []int32, seek OffsetSeek, kafka bool) (map[int32]int64, error) {
+	if len(partitions) == 0 {
+		partitions = this.Partitions(topic)
+	}
+	if len(partitions) == 0 {
+		return nil, errors.New(fmt.Sprintf("topic %s not found", topic))
+	}
+
+	cf := sarama.NewConfig()
+	cf.Version = sarama.V0_10_1_0 // ListOffsets v1 resolves time against the timestamp index
+	kfk, err := sarama.NewClient(this.BrokerList(), cf)
+	if err != nil {
+		return nil, err
+	}
+	defer kfk.Close()
+
+	var consumerOffsets map[int32]int64
+	if kafka {
+		if consumerOffsets, err = kafkaConsumerOffsetsOfTopic(kfk, group, topic, partitions); err != nil {
+			return nil, err
+		}
+	} else {
+		consumerOffsets = this.ConsumerOffsetsOfTopic(group, topic)
+	}
+	r := make(map[int32]int64, len(partitions))
+	for _, partition := range partitions {
+		oldest, err := kfk.GetOffset(topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return nil, err
+		}
+		newest, err := kfk.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return nil, err
+		}
+
+		var offset int64
+		switch seek.Whence {
+		case SeekAbsolute:
+			switch seek.Value {
+			case sarama.OffsetOldest:
+				offset = oldest
+			case sarama.OffsetNewest:
+				offset = newest
+			default:
+				offset = seek.Value
+			}
+
+		case SeekDelta:
+			current, present := consumerOffsets[partition]
+			if !present {
+				current = oldest
+			}
+			offset = current + seek.Value
+
+		case SeekTime:
+			// the first offset whose timestamp is at/after the time
+			if offset, err = kfk.GetOffset(topic, partition, seek.Value); err != nil {
+				return nil, err
+			}
+
+		default:
+			return nil, ErrInvalidOffsetSeek
+		}
+
+		r[partition] = seek.clamp(offset, oldest, newest)
+	}
+
+	return r, nil
+}
+
+// ResetConsumerGroupOffset writes the offsets of the consumer group into zk,
+// the offset is where the group will consume from.
+// It refuses while the group is online unless forced.
+func (this *ZkCluster) ResetConsumerGroupOffset(topic, group string,
+	offsets map[int32]int64, force bool) error {
+	this.zone.connectIfNeccessary()
+
+	if !force && this.ConsumerGroupOnline(topic, group) {
+		return ErrConsumerGroupOnline
+	}
+
+	// validate all the targets before writing any, never leave a partial reset
+	if err := this.validateOffsets(topic, offsets); err != nil {
+		return err
+	}
+
+	for partition, offset := range offsets {
+		if err := this.CommitConsumerOffset(topic, group, partition, offset); err != nil {
+			return err
+		}
+
+		log.Info("kafka[%s] group[%s] %s P:%d reset offset to %d", this.name, group, topic, partition, offset)
+	}
+
+	return nil
+}
+
+// ResetKafkaConsumerGroupOffset is ResetConsumerGroupOffset of a consumer
+// group that commits offsets to kafka instead of zk. Even if forced, the
+// group coordinator refuses while the group has members.
+func (this *ZkCluster) ResetKafkaConsumerGroupOffset(topic, group string,
+	offsets map[int32]int64, force bool) error {
+	this.zone.connectIfNeccessary()
+
+	if !force && this.ConsumerGroupOnline(topic, group) {
+		return ErrConsumerGroupOnline
+	}
+
+	if err := this.validateOffsets(topic, offsets); err != nil {
+		return err
+	}
+
+	// all the partitions in one commit request
+	if err := this.CommitKafkaConsumerOffsets(group, map[string]map[int32]int64{topic: offsets}); err != nil {
+		return err
+	}
+
+	log.Info("kafka[%s] group[%s] %s reset kafka offsets to %+v", this.name, group, topic, offsets)
+	return nil
+}
+
+func (this *ZkCluster) validateOffsets(topic string, offsets map[int32]int64) error {
+	partitions := make(map[int32]struct{})
+	for _, partition := range this.Partitions(topic) {
+		partitions[partition] = struct{}{}
+	}
+	for partition, offset := range offsets {
+		if _, present := partitions[partition]; !present {
+			return fmt.Errorf("%s partition %d not found", topic, partition)
+		}
+		if offset < 0 {
+			return fmt.Errorf("%s partition %d invalid offset %d", topic, partition, offset)
+		}
+	}
+	return nil
+}
+
+// ConsumerOffset returns the committed offset of a consumer group on a
+// partition, which is where the group will consume from.
+func (this *ZkCluster) ConsumerOffset(topic, group string, partition int32) (offset int64, present bool, err error) {
+	this.zone.connectIfNeccessary()
+
+	path := fmt.Sprintf("%s/%d", this.consumerGroupOffsetOfTopicPath(group, topic), partition)
+	data, _, err := this.zone.conn.Get(path)
+	if err != nil {
+		if err == zk.ErrNoNode {
+			err = nil
+		}
+		return
+	}
+
+	offset, err = strconv.ParseInt(string(data), 10, 64)
+	present = err == nil
+	return
+}
+
+// CommitConsumerOffset writes the offset of a consumer group on a partition.
+func (this *ZkCluster) CommitConsumerOffset(topic, group string, partition int32, offset int64) error {
+	this.zone.connectIfNeccessary()
+
+	path := fmt.Sprintf("%s/%d", this.consumerGroupOffsetOfTopicPath(group, topic), partition)
+	data := []byte(strconv.FormatInt(offset, 10))
+	if _, err := this.zone.conn.Set(path, data, -1); err != nil {
+		if err != zk.ErrNoNode {
+			return err
+		}
+
+		if err = this.zone.ensureParentDirExists(path); err != nil {
+			return err
+		}
+		if err = this.zone.createZnode(path, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (this *ZkCluster) ListChildren(recursive bool) ([]string, error) {
@@ -557,54 +822,70 @@ func readString(buf *bytes.Buffer) (string, error) {
 	return string(strbytes), nil
 }
 
-// consume topic: __consumer_offsets and process the message to get offsets of consumers
-func (this *ZkCluster) processConsumerOffsetsMessage(msg *sarama.ConsumerMessage) {
+// consume topic: __consumer_offsets and process the message to get offsets of consumers.
+// Returns nil if it's not an offset commit message, and Offset -1 if the offset is deleted.
+func (this *ZkCluster) processConsumerOffsetsMessage(msg *sarama.ConsumerMessage) *PartitionOffset {
 	var keyver, valver uint16
 	var partition uint32
 	var offset, timestamp uint64
 
 	buf := bytes.NewBuffer(msg.Key)
 	err := binary.Read(buf, binary.BigEndian, &keyver)
+	if err == nil && keyver == 2 {
+		// group metadata
+		return nil
+	}
 	if (err != nil) || ((keyver != 0) && (keyver != 1)) {
 		log.Warn("Failed to decode %s:%v offset %v: keyver", msg.Topic, msg.Partition, msg.Offset)
-		return
+		return nil
 	}
 	group, err := readString(buf)
 	if err != nil {
 		log.Warn("Failed to decode %s:%v offset %v: group", msg.Topic, msg.Partition, msg.Offset)
-		return
+		return nil
 	}
 	topic, err := readString(buf)
 	if err != nil {
 		log.Warn("Failed to decode %s:%v offset %v: topic", msg.Topic, msg.Partition, msg.Offset)
-		return
+		return nil
 	}
 	err = binary.Read(buf, binary.BigEndian, &partition)
 	if err != nil {
 		log.Warn("Failed to decode %s:%v offset %v: partition", msg.Topic, msg.Partition, msg.Offset)
-		return
+		return nil
+	}
+
+	if msg.Value == nil {
+		// tombstone of an expired or deleted offset
+		return &PartitionOffset{
+			Cluster:   this.Name(),
+			Topic:     topic,
+			Partition: int32(partition),
+			Group:     group,
+			Offset:    -1,
+		}
 	}
 
 	buf = bytes.NewBuffer(msg.Value)
 	err = binary.Read(buf, binary.BigEndian, &valver)
 	if (err != nil) || ((valver != 0) && (valver != 1)) {
 		log.Warn("Failed to decode %s:%v offset %v: valver", msg.Topic, msg.Partition, msg.Offset)
-		return
+		return nil
 	}
 	err = binary.Read(buf, binary.BigEndian, &offset)
 	if err != nil {
 		log.Warn("Failed to decode %s:%v offset %v: offset", msg.Topic, msg.Partition, msg.Offset)
-		return
+		return nil
 	}
 	_, err = readString(buf)
 	if err != nil {
 		log.Warn("Failed to decode %s:%v offset %v: metadata", msg.Topic, msg.Partition, msg.Offset)
-		return
+		return nil
 	}
 	err = binary.Read(buf, binary.BigEndian, &timestamp)
 	if err != nil {
 		log.Warn("Failed to decode %s:%v offset %v: timestamp", msg.Topic, msg.Partition, msg.Offset)
-		return
+		return nil
 	}
 
 	partitionOffset := &PartitionOffset{
@@ -616,5 +897,5 @@ func (this *ZkCluster) processConsumerOffsetsMessage(msg *sarama.ConsumerMessage
 		Offset:    int64(offset),
 	}
 	log.Debug("%+v", partitionOffset)
-	return
+	return partitionOffset
 }
@@ -8,6 +8,7 @@ import (
 	"path"
 	pt "path"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -161,6 +162,267 @@ func (this *ZkZone) LoadKatewayMetrics(katewayId string, key string) ([]byte, er
 	return data, err
 }
 
+// KatewayMaxDeliveries returns {group: max deliveries} of the consumer groups
+// whose poison messages will be moved to the dead letter topic.
+func (this *ZkZone) KatewayMaxDeliveries() map[string]int {
+	r := make(map[string]int)
+	for group, zdata := range this.ChildrenWithData(katewayDeadLetter) {
+		n, err := strconv.Atoi(strings.TrimSpace(string(zdata.data)))
+		if err != nil {
+			log.Error("%s: %v", katewayDeadLetterByGroup(group), err)
+			continue
+		}
+
+		r[group] = n
+	}
+
+	return r
+}
+
+func (this *ZkZone) SetKatewayMaxDeliveries(group string, n int) error {
+	this.connectIfNeccessary()
+
+	path := katewayDeadLetterByGroup(group)
+	this.ensureParentDirExists(path)
+
+	data := []byte(strconv.Itoa(n))
+	err := this.createZnode(path, data)
+	if err == zk.ErrNodeExists {
+		return this.setZnode(path, data)
+	}
+
+	return err
+}
+
+// KatewayCommitPolicies returns {group: commit policy} of the consumer groups
+// whose offset commit policy is set by admin or fixed by the first subscriber
+// asking one.
+func (this *ZkZone) KatewayCommitPolicies() map[string]string {
+	r := make(map[string]string)
+	for group, zdata := range this.ChildrenWithData(katewayCommit) {
+		r[group] = strings.TrimSpace(string(zdata.data))
+	}
+
+	return r
+}
+
+// CreateKatewayCommitPolicy sets the commit policy of a consumer group if it
+// has none, and returns the commit policy of the group.
+func (this *ZkZone) CreateKatewayCommitPolicy(group string, policy string) (string, error) {
+	this.connectIfNeccessary()
+
+	path := katewayCommitByGroup(group)
+	this.ensureParentDirExists(path)
+
+	err := this.createZnode(path, []byte(policy))
+	if err == nil {
+		return policy, nil
+	} else if err != zk.ErrNodeExists {
+		return "", err
+	}
+
+	data, _, err := this.conn.Get(path)
+	return strings.TrimSpace(string(data)), err
+}
+
+func (this *ZkZone) SetKatewayCommitPolicy(group string, policy string) error {
+	this.connectIfNeccessary()
+
+	path := katewayCommitByGroup(group)
+	this.ensureParentDirExists(path)
+
+	err := this.createZnode(path, []byte(policy))
+	if err == zk.ErrNodeExists {
+		return this.setZnode(path, []byte(policy))
+	}
+
+	return err
+}
+
+// KatewayWebhooks returns {id: webhook data} of all the push subscriptions.
+func (this *ZkZone) KatewayWebhooks() map[string][]byte {
+	r := make(map[string][]byte)
+	for id, zdata := range this.ChildrenWithData(katewayWebhooks) {
+		r[id] = zdata.data
+	}
+
+	return r
+}
+
+func (this *ZkZone) SetKatewayWebhook(id string, data []byte) error {
+	this.connectIfNeccessary()
+
+	path := katewayWebhookById(id)
+	this.ensureParentDirExists(path)
+
+	err := this.createZnode(path, data)
+	if err == zk.ErrNodeExists {
+		return this.setZnode(path, data)
+	}
+
+	return err
+}
+
+func (this *ZkZone) DeleteKatewayWebhook(id string) error {
+	this.connectIfNeccessary()
+
+	return this.conn.Delete(katewayWebhookById(id), -1)
+}
+
+// KatewaySubFilters returns {id: filter expression} of the consumer groups
+// whose messages are filtered.
+func (this *ZkZone) KatewaySubFilters() map[string]string {
+	r := make(map[string]string)
+	for id, zdata := range this.ChildrenWithData(katewaySubFilters) {
+		r[id] = string(zdata.data)
+	}
+
+	return r
+}
+
+// KatewaySubFilter returns the filter of a consumer group, empty if none.
+func (this *ZkZone) KatewaySubFilter(id string) (string, error) {
+	this.connectIfNeccessary()
+
+	data, _, err := this.conn.Get(katewaySubFilterById(id))
+	if err == zk.ErrNoNode {
+		return "", nil
+	}
+	return string(data), err
+}
+
+// CreateKatewaySubFilter sets the filter of a consumer group if it has none,
+// and returns the filter of the group.
+func (this *ZkZone) CreateKatewaySubFilter(id string, filter string) (string, error) {
+	this.connectIfNeccessary()
+
+	path := katewaySubFilterById(id)
+	this.ensureParentDirExists(path)
+
+	err := this.createZnode(path, []byte(filter))
+	if err == nil {
+		return filter, nil
+	} else if err != zk.ErrNodeExists {
+		return "", err
+	}
+
+	data, _, err := this.conn.Get(path)
+	return string(data), err
+}
+
+// KatewayPlugins returns {appid or topic: comma separated plugin names} of
+// the plugins enabled besides the default ones.
+func (this *ZkZone) KatewayPlugins() map[string]string {
+	r := make(map[string]string)
+	for target, zdata := range this.ChildrenWithData(katewayPlugins) {
+		r[target] = string(zdata.data)
+	}
+
+	return r
+}
+
+func (this *ZkZone) SetKatewayPlugins(target string, plugins string) error {
+	this.connectIfNeccessary()
+
+	path := katewayPluginsByTarget(target)
+	this.ensureParentDirExists(path)
+
+	data := []byte(plugins)
+	err := this.createZnode(path, data)
+	if err == zk.ErrNodeExists {
+		return this.setZnode(path, data)
+	}
+
+	return err
+}
+
+// KatewayEncryptedTopics returns the topics whose messages are encrypted.
+func (this *ZkZone) KatewayEncryptedTopics() []string {
+	r := make([]string, 0)
+	for topic := range this.ChildrenWithData(katewayEncryption) {
+		r = append(r, topic)
+	}
+
+	return r
+}
+
+func (this *ZkZone) SetKatewayTopicEncryption(topic string, on bool) error {
+	this.connectIfNeccessary()
+
+	path := katewayEncryptionByTopic(topic)
+	if !on {
+		err := this.conn.Delete(path, -1)
+		if err == zk.ErrNoNode {
+			return nil
+		}
+		return err
+	}
+
+	this.ensureParentDirExists(path)
+	err := this.createZnode(path, nil)
+	if err == zk.ErrNodeExists {
+		return nil
+	}
+
+	return err
+}
+
+// FlushKatewayQuotaUsage saves the quota usage of a kateway instance in an
+// ephemeral znode, which is gone with the instance.
+func (this *ZkZone) FlushKatewayQuotaUsage(katewayId string, data []byte) error {
+	path := katewayQuotaUsageById(this.Name(), katewayId)
+	err := this.CreateEphemeralZnode(path, data)
+	if err == zk.ErrNodeExists {
+		return this.setZnode(path, data)
+	}
+
+	return err
+}
+
+// KatewayQuotaUsages returns {kateway id: quota usage} of the live kateway
+// instances.
+func (this *ZkZone) KatewayQuotaUsages() map[string][]byte {
+	r := make(map[string][]byte)
+	for id, zdata := range this.ChildrenWithData(katewayQuotaUsageRoot(this.Name())) {
+		r[id] = zdata.data
+	}
+
+	return r
+}
+
+// CreateKatewayNonce records the nonce key of a signed request in the bucket
+// of its timestamp, and returns false if it's already recorded.
+func (this *ZkZone) CreateKatewayNonce(bucket int64, key string) (bool, error) {
+	this.connectIfNeccessary()
+
+	path := katewayNonceByKey(bucket, key)
+	if err := this.ensureParentDirExists(path); err != nil {
+		return false, err
+	}
+
+	err := this.createZnode(path, nil)
+	if err == zk.ErrNodeExists {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// PruneKatewayNonces deletes the nonce buckets before the bucket.
+func (this *ZkZone) PruneKatewayNonces(before int64) {
+	for _, name := range this.children(katewayNonces) {
+		bucket, err := strconv.ParseInt(name, 10, 64)
+		if err != nil || bucket >= before {
+			continue
+		}
+
+		// might be pruned by another kateway concurrently, retry next time
+		if err = this.DeleteRecursive(katewayNonceBucket(bucket)); err != nil {
+			log.Warn("%s: %v", katewayNonceBucket(bucket), err)
+		}
+	}
+}
+
 func (this *ZkZone) NewclusterWithPath(cluster, path string) *ZkCluster {
 	if c, present := this.zkclusters[cluster]; present {
 		return c